@@ -1,4 +1,4 @@
-import os, sys, json, argparse, importlib, traceback, time, fcntl, array, socket, struct
+import os, sys, json, argparse, importlib, inspect, traceback, time, fcntl, array, socket, struct
 import tornado.ioloop
 import tornado.web
 import tornado.httpserver
@@ -19,12 +19,68 @@ def recv_fds(sock, msglen, maxfds):
     return msg, list(fds)
 
 
+# passed to handlers that take a second argument (def f(event, context))
+class Context:
+    def __init__(self, deadline_ms, method, path):
+        # ms since the epoch, or None if the request has no timeout
+        self.deadline_ms = deadline_ms
+        # the request's method (a HEAD arrives as a GET), and its
+        # path, with the query string
+        self.method = method
+        self.path = path
+
+    # how long the handler has left (None if there is no limit), so it
+    # can set timeouts for calls it makes
+    def get_remaining_time_in_millis(self):
+        if self.deadline_ms is None:
+            return None
+        return max(self.deadline_ms - int(time.time() * 1000), 0)
+
+
+def takes_context(fn):
+    try:
+        return len(inspect.signature(fn).parameters) >= 2
+    except (TypeError, ValueError):
+        return False
+
+
 def web_server():
     print("sock2.py: start web server on fd: %d" % file_sock.fileno())
     sys.path.append('/handler')
 
     class SockFileHandler(tornado.web.RequestHandler):
-        def post(self):
+        # an "async def f" handler may serve several requests at once
+        # (see ol-sandbox-concurrency); a plain one blocks the loop.
+        # Every method is handled the same way (the worker decides
+        # which ones a lambda accepts; see ol-methods)
+        async def post(self):
+            # the worker is about to destroy this sandbox (see
+            # ol-shutdown-path); there's nothing to clean up if f was
+            # never imported.  The worker removes this header from
+            # client requests, so only it can send one
+            if self.request.headers.get("X-OL-Shutdown"):
+                f = sys.modules.get("f")
+                if f is not None and hasattr(f, "shutdown"):
+                    rv = f.shutdown()
+                    if inspect.isawaitable(rv):
+                        await rv
+                return
+
+            # the sandbox is new, and the handler may get ready
+            # before its first request (see ol-warmup-path; as for
+            # X-OL-Shutdown, only the worker can send this header)
+            if self.request.headers.get("X-OL-Warmup"):
+                try:
+                    import f
+                    if hasattr(f, "warmup"):
+                        rv = f.warmup()
+                        if inspect.isawaitable(rv):
+                            await rv
+                except Exception:
+                    self.set_status(500)
+                    self.write(traceback.format_exc())
+                return
+
             # we don't import this until we get a request; this is a
             # safeguard in case f is malicious (we don't
             # want it to interfere with ongoing setup, such as the
@@ -32,18 +88,35 @@ def web_server():
             import f
 
             try:
+                # requests without a body (e.g., GETs) get None
                 data = self.request.body
                 try :
-                    event = json.loads(data)
+                    event = json.loads(data) if data else None
                 except:
                     self.set_status(400)
-                    self.write('bad POST data: "%s"'%str(data))
+                    self.write('bad %s data: "%s"'%(self.request.method, str(data)))
                     return
-                self.write(json.dumps(f.f(event)))
+                deadline = self.request.headers.get("X-OL-Deadline-Ms")
+                if takes_context(f.f):
+                    context = Context(int(deadline) if deadline else None,
+                                      self.request.method, self.request.uri)
+                    rv = f.f(event, context)
+                else:
+                    rv = f.f(event)
+                if inspect.isawaitable(rv):
+                    rv = await rv
+                if isinstance(rv, (bytes, bytearray)):
+                    # binary responses are passed through as-is
+                    self.set_header("Content-Type", "application/octet-stream")
+                    self.write(bytes(rv))
+                else:
+                    self.write(json.dumps(rv))
             except Exception:
                 self.set_status(500) # internal error
                 self.write(traceback.format_exc())
 
+        get = head = put = delete = patch = options = post
+
     tornado_app = tornado.web.Application([
         (".*", SockFileHandler),
     ])
@@ -53,6 +126,28 @@ def web_server():
     server.start()
 
 
+# replace this process with a compiled handler.  The handler must
+# speak HTTP on the already-listening ol.sock, which it receives as fd
+# 3 (following the systemd LISTEN_FDS convention), so the worker can
+# talk to it exactly like it talks to web_server.
+def binary_server(path):
+    print("sock2.py: exec binary handler %s on fd: %d" % (path, file_sock.fileno()))
+    sys.stdout.flush()
+    sys.stderr.flush()
+
+    fd = file_sock.fileno()
+    if fd != 3:
+        os.dup2(fd, 3)
+    os.set_inheritable(3, True)
+
+    env = {
+        "LISTEN_FDS": "1",
+        "LISTEN_PID": str(os.getpid()),
+        "OL_SOCK_PATH": file_sock_path,
+    }
+    os.execve(path, [path], env)
+
+
 def fork_server():
     global file_sock
 
@@ -5,13 +5,24 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 )
 
 var Conf *Config
 
+// where Conf was loaded from (see ReloadConfPath)
+var confPath string
+
+// serializes ReplaceConf calls
+var replaceMutex sync.Mutex
+
 // Config represents the configuration for a worker server.
 type Config struct {
 	// worker directory, which contains handler code, pid file, logs, etc.
@@ -24,24 +35,72 @@ type Config struct {
 	// currently ignored as cgroup sandbox is not fully integrated
 	Sandbox string `json:"sandbox"`
 
+	// other sandbox types to run alongside the main one, which
+	// individual lambdas may select with ol-runtime (e.g., docker
+	// with Docker_runtime=runsc, for stronger isolation)
+	Extra_sandboxes []string `json:"extra_sandboxes"`
+
 	// what kind of server should be launched?  (e.g., lambda or sock)
 	Server_mode string `json:"server_mode"`
 
 	// location where code packages are stored.  Could be URL or local file path.
 	Registry string `json:"registry"`
 
+	// how to get code from the Registry: "local", "web", "s3"
+	// (for s3://<bucket>/<prefix>), "watch" (a local directory
+	// whose lambdas are pulled as soon as they change, for
+	// development), or one added with
+	// lambda.RegisterCodeSource.  If empty, it is chosen based
+	// on the form of the Registry
+	Code_source string `json:"code_source"`
+
 	// how long should some previously pulled code be used without a check for a newer version?
 	Registry_cache_ms int `json:"registry_cache_ms"`
 
+	// how long should we remember that a lambda was not found in
+	// the registry?  (shorter than Registry_cache_ms, so newly
+	// uploaded lambdas are found quickly)
+	Registry_not_found_cache_ms int `json:"registry_not_found_cache_ms"`
+
 	// directory to install packages to, that sandboxes will read from
 	Pkgs_dir string
 
 	// pip index address for installing python packages
 	Pip_index string `json:"pip_mirror"`
 
+	// directory or http(s):// URL of pre-built package layers
+	// (see lambda.PackageCache), extracted instead of running pip
+	// when there is one for a pinned package (empty to always
+	// use pip)
+	Package_cache string `json:"package_cache"`
+
 	// CACHE OPTIONS
 	Mem_pool_mb int `json:"mem_pool_mb"`
 
+	// how much of the memory pool to set aside for Zygotes (the
+	// import cache), either in MB (e.g., "512") or as a percent
+	// (e.g., "25%").  The rest is for handler Sandboxes, so that
+	// creating Zygotes can't crowd them out, or vice versa.  Empty
+	// means the Zygotes and handlers share the whole pool
+	Zygote_pool string `json:"zygote_pool"`
+
+	// keep this many paused Sandboxes, with no code yet, ready
+	// for lambdas that have no packages to install or import, so
+	// their cold starts skip creating a Sandbox (0 disables the
+	// warm pool; see lambda.WarmPool)
+	Warm_sandboxes int `json:"warm_sandboxes"`
+
+	// the most of Mem_pool_mb the warm Sandboxes may hold, which
+	// may mean fewer than Warm_sandboxes (0 means no limit besides
+	// Warm_sandboxes)
+	Warm_pool_mb int `json:"warm_pool_mb"`
+
+	// lambdas to pull and start an instance of as soon as the
+	// worker starts (in the background), so a worker joining a
+	// pool is ready for ones known to be hot (see
+	// lambda.LambdaMgr.Preload)
+	Preload_functions []string `json:"preload_functions"`
+
 	// can be empty (use root zygote only), a JSON obj (specifying
 	// the tree), or a path (to a file specifying the tree)
 	Import_cache_tree interface{} `json:"import_cache_tree"`
@@ -55,16 +114,121 @@ type Config struct {
 	// which OCI implementation to use for the docker sandbox (e.g., runc or runsc)
 	Docker_runtime string `json:"docker_runtime"`
 
+	// Python versions (besides the default python3) installed in
+	// the base image that lambdas may select with ol-python, mapped
+	// to the interpreter to run (e.g., "3.11": "python3.11")
+	Python_interpreters map[string]string `json:"python_interpreters"`
+
+	// initial log level of each lambda function: "debug", "info",
+	// "warn", or "error" (may be changed at runtime, per function)
+	Log_level string `json:"log_level"`
+
+	// URL to POST a JSON "code-changed" event to whenever a lambda
+	// switches to new code (empty for none)
+	Code_change_webhook string `json:"code_change_webhook"`
+
 	Limits   LimitsConfig   `json:"limits"`
+	Scaling  ScalingConfig  `json:"scaling"`
 	Features FeaturesConfig `json:"features"`
 	Trace    TraceConfig    `json:"trace"`
 	Storage  StorageConfig  `json:"storage"`
+	Record   RecordConfig   `json:"record"`
+	Egress   EgressConfig   `json:"egress"`
+	Cors     CorsConfig     `json:"cors"`
+	Audit    AuditConfig    `json:"audit"`
+	Auth     AuthConfig     `json:"auth"`
+	Package  PackageConfig  `json:"package"`
+
+	// message queues the worker consumes, invoking a lambda for
+	// each message (see lambda.EventSource)
+	Event_sources []EventSourceConfig `json:"event_sources"`
+
+	// custom routes to lambdas, besides /run/<lambda> (more may
+	// be added with the /admin/routes API)
+	Routes []RouteConfig `json:"routes"`
+
+	// other workers (base URLs, like http://10.0.0.2:5000) that
+	// requests this worker has no room for may be forwarded to
+	// (see Features.Forward_to_peers)
+	Peers []string `json:"peers"`
 }
 
 type FeaturesConfig struct {
 	Reuse_cgroups       bool `json:"reuse_cgroups"`
 	Import_cache        bool `json:"import_cache"`
 	Downsize_paused_mem bool `json:"downsize_paused_mem"`
+
+	// record all invocations (it may also be enabled for
+	// individual lambdas, with ol-record)
+	Record_invocations bool `json:"record_invocations"`
+
+	// never pause the first instance of each lambda, so that it is
+	// always ready for requests (may be overridden per lambda, with
+	// ol-keep-hot).  Its Sandbox keeps its full memory allocation.
+	Keep_one_hot bool `json:"keep_one_hot"`
+
+	// let lambdas with no traffic drop to zero instances (after
+	// Limits.Scale_to_zero_idle_ms), so they hold no Sandbox;
+	// the next request pays for a cold start.  May be overridden
+	// per lambda, with ol-scale-to-zero
+	Scale_to_zero bool `json:"scale_to_zero"`
+
+	// pull a lambda's code as soon as its LambdaFunc is created,
+	// rather than when the first request arrives.  Requests that
+	// arrive during that pull wait for it (up to
+	// Limits.Max_queue_ms, or Limits.Max_timeout_ms if there is
+	// no queue limit)
+	Eager_pull bool `json:"eager_pull"`
+
+	// when the import cache cannot provide a Sandbox, fail the
+	// request (503) instead of falling back to a cold Sandbox
+	Import_cache_strict bool `json:"import_cache_strict"`
+
+	// measure the CPU time each invocation uses in its Sandbox
+	// (where the Sandbox can report it), returning it in an
+	// X-OL-CPU-Us trailer
+	Cpu_accounting bool `json:"cpu_accounting"`
+
+	// leave internal detail (e.g., paths and underlying errors)
+	// out of error responses (see lambda.ErrorCode)
+	Redact_errors bool `json:"redact_errors"`
+
+	// respond to requests the worker fails (not ones the lambda
+	// fails) with a JSON error envelope, unless the client asks for
+	// text/plain; if false, errors are always plain text
+	Json_errors bool `json:"json_errors"`
+
+	// on a graceful shutdown, write a snapshot of the active
+	// lambdas (code, packages, and recent traffic) to the worker
+	// dir, and on startup, prewarm the lambdas in the previous
+	// worker's snapshot (see lambda.LambdaMgr.Handoff)
+	Handoff bool `json:"handoff"`
+
+	// gzip responses of at least Limits.Compress_min_bytes for
+	// clients that accept it, if their content type is likely to
+	// compress well (handlers that set Content-Encoding
+	// themselves are left alone)
+	Compress_responses bool `json:"compress_responses"`
+
+	// ping each new Sandbox before it serves its first request,
+	// replacing Sandboxes that don't answer (see
+	// lambda.SELF_TEST_ATTEMPTS)
+	Sandbox_self_test bool `json:"sandbox_self_test"`
+
+	// rather than rejecting a request because a queue is full
+	// (429) or it waited too long in one (503), forward it to
+	// the least loaded of the Peers (once)
+	Forward_to_peers bool `json:"forward_to_peers"`
+
+	// with a Zygote_pool, let Zygotes or handlers use the other
+	// partition's free memory while nothing is waiting for it
+	// (idle Sandboxes over their partition's share are evicted
+	// first)
+	Mem_pool_borrow bool `json:"mem_pool_borrow"`
+
+	// record who invoked each lambda, and when, with the Audit
+	// sink (may be overridden per lambda, with ol-audit)
+	Audit_invocations bool `json:"audit_invocations"`
 }
 
 type TraceConfig struct {
@@ -74,6 +238,144 @@ type TraceConfig struct {
 	Package bool `json:"package"`
 }
 
+type RecordConfig struct {
+	// how many recorded invocations to keep (oldest are deleted first)
+	Max_entries int `json:"max_entries"`
+
+	// request and response bodies are truncated to this size
+	Max_body_bytes int `json:"max_body_bytes"`
+
+	// headers (e.g., credentials) that are never recorded
+	Redact_headers []string `json:"redact_headers"`
+}
+
+type PackageConfig struct {
+	// for workers without internet access: packages are only
+	// installed from the wheels (or sdists) in this directory
+	// (e.g., unpacked from the tarball of an /admin/prefetch on a
+	// connected worker), and pip never uses the network.  An
+	// install that isn't there fails right away
+	Offline_dir string `json:"offline_dir"`
+}
+
+type AuditConfig struct {
+	// where audit records go: "file" (JSON lines), or a sink
+	// registered with lambda.RegisterAuditSink
+	Sink string `json:"sink"`
+
+	// for the file sink (default: audit.jsonl in the worker dir),
+	// which is rotated when it reaches Max_file_mb (0 for never),
+	// keeping Max_files old files
+	File        string `json:"file"`
+	Max_file_mb int    `json:"max_file_mb"`
+	Max_files   int    `json:"max_files"`
+
+	// request header that identifies the caller (e.g., set by an
+	// authenticating proxy in front of the worker); "" to record
+	// no caller.  Callers the worker authenticates itself (see
+	// Auth) are recorded by their token's subject instead
+	Identity_header string `json:"identity_header"`
+
+	// how many records may wait to be written; more are dropped
+	// (and counted in audit/dropped), rather than slowing requests
+	Queue int `json:"queue"`
+}
+
+type AuthConfig struct {
+	// how callers authenticate: "" (they don't; anyone who can
+	// reach the worker can do anything), "tokens" (static bearer
+	// tokens, from Tokens), or "jwt" (bearer JWTs, signed with
+	// Jwt_secret or Jwt_public_key_file)
+	Mode string `json:"mode"`
+
+	Tokens []AuthTokenConfig `json:"tokens"`
+
+	// HS256 secret, or PEM file with an RSA public key (for RS256)
+	Jwt_secret          string `json:"jwt_secret"`
+	Jwt_public_key_file string `json:"jwt_public_key_file"`
+
+	// JWTs with other issuers or audiences are rejected (if set)
+	Jwt_issuer   string `json:"jwt_issuer"`
+	Jwt_audience string `json:"jwt_audience"`
+
+	// JWT claim with the caller's permissions (a list, or a
+	// space-separated string, like "scope")
+	Jwt_permissions_claim string `json:"jwt_permissions_claim"`
+
+	// paths anyone may use (e.g., for health checks)
+	Open_paths []string `json:"open_paths"`
+}
+
+// a static bearer token, and what its holder (Subject, as recorded in
+// the audit log) may do: "invoke:<lambda-glob>", "admin:<endpoint-glob>",
+// or "*" for everything
+type AuthTokenConfig struct {
+	Token       string   `json:"token"`
+	Subject     string   `json:"subject"`
+	Permissions []string `json:"permissions"`
+}
+
+type EgressConfig struct {
+	// hosts ("host:port") and networks (CIDRs) every lambda may
+	// connect to, in addition to those in its ol-net-allow.  If
+	// both are empty, a lambda's connections aren't restricted
+	Default_allow []string `json:"default_allow"`
+
+	// only log what would be restricted, even where the Sandbox
+	// type can enforce it.  SOCK Sandboxes share the worker's
+	// network, so they can't, and a lambda with a policy can only
+	// run in one if this is set.
+	Log_only bool `json:"log_only"`
+}
+
+// CORS settings for lambdas that allow browser origins with ol-cors
+// (lambdas without it never get CORS headers)
+type CorsConfig struct {
+	// let browsers send credentials (cookies, etc.); the
+	// request's origin is then echoed, rather than "*" (may be
+	// overridden with ol-cors-credentials)
+	Allow_credentials bool `json:"allow_credentials"`
+
+	// how long (seconds) browsers may cache a preflight response
+	// (0 to leave it to the browser; may be overridden with
+	// ol-cors-max-age)
+	Max_age_s int `json:"max_age_s"`
+
+	// request headers allowed in preflights (empty to allow
+	// whatever the browser asks for)
+	Allow_headers []string `json:"allow_headers"`
+
+	// response headers scripts may read, besides the simple ones
+	Expose_headers []string `json:"expose_headers"`
+}
+
+type EventSourceConfig struct {
+	// only "kafka" so far (consumed via a Kafka REST proxy)
+	Type string `json:"type"`
+
+	// lambda to invoke
+	Lambda string `json:"lambda"`
+
+	// URL of the REST proxy
+	Url   string `json:"url"`
+	Topic string `json:"topic"`
+	Group string `json:"group"`
+
+	// how many messages to send in each invocation?  With 1, the
+	// body is the message itself; otherwise, it is a JSON array
+	// of messages (default 1)
+	Batch_size int `json:"batch_size"`
+
+	// how many invocations may be in progress at once? (default 1)
+	Max_concurrency int `json:"max_concurrency"`
+
+	// failed invocations are retried (with backoff) this many
+	// times (default 3), before their messages are sent to
+	// Dead_letter_topic (or, if that's empty, dropped)
+	Max_retries       int    `json:"max_retries"`
+	Dead_letter_topic string `json:"dead_letter_topic"`
+}
+
 type StoreString string
 
 func (s StoreString) Mode() StoreMode {
@@ -96,6 +398,34 @@ type StorageConfig struct {
 	Code    StoreString `json:"code"`
 }
 
+type ScalingConfig struct {
+	// how to decide how many instances each lambda should have:
+	// "default" (one per second of outstanding work), "request"
+	// (one per outstanding request), or one added with
+	// lambda.RegisterAutoscaler
+	Autoscaler string `json:"autoscaler"`
+
+	// after a lambda scales up, don't scale it down again for
+	// this long, so that instances needed for a burst are still
+	// around if another burst follows soon after (0 disables)
+	Scale_down_cooldown_ms int64 `json:"scale_down_cooldown_ms"`
+
+	// each lambda adjusts its instances at most once per second,
+	// plus a random delay of up to this long, so that lambdas on
+	// the same worker don't start and stop instances in lockstep
+	// (at most 1000)
+	Adjust_jitter_ms int64 `json:"adjust_jitter_ms"`
+
+	// the average execution time autoscalers see (see
+	// lambda.ScalingStats) is over each lambda's last this many
+	// requests, or, if Exec_avg_window_ms isn't 0, over its
+	// requests that finished within that many ms.  Fewer samples
+	// react faster, and more are steadier (0 means
+	// lambda.EXEC_AVG_DEFAULT_WINDOW).  Read when a lambda starts.
+	Exec_avg_window    int   `json:"exec_avg_window"`
+	Exec_avg_window_ms int64 `json:"exec_avg_window_ms"`
+}
+
 type LimitsConfig struct {
 	// how many processes can be created within a Sandbox?
 	Procs int `json:"procs"`
@@ -111,9 +441,112 @@ type LimitsConfig struct {
 	// for pip installs?
 	Installer_mem_mb int `json:"installer_mem_mb"`
 
+	// how long may a single package install take before the
+	// installer Sandbox is killed?  (0 means no limit)
+	Install_timeout_ms int64 `json:"install_timeout_ms"`
+
+	// how long may installing all the packages for a new version
+	// of a lambda take?  (0 means no limit)
+	Pull_timeout_ms int64 `json:"pull_timeout_ms"`
+
+	// how large may a lambda's code be, once extracted?  (0 means
+	// no limit)
+	Max_code_mb int `json:"max_code_mb"`
+
 	// The max lambda timeout given in milliseconds
 	// If no timeout is given by the lambda, this max timeout is also the default
 	Max_timeout_ms int64 `json:"max_timeout_ms"`
+
+	// how long may a request wait in a lambda's queue for an
+	// instance to serve it, before failing with 503?  (0 means
+	// no limit)
+	Max_queue_ms int64 `json:"max_queue_ms"`
+
+	// request bodies up to this size are read in full before an
+	// invocation is queued, so that if its Sandbox dies before
+	// responding, it can be retried on another (0 means never;
+	// larger bodies are streamed, and can't be retried)
+	Max_retryable_body_bytes int64 `json:"max_retryable_body_bytes"`
+
+	// how long may all the invocations in a batch (see
+	// LambdaFunc.InvokeBatch) take, together?  (0 means no limit)
+	Batch_timeout_ms int64 `json:"batch_timeout_ms"`
+
+	// how many invocations from one batch may run concurrently?
+	Batch_concurrency int `json:"batch_concurrency"`
+
+	// how many lambdas' code may be pulled (and packages
+	// installed) at once; others wait their turn (0 means no
+	// limit; only read at startup)
+	Pull_concurrency int `json:"pull_concurrency"`
+
+	// how many instances (i.e., virtual sandboxes) all lambdas
+	// may have between them (0 means no limit).  While over, the
+	// least busy lambdas give up instances first.
+	Max_instances int `json:"max_instances"`
+
+	// how long a new worker spends getting the lambdas in the
+	// previous worker's handoff snapshot ready (see
+	// Features.Handoff)
+	Handoff_budget_ms int64 `json:"handoff_budget_ms"`
+
+	// how long a handler's warmup (see ol-warmup-path) may take
+	Warmup_timeout_ms int64 `json:"warmup_timeout_ms"`
+
+	// how long must a lambda be idle before it scales to zero
+	// instances (see Features.Scale_to_zero)?
+	Scale_to_zero_idle_ms int64 `json:"scale_to_zero_idle_ms"`
+
+	// how long must a lambda with no instances be idle before its
+	// LambdaFunc is retired (freeing its goroutines)?  It is
+	// recreated if the lambda is used again (0 means never)
+	Idle_func_retire_ms int64 `json:"idle_func_retire_ms"`
+
+	// log a warning when the percentage of a function's recent
+	// invocations that failed (5xx or timeout) reaches this
+	// level (0 disables the alert)
+	Error_rate_alert_pct int `json:"error_rate_alert_pct"`
+
+	// smaller responses aren't worth compressing (see
+	// Features.Compress_responses)
+	Compress_min_bytes int `json:"compress_min_bytes"`
+
+	// how much disk may the packages a lambda installs take,
+	// altogether?  A lambda exceeding this fails to load (0 means
+	// no limit).  Particular lambdas (by name) may be given a
+	// different limit here; lambdas can't set their own
+	Max_deps_mb           int            `json:"max_deps_mb"`
+	Max_deps_mb_overrides map[string]int `json:"max_deps_mb_overrides"`
+
+	// how many packages may a lambda install, counting the
+	// dependencies of its packages, and how long may a chain of
+	// dependencies be (a package the lambda lists directly is at
+	// depth 1)?  Installs stop, failing the pull, at either limit
+	// (0 means no limit)
+	Max_install_pkgs  int `json:"max_install_pkgs"`
+	Max_install_depth int `json:"max_install_depth"`
+
+	// when this percentage of a function's last Breaker_window
+	// invocations failed, reject its requests (503) without
+	// starting more instances, for Breaker_cooldown_ms, after
+	// which one probe request decides whether to go back to
+	// normal (0 disables the breaker)
+	Breaker_error_pct   int   `json:"breaker_error_pct"`
+	Breaker_window      int   `json:"breaker_window"`
+	Breaker_cooldown_ms int64 `json:"breaker_cooldown_ms"`
+
+	// after this many requests in a row failed because a lambda's
+	// instances could not start a Sandbox (e.g., its packages are
+	// broken), the lambda is marked unhealthy, and its requests
+	// are rejected (503) in the same way as by an open breaker,
+	// until a probe request succeeds (0 disables this)
+	Start_failure_budget int `json:"start_failure_budget"`
+
+	// warn when less disk than this is free where the worker
+	// keeps code and scratch dirs (Worker_dir), as Sandboxes
+	// can't be created once it is full (0 disables the warning;
+	// the space left is always in the storage/free-mb gauge)
+	Min_free_disk_mb int `json:"min_free_disk_mb"`
 }
 
 // Defaults verifies the fields of Config are correct, and initializes some
@@ -134,33 +567,80 @@ func LoadDefaults(olPath string) error {
 	mem_pool_mb := Max(int(total_mb-500), 500)
 
 	Conf = &Config{
-		Worker_dir:        workerDir,
-		Server_mode:       "lambda",
-		Worker_port:       "5000",
-		Registry:          registryDir,
-		Sandbox:           "sock",
-		Pkgs_dir:          packagesDir,
-		Sandbox_config:    map[string]interface{}{},
-		SOCK_base_path:    baseImgDir,
-		Registry_cache_ms: 5000, // 5 seconds
-		Mem_pool_mb:       mem_pool_mb,
-		Import_cache_tree: "",
+		Worker_dir:                  workerDir,
+		Server_mode:                 "lambda",
+		Worker_port:                 "5000",
+		Registry:                    registryDir,
+		Sandbox:                     "sock",
+		Pkgs_dir:                    packagesDir,
+		Sandbox_config:              map[string]interface{}{},
+		SOCK_base_path:              baseImgDir,
+		Registry_cache_ms:           5000, // 5 seconds
+		Registry_not_found_cache_ms: 1000,
+		Mem_pool_mb:                 mem_pool_mb,
+		Import_cache_tree:           "",
+		Log_level:                   "info",
 		Limits: LimitsConfig{
-			Procs:            10,
-			Mem_mb:           50,
-			Installer_mem_mb: Max(250, Min(500, mem_pool_mb/2)),
-			Swappiness:       0,
-			Max_timeout_ms: 60000,
+			Procs:                    10,
+			Mem_mb:                   50,
+			Installer_mem_mb:         Max(250, Min(500, mem_pool_mb/2)),
+			Install_timeout_ms:       120000,
+			Pull_timeout_ms:          300000,
+			Max_code_mb:              500,
+			Swappiness:               0,
+			Max_timeout_ms:           60000,
+			Error_rate_alert_pct:     50,
+			Batch_timeout_ms:         300000,
+			Batch_concurrency:        8,
+			Pull_concurrency:         8,
+			Handoff_budget_ms:        60000,
+			Warmup_timeout_ms:        300000,
+			Max_retryable_body_bytes: 1 << 20,
+			Scale_to_zero_idle_ms:    30000,
+			Idle_func_retire_ms:      600000,
+			Compress_min_bytes:       1024,
+			Max_deps_mb:              4096,
+			Max_install_pkgs:         500,
+			Max_install_depth:        50,
+			Breaker_window:           20,
+			Breaker_cooldown_ms:      10000,
+			Start_failure_budget:     5,
+			Min_free_disk_mb:         1024,
+		},
+		Scaling: ScalingConfig{
+			Adjust_jitter_ms: 200,
 		},
 		Features: FeaturesConfig{
 			Import_cache:        true,
 			Downsize_paused_mem: true,
+			Json_errors:         true,
+			Handoff:             true,
 		},
 		Storage: StorageConfig{
 			Root:    "private",
 			Scratch: "",
 			Code:    "",
 		},
+		Cors: CorsConfig{
+			Expose_headers: []string{"X-OL-Invocation-Id"},
+		},
+		Record: RecordConfig{
+			Max_entries:    1000,
+			Max_body_bytes: 64 * 1024,
+			Redact_headers: []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"},
+		},
+		Auth: AuthConfig{
+			Jwt_permissions_claim: "permissions",
+			Open_paths:            []string{"/pid", "/status", "/stats"},
+		},
+		Audit: AuditConfig{
+			Sink:            "file",
+			File:            filepath.Join(workerDir, "audit.jsonl"),
+			Max_file_mb:     100,
+			Max_files:       5,
+			Identity_header: "X-Forwarded-User",
+			Queue:           1024,
+		},
 	}
 
 	return checkConf()
@@ -169,6 +649,8 @@ func LoadDefaults(olPath string) error {
 // ParseConfig reads a file and tries to parse it as a JSON string to a Config
 // instance.
 func LoadConf(path string) error {
+	confPath = path
+
 	config_raw, err := ioutil.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("could not open config (%v): %v\n", path, err.Error())
@@ -183,16 +665,24 @@ func LoadConf(path string) error {
 }
 
 func checkConf() error {
-	if !path.IsAbs(Conf.Worker_dir) {
+	return checkConfig(Conf)
+}
+
+func checkConfig(c *Config) error {
+	if !path.IsAbs(c.Worker_dir) {
 		return fmt.Errorf("Worker_dir cannot be relative")
 	}
 
-	if Conf.Sandbox == "sock" {
-		if Conf.SOCK_base_path == "" {
+	if _, err := ParseLogLevel(c.Log_level); err != nil {
+		return err
+	}
+
+	if c.Sandbox == "sock" {
+		if c.SOCK_base_path == "" {
 			return fmt.Errorf("must specify sock_base_path")
 		}
 
-		if !path.IsAbs(Conf.SOCK_base_path) {
+		if !path.IsAbs(c.SOCK_base_path) {
 			return fmt.Errorf("sock_base_path cannot be relative")
 		}
 
@@ -203,29 +693,230 @@ func checkConf() error {
 		// evicted.
 		//
 		// TODO: revise evictor and relax this
-		min_mem := 2 * Max(Conf.Limits.Installer_mem_mb, Conf.Limits.Mem_mb)
-		if min_mem > Conf.Mem_pool_mb {
+		min_mem := 2 * Max(c.Limits.Installer_mem_mb, c.Limits.Mem_mb)
+		if min_mem > c.Mem_pool_mb {
 			return fmt.Errorf("mem_pool_mb must be at least %d", min_mem)
 		}
-	} else if Conf.Sandbox == "docker" {
-		if Conf.Pkgs_dir == "" {
+
+		zygoteMB, err := c.ZygotePoolMB(c.Mem_pool_mb)
+		if err != nil {
+			return err
+		}
+		if zygoteMB > 0 {
+			if !c.Features.Import_cache {
+				return fmt.Errorf("zygote_pool requires features.import_cache")
+			}
+			if zygoteMB < c.Limits.Mem_mb {
+				return fmt.Errorf("zygote_pool must fit at least one Zygote (%d MB)", c.Limits.Mem_mb)
+			}
+			if c.Mem_pool_mb-zygoteMB < min_mem {
+				return fmt.Errorf("zygote_pool must leave at least %d MB of mem_pool_mb for handlers", min_mem)
+			}
+		}
+
+		if len(c.Egress.Default_allow) > 0 && !c.Egress.Log_only {
+			return fmt.Errorf("egress.default_allow cannot be enforced for sock Sandboxes (unless egress.log_only is set)")
+		}
+	} else if c.Sandbox == "docker" {
+		if c.Pkgs_dir == "" {
 			return fmt.Errorf("must specify packages directory")
 		}
 
-		if !path.IsAbs(Conf.Pkgs_dir) {
+		if !path.IsAbs(c.Pkgs_dir) {
 			return fmt.Errorf("Pkgs_dir cannot be relative")
 		}
 
-		if Conf.Features.Import_cache {
+		if c.Features.Import_cache {
 			return fmt.Errorf("features.import_cache must be disabled for docker Sandbox")
 		}
 	} else {
-		return fmt.Errorf("Unknown Sandbox type '%s'", Conf.Sandbox)
+		return fmt.Errorf("Unknown Sandbox type '%s'", c.Sandbox)
+	}
+
+	if c.Warm_sandboxes < 0 || c.Warm_pool_mb < 0 {
+		return fmt.Errorf("warm_sandboxes and warm_pool_mb cannot be negative")
+	}
+	if c.Warm_pool_mb >= c.Mem_pool_mb && c.Sandbox == "sock" {
+		return fmt.Errorf("warm_pool_mb must be less than mem_pool_mb")
+	}
+
+	if jitter := c.Scaling.Adjust_jitter_ms; jitter < 0 || jitter > 1000 {
+		return fmt.Errorf("scaling.adjust_jitter_ms must be between 0 and 1000")
+	}
+
+	if c.Scaling.Exec_avg_window < 0 || c.Scaling.Exec_avg_window_ms < 0 {
+		return fmt.Errorf("scaling.exec_avg_window and scaling.exec_avg_window_ms cannot be negative")
+	}
+
+	if c.Limits.Breaker_error_pct > 0 && c.Limits.Breaker_window < 1 {
+		return fmt.Errorf("limits.breaker_window must be at least 1")
+	}
+
+	if err := CheckRoutes(c.Routes); err != nil {
+		return err
+	}
+
+	for _, peer := range c.Peers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("peer '%s' is not an http(s) URL", peer)
+		}
+	}
+
+	if dir := c.Package.Offline_dir; dir != "" {
+		if !path.IsAbs(dir) {
+			return fmt.Errorf("package.offline_dir cannot be relative")
+		}
+		if strings.HasPrefix(c.Package_cache, "http://") || strings.HasPrefix(c.Package_cache, "https://") {
+			return fmt.Errorf("package.offline_dir cannot be used with a remote package_cache")
+		}
 	}
 
 	return nil
 }
 
+// ReloadConfPath returns the path of the config file the worker was
+// started with ("" if it only has defaults)
+func ReloadConfPath() string {
+	return confPath
+}
+
+// ParseConf reads and checks a config, without applying it.  Settings
+// the file doesn't mention keep their current values.
+func ParseConf(path string) (*Config, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config (%v): %v", path, err)
+	}
+
+	c, err := copyConf(Conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, c); err != nil {
+		return nil, fmt.Errorf("could not parse config (%v): %v", path, err)
+	}
+
+	if err := checkConfig(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReplaceConf makes c the worker's config (returning the old one),
+// without a restart.  Only the Limits, Features, Scaling, and Egress
+// sections may change, as the rest is only read at startup; if anything else
+// differs, c is rejected, and nothing changes.
+//
+// Conf is swapped for c, never modified in place, so code that reads
+// Conf once sees a consistent config (and new values take effect as
+// they are next read).
+func ReplaceConf(c *Config) (*Config, error) {
+	replaceMutex.Lock()
+	defer replaceMutex.Unlock()
+
+	if err := checkConfig(c); err != nil {
+		return nil, err
+	}
+
+	fixedOld, err := copyConf(Conf)
+	if err != nil {
+		return nil, err
+	}
+	fixedNew, err := copyConf(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, fixed := range []*Config{fixedOld, fixedNew} {
+		fixed.Limits = LimitsConfig{}
+		fixed.Features = FeaturesConfig{}
+		fixed.Scaling = ScalingConfig{}
+		fixed.Egress = EgressConfig{}
+	}
+	oldJson, _ := json.Marshal(fixedOld)
+	newJson, _ := json.Marshal(fixedNew)
+	if string(oldJson) != string(newJson) {
+		return nil, fmt.Errorf("only limits, features, scaling, and egress can be changed without a restart")
+	}
+
+	old := Conf
+	Conf = c
+	return old, nil
+}
+
+// deep copy, via JSON
+func copyConf(c *Config) (*Config, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	copied := &Config{}
+	if err := json.Unmarshal(raw, copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// CheckSandboxType makes sure a lambda's selected sandbox type is one
+// the worker runs ("" means the main one, Sandbox)
+func CheckSandboxType(typ string) error {
+	if typ == "" || typ == Conf.Sandbox {
+		return nil
+	}
+	for _, extra := range Conf.Extra_sandboxes {
+		if typ == extra {
+			return nil
+		}
+	}
+
+	available := append([]string{Conf.Sandbox}, Conf.Extra_sandboxes...)
+	return fmt.Errorf("sandbox type '%s' is not available (available types: %s)",
+		typ, strings.Join(available, ", "))
+}
+
+// ZygotePoolMB returns how much of a memory pool of totalMB is set
+// aside for Zygotes (see Zygote_pool), or 0 if it isn't partitioned
+func (c *Config) ZygotePoolMB(totalMB int) (int, error) {
+	s := strings.TrimSpace(c.Zygote_pool)
+	if s == "" {
+		return 0, nil
+	}
+
+	if pct := strings.TrimSuffix(s, "%"); pct != s {
+		n, err := strconv.Atoi(strings.TrimSpace(pct))
+		if err != nil || n < 0 || n >= 100 {
+			return 0, fmt.Errorf("zygote_pool '%s' must be a percent from 0 to 99", s)
+		}
+		return totalMB * n / 100, nil
+	}
+
+	mb, err := strconv.Atoi(s)
+	if err != nil || mb < 0 || mb >= totalMB {
+		return 0, fmt.Errorf("zygote_pool '%s' must be a number of MB less than %d (or a percent)", s, totalMB)
+	}
+	return mb, nil
+}
+
+// PythonInterpreter returns the interpreter to run for the given
+// Python version ("" meaning the default, python3)
+func PythonInterpreter(version string) (string, error) {
+	if version == "" {
+		return "python3", nil
+	}
+
+	if interp, ok := Conf.Python_interpreters[version]; ok {
+		return interp, nil
+	}
+
+	available := []string{}
+	for v := range Conf.Python_interpreters {
+		available = append(available, v)
+	}
+	sort.Strings(available)
+	available = append([]string{"default"}, available...)
+	return "", fmt.Errorf("Python %s is not installed (available versions: %s)",
+		version, strings.Join(available, ", "))
+}
+
 // SandboxConfJson marshals the Sandbox_config of the Config into a JSON string.
 func SandboxConfJson() string {
 	s, err := json.Marshal(Conf.Sandbox_config)
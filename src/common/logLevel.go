@@ -0,0 +1,48 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// how verbose a component's logging is; messages below the
+// configured level are dropped
+type LogLevel int32
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+// an empty string gives the default level (info)
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LOG_DEBUG, nil
+	case "", "info":
+		return LOG_INFO, nil
+	case "warn":
+		return LOG_WARN, nil
+	case "error":
+		return LOG_ERROR, nil
+	default:
+		return LOG_INFO, fmt.Errorf("unknown log level '%s' (expected debug, info, warn, or error)", s)
+	}
+}
+
+func (l LogLevel) String() string {
+	switch l {
+	case LOG_DEBUG:
+		return "debug"
+	case LOG_INFO:
+		return "info"
+	case LOG_WARN:
+		return "warn"
+	case LOG_ERROR:
+		return "error"
+	default:
+		return fmt.Sprintf("level-%d", int(l))
+	}
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maps requests to a lambda by path prefix (and optionally host and
+// method), so that e.g. /api/orders/create can run the "orders"
+// lambda, as if it were /run/orders/create
+type RouteConfig struct {
+	// matches this path, and any path under it
+	Prefix string `json:"prefix"`
+
+	// only requests with this Host header match ("" matches any)
+	Host string `json:"host"`
+
+	// only requests with these methods match (empty matches any)
+	Methods []string `json:"methods"`
+
+	// the lambda to run
+	Lambda string `json:"lambda"`
+}
+
+// normalize a route, and make sure it makes sense on its own
+func (route *RouteConfig) Normalize() error {
+	if !strings.HasPrefix(route.Prefix, "/") {
+		return fmt.Errorf("route prefix '%s' must start with '/'", route.Prefix)
+	}
+	if route.Lambda == "" {
+		return fmt.Errorf("route for prefix '%s' has no lambda", route.Prefix)
+	}
+	if route.Prefix != "/" {
+		route.Prefix = strings.TrimRight(route.Prefix, "/")
+	}
+	route.Host = strings.ToLower(route.Host)
+	for i, method := range route.Methods {
+		route.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+// do the (normalized) routes match some of the same requests, with
+// neither more specific than the other?
+func (route *RouteConfig) ConflictsWith(other *RouteConfig) bool {
+	if route.Prefix != other.Prefix || route.Host != other.Host {
+		return false
+	}
+	if len(route.Methods) == 0 || len(other.Methods) == 0 {
+		return true
+	}
+	for _, a := range route.Methods {
+		for _, b := range other.Methods {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (route *RouteConfig) String() string {
+	s := route.Prefix
+	if route.Host != "" {
+		s = route.Host + s
+	}
+	if len(route.Methods) > 0 {
+		s = strings.Join(route.Methods, ",") + " " + s
+	}
+	return s
+}
+
+// CheckRoutes normalizes routes, rejecting any that conflict
+func CheckRoutes(routes []RouteConfig) error {
+	for i := range routes {
+		if err := routes[i].Normalize(); err != nil {
+			return err
+		}
+		for j := 0; j < i; j++ {
+			if routes[i].ConflictsWith(&routes[j]) {
+				return fmt.Errorf("route %s (to %s) conflicts with route %s (to %s)",
+					routes[i].String(), routes[i].Lambda, routes[j].String(), routes[j].Lambda)
+			}
+		}
+	}
+	return nil
+}
@@ -5,16 +5,30 @@ import (
 	"container/list"
 	"fmt"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// a time-windowed RollingAvg keeps at most this many samples, however
+// many arrive within its window
+const ROLLING_AVG_MAX_SAMPLES = 10000
+
+// RollingAvg averages the most recent samples: the last size of them,
+// or (if window isn't 0) those added within the last window
 type RollingAvg struct {
-	size int
-	nums *list.List
-	sum  int
-	Avg  int
+	size   int
+	window time.Duration
+	nums   *list.List // of rollingSample, newest first
+	sum    int
+	Avg    int
+}
+
+type rollingSample struct {
+	num   int
+	added time.Time
 }
 
 func NewRollingAvg(size int) *RollingAvg {
@@ -26,11 +40,26 @@ func NewRollingAvg(size int) *RollingAvg {
 	}
 }
 
+// NewTimedRollingAvg averages the samples added within the last
+// window, so the average covers the same span of time however often
+// samples arrive.  Samples only expire as others are added, so after
+// a quiet period, Avg is still that of the last samples.
+func NewTimedRollingAvg(window time.Duration) *RollingAvg {
+	r := NewRollingAvg(ROLLING_AVG_MAX_SAMPLES)
+	r.window = window
+	return r
+}
+
 func (r *RollingAvg) Add(num int) {
+	now := time.Now()
 	r.sum += num
-	r.nums.PushFront(num)
-	if r.nums.Len() > r.size {
-		r.sum -= r.nums.Back().Value.(int)
+	r.nums.PushFront(rollingSample{num: num, added: now})
+	for r.nums.Len() > 1 {
+		oldest := r.nums.Back().Value.(rollingSample)
+		if r.nums.Len() <= r.size && (r.window == 0 || now.Sub(oldest.added) <= r.window) {
+			break
+		}
+		r.sum -= oldest.num
 		r.nums.Remove(r.nums.Back())
 	}
 	r.Avg = r.sum / r.nums.Len()
@@ -43,6 +72,34 @@ type msLatencyMsg struct {
 	x    int64
 }
 
+type counterMsg struct {
+	name string
+}
+
+type sumMsg struct {
+	name string
+	x    int64
+}
+
+type gaugeMsg struct {
+	name string
+	x    int64
+}
+
+type deleteGaugeMsg struct {
+	name string
+}
+
+type histogramMsg struct {
+	name string
+	ms   int64
+}
+
+type resetHistogramsMsg struct {
+	prefix string
+	done   chan bool
+}
+
 type snapshotMsg struct {
 	stats map[string]int64
 	done  chan bool
@@ -60,17 +117,58 @@ func initTaskOnce() {
 func statsTask() {
 	msCounts := make(map[string]int64)
 	msSums := make(map[string]int64)
+	counters := make(map[string]int64)
+	sums := make(map[string]int64)
+	gauges := make(map[string]int64)
+	histograms := make(map[string]*histogram)
 
 	for raw := range statsChan {
 		switch msg := raw.(type) {
 		case *msLatencyMsg:
 			msCounts[msg.name] += 1
 			msSums[msg.name] += msg.x
+		case *counterMsg:
+			counters[msg.name] += 1
+		case *sumMsg:
+			sums[msg.name] += msg.x
+		case *gaugeMsg:
+			gauges[msg.name] = msg.x
+		case *deleteGaugeMsg:
+			delete(gauges, msg.name)
+		case *histogramMsg:
+			h := histograms[msg.name]
+			if h == nil {
+				h = &histogram{buckets: make([]int64, len(HISTOGRAM_BUCKETS_MS)+1)}
+				histograms[msg.name] = h
+			}
+			h.add(msg.ms)
+		case *resetHistogramsMsg:
+			for k := range histograms {
+				if strings.HasPrefix(k, msg.prefix) {
+					delete(histograms, k)
+				}
+			}
+			msg.done <- true
 		case *snapshotMsg:
 			for k, cnt := range msCounts {
 				msg.stats[k+".cnt"] = cnt
 				msg.stats[k+".ms-avg"] = msSums[k] / cnt
 			}
+			for k, cnt := range counters {
+				msg.stats[k+".cnt"] = cnt
+			}
+			for k, x := range sums {
+				msg.stats[k+".sum"] = x
+			}
+			for k, x := range gauges {
+				msg.stats[k] = x
+			}
+			for k, h := range histograms {
+				msg.stats[k+".hist-cnt"] = h.count
+				msg.stats[k+".p50"] = h.percentile(50)
+				msg.stats[k+".p95"] = h.percentile(95)
+				msg.stats[k+".p99"] = h.percentile(99)
+			}
 			msg.done <- true
 		default:
 			panic(fmt.Sprintf("unkown type: %T", msg))
@@ -83,6 +181,48 @@ func record(name string, x int64) {
 	statsChan <- &msLatencyMsg{name, x}
 }
 
+// count an event that has no latency to measure
+func IncCounter(name string) {
+	initTaskOnce()
+	statsChan <- &counterMsg{name}
+}
+
+// add to a running total (e.g., of resources consumed)
+func AddSum(name string, x int64) {
+	initTaskOnce()
+	statsChan <- &sumMsg{name, x}
+}
+
+// set a stat that reports the most recent value (rather than an
+// average over all values, as for latencies)
+func SetGauge(name string, x int64) {
+	initTaskOnce()
+	statsChan <- &gaugeMsg{name, x}
+}
+
+// stop reporting a gauge (e.g., for something that no longer exists)
+func DeleteGauge(name string) {
+	initTaskOnce()
+	statsChan <- &deleteGaugeMsg{name}
+}
+
+// record a latency in a histogram, so that percentiles (rather than
+// just the average, as for T0/T1) are reported.  Histograms are
+// cumulative, until reset with ResetHistograms.
+func ObserveMs(name string, ms int64) {
+	initTaskOnce()
+	statsChan <- &histogramMsg{name, ms}
+}
+
+// clear the histograms whose names start with prefix ("" for all),
+// e.g., to measure before and after a tuning change
+func ResetHistograms(prefix string) {
+	initTaskOnce()
+	done := make(chan bool)
+	statsChan <- &resetHistogramsMsg{prefix, done}
+	<-done
+}
+
 func SnapshotStats() map[string]int64 {
 	initTaskOnce()
 	stats := make(map[string]int64)
@@ -92,6 +232,47 @@ func SnapshotStats() map[string]int64 {
 	return stats
 }
 
+// upper bounds of histogram buckets (the last bucket holds everything
+// bigger), so a histogram's memory is fixed
+var HISTOGRAM_BUCKETS_MS = []int64{
+	1, 2, 5, 10, 20, 50, 100, 200, 500,
+	1000, 2000, 5000, 10000, 20000, 60000, 120000, 300000,
+}
+
+type histogram struct {
+	buckets []int64 // counts, by HISTOGRAM_BUCKETS_MS
+	count   int64
+	max     int64
+}
+
+func (h *histogram) add(ms int64) {
+	i := sort.Search(len(HISTOGRAM_BUCKETS_MS), func(i int) bool {
+		return ms <= HISTOGRAM_BUCKETS_MS[i]
+	})
+	h.buckets[i] += 1
+	h.count += 1
+	if ms > h.max {
+		h.max = ms
+	}
+}
+
+// upper bound of the bucket containing the given percentile (or the
+// max, if smaller)
+func (h *histogram) percentile(pct int64) int64 {
+	target := (h.count*pct + 99) / 100
+	var seen int64 = 0
+	for i, cnt := range h.buckets {
+		seen += cnt
+		if seen >= target && i < len(HISTOGRAM_BUCKETS_MS) {
+			if HISTOGRAM_BUCKETS_MS[i] < h.max {
+				return HISTOGRAM_BUCKETS_MS[i]
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
 type Latency struct {
 	name         string
 	t0           time.Time
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -69,12 +70,46 @@ func (dm *DirMaker) Get(suffix string) string {
 	return filepath.Join(dm.prefix, id) + suffix
 }
 
-func (dm *DirMaker) Make(suffix string) string {
+// create a new dir (which may fail, e.g., if the disk is full; see
+// DiskUsage)
+func (dm *DirMaker) Make(suffix string) (string, error) {
 	dir := dm.Get(suffix)
 	if err := os.Mkdir(dir, 0777); err != nil {
-		panic(err)
+		return "", err
 	}
-	return dir
+	return dir, nil
+}
+
+// like Make, but the dir gets exactly the given permissions
+// (regardless of umask)
+func (dm *DirMaker) MakeMode(suffix string, perm os.FileMode) (string, error) {
+	dir := dm.Get(suffix)
+	if err := os.Mkdir(dir, perm); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, perm); err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// how much space is free (for unprivileged users) on the filesystem
+// holding path, and how big it is, in MB
+func DiskUsage(path string) (freeMB int64, totalMB int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	freeMB = int64(st.Bavail) * int64(st.Bsize) / 1024 / 1024
+	totalMB = int64(st.Blocks) * int64(st.Bsize) / 1024 / 1024
+	return freeMB, totalMB, nil
+}
+
+// did an operation fail because the disk (or the user's quota) is
+// full?
+func IsDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
 }
 
 func (dm *DirMaker) Cleanup() error {
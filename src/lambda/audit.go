@@ -0,0 +1,293 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// how many audit records may wait to be written, if Audit.Queue isn't set
+const AUDIT_DEFAULT_QUEUE = 1024
+
+// what the audit log says about one invocation
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	Lambda       string    `json:"lambda"`
+	InvocationId string    `json:"invocation_id"`
+
+	// who made the request (see Audit.Identity_header), and from
+	// where ("" if unknown)
+	Caller   string `json:"caller"`
+	SourceIP string `json:"source_ip"`
+
+	Method  string `json:"method"`
+	Status  int    `json:"status"`
+	ExecMs  int    `json:"exec_ms"`
+	QueueMs int    `json:"queue_ms"`
+}
+
+// somewhere audit records are kept (see Audit.Sink).  Write is only
+// called by the Auditor's task, never concurrently.
+type AuditSink interface {
+	Write(rec *AuditRecord) error
+	Close() error
+}
+
+// creates an AuditSink from the Audit config
+type AuditSinkFactory func(conf *common.AuditConfig) (AuditSink, error)
+
+// Audit.Sink -> factory
+var auditSinks = map[string]AuditSinkFactory{
+	"file": newFileAuditSink,
+}
+
+// make another kind of AuditSink available (e.g., for syslog), for
+// Audit.Sink to name
+func RegisterAuditSink(name string, factory AuditSinkFactory) {
+	auditSinks[name] = factory
+}
+
+// Auditor records who invoked which lambda, and when, for lambdas
+// that are audited (Features.Audit_invocations, or ol-audit).
+// Records are queued and written by a background task, so a slow
+// sink never holds up requests; records that don't fit in the queue
+// are dropped (and counted in audit/dropped).
+type Auditor struct {
+	sink    AuditSink
+	records chan *AuditRecord
+	done    chan bool
+	stopped chan bool // closed when auditTask returns
+}
+
+func NewAuditor(conf *common.AuditConfig) (*Auditor, error) {
+	factory, ok := auditSinks[conf.Sink]
+	if !ok {
+		return nil, fmt.Errorf("unknown audit sink '%s'", conf.Sink)
+	}
+	sink, err := factory(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := conf.Queue
+	if queue <= 0 {
+		queue = AUDIT_DEFAULT_QUEUE
+	}
+	a := &Auditor{
+		sink:    sink,
+		records: make(chan *AuditRecord, queue),
+		done:    make(chan bool),
+		stopped: make(chan bool),
+	}
+	go a.auditTask()
+	return a, nil
+}
+
+func (a *Auditor) auditTask() {
+	defer close(a.stopped)
+
+	write := func(rec *AuditRecord) {
+		if err := a.sink.Write(rec); err != nil {
+			log.Printf("could not write audit record for invocation %s of %s: %v", rec.InvocationId, rec.Lambda, err)
+			common.IncCounter("audit/failed")
+		} else {
+			common.IncCounter("audit/written")
+		}
+	}
+
+	for {
+		select {
+		case rec := <-a.records:
+			write(rec)
+		case <-a.done:
+			// write whatever was queued before stopping
+			for {
+				select {
+				case rec := <-a.records:
+					write(rec)
+				default:
+					if err := a.sink.Close(); err != nil {
+						log.Printf("could not close audit sink: %v", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// is f audited?  ol-audit overrides Features.Audit_invocations
+func (f *LambdaFunc) audited() bool {
+	if audit, _ := f.audit.Load().(*bool); audit != nil {
+		return *audit
+	}
+	return common.Conf.Features.Audit_invocations
+}
+
+type callerKey struct{}
+
+// WithCaller returns r, noting that it was made by caller (e.g., the
+// subject of a verified token), for the audit log
+func WithCaller(r *http.Request, caller string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+}
+
+// who made the request: the caller the worker authenticated (see
+// WithCaller), or else whoever the configured identity header names
+func auditCaller(r *http.Request) string {
+	if caller, ok := r.Context().Value(callerKey{}).(string); ok {
+		return caller
+	}
+	if header := common.Conf.Audit.Identity_header; header != "" {
+		return r.Header.Get(header)
+	}
+	return ""
+}
+
+// queue a record of req, if f is audited (never blocks)
+func (a *Auditor) record(f *LambdaFunc, req *Invocation) {
+	if a == nil || !f.audited() {
+		return
+	}
+
+	sourceIP, _, err := net.SplitHostPort(req.r.RemoteAddr)
+	if err != nil {
+		sourceIP = req.r.RemoteAddr
+	}
+	rec := &AuditRecord{
+		Time:         req.start,
+		Lambda:       f.name,
+		InvocationId: req.id,
+		Caller:       auditCaller(req.r),
+		SourceIP:     sourceIP,
+		Method:       req.r.Method,
+		Status:       req.sw.status,
+		ExecMs:       req.execMs,
+		QueueMs:      req.queueMs,
+	}
+
+	select {
+	case a.records <- rec:
+	default:
+		common.IncCounter("audit/dropped")
+	}
+}
+
+// write the records still queued, and close the sink
+func (a *Auditor) Cleanup() {
+	if a == nil {
+		return
+	}
+	close(a.done)
+	<-a.stopped
+}
+
+// appends records to a file, one JSON object per line.  Once the file
+// reaches Audit.Max_file_mb, it is renamed to <file>.1 (and <file>.1
+// to <file>.2, and so on), keeping Audit.Max_files old files.
+type fileAuditSink struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mutex sync.Mutex
+	file  *os.File // nil until the first Write
+	size  int64
+}
+
+func newFileAuditSink(conf *common.AuditConfig) (AuditSink, error) {
+	path := conf.File
+	if path == "" {
+		path = filepath.Join(common.Conf.Worker_dir, "audit.jsonl")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{
+		path:     path,
+		maxBytes: int64(conf.Max_file_mb) * 1024 * 1024,
+		maxFiles: conf.Max_files,
+	}, nil
+}
+
+func (s *fileAuditSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// move the current file aside, dropping the oldest
+func (s *fileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	if s.maxFiles <= 0 {
+		return os.Remove(s.path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxFiles))
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+func (s *fileAuditSink) Write(rec *AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileAuditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
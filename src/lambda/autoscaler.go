@@ -0,0 +1,97 @@
+package lambda
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// ScalingStats describes a lambda's recent load, for an Autoscaler
+type ScalingStats struct {
+	// requests dispatched to instances, but not yet finished
+	OutstandingReqs int
+
+	// average execution time of recent requests
+	AvgExecMs int
+
+	// current number of instances (of the current code version)
+	Instances int
+
+	// how many requests each instance can serve at once (see
+	// ol-sandbox-concurrency)
+	Concurrency int
+
+	// time since a request last arrived or finished
+	Idle time.Duration
+}
+
+// Autoscaler decides how many instances (i.e., virtual sandboxes) a
+// lambda should have.  Each LambdaFunc has its own Autoscaler, which
+// its Task consults whenever it considers scaling, so an Autoscaler
+// may keep state without locking.
+//
+// The Task enforces some things regardless of the Autoscaler: there
+// is at least one instance while requests are outstanding (or unless
+// the lambda may scale to zero), and the number of instances changes
+// by at most one per second.
+type Autoscaler interface {
+	Desired(stats ScalingStats) int
+}
+
+// Autoscalers that can be selected with Scaling.Autoscaler.  Others
+// may be added with RegisterAutoscaler.
+var autoscalers = map[string]func() Autoscaler{
+	"default": func() Autoscaler { return &workAutoscaler{} },
+	"request": func() Autoscaler { return &requestAutoscaler{} },
+}
+
+// RegisterAutoscaler makes an Autoscaler available to be selected by
+// name in Scaling.Autoscaler.  It must be called before the
+// LambdaMgr is created.
+func RegisterAutoscaler(name string, newAutoscaler func() Autoscaler) {
+	autoscalers[name] = newAutoscaler
+}
+
+func autoscalerFactory(name string) (func() Autoscaler, error) {
+	if name == "" {
+		name = "default"
+	}
+	newAutoscaler, ok := autoscalers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown autoscaler '%s'", name)
+	}
+	return newAutoscaler, nil
+}
+
+// aim to have 1 instance per second of outstanding work
+type workAutoscaler struct{}
+
+func (a *workAutoscaler) Desired(stats ScalingStats) int {
+	inProgressWorkMs := stats.OutstandingReqs * stats.AvgExecMs
+	desired := inProgressWorkMs / 1000 / common.Max(stats.Concurrency, 1)
+
+	// if we have, say, one job that will take 100 seconds,
+	// spinning up 100 instances won't do any good, so cap by
+	// how many instances the outstanding reqs could keep busy
+	if busy := perInstance(stats.OutstandingReqs, stats.Concurrency); busy < desired {
+		desired = busy
+	}
+	return desired
+}
+
+// how many instances it takes to serve reqs at once, with each serving
+// up to concurrency
+func perInstance(reqs, concurrency int) int {
+	concurrency = common.Max(concurrency, 1)
+	return (reqs + concurrency - 1) / concurrency
+}
+
+// aim to have 1 instance per outstanding request, or per Concurrency
+// of them (more instances, and thus less queueing, than the default,
+// at the cost of memory)
+type requestAutoscaler struct{}
+
+func (a *requestAutoscaler) Desired(stats ScalingStats) int {
+	return perInstance(stats.OutstandingReqs, stats.Concurrency)
+}
@@ -0,0 +1,129 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// result of one item in a batch, as returned to the client
+type BatchResult struct {
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+	ExecMs int    `json:"exec_ms"`
+}
+
+// InvokeBatch handles a request with the X-OL-Batch header, whose body
+// is a JSON array.  Each element is sent to the lambda as a separate
+// invocation (at most Batch_concurrency at a time, so a batch doesn't
+// crowd other requests out of the queue), and the response is a JSON
+// array of BatchResults, in the same order.
+//
+// Failed items don't stop the rest of the batch.  Items that haven't
+// run by the time Batch_timeout_ms expires fail with 504.
+func (f *LambdaFunc) InvokeBatch(w http.ResponseWriter, r *http.Request) {
+	t := common.T0("LambdaFunc.InvokeBatch")
+	defer t.T1()
+
+	// (the items' own CORS headers go nowhere)
+	if f.handleCORS(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ERR_BAD_REQUEST_BODY, "could not read batch body", err)
+		return
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		writeError(w, r, http.StatusBadRequest, ERR_BAD_REQUEST_BODY, "batch body must be a JSON array", err)
+		return
+	}
+
+	common.IncCounter("lambda/" + f.name + "/batches")
+
+	ctx := r.Context()
+	if timeoutMs := common.Conf.Limits.Batch_timeout_ms; IsFiniteTimeout(timeoutMs) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	results := make([]BatchResult, len(items))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < common.Max(1, common.Conf.Limits.Batch_concurrency); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range next {
+				results[idx] = f.invokeBatchItem(ctx, r, items[idx])
+			}
+		}()
+	}
+	for idx := range items {
+		next <- idx
+	}
+	close(next)
+	wg.Wait()
+
+	b, err := json.Marshal(results)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// run one item of a batch, retrying (until ctx is done) if the queue
+// is full
+func (f *LambdaFunc) invokeBatchItem(ctx context.Context, batch *http.Request, item []byte) BatchResult {
+	common.IncCounter("lambda/" + f.name + "/batch-items")
+
+	backoff := 10 * time.Millisecond
+	for {
+		if ctx.Err() != nil {
+			return BatchResult{
+				Status: http.StatusGatewayTimeout,
+				Body:   "batch deadline exceeded before this item ran",
+			}
+		}
+
+		r, err := http.NewRequestWithContext(ctx, "POST", batch.URL.String(), bytes.NewReader(item))
+		if err != nil {
+			return BatchResult{Status: http.StatusInternalServerError, Body: err.Error()}
+		}
+		r.Header = batch.Header.Clone()
+		r.Header.Del("X-OL-Batch")
+		r.Header.Del("Content-Length")
+
+		rec := httptest.NewRecorder()
+		req := f.invoke(rec, r)
+
+		// retry if the queue was full (or code is still being
+		// installed), rather than failing the item
+		if rec.Code == http.StatusTooManyRequests || (rec.Code == http.StatusServiceUnavailable && req == nil) {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff = time.Duration(common.Min(int(backoff*2), int(time.Second)))
+			continue
+		}
+
+		res := BatchResult{Status: rec.Code, Body: rec.Body.String()}
+		if req != nil {
+			res.ExecMs = req.execMs
+		}
+		return res
+	}
+}
@@ -0,0 +1,108 @@
+package lambda
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// a buffered body larger than this is kept in a temp file, rather than
+// in memory
+const BODY_BUFFER_MEMORY_BYTES = 1 << 20
+
+// a request body read in full before the request is queued, so it can
+// be sent to a Sandbox again (see Limits.Max_retryable_body_bytes)
+type bufferedBody struct {
+	mem  []byte
+	file *os.File // nil if the body is in mem
+	size int64
+}
+
+// a reader of the whole body, from the start
+func (b *bufferedBody) reader() io.ReadCloser {
+	if b.file != nil {
+		return ioutil.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.mem))
+}
+
+// remove the temp file, if any (once the request is done)
+func (b *bufferedBody) cleanup() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+// r's body, with something else to do when it is closed
+type spliceBody struct {
+	io.Reader
+	close func() error
+}
+
+func (sb *spliceBody) Close() error {
+	return sb.close()
+}
+
+// read r's body, if it is at most limit bytes, replacing it with one
+// that can be re-read (also with GetBody).  For a larger body, r is
+// left as it was (what was read is put back in front), and nil is
+// returned.
+func bufferBody(r *http.Request, limit int64) (*bufferedBody, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength > limit {
+		return nil, nil
+	}
+	orig := r.Body
+
+	// read into memory first, as most bodies are small
+	memLimit := int64(BODY_BUFFER_MEMORY_BYTES)
+	if limit < memLimit {
+		memLimit = limit
+	}
+	mem, err := ioutil.ReadAll(io.LimitReader(orig, memLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	b := &bufferedBody{mem: mem, size: int64(len(mem))}
+
+	if b.size > BODY_BUFFER_MEMORY_BYTES && b.size <= limit {
+		// too much to keep in memory
+		if b.file, err = ioutil.TempFile("", "ol-body-"); err != nil {
+			return nil, err
+		}
+		b.mem = nil
+		n, err := b.file.Write(mem)
+		if err == nil {
+			var m int64
+			m, err = io.Copy(b.file, io.LimitReader(orig, limit-int64(n)+1))
+			b.size = int64(n) + m
+		}
+		if err != nil {
+			b.cleanup()
+			return nil, err
+		}
+	}
+
+	if b.size > limit {
+		// put back what was read, ahead of the rest
+		prefix := b.reader()
+		r.Body = &spliceBody{
+			Reader: io.MultiReader(prefix, orig),
+			close: func() error {
+				b.cleanup()
+				return orig.Close()
+			},
+		}
+		return nil, nil
+	}
+
+	orig.Close()
+	r.Body = b.reader()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return b.reader(), nil
+	}
+	r.ContentLength = b.size
+	return b, nil
+}
@@ -0,0 +1,131 @@
+package lambda
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// a body of n bytes that aren't all the same, so a misplaced chunk
+// would show
+func testBody(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// a buffered body can be read again in full, however much of it was
+// read before; a body over the limit is left to be streamed, intact
+func TestBufferBody(t *testing.T) {
+	const limit = 4 << 20
+	tests := []struct {
+		size     int
+		buffered bool
+		inFile   bool
+	}{
+		{1000, true, false},
+		{BODY_BUFFER_MEMORY_BYTES, true, false},
+		{BODY_BUFFER_MEMORY_BYTES + 1, true, true},
+		{limit, true, true},
+		{limit + 1, false, false},
+	}
+
+	for _, test := range tests {
+		body := testBody(test.size)
+		r := httptest.NewRequest("POST", "/run/f", bytes.NewReader(body))
+		r.ContentLength = -1 // (as for a chunked request)
+		buf, err := bufferBody(r, limit)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", test.size, err)
+		}
+
+		if !test.buffered {
+			if buf != nil {
+				t.Errorf("%d bytes: buffered, over the %d byte limit", test.size, limit)
+			}
+			if got, _ := ioutil.ReadAll(r.Body); !bytes.Equal(got, body) {
+				t.Errorf("%d bytes: streamed body differs (%d bytes)", test.size, len(got))
+			}
+			r.Body.Close()
+			continue
+		}
+
+		if buf == nil {
+			t.Fatalf("%d bytes: not buffered", test.size)
+		}
+		if (buf.file != nil) != test.inFile {
+			t.Errorf("%d bytes: in a file is %v, expected %v", test.size, buf.file != nil, test.inFile)
+		}
+		if r.ContentLength != int64(test.size) {
+			t.Errorf("%d bytes: ContentLength is %d", test.size, r.ContentLength)
+		}
+
+		// a Sandbox reads part of the body before failing
+		io.CopyN(ioutil.Discard, r.Body, int64(test.size/2))
+
+		req := &Invocation{r: r, bodyBuf: buf}
+		if !req.rewind() {
+			t.Fatalf("%d bytes: can't rewind", test.size)
+		}
+		if got, _ := ioutil.ReadAll(r.Body); !bytes.Equal(got, body) {
+			t.Errorf("%d bytes: rewound body differs (%d bytes)", test.size, len(got))
+		}
+		getBody, _ := r.GetBody()
+		if got, _ := ioutil.ReadAll(getBody); !bytes.Equal(got, body) {
+			t.Errorf("%d bytes: GetBody differs (%d bytes)", test.size, len(got))
+		}
+
+		buf.cleanup()
+		if buf.file != nil {
+			if _, err := os.Stat(buf.file.Name()); !os.IsNotExist(err) {
+				t.Errorf("%d bytes: temp file left after cleanup", test.size)
+			}
+		}
+	}
+}
+
+// a request whose Sandbox dies after reading part of the body is
+// retried on another Sandbox, with the whole body
+func TestRetryAfterPartialBody(t *testing.T) {
+	for _, size := range []int{100 << 10, 2 << 20} {
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			mgr, pool := newTestMgr(t, echoHandler)
+			common.Conf.Limits.Max_retryable_body_bytes = 4 << 20
+			name := fmt.Sprintf("partial-%d", size)
+			registerLambda(t, name, "def f(event):\n    return event\n")
+
+			var once sync.Once
+			pool.beforeSend = func(req *http.Request) (err error) {
+				once.Do(func() {
+					io.CopyN(ioutil.Discard, req.Body, int64(size/2))
+					err = fmt.Errorf("%w: connection reset", sandbox.ErrUnreachable)
+				})
+				return err
+			}
+
+			body := testBody(size)
+			retriedBefore := common.SnapshotStats()["lambda/"+name+"/retried.cnt"]
+			rec := invoke(t, mgr, name, string(body))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %.200s", rec.Code, rec.Body.String())
+			}
+			if !bytes.Equal(rec.Body.Bytes(), body) {
+				t.Errorf("the handler got %d bytes, which differ from the %d sent", rec.Body.Len(), size)
+			}
+			if retried := common.SnapshotStats()["lambda/"+name+"/retried.cnt"] - retriedBefore; retried != 1 {
+				t.Errorf("retried %d times", retried)
+			}
+		})
+	}
+}
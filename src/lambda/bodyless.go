@@ -0,0 +1,93 @@
+package lambda
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// header on requests forwarded to a Sandbox as GETs, that arrived as
+// HEADs (see LambdaInstance.Task)
+const ORIGINAL_METHOD_HEADER = "X-OL-Original-Method"
+
+// keeps body bytes out of responses that must not have a body: those
+// to HEAD requests, and 204 and 304 responses (interim 1xx statuses
+// are passed on, ahead of the real one).  Handlers often
+// write a body regardless, which the http.Server would reject with an
+// error (failing the proxy mid-response).
+//
+// For a HEAD, the status and headers are held back until finish, so
+// Content-Length can be set to the size of the body the handler
+// wrote (as for the equivalent GET), unless it set one itself.
+//
+// Sits beneath an Invocation's statusWriter, so the statusWriter still
+// counts the bytes the handler wrote.
+type bodylessWriter struct {
+	http.ResponseWriter
+	head bool
+
+	status    int  // 0 until WriteHeader
+	sent      bool // status and headers were sent
+	bodyBytes int64
+}
+
+func newBodylessWriter(w http.ResponseWriter, r *http.Request) *bodylessWriter {
+	return &bodylessWriter{ResponseWriter: w, head: r.Method == "HEAD"}
+}
+
+// may a response with this status have a body?
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// is this an interim status (e.g., 103 Early Hints), which comes ahead
+// of the real one?
+func informational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+func (bw *bodylessWriter) WriteHeader(status int) {
+	if informational(status) {
+		bw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if bw.status != 0 {
+		return
+	}
+	bw.status = status
+	if status == http.StatusNoContent {
+		bw.Header().Del("Content-Length")
+	}
+
+	// a HEAD that has its Content-Length already needn't wait
+	if !bw.head || bw.Header().Get("Content-Length") != "" || !bodyAllowed(status) {
+		bw.send()
+	}
+}
+
+func (bw *bodylessWriter) send() {
+	if !bw.sent {
+		bw.sent = true
+		bw.ResponseWriter.WriteHeader(bw.status)
+	}
+}
+
+func (bw *bodylessWriter) Write(b []byte) (int, error) {
+	if bw.status == 0 {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if bw.head || !bodyAllowed(bw.status) {
+		bw.bodyBytes += int64(len(b))
+		return len(b), nil
+	}
+	return bw.ResponseWriter.Write(b)
+}
+
+// send the status and headers, if they were held back (after the
+// response is complete)
+func (bw *bodylessWriter) finish() {
+	if bw.status == 0 || bw.sent {
+		return
+	}
+	bw.Header().Set("Content-Length", strconv.FormatInt(bw.bodyBytes, 10))
+	bw.send()
+}
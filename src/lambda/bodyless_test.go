@@ -0,0 +1,105 @@
+package lambda
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// records every status written, not just the first
+type statusLog struct {
+	*httptest.ResponseRecorder
+	statuses []int
+}
+
+func (sl *statusLog) WriteHeader(status int) {
+	sl.statuses = append(sl.statuses, status)
+	if !informational(status) {
+		sl.ResponseRecorder.WriteHeader(status)
+	}
+}
+
+// a handler that always writes a body, whatever the method or status
+func writeBody(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	w.Write([]byte("hello, world"))
+}
+
+func TestBodylessWriter(t *testing.T) {
+	tests := []struct {
+		method     string
+		status     int
+		wantBody   string
+		wantLength string
+	}{
+		{"GET", http.StatusOK, "hello, world", ""},
+		{"HEAD", http.StatusOK, "", "12"},
+		{"HEAD", http.StatusNotFound, "", "12"},
+		{"GET", http.StatusNoContent, "", ""},
+		{"HEAD", http.StatusNoContent, "", ""},
+		{"GET", http.StatusNotModified, "", ""},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		bw := newBodylessWriter(rec, httptest.NewRequest(test.method, "/run/f", nil))
+		writeBody(bw, test.status)
+		bw.finish()
+
+		if rec.Code != test.status {
+			t.Errorf("%s %d: got status %d", test.method, test.status, rec.Code)
+		}
+		if body := rec.Body.String(); body != test.wantBody {
+			t.Errorf("%s %d: got body %q, expected %q", test.method, test.status, body, test.wantBody)
+		}
+		if length := rec.Header().Get("Content-Length"); length != test.wantLength {
+			t.Errorf("%s %d: got Content-Length %q, expected %q", test.method, test.status, length, test.wantLength)
+		}
+	}
+}
+
+// a HEAD whose handler set Content-Length needn't wait for the body
+func TestBodylessWriterHeadWithLength(t *testing.T) {
+	rec := httptest.NewRecorder()
+	bw := newBodylessWriter(rec, httptest.NewRequest("HEAD", "/run/f", nil))
+	bw.Header().Set("Content-Length", "100")
+	bw.WriteHeader(http.StatusOK)
+
+	if !bw.sent {
+		t.Fatalf("headers were held back")
+	}
+	bw.Write([]byte("partial"))
+	bw.finish()
+	if rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "100" {
+		t.Errorf("got body %q, Content-Length %q", rec.Body.String(), rec.Header().Get("Content-Length"))
+	}
+}
+
+// a 103 Early Hints goes ahead of the real status, which still decides
+// whether there is a body
+func TestBodylessWriterInformational(t *testing.T) {
+	for _, method := range []string{"GET", "HEAD"} {
+		log := &statusLog{ResponseRecorder: httptest.NewRecorder()}
+		sw := &statusWriter{ResponseWriter: log}
+		bw := newBodylessWriter(sw, httptest.NewRequest(method, "/run/f", nil))
+		bw.Header().Set("Link", "</style.css>; rel=preload")
+		bw.WriteHeader(http.StatusEarlyHints)
+		writeBody(bw, http.StatusOK)
+		bw.finish()
+
+		if len(log.statuses) != 2 || log.statuses[0] != http.StatusEarlyHints || log.statuses[1] != http.StatusOK {
+			t.Errorf("%s: got statuses %v", method, log.statuses)
+		}
+		if sw.status != http.StatusOK {
+			t.Errorf("%s: statusWriter recorded %d", method, sw.status)
+		}
+		wantBody := "hello, world"
+		if method == "HEAD" {
+			wantBody = ""
+		}
+		if body := log.Body.String(); body != wantBody {
+			t.Errorf("%s: got body %q, expected %q", method, body, wantBody)
+		}
+	}
+}
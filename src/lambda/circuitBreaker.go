@@ -0,0 +1,193 @@
+package lambda
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// states of a circuitBreaker (the values of its
+// lambda/<name>/breaker-state gauge)
+const (
+	BREAKER_CLOSED    = 0 // requests run as usual
+	BREAKER_OPEN      = 1 // requests are rejected
+	BREAKER_HALF_OPEN = 2 // a single probe request may run
+)
+
+// circuitBreaker stops a lambda whose recent requests mostly failed
+// (see Limits.Breaker_error_pct), or whose instances keep failing to
+// start (see Limits.Start_failure_budget), from taking more requests,
+// so it doesn't keep creating instances that are doomed to fail too.
+// After Limits.Breaker_cooldown_ms, one probe request is let through,
+// and if it succeeds, requests run as usual again.
+//
+// Only the LambdaFunc's Task uses it, so there's no locking.
+type circuitBreaker struct {
+	f     *LambdaFunc
+	state int
+
+	// whether each of the last requests failed (a ring, while the
+	// breaker is closed)
+	outcomes []bool
+	next     int
+	count    int
+	failures int
+
+	// requests in a row that failed because their instance could
+	// not start a Sandbox, and whether the breaker opened because
+	// of them (the lambda is then unhealthy)
+	startFailures int
+	unhealthy     bool
+
+	// when the breaker last opened
+	opened time.Time
+
+	// the request let through while half open, if it hasn't
+	// finished
+	probe      *Invocation
+	probeStart time.Time
+}
+
+func (b *circuitBreaker) cooldown() time.Duration {
+	return time.Duration(common.Conf.Limits.Breaker_cooldown_ms) * time.Millisecond
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	common.SetGauge("lambda/"+b.f.name+"/breaker-state", int64(state))
+}
+
+func (b *circuitBreaker) open(reason string) {
+	b.f.warnf("circuit breaker open for %v, as %s", b.cooldown(), reason)
+	common.IncCounter("lambda/" + b.f.name + "/breaker-opened")
+	b.opened = time.Now()
+	b.probe = nil
+	b.setState(BREAKER_OPEN)
+}
+
+func (b *circuitBreaker) close() {
+	b.f.infof("circuit breaker closed")
+	b.outcomes = nil
+	b.probe = nil
+	b.startFailures = 0
+	b.setUnhealthy(false)
+	b.setState(BREAKER_CLOSED)
+}
+
+func (b *circuitBreaker) setUnhealthy(unhealthy bool) {
+	b.unhealthy = unhealthy
+	if unhealthy {
+		common.SetGauge("lambda/"+b.f.name+"/unhealthy", 1)
+	} else {
+		common.SetGauge("lambda/"+b.f.name+"/unhealthy", 0)
+	}
+}
+
+// is either reason to open the breaker configured?
+func (b *circuitBreaker) enabled() bool {
+	return common.Conf.Limits.Breaker_error_pct > 0 || common.Conf.Limits.Start_failure_budget > 0
+}
+
+// is the breaker keeping the lambda from getting more instances?
+func (b *circuitBreaker) frozen() bool {
+	return b.state != BREAKER_CLOSED
+}
+
+// may req run?  While the breaker is half open, only one request (the
+// probe) may run at a time
+func (b *circuitBreaker) allow(req *Invocation) bool {
+	if !b.enabled() && b.state != BREAKER_CLOSED {
+		// (the breaker was disabled by a reload)
+		b.close()
+	}
+
+	switch b.state {
+	case BREAKER_CLOSED:
+		return true
+	case BREAKER_OPEN:
+		if time.Since(b.opened) < b.cooldown() {
+			return false
+		}
+		b.f.infof("circuit breaker half open, letting a probe request through")
+		b.setState(BREAKER_HALF_OPEN)
+	case BREAKER_HALF_OPEN:
+		// a probe that never finished (e.g., because its
+		// instance was killed) is replaced after a cooldown
+		if b.probe != nil && time.Since(b.probeStart) < b.cooldown() {
+			return false
+		}
+	}
+
+	b.probe = req
+	b.probeStart = time.Now()
+	return true
+}
+
+// about how long until allow might let a request through
+func (b *circuitBreaker) retryAfter() time.Duration {
+	start := b.opened
+	if b.state == BREAKER_HALF_OPEN {
+		start = b.probeStart
+	}
+	if left := time.Until(start.Add(b.cooldown())); left > time.Second {
+		return left
+	}
+	return time.Second
+}
+
+// count the outcome of a finished request (see Invocation.error)
+func (b *circuitBreaker) record(req *Invocation) {
+	if !b.enabled() {
+		return
+	}
+
+	// (a request that failed for another reason says nothing
+	// about whether instances can start)
+	if req.startFailed {
+		b.startFailures += 1
+	} else if !req.error {
+		b.startFailures = 0
+	}
+
+	switch b.state {
+	case BREAKER_CLOSED:
+		if budget := common.Conf.Limits.Start_failure_budget; budget > 0 && b.startFailures >= budget {
+			b.setUnhealthy(true)
+			b.open(fmt.Sprintf("the last %d requests failed because no instance could start", b.startFailures))
+			return
+		}
+
+		pct := common.Conf.Limits.Breaker_error_pct
+		if pct <= 0 {
+			return
+		}
+		window := common.Conf.Limits.Breaker_window
+		if len(b.outcomes) != window {
+			b.outcomes = make([]bool, window)
+			b.next, b.count, b.failures = 0, 0, 0
+		}
+		if b.outcomes[b.next] {
+			b.failures -= 1
+		}
+		b.outcomes[b.next] = req.error
+		if req.error {
+			b.failures += 1
+		}
+		b.next = (b.next + 1) % window
+		b.count = common.Min(b.count+1, window)
+
+		if b.count == window && b.failures*100 >= pct*window {
+			b.open(fmt.Sprintf("%d of the last %d requests failed", b.failures, window))
+		}
+	case BREAKER_HALF_OPEN:
+		if req != b.probe {
+			return // (it started before the breaker opened)
+		}
+		if req.error {
+			b.open("the probe request failed")
+		} else {
+			b.close()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package lambda
+
+import (
+	"container/list"
+	"os"
+)
+
+// cleanupQueue does a LambdaFunc's cleanup, such as killing instances
+// and deleting old code.  We want to do these asyncronously, but in
+// order.  Thus, we use a chan to get FIFO behavior and a single
+// cleanup task to get async.
+//
+// two types can be sent to this chan:
+//
+// 1. string: this is a path to be deleted
+//
+// 2. chan: this is a signal chan that corresponds to previously
+// initiated cleanup work.  We block until we receive the complete
+// signal, before proceeding to subsequent cleanup tasks in the FIFO.
+//
+// Only the LambdaFunc's Task sends to it.
+type cleanupQueue struct {
+	f   *LambdaFunc
+	ops chan interface{}
+
+	// closed once the cleanup task has done everything (see
+	// finish)
+	done chan bool
+}
+
+func newCleanupQueue(f *LambdaFunc) *cleanupQueue {
+	q := &cleanupQueue{
+		f:    f,
+		ops:  make(chan interface{}, 32),
+		done: make(chan bool),
+	}
+	go q.task()
+	return q
+}
+
+func (q *cleanupQueue) task() {
+	for {
+		msg, ok := <-q.ops
+		if !ok {
+			close(q.done)
+			return
+		}
+
+		switch op := msg.(type) {
+		case string:
+			if err := os.RemoveAll(op); err != nil {
+				q.f.warnf("Async code cleanup could not delete %s, even after all instances using it killed: %v", op, err)
+			}
+		case chan bool:
+			<-op
+		}
+	}
+}
+
+// delete a code dir, once the instances killed before are gone
+func (q *cleanupQueue) removeDir(dir string) {
+	q.ops <- dir
+}
+
+// signal an instance to die (later cleanup waits for it)
+func (q *cleanupQueue) kill(linst *LambdaInstance) {
+	q.ops <- linst.AsyncKill()
+}
+
+// signal instances to die (later cleanup waits for them)
+func (q *cleanupQueue) killAll(instances *list.List) {
+	for el := instances.Front(); el != nil; el = el.Next() {
+		q.kill(el.Value.(*LambdaInstance))
+	}
+}
+
+// there is nothing more to clean up; done is closed once what was
+// queued is finished
+func (q *cleanupQueue) finish() {
+	close(q.ops)
+}
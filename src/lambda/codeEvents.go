@@ -0,0 +1,118 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// a slow webhook should never hold up anything else
+const CODE_CHANGE_WEBHOOK_TIMEOUT = 5 * time.Second
+
+// CodeChangeEvent is published (to Code_change_webhook) whenever a
+// lambda switches to a new version of its code, so that downstream
+// systems can invalidate their caches.
+type CodeChangeEvent struct {
+	Event     string    `json:"event"`
+	Lambda    string    `json:"lambda"`
+	OldHash   string    `json:"old_hash"`
+	NewHash   string    `json:"new_hash"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// hashCodeDir computes a content hash over the regular files in a
+// lambda's code directory (names and contents), so that the same
+// code always has the same hash, regardless of where it was pulled
+// to.  Returns "" if the hash cannot be computed.
+func hashCodeDir(codeDir string) string {
+	h := sha256.New()
+
+	// Walk visits files in lexical order, so the hash is stable
+	err := filepath.Walk(codeDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(codeDir, path)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		h.Write([]byte(rel))
+		h.Write([]byte{0})
+		_, err = io.Copy(h, file)
+		return err
+	})
+
+	if err != nil {
+		log.Printf("could not hash code in %s: %v", codeDir, err)
+		return ""
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// publishCodeChange sends a code-changed event to the configured
+// webhook (if any).  This is fire-and-forget: it returns immediately,
+// and failures are only logged.
+func (f *LambdaFunc) publishCodeChange(oldHash, newHash string) {
+	url := common.Conf.Code_change_webhook
+	if url == "" {
+		return
+	}
+
+	event := &CodeChangeEvent{
+		Event:     "code-changed",
+		Lambda:    f.name,
+		OldHash:   oldHash,
+		NewHash:   newHash,
+		Timestamp: time.Now(),
+	}
+
+	go func() {
+		body, err := json.Marshal(event)
+		if err != nil {
+			panic(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), CODE_CHANGE_WEBHOOK_TIMEOUT)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			f.warnf("bad code change webhook %s: %v", url, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			f.warnf("code change webhook failed: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			f.warnf("code change webhook returned %s", resp.Status)
+		}
+	}()
+}
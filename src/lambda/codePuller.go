@@ -0,0 +1,186 @@
+package lambda
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// failed pulls are retried after PULL_RETRY_MIN, doubling with each
+// consecutive failure, up to PULL_RETRY_MAX
+const (
+	PULL_RETRY_MIN = time.Second
+	PULL_RETRY_MAX = 5 * time.Minute
+)
+
+// result of a background code pull (see codePuller)
+type pullResult struct {
+	codeDir  string
+	codeHash string            // only computed for new code
+	resolved map[string]string // see PackagePuller.ResolvedVersions
+	meta     *sandbox.SandboxMeta
+	pullTime time.Time
+	err      error
+}
+
+// codePuller checks for new code for a LambdaFunc in the background
+// (see pullHandler), and holds the requests and Prewarm callers that
+// are waiting for the first code.  Pulls report back on done, and the
+// Task switches to the new code (see rollout).
+//
+// Only the LambdaFunc's Task uses it, so there's no locking.
+type codePuller struct {
+	f       *LambdaFunc
+	done    chan *pullResult
+	pulling bool
+
+	// requests, and Prewarm callers, waiting for the first code
+	waiting     *list.List // of *Invocation
+	warmWaiting []*warmRequest
+}
+
+func newCodePuller(f *LambdaFunc) *codePuller {
+	return &codePuller{
+		f:       f,
+		done:    make(chan *pullResult, 1),
+		waiting: list.New(),
+	}
+}
+
+// check for code newer than the latest version (the canary's, if
+// there is one) in the background
+func (p *codePuller) start() {
+	f := p.f
+	p.pulling = true
+	latestCodeDir := f.codeDir
+	if f.canary != nil {
+		latestCodeDir = f.canary.codeDir
+	}
+	go func(curCodeDir string) {
+		res := &pullResult{pullTime: time.Now()}
+		waited := f.lmgr.pulls.do(func() {
+			start := time.Now()
+			res.codeDir, res.meta, res.err = f.pullHandler(curCodeDir)
+			f.observePhase("pull", time.Since(start))
+		})
+		if waited > 0 {
+			f.observePhase("pull-wait", waited)
+		}
+		if res.err == nil && res.meta != nil {
+			res.codeHash = hashCodeDir(res.codeDir)
+			res.resolved = f.lmgr.PackagePuller.ResolvedVersions(res.meta.Python, res.meta.Installs)
+			f.lmgr.DepTracer.TraceResolved(res.codeDir, res.resolved)
+		}
+		p.done <- res
+	}(latestCodeDir)
+}
+
+// note the outcome of a pull from done: when to pull again, and (if
+// it failed) when to retry
+func (p *codePuller) finish(res *pullResult) {
+	f := p.f
+	p.pulling = false
+
+	if res.err != nil {
+		f.pullFailures += 1
+		f.pullErr = res.err
+		backoff := PULL_RETRY_MIN << uint(common.Min(f.pullFailures-1, 16))
+		if backoff > PULL_RETRY_MAX {
+			backoff = PULL_RETRY_MAX
+		}
+		f.pullRetryAt = time.Now().Add(backoff)
+		f.errorf("Error checking for new lambda code (will retry in %v): %v", backoff, res.err)
+	} else {
+		f.lastPull = &res.pullTime
+		f.pullFailures = 0
+		f.pullErr = nil
+	}
+}
+
+// hold a request until the first pull finishes (see release)
+func (p *codePuller) wait(req *Invocation) {
+	f := p.f
+	if p.waiting.Len() >= cap(f.funcChan) {
+		f.shed(req, "func_queue_full", p.waiting.Len(), cap(f.funcChan))
+		return
+	}
+
+	// don't wait forever on the first pull
+	waitMs := common.Conf.Limits.Max_queue_ms
+	if !IsFiniteTimeout(waitMs) {
+		waitMs = common.Conf.Limits.Max_timeout_ms
+	}
+	if IsFiniteTimeout(waitMs) && req.queueTimer == nil {
+		f.expireAfter(req, time.Duration(waitMs)*time.Millisecond, "request waited too long for lambda code")
+	}
+	p.waiting.PushBack(req)
+}
+
+// a Prewarm caller, while there's no code yet
+func (p *codePuller) warm(warm *warmRequest) {
+	if p.pulling {
+		p.warmWaiting = append(p.warmWaiting, warm)
+	} else if time.Now().Before(p.f.pullRetryAt) {
+		// the last pull failed, and it's too soon to try
+		// again
+		warm.done <- p.f.pullErr
+	} else {
+		p.warmWaiting = append(p.warmWaiting, warm)
+		p.start()
+	}
+}
+
+// after a pull, prewarm for (or fail) the Prewarm callers, and
+// dispatch (or fail) the requests that arrived before there was any
+// code
+func (p *codePuller) release(res *pullResult, prewarm func(n int), dispatch func(req *Invocation)) {
+	f := p.f
+	for _, warm := range p.warmWaiting {
+		if f.codeDir != "" {
+			prewarm(warm.instances)
+			warm.done <- nil
+		} else {
+			warm.done <- res.err
+		}
+	}
+	p.warmWaiting = nil
+
+	for p.waiting.Len() > 0 {
+		req := p.waiting.Remove(p.waiting.Front()).(*Invocation)
+		if f.codeDir == "" {
+			if !req.claim() {
+				// it already expired
+				continue
+			}
+			f.failPull(req, res.err)
+			req.done <- true
+		} else if atomic.LoadInt32(&req.state) == INVOCATION_QUEUED {
+			dispatch(req)
+		}
+	}
+}
+
+// is nothing waiting on a pull?
+func (p *codePuller) idle() bool {
+	return !p.pulling && p.waiting.Len() == 0
+}
+
+// nothing will ever serve those waiting for code
+func (p *codePuller) shutdown() {
+	for p.waiting.Len() > 0 {
+		req := p.waiting.Remove(p.waiting.Front()).(*Invocation)
+		if req.claim() {
+			req.fail(http.StatusServiceUnavailable, ERR_SHUTTING_DOWN, "lambda function is shutting down", nil)
+			req.done <- true
+		}
+	}
+	for _, warm := range p.warmWaiting {
+		warm.done <- fmt.Errorf("lambda function is shutting down")
+	}
+	p.warmWaiting = nil
+}
@@ -0,0 +1,225 @@
+package lambda
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+var notFound404 = errors.New("file does not exist")
+
+// where lambda code comes from (see Code_source in the config).  The
+// HandlerPuller calls Fetch whenever a lambda's code may be stale.
+type CodeSource interface {
+	// get the named lambda's code into a code dir (from the
+	// DirMaker the CodeSource was created with), returning it.
+	// If the code is unchanged since the last Fetch, the same
+	// dir may be returned.  If there is no such lambda, the
+	// error wraps ErrLambdaNotFound.
+	Fetch(name string) (codeDir string, err error)
+
+	// forget what was cached for the named lambda, so the next
+	// Fetch gets it from scratch
+	Reset(name string)
+}
+
+// kinds of CodeSource, by name, each created from the Registry
+// location and the DirMaker to extract code into.  More may be added
+// with RegisterCodeSource.
+var codeSources = map[string]func(location string, dirMaker *common.DirMaker) (CodeSource, error){
+	"local": newLocalSource,
+	"web":   newWebSource,
+	"s3":    newS3Source,
+	"watch": newWatchSource,
+}
+
+// RegisterCodeSource makes a CodeSource available to be selected by
+// name in Code_source.  It must be called before the LambdaMgr is
+// created.
+func RegisterCodeSource(name string, newSource func(location string, dirMaker *common.DirMaker) (CodeSource, error)) {
+	codeSources[name] = newSource
+}
+
+// create the named kind of CodeSource for the given location.  With
+// no name, the kind is guessed from the location: http(s):// URLs are
+// "web", s3:// URLs are "s3", and anything else is a "local" path.
+func NewCodeSource(name, location string, dirMaker *common.DirMaker) (CodeSource, error) {
+	if name == "" {
+		switch {
+		case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+			name = "web"
+		case strings.HasPrefix(location, "s3://"):
+			name = "s3"
+		default:
+			name = "local"
+		}
+	}
+
+	newSource, ok := codeSources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown code source '%s'", name)
+	}
+	return newSource(location, dirMaker)
+}
+
+// a registry directory on the worker's file system
+type localSource struct {
+	codeDirCache
+	prefix string
+}
+
+func newLocalSource(location string, dirMaker *common.DirMaker) (CodeSource, error) {
+	return &localSource{codeDirCache: codeDirCache{dirMaker: dirMaker}, prefix: location}, nil
+}
+
+func (s *localSource) Fetch(name string) (targetDir string, err error) {
+	paths := []string{
+		filepath.Join(s.prefix, name) + ".tar.gz",
+		filepath.Join(s.prefix, name) + ".py",
+		filepath.Join(s.prefix, name),
+	}
+
+	for i := 0; i < len(paths); i++ {
+		if _, err := os.Stat(paths[i]); !os.IsNotExist(err) {
+			return s.extract(paths[i], name, true)
+		}
+	}
+
+	return "", fmt.Errorf("%w at any of these locations: %s", ErrLambdaNotFound, strings.Join(paths, ", "))
+}
+
+// TODO: for web registries, support an HTTP-based access key
+// (https://en.wikipedia.org/wiki/Basic_access_authentication)
+
+// a registry served over HTTP
+type webSource struct {
+	codeDirCache
+	prefix string
+}
+
+func newWebSource(location string, dirMaker *common.DirMaker) (CodeSource, error) {
+	return &webSource{codeDirCache: codeDirCache{dirMaker: dirMaker}, prefix: strings.TrimRight(location, "/")}, nil
+}
+
+// an S3 bucket (s3://bucket/prefix), which is just a web registry at
+// the bucket's URL.  Objects are fetched without signing requests, so
+// they must be readable anonymously (a private bucket needs its own
+// CodeSource; see RegisterCodeSource).
+func newS3Source(location string, dirMaker *common.DirMaker) (CodeSource, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("S3 registry should be s3://<bucket>/<prefix>, not '%s'", location)
+	}
+	return newWebSource("https://"+u.Host+".s3.amazonaws.com"+u.Path, dirMaker)
+}
+
+func (s *webSource) Fetch(name string) (targetDir string, err error) {
+	urls := []string{
+		s.prefix + "/" + name + ".tar.gz",
+		s.prefix + "/" + name + ".py",
+	}
+
+	for i := 0; i < len(urls); i++ {
+		targetDir, err = s.fetchURL(urls[i], name)
+		if err == nil {
+			return targetDir, nil
+		} else if err != notFound404 {
+			// 404 is OK, because we just go on to check the next URLs
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("%w at any of these locations: %s", ErrLambdaNotFound, strings.Join(urls, ", "))
+}
+
+func (s *webSource) fetchURL(src, lambdaName string) (targetDir string, err error) {
+	// grab latest lambda code if it's changed (pass
+	// If-Modified-Since so this can be determined on server side
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return "", err
+	}
+
+	cacheEntry := s.getCache(lambdaName)
+	if cacheEntry != nil {
+		if cacheEntry.version != "" {
+			req.Header.Set("If-Modified-Since", cacheEntry.version)
+		}
+		if cacheEntry.etag != "" {
+			req.Header.Set("If-None-Match", cacheEntry.etag)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", notFound404
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cacheEntry != nil {
+		countPull(lambdaName, true)
+		return cacheEntry.path, nil
+	}
+
+	// download to local file, then use pullLocalFile to finish
+	dir, err := ioutil.TempDir("", "ol-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	parts := strings.Split(src, "/")
+	localPath := filepath.Join(dir, parts[len(parts)-1])
+	out, err := os.Create(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	// the compressed code can't be bigger than the extracted
+	// code, so don't download more than Max_code_mb
+	body := io.Reader(resp.Body)
+	maxBytes := int64(common.Conf.Limits.Max_code_mb) * 1024 * 1024
+	if maxBytes > 0 {
+		body = io.LimitReader(resp.Body, maxBytes+1)
+	}
+	n, err := io.Copy(out, body)
+	if err != nil {
+		return "", err
+	}
+	if maxBytes > 0 && n > maxBytes {
+		return "", fmt.Errorf("lambda code at %s exceeds max_code_mb limit of %d MB", src, common.Conf.Limits.Max_code_mb)
+	}
+
+	targetDir, err = s.extract(localPath, lambdaName, false)
+
+	// record directory in cache, by mod time and/or ETag (the
+	// hash catches a server that supports neither)
+	if err == nil {
+		hash, err := hashFile(localPath)
+		if err != nil {
+			return "", err
+		}
+		s.putCache(lambdaName, &CacheEntry{
+			version: resp.Header.Get("Last-Modified"),
+			etag:    resp.Header.Get("ETag"),
+			hash:    hash,
+			path:    targetDir,
+		})
+	}
+
+	return targetDir, err
+}
@@ -0,0 +1,187 @@
+package lambda
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// compresses a response with gzip (see Features.Compress_responses),
+// if it turns out to be worth it.  The start of the body is held back
+// until there are Limits.Compress_min_bytes of it (or the handler is
+// done), at which point we know whether to compress.  Until then, the
+// status and headers aren't sent either, so that Content-Encoding can
+// still be set.
+//
+// Sits between an Invocation's statusWriter and the rest of the
+// writers for a request (see LambdaInstance.Task), so recordings and
+// debug logs see the uncompressed body.
+type compressWriter struct {
+	http.ResponseWriter
+	minBytes int
+
+	status  int
+	buf     bytes.Buffer
+	decided bool // status and headers were sent
+	gz      *gzip.Writer
+
+	// time spent compressing (which doesn't count as execution)
+	elapsed time.Duration
+}
+
+// a compressWriter for req, or nil if its response shouldn't be
+// compressed
+func newCompressWriter(req *Invocation) *compressWriter {
+	if !common.Conf.Features.Compress_responses || req.r.Method == "HEAD" {
+		return nil
+	}
+	if !acceptsGzip(req.r.Header.Get("Accept-Encoding")) {
+		return nil
+	}
+	return &compressWriter{ResponseWriter: req.w, minBytes: common.Conf.Limits.Compress_min_bytes}
+}
+
+// does an Accept-Encoding header allow gzip?
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		// (q=0 means "not acceptable")
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// is a body of this type likely to get smaller when compressed?
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || informational(status) {
+		cw.ResponseWriter.WriteHeader(status)
+	} else if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf.Write(b)
+		if cw.buf.Len() < cw.minBytes {
+			return len(b), nil
+		}
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if cw.gz == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	start := time.Now()
+	n, err := cw.gz.Write(b)
+	cw.elapsed += time.Since(start)
+	return n, err
+}
+
+// send the status and headers, and whatever of the body we held back,
+// compressing it if that's worthwhile
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+
+	h := cw.Header()
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(cw.buf.Bytes())
+	}
+	compress := cw.buf.Len() > 0 && cw.buf.Len() >= cw.minBytes && h.Get("Content-Encoding") == "" &&
+		compressibleType(contentType) &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified
+
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+	if compress {
+		cw.gz = gzip.NewWriter(cw.ResponseWriter)
+		start := time.Now()
+		_, err := cw.gz.Write(cw.buf.Bytes())
+		cw.elapsed += time.Since(start)
+		cw.buf.Reset()
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(cw.buf.Bytes())
+	cw.buf.Reset()
+	return err
+}
+
+// throw away what was held back, and pass anything written from now
+// on straight through (e.g., an error response after a timeout).
+// Returns false if it is too late, because the response started.
+func (cw *compressWriter) discard() bool {
+	if cw.decided {
+		return false
+	}
+	cw.decided = true
+	cw.status = 0
+	cw.buf.Reset()
+	return true
+}
+
+// the handler is done: send what was held back, and finish the
+// compressed stream.  Returns the total time spent compressing.
+func (cw *compressWriter) finish() time.Duration {
+	if !cw.decided {
+		if err := cw.decide(); err != nil {
+			return cw.elapsed
+		}
+	}
+	if cw.gz != nil {
+		start := time.Now()
+		cw.gz.Close()
+		cw.elapsed += time.Since(start)
+		cw.gz = nil
+	}
+	return cw.elapsed
+}
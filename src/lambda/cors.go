@@ -0,0 +1,199 @@
+package lambda
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// CORS response headers, which depend on the request's origin, so
+// they are never replayed from the response cache
+var corsResponseHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Expose-Headers",
+}
+
+// how a lambda with ol-cors answers browsers (see corsPolicyFor)
+type corsPolicy struct {
+	origins     []string
+	credentials bool
+	maxAgeS     int
+}
+
+// an ol-cors origin must be "*", or scheme://host[:port], where the
+// host may start with "*." (for any subdomain)
+func checkCORSOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("origin '%s' must be * or like https://host[:port]", origin)
+	}
+	if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+		return fmt.Errorf("origin '%s' may only have a wildcard at the start of its host", origin)
+	}
+	return nil
+}
+
+// the CORS policy for a lambda's current code (and canary, whose
+// origins are also allowed), or nil if neither has ol-cors
+func corsPolicyFor(meta *sandbox.SandboxMeta, canary *sandbox.SandboxMeta) *corsPolicy {
+	if meta == nil || len(meta.CORSOrigins) == 0 {
+		if canary == nil || len(canary.CORSOrigins) == 0 {
+			return nil
+		}
+		meta, canary = canary, nil
+	}
+
+	policy := &corsPolicy{
+		origins:     meta.CORSOrigins,
+		credentials: common.Conf.Cors.Allow_credentials,
+		maxAgeS:     common.Conf.Cors.Max_age_s,
+	}
+	if canary != nil {
+		policy.origins = append(append([]string{}, meta.CORSOrigins...), canary.CORSOrigins...)
+	}
+	if meta.CORSCredentials != nil {
+		policy.credentials = *meta.CORSCredentials
+	}
+	if meta.CORSMaxAgeS > 0 {
+		policy.maxAgeS = meta.CORSMaxAgeS
+	}
+	return policy
+}
+
+// does origin (from an Origin header) match one of the policy's?
+func (p *corsPolicy) allows(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, pattern := range p.origins {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+
+		// https://*.example.com matches https://a.example.com
+		scheme, host, ok := strings.Cut(pattern, "://*.")
+		if ok && strings.HasPrefix(strings.ToLower(origin), strings.ToLower(scheme)+"://") &&
+			strings.HasSuffix(strings.ToLower(origin), "."+strings.ToLower(host)) {
+			return true
+		}
+	}
+	return false
+}
+
+// the Access-Control-Allow-Origin value for an allowed origin
+func (p *corsPolicy) allowOrigin(origin string) string {
+	for _, pattern := range p.origins {
+		// "*" can't be used with credentials
+		if pattern == "*" && !p.credentials {
+			return "*"
+		}
+	}
+	return origin
+}
+
+// IsPreflight reports whether r is a CORS preflight.  Browsers send
+// preflights without credentials, so they are answered (see
+// LambdaFunc.Preflight) without being authorized.
+func IsPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Preflight answers a CORS preflight for the lambda (see IsPreflight)
+func (f *LambdaFunc) Preflight(w http.ResponseWriter, r *http.Request) {
+	f.handleCORS(w, r)
+}
+
+// DefaultPreflight answers a CORS preflight for a lambda that isn't
+// loaded (see LambdaMgr.Lookup) as if it had no ol-cors
+func DefaultPreflight(w http.ResponseWriter, r *http.Request) {
+	defaultCORS(w, nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// the CORS headers of a lambda without ol-cors, which any origin may
+// call (with its ol-methods, if it has them)
+func defaultCORS(w http.ResponseWriter, methods []string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if methods != nil {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	} else {
+		w.Header().Set("Access-Control-Allow-Methods",
+			"GET, PUT, POST, DELETE, OPTIONS")
+	}
+	w.Header().Set("Access-Control-Allow-Headers",
+		"Content-Type, Content-Range, Content-Disposition, Content-Description, X-Requested-With")
+}
+
+// add CORS headers for r to w, and answer it if it is a preflight.
+// Lambdas without ol-cors allow any origin, and answer OPTIONS
+// requests with a 200 (unless they have ol-methods, in which case a
+// non-preflight OPTIONS is left to checkMethod).  Returns true if it
+// responded.
+func (f *LambdaFunc) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	policy, _ := f.cors.Load().(*corsPolicy)
+	if policy == nil {
+		methods, _ := f.methods.Load().([]string)
+		defaultCORS(w, methods)
+		if r.Method == "OPTIONS" && (methods == nil || IsPreflight(r)) {
+			w.WriteHeader(http.StatusOK)
+			return true
+		}
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	preflight := IsPreflight(r)
+	w.Header().Add("Vary", "Origin")
+
+	// a disallowed origin gets no CORS headers (even any set
+	// already), so the browser won't let the page see the response
+	if !policy.allows(origin) {
+		for name := range w.Header() {
+			if strings.HasPrefix(name, "Access-Control-Allow-") {
+				w.Header().Del(name)
+			}
+		}
+		if preflight {
+			common.IncCounter("lambda/" + f.name + "/cors-rejected")
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", policy.allowOrigin(origin))
+	if policy.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if expose := common.Conf.Cors.Expose_headers; len(expose) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+		}
+		return false
+	}
+
+	methods, _ := f.methods.Load().([]string)
+	if methods == nil {
+		methods = []string{r.Header.Get("Access-Control-Request-Method")}
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if headers := common.Conf.Cors.Allow_headers; len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		w.Header().Set("Access-Control-Allow-Headers", requested)
+	}
+	if policy.maxAgeS > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.maxAgeS))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
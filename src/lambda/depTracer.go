@@ -3,27 +3,70 @@ package lambda
 import (
 	"bufio"
 	"encoding/json"
+	"io/ioutil"
+	"log"
 	"os"
+	"sync"
+	"time"
 )
 
+// buffered trace events are written out at least this often, so the
+// file is never far behind
+const DEP_TRACE_FLUSH_INTERVAL = 10 * time.Second
+
+// how many versions of each lambda's code ImportHints describes
+const DEP_TRACE_ZYGOTE_DEPLOYS = 3
+
 type DepTracer struct {
 	file   *os.File
 	writer *bufio.Writer
-	events chan map[string]interface{}
+
+	// two types can be sent to this chan (handled in order):
+	//
+	// 1. map[string]interface{}: an event to trace
+	//
+	// 2. chan error: a request to flush what was traced so far
+	// to the file (the result is sent back on the chan)
+	events chan interface{}
 	done   chan bool
+
+	// lambda name -> the Zygotes its Sandboxes were created
+	// from, for its latest versions (see TraceZygote)
+	mutex   sync.Mutex
+	zygotes map[string][]*DeployZygotes
+}
+
+// DeployZygotes describes how the import cache created Sandboxes for
+// one version of a lambda's code (see DepTracer.ImportHints)
+type DeployZygotes struct {
+	CodeDir string           `json:"code_dir"`
+	Creates []*ZygoteCreates `json:"creates"`
+
+	// from the latest creation (the tree may have been reloaded
+	// since earlier ones)
+	Attribution *ZygoteAttribution `json:"attribution"`
+	Hints       []string           `json:"hints"`
+}
+
+// ZygoteCreates counts the Sandboxes created from one Zygote
+type ZygoteCreates struct {
+	Zygote string `json:"zygote"`
+	Match  string `json:"match"`
+	Count  int    `json:"count"`
 }
 
 func NewDepTracer(logPath string) (*DepTracer, error) {
-	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY, 0600)
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
 	}
 
 	t := &DepTracer{
-		file:   file,
-		writer: bufio.NewWriter(file),
-		events: make(chan map[string]interface{}, 128),
-		done:   make(chan bool),
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		events:  make(chan interface{}, 128),
+		done:    make(chan bool),
+		zygotes: make(map[string][]*DeployZygotes),
 	}
 	go t.run()
 
@@ -31,8 +74,21 @@ func NewDepTracer(logPath string) (*DepTracer, error) {
 }
 
 func (t *DepTracer) run() {
+	ticker := time.NewTicker(DEP_TRACE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
 	for {
-		ev, ok := <-t.events
+		var msg interface{}
+		var ok bool
+		select {
+		case msg, ok = <-t.events:
+		case <-ticker.C:
+			if err := t.writer.Flush(); err != nil {
+				log.Printf("could not flush dep trace: %v", err)
+			}
+			continue
+		}
+
 		if !ok {
 			t.writer.Flush()
 			t.file.Close()
@@ -40,13 +96,18 @@ func (t *DepTracer) run() {
 			return
 		}
 
-		b, err := json.Marshal(ev)
-		if err != nil {
-			panic(err)
-		}
+		switch op := msg.(type) {
+		case map[string]interface{}:
+			b, err := json.Marshal(op)
+			if err != nil {
+				panic(err)
+			}
 
-		t.writer.Write(b)
-		t.writer.WriteString("\n")
+			t.writer.Write(b)
+			t.writer.WriteString("\n")
+		case chan error:
+			op <- t.writer.Flush()
+		}
 	}
 }
 
@@ -55,12 +116,38 @@ func (t *DepTracer) Cleanup() {
 	<-t.done
 }
 
+// Flush writes everything traced so far to the file (events traced
+// concurrently with the Flush may or may not be included)
+func (t *DepTracer) Flush() error {
+	result := make(chan error, 1)
+	t.events <- result
+	return <-result
+}
+
+// Snapshot returns the trace so far (one JSON event per line), or nil
+// if it could not be read
+func (t *DepTracer) Snapshot() []byte {
+	if err := t.Flush(); err != nil {
+		log.Printf("could not flush dep trace: %v", err)
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(t.file.Name())
+	if err != nil {
+		log.Printf("could not read dep trace: %v", err)
+		return nil
+	}
+	return b
+}
+
 func (t *DepTracer) TracePackage(p *Package) {
 	t.events <- map[string]interface{}{
-		"type": "package",
-		"name": p.name,
-		"deps": p.meta.Deps,
-		"top":  p.meta.TopLevel,
+		"type":    "package",
+		"name":    p.name,
+		"python":  p.python,
+		"deps":    p.meta.Deps,
+		"top":     p.meta.TopLevel,
+		"version": p.meta.Version,
 	}
 }
 
@@ -72,6 +159,90 @@ func (t *DepTracer) TraceFunction(codeDir string, directDeps []string) {
 	}
 }
 
+// the full set of packages (with versions) a function's code runs
+// with, including transitive deps
+func (t *DepTracer) TraceResolved(codeDir string, resolved map[string]string) {
+	t.events <- map[string]interface{}{
+		"type":     "resolved",
+		"name":     codeDir,
+		"resolved": resolved,
+	}
+}
+
+// the import cache created a Sandbox for the named lambda (running
+// the code in codeDir) from the Zygote described by attr
+func (t *DepTracer) TraceZygote(lambdaName string, codeDir string, attr *ZygoteAttribution) {
+	t.events <- map[string]interface{}{
+		"type":   "zygote",
+		"name":   codeDir,
+		"lambda": lambdaName,
+		"zygote": attr.Zygote,
+		"match":  attr.Match,
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	deploys := t.zygotes[lambdaName]
+	var deploy *DeployZygotes
+	for _, d := range deploys {
+		if d.CodeDir == codeDir {
+			deploy = d
+		}
+	}
+	if deploy == nil {
+		deploy = &DeployZygotes{CodeDir: codeDir}
+		deploys = append(deploys, deploy)
+		if len(deploys) > DEP_TRACE_ZYGOTE_DEPLOYS {
+			deploys = deploys[1:]
+		}
+		t.zygotes[lambdaName] = deploys
+	}
+
+	name := zygoteName(attr.Zygote)
+	var creates *ZygoteCreates
+	for _, c := range deploy.Creates {
+		if c.Zygote == name {
+			creates = c
+		}
+	}
+	if creates == nil {
+		creates = &ZygoteCreates{Zygote: name}
+		deploy.Creates = append(deploy.Creates, creates)
+	}
+	creates.Match = attr.Match
+	creates.Count += 1
+	deploy.Attribution = attr
+	deploy.Hints = attr.Hints()
+}
+
+// ImportHints describes which Zygotes the named lambda's Sandboxes
+// were created from, for its latest versions (oldest first), with
+// suggestions for its ol-import hints.  Returns nil if the import
+// cache never created one for it.
+func (t *DepTracer) ImportHints(lambdaName string) []*DeployZygotes {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	deploys := t.zygotes[lambdaName]
+	if len(deploys) == 0 {
+		return nil
+	}
+
+	// copies, as TraceZygote keeps updating them
+	result := []*DeployZygotes{}
+	for _, d := range deploys {
+		c := *d
+		c.Creates = []*ZygoteCreates{}
+		for _, creates := range d.Creates {
+			copied := *creates
+			c.Creates = append(c.Creates, &copied)
+		}
+		result = append(result, &c)
+	}
+	return result
+}
+
 func (t *DepTracer) TraceInvocation(codeDir string) {
 	t.events <- map[string]interface{}{
 		"type": "invocation",
@@ -0,0 +1,157 @@
+package lambda
+
+import (
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// how many events a subscriber may have waiting; beyond this, the
+// oldest are dropped
+const DEPLOY_EVENT_QUEUE = 256
+
+// types of DeployEvent
+const (
+	EVENT_CODE_PULLED        = "code_pulled"
+	EVENT_INSTALL_COMPLETED  = "install_completed"
+	EVENT_INSTANCES_REPLACED = "instances_replaced"
+	EVENT_FUNCTION_KILLED    = "function_killed"
+)
+
+// DeployEvent is something tooling may want to know about a lambda's
+// code as it is rolled out (e.g., when new code went live on this
+// worker).  Fields that don't apply to the Type are omitted.
+type DeployEvent struct {
+	Seq    uint64    `json:"seq"`
+	Type   string    `json:"type"`
+	Lambda string    `json:"lambda"`
+	Time   time.Time `json:"time"`
+
+	// code_pulled: the newest code before and after the pull
+	// (instances_replaced: the code now running)
+	OldHash string `json:"old_hash,omitempty"`
+	NewHash string `json:"new_hash,omitempty"`
+
+	// install_completed: package -> installed version
+	Packages map[string]string `json:"packages,omitempty"`
+
+	// instances_replaced: how many instances of older code were
+	// replaced
+	Instances int `json:"instances,omitempty"`
+
+	// function_killed: why ("shutdown", or "idle")
+	Reason string `json:"reason,omitempty"`
+}
+
+// EventBus passes DeployEvents to subscribers (e.g., an admin client
+// streaming them).  Publishing never blocks: each subscriber has its
+// own bounded queue, which drops its oldest events when full.
+type EventBus struct {
+	mutex sync.Mutex
+	seq   uint64
+	subs  map[*EventSubscription]bool
+}
+
+// EventSubscription receives the events published after Subscribe,
+// until it is closed
+type EventSubscription struct {
+	bus *EventBus
+
+	// lambdas to receive events for (all, if empty)
+	lambdas map[string]bool
+
+	// protected by bus.mutex
+	queue   []*DeployEvent
+	dropped int
+
+	// has a value when the queue isn't empty
+	ready chan bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*EventSubscription]bool)}
+}
+
+// Subscribe to events for the given lambdas (or all, if none)
+func (bus *EventBus) Subscribe(lambdas []string) *EventSubscription {
+	sub := &EventSubscription{
+		bus:     bus,
+		lambdas: make(map[string]bool),
+		ready:   make(chan bool, 1),
+	}
+	for _, name := range lambdas {
+		sub.lambdas[name] = true
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.subs[sub] = true
+	common.SetGauge("deploy-events/subscribers", int64(len(bus.subs)))
+	return sub
+}
+
+// queue ev for every interested subscriber
+func (bus *EventBus) publish(ev *DeployEvent) {
+	if bus == nil {
+		return
+	}
+	ev.Time = time.Now()
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.seq += 1
+	ev.Seq = bus.seq
+	for sub := range bus.subs {
+		if len(sub.lambdas) > 0 && !sub.lambdas[ev.Lambda] {
+			continue
+		}
+		if len(sub.queue) >= DEPLOY_EVENT_QUEUE {
+			sub.queue = sub.queue[1:]
+			sub.dropped += 1
+			common.IncCounter("deploy-events/dropped")
+		}
+		sub.queue = append(sub.queue, ev)
+		select {
+		case sub.ready <- true:
+		default:
+		}
+	}
+}
+
+// Ready has a value when there may be events to Take
+func (sub *EventSubscription) Ready() <-chan bool {
+	return sub.ready
+}
+
+// Take the queued events, oldest first, and how many were dropped
+// (since the last Take) because the queue was full
+func (sub *EventSubscription) Take() (events []*DeployEvent, dropped int) {
+	sub.bus.mutex.Lock()
+	defer sub.bus.mutex.Unlock()
+
+	events, dropped = sub.queue, sub.dropped
+	sub.queue, sub.dropped = nil, 0
+	return events, dropped
+}
+
+// stop receiving events
+func (sub *EventSubscription) Close() {
+	sub.bus.mutex.Lock()
+	defer sub.bus.mutex.Unlock()
+	delete(sub.bus.subs, sub)
+	common.SetGauge("deploy-events/subscribers", int64(len(sub.bus.subs)))
+}
+
+// publish an event about f (called by its Task, so must not block)
+func (f *LambdaFunc) publishEvent(ev *DeployEvent) {
+	ev.Lambda = f.name
+	f.lmgr.events.publish(ev)
+}
+
+// SubscribeEvents subscribes to the deploy events of the given lambdas
+// (or all, if none); the subscription must be closed
+func (mgr *LambdaMgr) SubscribeEvents(lambdas []string) *EventSubscription {
+	return mgr.events.Subscribe(lambdas)
+}
@@ -0,0 +1,111 @@
+package lambda
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// DependencyReport describes the packages a lambda's current code
+// runs with: the ol-install packages, plus all their transitive deps,
+// with the versions pip actually installed.  Users can use this to
+// pin versions intentionally.
+type DependencyReport struct {
+	Lambda   string            `json:"lambda"`
+	Resolved map[string]string `json:"resolved"` // package -> version
+
+	// the Python version the packages are for (see ol-python)
+	Python string `json:"python,omitempty"`
+
+	// identifies the version of the code (see hashCodeDir; "" if
+	// it wasn't computed)
+	CodeHash string `json:"code_hash,omitempty"`
+
+	// the code's directives
+	meta *sandbox.SandboxMeta
+
+	// ol-install-optional packages that could not be installed,
+	// so the code runs without them
+	Skipped []string `json:"skipped"`
+
+	// how Resolved differs from the previous version of the code
+	// (empty for the first version)
+	Changelog []string `json:"changelog"`
+}
+
+// describe how the resolved packages changed between two deploys,
+// sorted by package name
+func diffDeps(old, new map[string]string) []string {
+	names := []string{}
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []string{}
+	for _, name := range names {
+		oldVersion, inOld := old[name]
+		newVersion, inNew := new[name]
+		if !inOld {
+			changes = append(changes, fmt.Sprintf("added %s %s", name, newVersion))
+		} else if !inNew {
+			changes = append(changes, fmt.Sprintf("removed %s %s", name, oldVersion))
+		} else if oldVersion != newVersion {
+			changes = append(changes, fmt.Sprintf("changed %s %s -> %s", name, oldVersion, newVersion))
+		}
+	}
+	return changes
+}
+
+// record the packages of code the Task is switching to, logging how
+// they differ from the previous code's
+func (f *LambdaFunc) setDeps(codeHash string, meta *sandbox.SandboxMeta, resolved map[string]string) {
+	if resolved == nil {
+		resolved = map[string]string{}
+	}
+	var skipped []string
+	python := ""
+	if meta != nil {
+		skipped, python = meta.SkippedInstalls, meta.Python
+	}
+	if skipped == nil {
+		skipped = []string{}
+	}
+	report := &DependencyReport{
+		Lambda:    f.name,
+		Resolved:  resolved,
+		Python:    python,
+		CodeHash:  codeHash,
+		Skipped:   skipped,
+		Changelog: []string{},
+		meta:      meta,
+	}
+	common.SetGauge("lambda/"+f.name+"/optional-skipped", int64(len(skipped)))
+
+	f.depsMutex.Lock()
+	defer f.depsMutex.Unlock()
+
+	if f.deps != nil {
+		report.Changelog = diffDeps(f.deps.Resolved, resolved)
+		for _, change := range report.Changelog {
+			f.infof("dependency changelog: %s", change)
+		}
+	}
+	f.deps = report
+}
+
+// Dependencies returns the packages the lambda's current code runs
+// with, or nil if no code has been pulled yet.  The report must not
+// be modified.
+func (f *LambdaFunc) Dependencies() *DependencyReport {
+	f.depsMutex.Lock()
+	defer f.depsMutex.Unlock()
+	return f.deps
+}
@@ -0,0 +1,93 @@
+package lambda
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// how often the worker dir's filesystem is checked for free space
+const DISK_CHECK_INTERVAL = 10 * time.Second
+
+// publishes how much space is left where the worker creates code and
+// scratch dirs (in the storage/* gauges), and warns when it drops
+// below Limits.Min_free_disk_mb, before creating those dirs (and so
+// Sandboxes) starts failing
+type diskWatcher struct {
+	path string
+
+	// Limits.Min_free_disk_mb, which may change on reload (see
+	// setMinMB), accessed atomically
+	minMB int64
+
+	done   chan bool
+	exited chan bool
+}
+
+func newDiskWatcher(path string, minMB int) *diskWatcher {
+	dw := &diskWatcher{
+		path:   path,
+		minMB:  int64(minMB),
+		done:   make(chan bool),
+		exited: make(chan bool),
+	}
+	go dw.watchTask()
+	return dw
+}
+
+// change the free space below which the watcher warns
+func (dw *diskWatcher) setMinMB(minMB int) {
+	if dw != nil {
+		atomic.StoreInt64(&dw.minMB, int64(minMB))
+	}
+}
+
+func (dw *diskWatcher) watchTask() {
+	defer close(dw.exited)
+
+	ticker := time.NewTicker(DISK_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	low := false
+	for {
+		freeMB, totalMB, err := common.DiskUsage(dw.path)
+		if err != nil {
+			log.Printf("could not check free space in %s: %v", dw.path, err)
+		} else {
+			common.SetGauge("storage/free-mb", freeMB)
+			common.SetGauge("storage/total-mb", totalMB)
+
+			// (warn once each time it gets low)
+			minMB := atomic.LoadInt64(&dw.minMB)
+			if minMB > 0 && freeMB < minMB && !low {
+				log.Printf("WARNING: only %d of %d MB free in %s (limits.min_free_disk_mb is %d); Sandboxes can't be created once it is full",
+					freeMB, totalMB, dw.path, minMB)
+				common.IncCounter("storage/low-space")
+			} else if low && freeMB >= minMB {
+				log.Printf("%d MB free again in %s", freeMB, dw.path)
+			}
+			low = minMB > 0 && freeMB < minMB
+			if low {
+				common.SetGauge("storage/low", 1)
+			} else {
+				common.SetGauge("storage/low", 0)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-dw.done:
+			return
+		}
+	}
+}
+
+// stop watching, returning once watchTask has exited
+func (dw *diskWatcher) stop() {
+	if dw != nil {
+		close(dw.done)
+		<-dw.exited
+	}
+}
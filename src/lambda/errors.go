@@ -0,0 +1,187 @@
+package lambda
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// ErrorCode identifies why the worker (rather than the lambda itself)
+// failed a request.  Clients should match on these, rather than on
+// the message.
+type ErrorCode string
+
+const (
+	ERR_CODE_INSTALLING        ErrorCode = "CODE_INSTALLING"
+	ERR_FUNCTION_QUEUE_FULL    ErrorCode = "FUNCTION_QUEUE_FULL"
+	ERR_INSTANCE_QUEUE_FULL    ErrorCode = "INSTANCE_QUEUE_FULL"
+	ERR_QUEUE_TIMEOUT          ErrorCode = "QUEUE_TIMEOUT"
+	ERR_METHOD_NOT_ALLOWED     ErrorCode = "METHOD_NOT_ALLOWED"
+	ERR_LAMBDA_NOT_FOUND       ErrorCode = "LAMBDA_NOT_FOUND"
+	ERR_PULL_FAILED            ErrorCode = "PULL_FAILED"
+	ERR_LOAD_FAILED            ErrorCode = "LOAD_FAILED"
+	ERR_SHUTTING_DOWN          ErrorCode = "SHUTTING_DOWN"
+	ERR_IMPORT_CACHE_FAILED    ErrorCode = "IMPORT_CACHE_FAILED"
+	ERR_SANDBOX_CREATE_FAILED  ErrorCode = "SANDBOX_CREATE_FAILED"
+	ERR_SANDBOX_CONNECT_FAILED ErrorCode = "SANDBOX_CONNECT_FAILED"
+	ERR_TIMEOUT                ErrorCode = "TIMEOUT"
+	ERR_BAD_REQUEST_BODY       ErrorCode = "BAD_REQUEST_BODY"
+	ERR_CIRCUIT_OPEN           ErrorCode = "CIRCUIT_OPEN"
+	ERR_FUNCTION_UNHEALTHY     ErrorCode = "FUNCTION_UNHEALTHY"
+	ERR_INSUFFICIENT_STORAGE   ErrorCode = "INSUFFICIENT_STORAGE"
+	ERR_UNAUTHENTICATED        ErrorCode = "UNAUTHENTICATED"
+	ERR_FORBIDDEN              ErrorCode = "FORBIDDEN"
+	ERR_WARMUP_FAILED          ErrorCode = "WARMUP_FAILED"
+)
+
+// LoadError is returned by pulls that found a lambda's code, but could
+// not prepare it to run (e.g., because of a bad ol-* directive, or a
+// package that fails to install)
+type LoadError struct {
+	Err error
+}
+
+func (e *LoadError) Error() string {
+	return "could not load lambda code: " + e.Err.Error()
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// the body of an error response (with Features.Json_errors, unless the
+// client asked for text/plain)
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code         ErrorCode `json:"code"`
+	Message      string    `json:"message"`
+	InvocationId string    `json:"invocation_id,omitempty"`
+
+	// for a full queue (429): which queue ("func_queue_full" or
+	// "inst_queue_full"), how full it is, and about how long until
+	// it has room (also in the Retry-After header)
+	Reason        string `json:"reason,omitempty"`
+	QueueDepth    int    `json:"queue_depth,omitempty"`
+	QueueCapacity int    `json:"queue_capacity,omitempty"`
+	RetryAfterMs  int64  `json:"retry_after_ms,omitempty"`
+}
+
+// respond with an error.  msg is safe to show anyone; detail (which
+// may be nil) is the underlying error, which may mention internal
+// paths, so it is left out with Features.Redact_errors.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, msg string, detail error) {
+	writeErrorBody(w, r, status, errorBody{Code: code, Message: msg}, detail)
+}
+
+// WriteError responds with an error in the same format as invocation
+// errors, for servers that reject requests before they reach a lambda
+// (e.g., unauthenticated ones)
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, msg string, detail error) {
+	writeError(w, r, status, code, msg, detail)
+}
+
+// like writeError, for a body with more than a code and message
+func writeErrorBody(w http.ResponseWriter, r *http.Request, status int, body errorBody, detail error) {
+	if detail != nil && !common.Conf.Features.Redact_errors {
+		body.Message += ": " + detail.Error()
+	}
+
+	if !common.Conf.Features.Json_errors || wantsText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(body.Message + "\n"))
+		return
+	}
+
+	body.InvocationId = w.Header().Get("X-OL-Invocation-Id")
+	b, err := json.Marshal(&errorEnvelope{body})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+// does the client prefer plain text over JSON?
+func wantsText(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(accept, ";")[0])
+		switch mediaType {
+		case "text/plain":
+			return true
+		case "application/json", "application/*", "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+// respond to the invocation with an error (see writeError)
+func (req *Invocation) fail(status int, code ErrorCode, msg string, detail error) {
+	writeError(req.w, req.r, status, code, msg, detail)
+}
+
+// say which limit a request that timed out hit (see
+// TIMEOUT_SOURCE_HEADER), and fail it
+func (req *Invocation) failTimeout(msg string, source string, timeoutMs int64) {
+	req.w.Header().Set(TIMEOUT_SOURCE_HEADER, source)
+	req.w.Header().Set(TIMEOUT_MS_HEADER, strconv.FormatInt(timeoutMs, 10))
+	req.fail(http.StatusGatewayTimeout, ERR_TIMEOUT,
+		fmt.Sprintf("%s (%s timeout of %d ms)", msg, source, timeoutMs), nil)
+}
+
+// respond to a request that cannot run, because the lambda's code
+// could not be pulled.  Only a lambda that doesn't exist gets a 404;
+// otherwise, the client may retry (after the Task's pull backoff), as
+// the code or the registry may be fixed.
+func (f *LambdaFunc) failPull(req *Invocation, err error) {
+	var loadErr *LoadError
+	if errors.Is(err, ErrLambdaNotFound) {
+		req.fail(http.StatusNotFound, ERR_LAMBDA_NOT_FOUND, "lambda function not found", err)
+		return
+	}
+
+	retry := int(math.Ceil(time.Until(f.pullRetryAt).Seconds()))
+	req.w.Header().Set("Retry-After", strconv.Itoa(common.Max(retry, 1)))
+	if errors.As(err, &loadErr) {
+		req.fail(http.StatusServiceUnavailable, ERR_LOAD_FAILED, "could not load lambda code", loadErr.Err)
+	} else {
+		req.fail(http.StatusServiceUnavailable, ERR_PULL_FAILED, "could not pull lambda code", err)
+	}
+}
+
+// respond 429, because the queue with the given depth and capacity
+// is full ("func_queue_full" for funcChan, "inst_queue_full" for an
+// instChan).  Clients can back off for about as long as it should
+// take the lambda's instances to work through the queue.
+func (f *LambdaFunc) failQueueFull(w http.ResponseWriter, r *http.Request, reason string, depth, capacity int) {
+	code, msg := ERR_FUNCTION_QUEUE_FULL, "lambda function queue is full"
+	if reason == "inst_queue_full" {
+		code, msg = ERR_INSTANCE_QUEUE_FULL, "lambda instance queue is full"
+	}
+
+	instances := common.Max(int(atomic.LoadInt32(&f.numInstances)), 1)
+	retryMs := common.Max(int(atomic.LoadInt64(&f.avgExecMs))*depth/instances, 1)
+	w.Header().Set("Retry-After", strconv.Itoa((retryMs+999)/1000))
+
+	writeErrorBody(w, r, http.StatusTooManyRequests, errorBody{
+		Code:          code,
+		Message:       msg,
+		Reason:        reason,
+		QueueDepth:    depth,
+		QueueCapacity: capacity,
+		RetryAfterMs:  int64(retryMs),
+	}, nil)
+}
@@ -0,0 +1,432 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// backoff between retries of a failed invocation (or poll), doubling
+// each time
+const (
+	EVENT_RETRY_MIN = 1 * time.Second
+	EVENT_RETRY_MAX = 1 * time.Minute
+)
+
+// EventMessage is one message consumed from an EventSource
+type EventMessage struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Key       []byte `json:"-"`
+	Value     []byte `json:"-"`
+}
+
+// EventSource is a message queue that lambdas may be triggered by
+// (see Conf.Event_sources).  Messages are committed only after they
+// have been handled (successfully, or by sending them to the dead
+// letter topic/queue), so they are delivered at least once.
+type EventSource interface {
+	// block until there are new messages (or ctx is done)
+	Poll(ctx context.Context) ([]*EventMessage, error)
+
+	// mark messages (and all before them) as handled
+	Commit(ctx context.Context, msgs []*EventMessage) error
+
+	// send messages that could not be handled to the dead letter
+	// topic/queue
+	DeadLetter(ctx context.Context, msgs []*EventMessage) error
+
+	Close() error
+}
+
+func newEventSource(conf common.EventSourceConfig) (EventSource, error) {
+	switch conf.Type {
+	case "kafka":
+		return newKafkaSource(conf)
+	default:
+		return nil, fmt.Errorf("unknown event source type '%s'", conf.Type)
+	}
+}
+
+// consumes messages from an EventSource, invoking a lambda for
+// each batch of them
+type eventSourceRunner struct {
+	mgr    *LambdaMgr
+	conf   common.EventSourceConfig
+	source EventSource
+	cancel context.CancelFunc
+	done   chan bool
+}
+
+func (mgr *LambdaMgr) startEventSource(conf common.EventSourceConfig) (*eventSourceRunner, error) {
+	if conf.Batch_size <= 0 {
+		conf.Batch_size = 1
+	}
+	if conf.Max_concurrency <= 0 {
+		conf.Max_concurrency = 1
+	}
+	if conf.Max_retries < 0 {
+		conf.Max_retries = 0
+	} else if conf.Max_retries == 0 {
+		conf.Max_retries = 3
+	}
+
+	if err := ValidateName(conf.Lambda); err != nil {
+		return nil, err
+	}
+
+	source, err := newEventSource(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runner := &eventSourceRunner{
+		mgr:    mgr,
+		conf:   conf,
+		source: source,
+		cancel: cancel,
+		done:   make(chan bool),
+	}
+	go runner.run(ctx)
+	return runner, nil
+}
+
+func (runner *eventSourceRunner) stop() {
+	runner.cancel()
+	<-runner.done
+}
+
+func (runner *eventSourceRunner) run(ctx context.Context) {
+	defer runner.mgr.registerGoroutine(fmt.Sprintf("eventSourceRunner [%s %s -> FUNC %s]",
+		runner.conf.Type, runner.conf.Topic, runner.conf.Lambda))()
+	defer func() {
+		if err := runner.source.Close(); err != nil {
+			log.Printf("could not close %s event source: %v", runner.conf.Type, err)
+		}
+		runner.done <- true
+	}()
+
+	backoff := EVENT_RETRY_MIN
+	for ctx.Err() == nil {
+		msgs, err := runner.source.Poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("could not poll %s event source for %s (will retry in %v): %v",
+				runner.conf.Type, runner.conf.Lambda, backoff, err)
+			sleepCtx(ctx, backoff)
+			backoff = nextEventBackoff(backoff)
+			continue
+		}
+		backoff = EVENT_RETRY_MIN
+
+		if len(msgs) == 0 {
+			continue
+		}
+
+		// every batch must be handled before we commit, as a
+		// commit covers all messages up to an offset
+		sem := make(chan bool, runner.conf.Max_concurrency)
+		var wg sync.WaitGroup
+		for start := 0; start < len(msgs); start += runner.conf.Batch_size {
+			end := common.Min(start+runner.conf.Batch_size, len(msgs))
+			sem <- true
+			wg.Add(1)
+			go func(batch []*EventMessage) {
+				defer wg.Done()
+				runner.handle(ctx, batch)
+				<-sem
+			}(msgs[start:end])
+		}
+		wg.Wait()
+
+		// on shutdown, don't commit batches that were cut
+		// short; they'll be delivered again
+		if ctx.Err() != nil {
+			return
+		}
+		if err := runner.source.Commit(ctx, msgs); err != nil {
+			log.Printf("could not commit %d messages from %s event source for %s: %v",
+				len(msgs), runner.conf.Type, runner.conf.Lambda, err)
+		}
+	}
+}
+
+// invoke the lambda for a batch of messages, retrying failures
+// (with backoff), and dead-lettering the batch if it never succeeds
+func (runner *eventSourceRunner) handle(ctx context.Context, batch []*EventMessage) {
+	stat := "event-source/" + runner.conf.Lambda
+	backoff := EVENT_RETRY_MIN
+
+	var err error
+	for attempt := 0; attempt <= runner.conf.Max_retries; attempt++ {
+		if attempt > 0 {
+			common.IncCounter(stat + "/retries")
+			if !sleepCtx(ctx, backoff) {
+				return
+			}
+			backoff = nextEventBackoff(backoff)
+		}
+
+		if err = runner.invoke(ctx, batch); err == nil {
+			common.IncCounter(stat + "/delivered")
+			return
+		} else if ctx.Err() != nil {
+			return
+		}
+	}
+
+	if runner.conf.Dead_letter_topic == "" {
+		log.Printf("dropping %d messages for %s after %d retries (no dead letter topic): %v",
+			len(batch), runner.conf.Lambda, runner.conf.Max_retries, err)
+		common.IncCounter(stat + "/dropped")
+		return
+	}
+
+	log.Printf("sending %d messages for %s to dead letter topic %s after %d retries: %v",
+		len(batch), runner.conf.Lambda, runner.conf.Dead_letter_topic, runner.conf.Max_retries, err)
+	if err := runner.source.DeadLetter(ctx, batch); err != nil {
+		log.Printf("could not send messages to dead letter topic %s: %v", runner.conf.Dead_letter_topic, err)
+	}
+	common.IncCounter(stat + "/dead-lettered")
+}
+
+// invoke the lambda once (a non-2xx response is an error).  The body
+// is the message itself, or a JSON array of messages (with their
+// values as strings) for a batch.
+func (runner *eventSourceRunner) invoke(ctx context.Context, batch []*EventMessage) error {
+	var body []byte
+	if len(batch) == 1 {
+		body = batch[0].Value
+	} else {
+		type batchMessage struct {
+			*EventMessage
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+		items := make([]batchMessage, len(batch))
+		for i, msg := range batch {
+			items[i] = batchMessage{msg, string(msg.Key), string(msg.Value)}
+		}
+		var err error
+		if body, err = json.Marshal(items); err != nil {
+			return err
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, "POST", "/run/"+runner.conf.Lambda, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("X-OL-Event-Source", runner.conf.Type)
+	r.Header.Set("X-OL-Event-Topic", batch[0].Topic)
+	if len(batch) == 1 {
+		r.Header.Set("X-OL-Event-Partition", strconv.Itoa(batch[0].Partition))
+		r.Header.Set("X-OL-Event-Offset", strconv.FormatInt(batch[0].Offset, 10))
+		if batch[0].Key != nil {
+			r.Header.Set("X-OL-Event-Key", base64.StdEncoding.EncodeToString(batch[0].Key))
+		}
+	} else {
+		r.Header.Set("X-OL-Event-Batch-Size", strconv.Itoa(len(batch)))
+	}
+
+	f, err := runner.mgr.Get(runner.conf.Lambda)
+	if err != nil {
+		return err
+	}
+	w := httptest.NewRecorder()
+	f.Invoke(w, r)
+	if w.Code < 200 || w.Code > 299 {
+		return fmt.Errorf("lambda returned status %d: %s", w.Code, w.Body.String())
+	}
+	return nil
+}
+
+func nextEventBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > EVENT_RETRY_MAX {
+		return EVENT_RETRY_MAX
+	}
+	return backoff
+}
+
+// sleep for d, unless ctx is done first (then returns false)
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// kafkaSource consumes a topic through a Kafka REST proxy (v2 API),
+// as a member of a consumer group, committing offsets manually
+type kafkaSource struct {
+	conf    common.EventSourceConfig
+	client  *http.Client
+	baseURI string // of our consumer instance
+}
+
+const KAFKA_CONTENT_TYPE = "application/vnd.kafka.v2+json"
+const KAFKA_BINARY_CONTENT_TYPE = "application/vnd.kafka.binary.v2+json"
+
+func newKafkaSource(conf common.EventSourceConfig) (*kafkaSource, error) {
+	if conf.Url == "" || conf.Topic == "" || conf.Group == "" {
+		return nil, fmt.Errorf("kafka event source for %s needs a url, topic, and group", conf.Lambda)
+	}
+
+	k := &kafkaSource{conf: conf, client: &http.Client{Timeout: time.Minute}}
+
+	// create a consumer instance, then subscribe it to the topic
+	var consumer struct {
+		BaseURI string `json:"base_uri"`
+	}
+	err := k.call(context.Background(), "POST", conf.Url+"/consumers/"+conf.Group, KAFKA_CONTENT_TYPE, map[string]string{
+		"format":             "binary",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	}, &consumer)
+	if err != nil {
+		return nil, fmt.Errorf("could not create kafka consumer: %v", err)
+	}
+	k.baseURI = consumer.BaseURI
+
+	err = k.call(context.Background(), "POST", k.baseURI+"/subscription", KAFKA_CONTENT_TYPE, map[string][]string{
+		"topics": {conf.Topic},
+	}, nil)
+	if err != nil {
+		k.Close()
+		return nil, fmt.Errorf("could not subscribe to kafka topic %s: %v", conf.Topic, err)
+	}
+
+	return k, nil
+}
+
+// send a JSON request to the REST proxy, decoding the JSON response
+// (if any) into out
+func (k *kafkaSource) call(ctx context.Context, method, url, contentType string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", contentType)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned status %d: %s", method, url, resp.StatusCode, string(respBody))
+	}
+	if out != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+func (k *kafkaSource) Poll(ctx context.Context) ([]*EventMessage, error) {
+	var records []struct {
+		Topic     string `json:"topic"`
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		Key       []byte `json:"key"`   // base64 in JSON
+		Value     []byte `json:"value"` // base64 in JSON
+	}
+	if err := k.call(ctx, "GET", k.baseURI+"/records", KAFKA_BINARY_CONTENT_TYPE, nil, &records); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*EventMessage, len(records))
+	for i, rec := range records {
+		msgs[i] = &EventMessage{
+			Topic:     rec.Topic,
+			Partition: rec.Partition,
+			Offset:    rec.Offset,
+			Key:       rec.Key,
+			Value:     rec.Value,
+		}
+	}
+	return msgs, nil
+}
+
+func (k *kafkaSource) Commit(ctx context.Context, msgs []*EventMessage) error {
+	type offset struct {
+		Topic     string `json:"topic"`
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+	}
+
+	// the last offset in each partition covers the ones before it
+	last := make(map[string]map[int]int64)
+	for _, msg := range msgs {
+		if last[msg.Topic] == nil {
+			last[msg.Topic] = make(map[int]int64)
+		}
+		if prev, ok := last[msg.Topic][msg.Partition]; !ok || msg.Offset > prev {
+			last[msg.Topic][msg.Partition] = msg.Offset
+		}
+	}
+
+	offsets := []offset{}
+	for topic, partitions := range last {
+		for partition, off := range partitions {
+			offsets = append(offsets, offset{topic, partition, off})
+		}
+	}
+
+	return k.call(ctx, "POST", k.baseURI+"/offsets", KAFKA_CONTENT_TYPE, map[string][]offset{"offsets": offsets}, nil)
+}
+
+func (k *kafkaSource) DeadLetter(ctx context.Context, msgs []*EventMessage) error {
+	type record struct {
+		Key   []byte `json:"key,omitempty"` // base64 in JSON
+		Value []byte `json:"value"`
+	}
+
+	records := make([]record, len(msgs))
+	for i, msg := range msgs {
+		records[i] = record{msg.Key, msg.Value}
+	}
+
+	url := k.conf.Url + "/topics/" + k.conf.Dead_letter_topic
+	return k.call(ctx, "POST", url, KAFKA_BINARY_CONTENT_TYPE, map[string][]record{"records": records}, nil)
+}
+
+// leave the consumer group, so our partitions are reassigned right
+// away
+func (k *kafkaSource) Close() error {
+	return k.call(context.Background(), "DELETE", k.baseURI, KAFKA_CONTENT_TYPE, nil, nil)
+}
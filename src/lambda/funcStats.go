@@ -0,0 +1,96 @@
+package lambda
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// how many requests' execution times are averaged for autoscaling, if
+// Scaling.Exec_avg_window isn't set
+const EXEC_AVG_DEFAULT_WINDOW = 10
+
+// the rolling average of execution times a lambda's autoscaler sees
+// (see Scaling.Exec_avg_window)
+func newExecAvg() *common.RollingAvg {
+	if ms := common.Conf.Scaling.Exec_avg_window_ms; ms > 0 {
+		return common.NewTimedRollingAvg(time.Duration(ms) * time.Millisecond)
+	}
+	if n := common.Conf.Scaling.Exec_avg_window; n > 0 {
+		return common.NewRollingAvg(n)
+	}
+	return common.NewRollingAvg(EXEC_AVG_DEFAULT_WINDOW)
+}
+
+// funcStats keeps the stats of a LambdaFunc's finished requests: how
+// long they ran (for autoscaling), how big their bodies were, and how
+// many failed (warning when that reaches
+// Limits.Error_rate_alert_pct).
+//
+// Only the LambdaFunc's Task uses it, so there's no locking.
+type funcStats struct {
+	f         *LambdaFunc
+	execMs    *common.RollingAvg
+	reqBytes  *common.RollingAvg
+	respBytes *common.RollingAvg
+
+	// percentage of recent invocations that failed (each is
+	// counted as 0 or 100)
+	errorPct   *common.RollingAvg
+	errorAlert bool
+}
+
+func newFuncStats(f *LambdaFunc) *funcStats {
+	return &funcStats{
+		f:         f,
+		execMs:    newExecAvg(),
+		reqBytes:  common.NewRollingAvg(10),
+		respBytes: common.NewRollingAvg(10),
+		errorPct:  common.NewRollingAvg(100),
+	}
+}
+
+// count a request that was served (see Invocation.error)
+func (s *funcStats) record(req *Invocation) {
+	f := s.f
+	s.execMs.Add(req.execMs)
+	atomic.StoreInt64(&f.avgExecMs, int64(s.execMs.Avg))
+	s.observeBytes(req)
+	f.observePhase("exec", time.Duration(req.execMs)*time.Millisecond)
+	f.recentRequests.add(req)
+
+	if req.error {
+		s.errorPct.Add(100)
+	} else {
+		s.errorPct.Add(0)
+	}
+	common.SetGauge("lambda/"+f.name+"/error-pct", int64(s.errorPct.Avg))
+
+	alertPct := common.Conf.Limits.Error_rate_alert_pct
+	if alertPct > 0 && !s.errorAlert && s.errorPct.Avg >= alertPct {
+		f.warnf("error rate of %d%% has reached alert threshold of %d%%", s.errorPct.Avg, alertPct)
+		s.errorAlert = true
+	} else if s.errorAlert && s.errorPct.Avg < alertPct {
+		f.infof("error rate has recovered to %d%%", s.errorPct.Avg)
+		s.errorAlert = false
+	}
+}
+
+// record how many body bytes a finished invocation read and wrote, in
+// total and averaged over the last few (like execMs)
+func (s *funcStats) observeBytes(req *Invocation) {
+	var in int64
+	if req.body != nil {
+		in = req.body.n
+	}
+	out := req.sw.written
+
+	name := s.f.name
+	common.AddSum("lambda/"+name+"/request-bytes", in)
+	common.AddSum("lambda/"+name+"/response-bytes", out)
+	s.reqBytes.Add(int(in))
+	s.respBytes.Add(int(out))
+	common.SetGauge("lambda/"+name+"/avg-request-bytes", int64(s.reqBytes.Avg))
+	common.SetGauge("lambda/"+name+"/avg-response-bytes", int64(s.respBytes.Avg))
+}
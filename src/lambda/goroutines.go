@@ -0,0 +1,53 @@
+package lambda
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// remember what a goroutine is doing (e.g., which lambda's Task it
+// runs), so that DumpGoroutines can say so.  The caller must call
+// the returned func when the goroutine exits.
+func (mgr *LambdaMgr) registerGoroutine(what string) func() {
+	id := common.GetGoroutineID()
+	mgr.goroutines.Store(id, what)
+	return func() {
+		mgr.goroutines.Delete(id)
+	}
+}
+
+// DumpGoroutines returns the stacks of all goroutines (in the same
+// format as a Go crash dump), with a comment before each goroutine
+// that runs a registered task, saying which one it is
+func (mgr *LambdaMgr) DumpGoroutines() string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	var out bytes.Buffer
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		// each stack starts with "goroutine <id> [<state>]:"
+		fields := bytes.Fields(stack)
+		if len(fields) >= 2 {
+			if id, err := strconv.ParseUint(string(fields[1]), 10, 64); err == nil {
+				if what, ok := mgr.goroutines.Load(id); ok {
+					out.WriteString(fmt.Sprintf("# %s\n", what))
+				}
+			}
+		}
+		out.Write(stack)
+		out.WriteString("\n\n")
+	}
+
+	return out.String()
+}
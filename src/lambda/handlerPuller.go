@@ -1,103 +1,105 @@
 package lambda
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 )
 
-var notFound404 = errors.New("file does not exist")
-
-// TODO: for web registries, support an HTTP-based access key
-// (https://en.wikipedia.org/wiki/Basic_access_authentication)
+// returned (wrapped) by Pull when the lambda isn't in the registry
+var ErrLambdaNotFound = errors.New("lambda not found")
 
+// pulls lambda code from a CodeSource, remembering which lambdas
+// weren't found
 type HandlerPuller struct {
-	prefix   string   // combine with name to get file path or URL
-	dirCache sync.Map // key=lambda name, value=version, directory path
+	source   CodeSource
+	notFound sync.Map // key=lambda name, value=*notFoundEntry
+}
+
+// code extracted from a CodeSource, so that unchanged code isn't
+// extracted again.  The CodeSources in this package share it.
+type codeDirCache struct {
+	dirCache sync.Map // key=lambda name, value=*CacheEntry
 	dirMaker *common.DirMaker
 }
 
 type CacheEntry struct {
 	version string // could be a timestamp for a file or web resource
+	etag    string // for web resources that have one
+	hash    string // of the file (or directory) the code came from
 	path    string // where code is extracted to a dir
 }
 
-func NewHandlerPuller(dirMaker *common.DirMaker) (cp *HandlerPuller, err error) {
-	return &HandlerPuller{
-		prefix:   common.Conf.Registry,
-		dirMaker: dirMaker,
-	}, nil
+// remembers that a lambda wasn't found, so requests for names that
+// don't exist don't each cost a registry round trip
+type notFoundEntry struct {
+	err  error
+	time time.Time
 }
 
-func (cp *HandlerPuller) isRemote() bool {
-	return strings.HasPrefix(cp.prefix, "http://") || strings.HasPrefix(cp.prefix, "https://")
+func NewHandlerPuller(source CodeSource) (cp *HandlerPuller, err error) {
+	return &HandlerPuller{source: source}, nil
 }
 
 func (cp *HandlerPuller) Pull(name string) (targetDir string, err error) {
 	t := common.T0("pull-lambda")
 	defer t.T1()
 
-	matched, err := regexp.MatchString(`^[A-Za-z0-9\.\-\_]+$`, name)
-	if err != nil {
+	if err := ValidateName(name); err != nil {
 		return "", err
-	} else if !matched {
-		msg := "bad lambda name '%s', can only contain letters, numbers, period, dash, and underscore"
-		return "", fmt.Errorf(msg, name)
 	}
 
-	if cp.isRemote() {
-		// registry type = web
-		urls := []string{
-			cp.prefix + "/" + name + ".tar.gz",
-			cp.prefix + "/" + name + ".py",
-		}
-
-		for i := 0; i < len(urls); i++ {
-			targetDir, err = cp.pullRemoteFile(urls[i], name)
-			if err == nil {
-				return targetDir, nil
-			} else if err != notFound404 {
-				// 404 is OK, because we just go on to check the next URLs
-				return "", err
-			}
-		}
-
-		return "", fmt.Errorf("lambda not found at any of these locations: %s", strings.Join(urls, ", "))
-	} else {
-		// registry type = file
-		paths := []string{
-			filepath.Join(cp.prefix, name) + ".tar.gz",
-			filepath.Join(cp.prefix, name) + ".py",
-			filepath.Join(cp.prefix, name),
+	if entry, ok := cp.notFound.Load(name); ok {
+		entry := entry.(*notFoundEntry)
+		ttl := time.Duration(common.Conf.Registry_not_found_cache_ms) * time.Millisecond
+		if changed, _ := cp.Changed(name); time.Since(entry.time) < ttl && !changed {
+			return "", entry.err
 		}
+		cp.notFound.Delete(name)
+	}
 
-		for i := 0; i < len(paths); i++ {
-			if _, err := os.Stat(paths[i]); !os.IsNotExist(err) {
-				targetDir, err = cp.pullLocalFile(paths[i], name)
-				return targetDir, err
-			}
-		}
+	targetDir, err = cp.source.Fetch(name)
+	if errors.Is(err, ErrLambdaNotFound) {
+		cp.notFound.Store(name, &notFoundEntry{err: err, time: time.Now()})
+	}
+	return targetDir, err
+}
 
-		return "", fmt.Errorf("lambda not found at any of these locations: %s", strings.Join(paths, ", "))
+// whether the named lambda changed since it was last pulled, if the
+// CodeSource watches for changes (ok is false if it doesn't, in which
+// case only pulling can tell)
+func (cp *HandlerPuller) Changed(name string) (changed bool, ok bool) {
+	watcher, ok := cp.source.(codeWatcher)
+	if !ok {
+		return false, false
 	}
+	return watcher.changed(name), true
 }
 
 // delete any caching associated with this handler
 func (cp *HandlerPuller) Reset(name string) {
-	cp.dirCache.Delete(name)
+	cp.source.Reset(name)
+	cp.notFound.Delete(name)
 }
 
-func (cp *HandlerPuller) pullLocalFile(src, lambdaName string) (targetDir string, err error) {
+func (c *codeDirCache) Reset(name string) {
+	c.dirCache.Delete(name)
+}
+
+// extract code from a .py, .tar.gz, or directory into a code dir.  A
+// file from a local registry is cached by its mod time (byModTime),
+// as well as its hash.
+func (c *codeDirCache) extract(src, lambdaName string, byModTime bool) (targetDir string, err error) {
 	stat, err := os.Stat(src)
 	if err != nil {
 		return "", err
@@ -105,32 +107,62 @@ func (cp *HandlerPuller) pullLocalFile(src, lambdaName string) (targetDir string
 
 	if stat.Mode().IsDir() {
 		// this is really just a debug mode, and is not
-		// expected to be efficient
-		targetDir = cp.dirMaker.Get(lambdaName)
+		// expected to be efficient (though we don't copy it
+		// again if nothing changed)
+		hash := hashCodeDir(src)
+		if cacheEntry := c.unchanged(lambdaName, hash); cacheEntry != nil {
+			return cacheEntry.path, nil
+		}
+		countPull(lambdaName, false)
+
+		targetDir = c.dirMaker.Get(lambdaName)
 
 		cmd := exec.Command("cp", "-r", src, targetDir)
 		if output, err := cmd.CombinedOutput(); err != nil {
 			return "", fmt.Errorf("%s :: %s", err, string(output))
 		}
+		if err := checkCodeSize(targetDir); err != nil {
+			os.RemoveAll(targetDir)
+			return "", err
+		}
+		if hash != "" {
+			c.putCache(lambdaName, &CacheEntry{hash: hash, path: targetDir})
+		}
 		return targetDir, nil
 	} else if !stat.Mode().IsRegular() {
 		return "", fmt.Errorf("%s not a file or directory", src)
 	}
 
 	// for regular files, we cache based on mod time.  We don't
-	// cache at the file level if this is a remote store (because
-	// caching is handled at the web level)
+	// cache at the file level for a file downloaded from a remote
+	// store (because caching is handled at the web level)
 	version := stat.ModTime().String()
-	if !cp.isRemote() {
-		cacheEntry := cp.getCache(lambdaName)
+	if byModTime {
+		cacheEntry := c.getCache(lambdaName)
 		if cacheEntry != nil && cacheEntry.version == version {
 			// hit:
+			countPull(lambdaName, true)
 			return cacheEntry.path, nil
 		}
 	}
 
+	// the file may have been rewritten (or downloaded again)
+	// with the same contents, in which case there's no need to
+	// extract it again
+	hash, err := hashFile(src)
+	if err != nil {
+		return "", err
+	}
+	if cacheEntry := c.unchanged(lambdaName, hash); cacheEntry != nil {
+		if byModTime {
+			c.putCache(lambdaName, &CacheEntry{version: version, hash: hash, path: cacheEntry.path})
+		}
+		return cacheEntry.path, nil
+	}
+	countPull(lambdaName, false)
+
 	// miss:
-	targetDir = cp.dirMaker.Get(lambdaName)
+	targetDir = c.dirMaker.Get(lambdaName)
 	if err := os.Mkdir(targetDir, os.ModeDir); err != nil {
 		return "", err
 	}
@@ -149,81 +181,100 @@ func (cp *HandlerPuller) pullLocalFile(src, lambdaName string) (targetDir string
 		return "", fmt.Errorf("lambda file %s not a .ta.rgz or .py", src)
 	}
 
-	if !cp.isRemote() {
-		cp.putCache(lambdaName, version, targetDir)
+	if err := checkCodeSize(targetDir); err != nil {
+		os.RemoveAll(targetDir)
+		return "", err
+	}
+
+	if byModTime {
+		c.putCache(lambdaName, &CacheEntry{version: version, hash: hash, path: targetDir})
 	}
 
 	return targetDir, nil
 }
 
-func (cp *HandlerPuller) pullRemoteFile(src, lambdaName string) (targetDir string, err error) {
-	// grab latest lambda code if it's changed (pass
-	// If-Modified-Since so this can be determined on server side
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", src, nil)
-	if err != nil {
-		return "", err
+// the cache entry for a lambda, if its code (with the given hash)
+// is the same as was last extracted.  Only kept in memory, as code
+// dirs don't outlive the worker (see common.NewDirMaker).
+func (c *codeDirCache) unchanged(lambdaName, hash string) *CacheEntry {
+	cacheEntry := c.getCache(lambdaName)
+	if hash == "" || cacheEntry == nil || cacheEntry.hash != hash {
+		return nil
 	}
+	countPull(lambdaName, true)
+	return cacheEntry
+}
 
-	cacheEntry := cp.getCache(lambdaName)
-	if cacheEntry != nil {
-		req.Header.Set("If-Modified-Since", cacheEntry.version)
+// count a pull that reused the code already extracted (skipped), or
+// that had to copy or extract it again
+func countPull(lambdaName string, skipped bool) {
+	if skipped {
+		common.IncCounter("lambda/" + lambdaName + "/pull-skipped")
+	} else {
+		common.IncCounter("lambda/" + lambdaName + "/pull-downloaded")
 	}
+}
 
-	resp, err := client.Do(req)
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusNotFound {
-		return "", notFound404
-	}
+	defer file.Close()
 
-	if resp.StatusCode == http.StatusNotModified {
-		return cacheEntry.path, nil
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	// download to local file, then use pullLocalFile to finish
-	dir, err := ioutil.TempDir("", "ol-")
-	if err != nil {
-		return "", err
+// make sure code extracted to dir is no larger than Max_code_mb, so
+// that a bad deploy can't fill the worker's disk
+func checkCodeSize(dir string) error {
+	maxMB := common.Conf.Limits.Max_code_mb
+	if maxMB <= 0 {
+		return nil
 	}
-	defer os.RemoveAll(dir)
 
-	parts := strings.Split(src, "/")
-	localPath := filepath.Join(dir, parts[len(parts)-1])
-	out, err := os.Create(localPath)
+	total, err := dirSizeBytes(dir)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer out.Close()
 
-	if _, err = io.Copy(out, resp.Body); err != nil {
-		return "", err
+	if total > int64(maxMB)*1024*1024 {
+		return fmt.Errorf("lambda code is %.1f MB, exceeding max_code_mb limit of %d MB", float64(total)/(1024*1024), maxMB)
 	}
+	return nil
+}
 
-	targetDir, err = cp.pullLocalFile(localPath, lambdaName)
-
-	// record directory in cache, by mod time
-	if err == nil {
-		version := resp.Header.Get("Last-Modified")
-		if version != "" {
-			cp.putCache(lambdaName, version, targetDir)
+// the total size of the files under dir
+func dirSizeBytes(dir string) (int64, error) {
+	var total int64 = 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-	}
-
-	return targetDir, err
+		total += info.Size()
+		return nil
+	})
+	return total, err
 }
 
-func (cp *HandlerPuller) getCache(name string) *CacheEntry {
-	entry, found := cp.dirCache.Load(name)
+// the cache entry for a lambda, unless the dir it refers to has
+// since been deleted (e.g., by a LambdaFunc that was killed)
+func (c *codeDirCache) getCache(name string) *CacheEntry {
+	entry, found := c.dirCache.Load(name)
 	if !found {
 		return nil
 	}
+	if _, err := os.Stat(entry.(*CacheEntry).path); err != nil {
+		c.dirCache.Delete(name)
+		return nil
+	}
 	return entry.(*CacheEntry)
 }
 
-func (cp *HandlerPuller) putCache(name, version, path string) {
-	cp.dirCache.Store(name, &CacheEntry{version, path})
+func (c *codeDirCache) putCache(name string, entry *CacheEntry) {
+	c.dirCache.Store(name, entry)
 }
@@ -0,0 +1,64 @@
+package lambda
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// a registry dir for a lambda with an f.py, and a file of extraMB
+func registerLambdaDir(t *testing.T, name string, extraMB int) {
+	dir := filepath.Join(common.Conf.Registry, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "f.py"), []byte("def f(event):\n    return event\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assets := make([]byte, extraMB*1024*1024)
+	if err := ioutil.WriteFile(filepath.Join(dir, "assets.bin"), assets, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// code larger than Max_code_mb fails to pull, and leaves nothing
+// behind in the code dir
+func TestMaxCodeSize(t *testing.T) {
+	mgr, _ := newTestMgr(t, echoHandler)
+	common.Conf.Limits.Max_code_mb = 1
+	registerLambdaDir(t, "small", 0)
+	registerLambdaDir(t, "big", 2)
+
+	codeDir := filepath.Join(common.Conf.Worker_dir, "code")
+	before, err := ioutil.ReadDir(codeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mgr.HandlerPuller.Pull("big"); err == nil || !strings.Contains(err.Error(), "max_code_mb") {
+		t.Fatalf("expected a max_code_mb error, got %v", err)
+	}
+	after, err := ioutil.ReadDir(codeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("the oversized code was left in %s", codeDir)
+	}
+
+	// invoking the lambda fails with the same error
+	rec := invoke(t, mgr, "big", "{}")
+	if rec.Code == http.StatusOK || !strings.Contains(rec.Body.String(), "max_code_mb") {
+		t.Errorf("got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// while code within the limit is pulled as usual
+	if rec := invoke(t, mgr, "small", "{}"); rec.Code != http.StatusOK {
+		t.Errorf("got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,233 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// the format of handoff snapshots this worker writes.  Snapshots with
+// another version are ignored (with a log message), so a worker never
+// misreads one from an older or newer binary.
+const HANDOFF_VERSION = 1
+
+// where a worker leaves its snapshot for the next one, in the worker dir
+const HANDOFF_FILE = "handoff.json"
+
+// HandoffSnapshot is what a worker shutting down gracefully knows
+// about its active lambdas, so the next worker (e.g., after an
+// upgrade) can get them ready before their traffic returns
+type HandoffSnapshot struct {
+	Version   int               `json:"version"`
+	Time      time.Time         `json:"time"`
+	Functions []HandoffFunction `json:"functions"`
+}
+
+type HandoffFunction struct {
+	Name string `json:"name"`
+
+	// the code that was running, and its directives and packages
+	CodeHash string               `json:"code_hash,omitempty"`
+	Meta     *sandbox.SandboxMeta `json:"meta,omitempty"`
+	Python   string               `json:"python,omitempty"`
+	Resolved map[string]string    `json:"resolved,omitempty"`
+
+	// recent requests per second, and how they were being served
+	Rate      float64 `json:"rate"`
+	AvgExecMs int64   `json:"avg_exec_ms"`
+	Instances int     `json:"instances"`
+}
+
+func handoffPath() string {
+	return filepath.Join(common.Conf.Worker_dir, HANDOFF_FILE)
+}
+
+// f's recent requests per second (its score is about rate times
+// INSTANCE_BUDGET_HALF_LIFE / ln 2)
+func (b *instanceBudget) rate(f *LambdaFunc) (rate float64, instances int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	e := b.funcs[f]
+	if e == nil {
+		return 0, 0
+	}
+	return e.decayed(time.Now()) * math.Ln2 / INSTANCE_BUDGET_HALF_LIFE.Seconds(), e.instances
+}
+
+// write a snapshot of the lambdas that have code, for the next worker
+// (see Handoff).  Called as the worker shuts down, before the lambdas
+// are killed.
+func (mgr *LambdaMgr) writeHandoff() error {
+	snap := &HandoffSnapshot{Version: HANDOFF_VERSION, Time: time.Now(), Functions: []HandoffFunction{}}
+
+	mgr.mapMutex.RLock()
+	for name, f := range mgr.lfuncMap {
+		deps := f.Dependencies()
+		if deps == nil {
+			continue
+		}
+		rate, instances := mgr.instanceBudget.rate(f)
+		snap.Functions = append(snap.Functions, HandoffFunction{
+			Name:      name,
+			CodeHash:  deps.CodeHash,
+			Meta:      deps.meta,
+			Python:    deps.Python,
+			Resolved:  deps.Resolved,
+			Rate:      rate,
+			AvgExecMs: atomic.LoadInt64(&f.avgExecMs),
+			Instances: instances,
+		})
+	}
+	mgr.mapMutex.RUnlock()
+
+	b, err := json.MarshalIndent(snap, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// (rename, so the next worker never reads half a snapshot)
+	tmp := handoffPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, handoffPath()); err != nil {
+		return err
+	}
+	log.Printf("wrote handoff snapshot of %d lambdas to %s", len(snap.Functions), handoffPath())
+	return nil
+}
+
+// read (and remove, so it is only used once) the previous worker's
+// snapshot; nil if there is none
+func readHandoff() (*HandoffSnapshot, error) {
+	b, err := ioutil.ReadFile(handoffPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	os.Remove(handoffPath())
+
+	// check the version before anything else, as the rest of
+	// another version's format may differ
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(b, &version); err != nil {
+		return nil, fmt.Errorf("bad handoff snapshot: %v", err)
+	}
+	if version.Version != HANDOFF_VERSION {
+		return nil, fmt.Errorf("handoff snapshot has version %d (expected %d)", version.Version, HANDOFF_VERSION)
+	}
+
+	snap := &HandoffSnapshot{}
+	if err := json.Unmarshal(b, snap); err != nil {
+		return nil, fmt.Errorf("bad handoff snapshot: %v", err)
+	}
+	return snap, nil
+}
+
+// how many instances to prewarm for a lambda: enough for its recent
+// rate, but no more than it had
+func (hf *HandoffFunction) instances() int {
+	n := int(math.Ceil(hf.Rate * float64(hf.AvgExecMs) / 1000))
+	if hf.Meta != nil && hf.Meta.Concurrency > 1 {
+		n = (n + hf.Meta.Concurrency - 1) / hf.Meta.Concurrency
+	}
+	return common.Max(common.Min(n, hf.Instances), 1)
+}
+
+// Handoff gets the lambdas the previous worker left a snapshot of
+// ready, busiest first: pulling their code and prewarming instances
+// in proportion to their recent rates, until Limits.Handoff_budget_ms
+// runs out (lambdas not reached by then start on demand, as usual).
+func (mgr *LambdaMgr) Handoff() {
+	if !common.Conf.Features.Handoff {
+		return
+	}
+
+	snap, err := readHandoff()
+	if err != nil {
+		log.Printf("ignoring handoff snapshot: %v", err)
+		common.IncCounter("handoff/ignored")
+		return
+	} else if snap == nil {
+		return
+	}
+
+	start := time.Now()
+	budget := time.Duration(common.Conf.Limits.Handoff_budget_ms) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+
+	funcs := snap.Functions
+	sort.Slice(funcs, func(i, j int) bool {
+		return funcs[i].Rate > funcs[j].Rate
+	})
+	log.Printf("take over %d lambdas from the previous worker (snapshot from %v)",
+		len(funcs), snap.Time.Format(time.RFC3339))
+
+	// (as many at once as pulls may run, so the busiest go first)
+	workers := common.Max(common.Conf.Limits.Pull_concurrency, 1)
+	next := make(chan *HandoffFunction)
+	var wg sync.WaitGroup
+	var warmed int64
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hf := range next {
+				if mgr.handoffFunction(hf) {
+					atomic.AddInt64(&warmed, 1)
+				}
+			}
+		}()
+	}
+
+Send:
+	for i := range funcs {
+		select {
+		case next <- &funcs[i]:
+		case <-ctx.Done():
+			log.Printf("handoff budget of %v ran out, with %d lambdas left", budget, len(funcs)-i)
+			common.AddSum("handoff/skipped", int64(len(funcs)-i))
+			break Send
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	log.Printf("took over %d of %d lambdas in %v", warmed, len(funcs), time.Since(start))
+}
+
+// prewarm one lambda from the snapshot, returning whether it worked
+func (mgr *LambdaMgr) handoffFunction(hf *HandoffFunction) bool {
+	f, err := mgr.Get(hf.Name)
+	if err == nil {
+		err = f.PrewarmInstances(hf.instances())
+	}
+	if err != nil {
+		log.Printf("could not take over lambda %s: %v", hf.Name, err)
+		common.IncCounter("handoff/failed")
+		return false
+	}
+
+	if deps := f.Dependencies(); deps != nil && hf.CodeHash != "" && deps.CodeHash != "" && deps.CodeHash != hf.CodeHash {
+		f.infof("code changed since the handoff snapshot (%s -> %s)", hf.CodeHash, deps.CodeHash)
+	}
+	common.IncCounter("handoff/ok")
+	return true
+}
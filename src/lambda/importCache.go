@@ -1,13 +1,17 @@
 package lambda
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 	"github.com/open-lambda/open-lambda/ol/sandbox"
@@ -18,7 +22,15 @@ type ImportCache struct {
 	scratchDirs *common.DirMaker
 	pkgPuller   *PackagePuller
 	sbPool      sandbox.SandboxPool
-	root        *ImportCacheNode
+
+	// the Zygote tree (from Import_cache_tree), as JSON
+	treeJSON []byte
+
+	// each Python version gets its own tree of Zygotes (with the
+	// same structure), as a Zygote can only fork Sandboxes that
+	// run the same Python.  Trees are created when first needed.
+	mutex sync.Mutex
+	roots map[string]*ImportCacheNode
 }
 
 // a node in a tree of Zygotes
@@ -34,6 +46,9 @@ type ImportCacheNode struct {
 	// backpointers based on Children structure
 	parent *ImportCacheNode
 
+	// Python version of the tree this node is in
+	python string
+
 	// Packages of all our ancestors
 	indirectPackages []string
 
@@ -48,6 +63,14 @@ type ImportCacheNode struct {
 	createNonleafChild int64
 	createLeafChild    int64
 
+	// how often Lookup chose this node (accessed atomically)
+	hits int64
+
+	// when sb was created, and which lambdas most recently
+	// used it (see DebugTree)
+	created       time.Time
+	recentLambdas []string
+
 	// Sandbox for this node of the tree (may be nil); codeDir
 	// doesn't contain a lambda, but does contain a packages dir
 	// linking to the packages in Packages and indirectPackages.
@@ -69,63 +92,97 @@ func NewImportCache(codeDirs *common.DirMaker, scratchDirs *common.DirMaker, sbP
 		scratchDirs: scratchDirs,
 		sbPool:      sbPool,
 		pkgPuller:   pp,
+		treeJSON:    []byte("{}"),
+		roots:       make(map[string]*ImportCacheNode),
 	}
 
 	// a static tree of Zygotes may be specified by a file (if so, parse and init it)
-	cache.root = &ImportCacheNode{}
 	switch treeConf := common.Conf.Import_cache_tree.(type) {
 	case string:
 		if treeConf != "" {
-			var b []byte
 			if strings.HasPrefix(treeConf, "{") && strings.HasSuffix(treeConf, "}") {
-				b = []byte(treeConf)
+				cache.treeJSON = []byte(treeConf)
 			} else {
-				b, err = ioutil.ReadFile(treeConf)
+				cache.treeJSON, err = ioutil.ReadFile(treeConf)
 				if err != nil {
 					return nil, fmt.Errorf("could not open import tree file (%v): %v\n", treeConf, err.Error())
 				}
 			}
-
-			if err := json.Unmarshal(b, cache.root); err != nil {
-				return nil, fmt.Errorf("could parse import tree file (%v): %v\n", treeConf, err.Error())
-			}
 		}
 	case map[string]interface{}:
-		b, err := json.Marshal(treeConf)
+		cache.treeJSON, err = json.Marshal(treeConf)
 		if err != nil {
 			return nil, err
 		}
-		if err := json.Unmarshal(b, cache.root); err != nil {
-			return nil, err
-		}
 	default:
 		return nil, fmt.Errorf("unexpected type for import_cache_tree setting: %T", treeConf)
 	}
 
-	// check and print tree
-	if len(cache.root.Packages) > 0 {
-		return nil, fmt.Errorf("root node in import cache may not import packages\n")
+	// check and print tree (for the default Python)
+	root, err := cache.newTree("")
+	if err != nil {
+		return nil, err
 	}
-	cache.recursiveInit(cache.root, []string{})
+	cache.roots[""] = root
 	log.Printf("Import Cache Tree:")
-	cache.root.Dump(0)
+	root.Dump(0)
 
 	return cache, nil
 }
 
+func (cache *ImportCache) newTree(python string) (*ImportCacheNode, error) {
+	root := &ImportCacheNode{}
+	if err := json.Unmarshal(cache.treeJSON, root); err != nil {
+		return nil, fmt.Errorf("could parse import tree (%v): %v\n", string(cache.treeJSON), err.Error())
+	}
+
+	if len(root.Packages) > 0 {
+		return nil, fmt.Errorf("root node in import cache may not import packages\n")
+	}
+	cache.recursiveInit(root, python, []string{})
+	return root, nil
+}
+
+// get the root of the Zygote tree for a Python version
+func (cache *ImportCache) rootFor(python string) *ImportCacheNode {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	root := cache.roots[python]
+	if root == nil {
+		var err error
+		if root, err = cache.newTree(python); err != nil {
+			// the same tree was already parsed successfully at startup
+			panic(err)
+		}
+		cache.roots[python] = root
+	}
+	return root
+}
+
 func (cache *ImportCache) Cleanup() {
-	log.Printf("Import Cache Tree:")
-	cache.root.Dump(0)
-	cache.recursiveKill(cache.root)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for python, root := range cache.roots {
+		if python == "" {
+			log.Printf("Import Cache Tree:")
+		} else {
+			log.Printf("Import Cache Tree (Python %s):", python)
+		}
+		root.Dump(0)
+		cache.recursiveKill(root)
+	}
 }
 
-// 1. populate parent field of every struct
+// 1. populate parent and python fields of every struct
 // 2. populate indirectPackages to contain the packages of every ancestor
-func (cache *ImportCache) recursiveInit(node *ImportCacheNode, indirectPackages []string) {
+func (cache *ImportCache) recursiveInit(node *ImportCacheNode, python string, indirectPackages []string) {
+	node.python = python
 	node.indirectPackages = indirectPackages
 	for _, child := range node.Children {
 		child.parent = node
-		cache.recursiveInit(child, node.AllPackages())
+		cache.recursiveInit(child, python, node.AllPackages())
 	}
 }
 
@@ -142,14 +199,110 @@ func (cache *ImportCache) recursiveKill(node *ImportCacheNode) {
 	node.mutex.Unlock()
 }
 
-// (1) find Zygote and (2) use it to try creating a new Sandbox
-func (cache *ImportCache) Create(childSandboxPool sandbox.SandboxPool, isLeaf bool, codeDir, scratchDir string, meta *sandbox.SandboxMeta) (sandbox.Sandbox, error) {
-	node := cache.root.Lookup(meta.Installs)
+// (1) find Zygote and (2) use it to try creating a new Sandbox (for
+// the named lambda)
+//
+// Create latency is tracked separately by how well the Zygote matched
+// (exact, prefix, or other), so the benefit of better matches can be
+// seen in the stats.
+//
+// Also returns which Zygote was used, and how well the lambda's
+// ol-import hints fit the tree (see attribute), even on failure.
+func (cache *ImportCache) Create(childSandboxPool sandbox.SandboxPool, isLeaf bool, codeDir, scratchDir string, meta *sandbox.SandboxMeta, lambdaName string) (sandbox.Sandbox, *ZygoteAttribution, error) {
+	node, attr := cache.attribute(meta)
+	t := common.T0("ImportCache.Create/" + attr.Match)
+	defer t.T1()
+
+	atomic.AddInt64(&node.hits, 1)
+	node.usedBy(lambdaName)
+
+	log.Printf("Try using Zygote from <%v> (%s match)", node, attr.Match)
+	sb, err := cache.createChildSandboxFromNode(childSandboxPool, node, isLeaf, codeDir, scratchDir, meta)
+	return sb, attr, err
+}
+
+// find the Zygote for a lambda's Sandboxes (see Lookup), and check
+// whether different hints would have found a warmer one (importing
+// more of the lambda's packages)
+func (cache *ImportCache) attribute(meta *sandbox.SandboxMeta) (*ImportCacheNode, *ZygoteAttribution) {
+	// the ol-import list is in the order the lambda declared
+	// it, so it tells us which packages matter most to have
+	// pre-imported (the first ones are usually the base
+	// packages the others build on)
+	order := meta.Imports
+	if len(order) == 0 {
+		order = meta.Installs
+	}
+
+	root := cache.rootFor(meta.Python)
+	node := root.Lookup(meta.Installs, order)
 	if node == nil {
 		panic(fmt.Errorf("did not find Zygote; at least expected to find the root"))
 	}
-	log.Printf("Try using Zygote from <%v>", node)
-	return cache.createChildSandboxFromNode(childSandboxPool, node, isLeaf, codeDir, scratchDir, meta)
+
+	attr := &ZygoteAttribution{
+		Zygote:   node.AllPackages(),
+		Match:    "other",
+		Declared: meta.Imports,
+		Matched:  node.prefixMatch(meta.Imports),
+	}
+	if node.matchesExactly(meta.Installs) {
+		attr.Match = "exact"
+	} else if node.prefixMatch(order) > 0 {
+		attr.Match = "prefix"
+	}
+
+	installed := make(map[string]bool)
+	for _, p := range meta.Installs {
+		installed[p] = true
+	}
+
+	// the warmest Zygote the lambda could use, and the warmest
+	// it could use if it installed a few more packages
+	var usable, nearly *ImportCacheNode
+	var nearlyMissing []string
+	imported := make(map[string]bool)
+	root.walk(func(n *ImportCacheNode) {
+		for _, p := range n.Packages {
+			imported[normalizePkg(strings.Split(p, "==")[0])] = true
+		}
+
+		all := n.AllPackages()
+		missing := []string{}
+		for _, p := range all {
+			if !installed[p] {
+				missing = append(missing, p)
+			}
+		}
+		if len(missing) == 0 {
+			if usable == nil || len(all) > len(usable.AllPackages()) {
+				usable = n
+			}
+		} else if len(missing) <= ZYGOTE_HINT_MAX_MISSING {
+			if nearly == nil || len(all) > len(nearly.AllPackages()) {
+				nearly, nearlyMissing = n, missing
+			}
+		}
+	})
+
+	// (only if listing its packages first would really choose it)
+	warmest := len(attr.Zygote)
+	if usable != nil && len(usable.AllPackages()) > warmest && root.Lookup(meta.Installs, usable.AllPackages()) == usable {
+		attr.Better = usable.AllPackages()
+		warmest = len(attr.Better)
+	}
+	if nearly != nil && len(nearly.AllPackages()) > warmest {
+		attr.Missing = nearlyMissing
+		attr.MissingZygote = nearly.AllPackages()
+	}
+
+	for _, p := range meta.Imports {
+		if !imported[normalizePkg(strings.Split(p, "==")[0])] {
+			attr.Unused = append(attr.Unused, p)
+		}
+	}
+
+	return node, attr
 }
 
 // use getSandboxInNode to create a Zygote for the node (creating one
@@ -260,17 +413,20 @@ func (cache *ImportCache) putSandboxInNode(node *ImportCacheNode, sb sandbox.San
 func (cache *ImportCache) createSandboxInNode(node *ImportCacheNode) (err error) {
 	// populate codeDir/packages with deps, and record top-level mods)
 	if node.codeDir == "" {
-		codeDir := cache.codeDirs.Make("import-cache")
+		codeDir, err := cache.codeDirs.Make("import-cache")
+		if err != nil {
+			return err
+		}
 		// TODO: clean this up upon failure
 
-		installs, err := cache.pkgPuller.InstallRecursive(node.Packages)
+		installs, err := cache.pkgPuller.InstallRecursive(context.Background(), node.python, node.Packages)
 		if err != nil {
 			return err
 		}
 
 		topLevelMods := []string{}
 		for _, name := range node.Packages {
-			pkg, err := cache.pkgPuller.GetPkg(name)
+			pkg, err := cache.pkgPuller.GetPkg(context.Background(), node.python, name)
 			if err != nil {
 				return err
 			}
@@ -284,10 +440,14 @@ func (cache *ImportCache) createSandboxInNode(node *ImportCacheNode) (err error)
 		node.meta = &sandbox.SandboxMeta{
 			Installs: installs,
 			Imports:  topLevelMods,
+			Python:   node.python,
 		}
 	}
 
-	scratchDir := cache.scratchDirs.Make("import-cache")
+	scratchDir, err := cache.scratchDirs.Make("import-cache")
+	if err != nil {
+		return err
+	}
 	var sb sandbox.Sandbox
 	if node.parent != nil {
 		sb, err = cache.createChildSandboxFromNode(cache.sbPool, node.parent, false, node.codeDir, scratchDir, node.meta)
@@ -300,6 +460,7 @@ func (cache *ImportCache) createSandboxInNode(node *ImportCacheNode) (err error)
 	}
 
 	node.sb = sb
+	node.created = time.Now()
 	return nil
 }
 
@@ -309,7 +470,12 @@ func (node *ImportCacheNode) AllPackages() []string {
 	return append(node.indirectPackages[:n:n], node.Packages...)
 }
 
-func (node *ImportCacheNode) Lookup(packages []string) *ImportCacheNode {
+// find the best Zygote for a lambda needing the given packages.  Any
+// Zygote whose packages are a subset of those will work, but we
+// prefer (1) one importing exactly the packages needed, then (2) one
+// that imports the longest prefix of order, then (3) the deepest one
+// (as it has more packages pre-imported)
+func (node *ImportCacheNode) Lookup(packages []string, order []string) *ImportCacheNode {
 	// if this node imports a package that's not wanted by the
 	// lambda, neither this Zygote nor its children will work
 	for _, nodePkg := range node.Packages {
@@ -325,19 +491,273 @@ func (node *ImportCacheNode) Lookup(packages []string) *ImportCacheNode {
 		}
 	}
 
+	// FAST PATH: nothing could be better than this node
+	if node.matchesExactly(packages) {
+		return node
+	}
+
 	// check our descendents; is one of them a Zygote that works?
 	// we prefer a child Zygote over the one for this node,
 	// because they have more packages pre-imported
+	var best *ImportCacheNode = nil
+	bestPrefix := -1
 	for _, child := range node.Children {
-		result := child.Lookup(packages)
-		if result != nil {
+		result := child.Lookup(packages, order)
+		if result == nil {
+			continue
+		}
+		if result.matchesExactly(packages) {
 			return result
 		}
+
+		// on ties, the earlier child wins
+		if prefix := result.prefixMatch(order); prefix > bestPrefix {
+			best = result
+			bestPrefix = prefix
+		}
+	}
+
+	if best != nil {
+		return best
 	}
 
 	return node
 }
 
+// does this node (with its ancestors) import exactly these packages?
+func (node *ImportCacheNode) matchesExactly(packages []string) bool {
+	all := node.AllPackages()
+	if len(all) != len(packages) {
+		return false
+	}
+
+	want := make(map[string]bool)
+	for _, p := range packages {
+		want[p] = true
+	}
+	for _, p := range all {
+		if !want[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// how many of the leading entries in order does this node (with its
+// ancestors) import?
+func (node *ImportCacheNode) prefixMatch(order []string) int {
+	have := make(map[string]bool)
+	for _, p := range node.AllPackages() {
+		have[normalizePkg(strings.Split(p, "==")[0])] = true
+	}
+
+	n := 0
+	for _, p := range order {
+		if !have[normalizePkg(strings.Split(p, "==")[0])] {
+			break
+		}
+		n += 1
+	}
+	return n
+}
+
+// call fn for this node and all its descendents
+func (node *ImportCacheNode) walk(fn func(*ImportCacheNode)) {
+	fn(node)
+	for _, child := range node.Children {
+		child.walk(fn)
+	}
+}
+
+// how many packages a lambda may lack for a Zygote, for attribute to
+// suggest installing them
+const ZYGOTE_HINT_MAX_MISSING = 2
+
+// ZygoteAttribution describes the Zygote the import cache chose for a
+// lambda, and how the lambda's hints could choose a better one (see
+// Hints)
+type ZygoteAttribution struct {
+	Zygote   []string `json:"zygote"` // all its packages (none for the root)
+	Match    string   `json:"match"`  // exact, prefix, or other
+	Declared []string `json:"declared"`
+
+	// how many of the leading ol-import packages the Zygote imports
+	Matched int `json:"matched"`
+
+	// a warmer Zygote, that listing its packages first in
+	// ol-import would have chosen
+	Better []string `json:"better,omitempty"`
+
+	// packages that, if the lambda installed them too, would let
+	// it use the warmer MissingZygote
+	Missing       []string `json:"missing,omitempty"`
+	MissingZygote []string `json:"missing_zygote,omitempty"`
+
+	// ol-import packages that no Zygote in the tree imports
+	Unused []string `json:"unused,omitempty"`
+}
+
+func zygoteName(packages []string) string {
+	if len(packages) == 0 {
+		return "ROOT"
+	}
+	return strings.Join(packages, ",")
+}
+
+// suggestions for the lambda's author, about its ol-import and
+// ol-install lists
+func (attr *ZygoteAttribution) Hints() []string {
+	hints := []string{}
+	if len(attr.Better) > 0 {
+		chosen := make(map[string]bool)
+		for _, p := range attr.Zygote {
+			chosen[p] = true
+		}
+		add := []string{}
+		for _, p := range attr.Better {
+			if !chosen[p] {
+				add = append(add, p)
+			}
+		}
+		hints = append(hints, fmt.Sprintf("ol-import hint missed: listing %s first would have selected a warmer Zygote (%s)",
+			strings.Join(add, ","), zygoteName(attr.Better)))
+	}
+	if len(attr.Missing) > 0 {
+		hints = append(hints, fmt.Sprintf("installing %s would have enabled a warmer Zygote (%s)",
+			strings.Join(attr.Missing, ","), zygoteName(attr.MissingZygote)))
+	}
+	if len(attr.Unused) > 0 {
+		hints = append(hints, fmt.Sprintf("imports %s are declared but never used by the Zygote tree",
+			strings.Join(attr.Unused, ",")))
+	}
+	return hints
+}
+
+// how many of the lambdas that most recently used a node to remember
+const ZYGOTE_RECENT_LAMBDAS = 5
+
+// remember that a lambda used this node's Zygote
+func (node *ImportCacheNode) usedBy(lambdaName string) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	recent := []string{lambdaName}
+	for _, name := range node.recentLambdas {
+		if name != lambdaName && len(recent) < ZYGOTE_RECENT_LAMBDAS {
+			recent = append(recent, name)
+		}
+	}
+	node.recentLambdas = recent
+}
+
+// ZygoteInfo describes a node in the import cache tree (see DebugTree)
+type ZygoteInfo struct {
+	Packages         []string      `json:"packages"`
+	IndirectPackages []string      `json:"indirect_packages"`
+	Python           string        `json:"python,omitempty"`
+	Live             bool          `json:"live"`
+	MemMB            int           `json:"mem_mb"` // -1 if unknown
+	Created          *time.Time    `json:"created,omitempty"`
+	Hits             int64         `json:"hits"`
+	Forks            int64         `json:"forks"`
+	RecentLambdas    []string      `json:"recent_lambdas"`
+	Children         []*ZygoteInfo `json:"children"`
+}
+
+// DebugTree describes the Zygote tree (one per Python version in
+// use), for tuning the import cache
+func (cache *ImportCache) DebugTree() []*ZygoteInfo {
+	cache.mutex.Lock()
+	roots := []*ImportCacheNode{}
+	for _, root := range cache.roots {
+		roots = append(roots, root)
+	}
+	cache.mutex.Unlock()
+
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i].python < roots[j].python
+	})
+
+	infos := []*ZygoteInfo{}
+	for _, root := range roots {
+		infos = append(infos, root.info())
+	}
+	return infos
+}
+
+func (node *ImportCacheNode) info() *ZygoteInfo {
+	info := &ZygoteInfo{
+		Packages:         node.Packages,
+		IndirectPackages: node.indirectPackages,
+		Python:           node.python,
+		MemMB:            -1,
+		Hits:             atomic.LoadInt64(&node.hits),
+		Forks:            atomic.LoadInt64(&node.createLeafChild) + atomic.LoadInt64(&node.createNonleafChild),
+		Children:         []*ZygoteInfo{},
+	}
+
+	node.mutex.Lock()
+	if node.sb != nil {
+		info.Live = true
+		created := node.created
+		info.Created = &created
+		if stat, err := node.sb.Status(sandbox.StatusMemUsageMB); err == nil {
+			if mb, err := strconv.Atoi(stat); err == nil {
+				info.MemMB = mb
+			}
+		}
+	}
+	info.RecentLambdas = append([]string{}, node.recentLambdas...)
+	node.mutex.Unlock()
+
+	for _, child := range node.Children {
+		info.Children = append(info.Children, child.info())
+	}
+	return info
+}
+
+// DebugTreeString draws the Zygote tree (see DebugTree) as text
+func (cache *ImportCache) DebugTreeString() string {
+	s := ""
+	for _, root := range cache.DebugTree() {
+		if root.Python == "" {
+			s += "IMPORT CACHE TREE:\n"
+		} else {
+			s += fmt.Sprintf("IMPORT CACHE TREE (Python %s):\n", root.Python)
+		}
+		s += root.treeString("", "")
+	}
+	return s
+}
+
+func (info *ZygoteInfo) treeString(prefix, childPrefix string) string {
+	name := zygoteName(info.Packages)
+
+	mem := "-"
+	if info.MemMB >= 0 {
+		mem = fmt.Sprintf("%d MB", info.MemMB)
+	}
+	state := "not live"
+	if info.Live {
+		state = "live since " + info.Created.Format(time.RFC3339)
+	}
+
+	s := fmt.Sprintf("%s%s [hits=%d, forks=%d, mem=%s, %s]", prefix, name, info.Hits, info.Forks, mem, state)
+	if len(info.RecentLambdas) > 0 {
+		s += " recent: " + strings.Join(info.RecentLambdas, ",")
+	}
+	s += "\n"
+
+	for i, child := range info.Children {
+		if i == len(info.Children)-1 {
+			s += child.treeString(childPrefix+"└── ", childPrefix+"    ")
+		} else {
+			s += child.treeString(childPrefix+"├── ", childPrefix+"│   ")
+		}
+	}
+	return s
+}
+
 func (node *ImportCacheNode) String() string {
 	s := strings.Join(node.Packages, ",")
 	if s == "" {
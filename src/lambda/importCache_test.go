@@ -0,0 +1,62 @@
+package lambda
+
+import (
+	"testing"
+)
+
+// a Zygote tree, as it would be read from the import cache config
+func testZygoteTree() *ImportCacheNode {
+	root := &ImportCacheNode{
+		Children: []*ImportCacheNode{
+			{Packages: []string{"requests"}},
+			{Packages: []string{"scipy"}},
+			{
+				Packages: []string{"numpy"},
+				Children: []*ImportCacheNode{
+					{Packages: []string{"pandas"}},
+					{Packages: []string{"matplotlib"}},
+				},
+			},
+		},
+	}
+	(&ImportCache{}).recursiveInit(root, "", []string{})
+	return root
+}
+
+func TestZygoteLookup(t *testing.T) {
+	tests := []struct {
+		packages []string
+		order    []string
+		want     string
+	}{
+		// an exact match wins, wherever it is
+		{[]string{"requests"}, nil, "requests"},
+		{[]string{"pandas", "numpy"}, []string{"pandas", "numpy"}, "pandas [indirect: numpy]"},
+
+		// the longest prefix of the import order wins over
+		// Zygotes that match less of it (even earlier ones)
+		{[]string{"numpy", "pandas", "requests", "scipy"}, []string{"numpy", "pandas", "requests", "scipy"}, "pandas [indirect: numpy]"},
+		{[]string{"numpy", "pandas", "matplotlib"}, []string{"numpy", "matplotlib", "pandas"}, "matplotlib [indirect: numpy]"},
+		{[]string{"numpy", "scipy"}, []string{"scipy", "numpy"}, "scipy"},
+		{[]string{"numpy", "scipy"}, []string{"numpy", "scipy"}, "numpy"},
+
+		// versions and spelling don't affect the prefix
+		{[]string{"numpy", "pandas", "scipy"}, []string{"NumPy==1.26.4", "pandas", "scipy"}, "pandas [indirect: numpy]"},
+
+		// with no prefix matched, the earliest Zygote that works
+		{[]string{"requests", "scipy", "flask"}, []string{"flask"}, "requests"},
+
+		// nothing else works
+		{[]string{"flask"}, []string{"flask"}, "ROOT"},
+	}
+
+	root := testZygoteTree()
+	for _, test := range tests {
+		node := root.Lookup(test.packages, test.order)
+		if node == nil {
+			t.Errorf("%v %v: no Zygote", test.packages, test.order)
+		} else if got := node.String(); got != test.want {
+			t.Errorf("%v %v: got %s, expected %s", test.packages, test.order, got, test.want)
+		}
+	}
+}
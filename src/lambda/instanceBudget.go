@@ -0,0 +1,155 @@
+package lambda
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// a lambda's traffic score (requests received, decayed) halves over
+// this long, so it reflects recent traffic
+const INSTANCE_BUDGET_HALF_LIFE = time.Minute
+
+// how often the lambdas that must give up instances are chosen again,
+// while over budget
+const INSTANCE_BUDGET_RANK_INTERVAL = time.Second
+
+// instanceBudget keeps the number of instances (i.e., virtual
+// sandboxes, whether or not they have a Sandbox right now) across all
+// of the worker's lambdas within Limits.Max_instances.  Each lambda's
+// Task reports how many instances it has, and how many requests it
+// received, and consults the budget before scaling up.
+//
+// A lambda with no instances may always start one (or its requests
+// would wait forever), which can put the worker over budget.  While
+// over budget, the least busy lambdas give up instances (even below
+// one, if idle), so busy lambdas keep theirs.
+type instanceBudget struct {
+	mutex sync.Mutex
+	total int
+	funcs map[*LambdaFunc]*budgetEntry
+
+	// lambdas that must give up instances (see rank)
+	shed     map[*LambdaFunc]bool
+	rankedAt time.Time
+}
+
+type budgetEntry struct {
+	instances int
+	score     float64
+	updated   time.Time
+}
+
+func newInstanceBudget() *instanceBudget {
+	return &instanceBudget{
+		funcs: make(map[*LambdaFunc]*budgetEntry),
+		shed:  make(map[*LambdaFunc]bool),
+	}
+}
+
+// the cap on instances (0 for none); Limits may change with Reload
+func (b *instanceBudget) limit() int {
+	return common.Conf.Limits.Max_instances
+}
+
+// the entry's score, decayed to now
+func (e *budgetEntry) decayed(now time.Time) float64 {
+	halfLives := float64(now.Sub(e.updated)) / float64(INSTANCE_BUDGET_HALF_LIFE)
+	return e.score * math.Pow(0.5, halfLives)
+}
+
+// f now has this many instances, and received arrivals requests since
+// its last report
+func (b *instanceBudget) report(f *LambdaFunc, instances int, arrivals int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	e, ok := b.funcs[f]
+	if !ok {
+		e = &budgetEntry{updated: now}
+		b.funcs[f] = e
+	}
+	b.total += instances - e.instances
+	e.instances = instances
+	e.score = e.decayed(now) + float64(arrivals)
+	e.updated = now
+
+	common.SetGauge("instances/total", int64(b.total))
+	common.SetGauge("instances/cap", int64(b.limit()))
+}
+
+// forget f (once its Task exits, with no instances)
+func (b *instanceBudget) remove(f *LambdaFunc) {
+	b.report(f, 0, 0)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.funcs, f)
+	delete(b.shed, f)
+}
+
+// may f start another instance?
+func (b *instanceBudget) mayGrow(f *LambdaFunc) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	limit := b.limit()
+	if limit <= 0 || b.total < limit {
+		return true
+	}
+	if e := b.funcs[f]; e == nil || e.instances == 0 {
+		return true
+	}
+	common.IncCounter("instances/budget-denied")
+	return false
+}
+
+// must f give up instances, because the worker is over budget and f
+// is among the least busy lambdas that have some?
+func (b *instanceBudget) mustShrink(f *LambdaFunc) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	limit := b.limit()
+	if limit <= 0 || b.total <= limit {
+		return false
+	}
+	if time.Since(b.rankedAt) >= INSTANCE_BUDGET_RANK_INTERVAL {
+		b.rank(b.total - limit)
+	}
+	return b.shed[f]
+}
+
+// choose the least busy lambdas, with enough instances between them
+// to cover the excess
+func (b *instanceBudget) rank(excess int) {
+	now := time.Now()
+	type candidate struct {
+		f         *LambdaFunc
+		instances int
+		score     float64
+	}
+	candidates := []candidate{}
+	for f, e := range b.funcs {
+		if e.instances > 0 {
+			candidates = append(candidates, candidate{f, e.instances, e.decayed(now)})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score < candidates[j].score
+	})
+
+	b.shed = make(map[*LambdaFunc]bool)
+	for _, c := range candidates {
+		if excess <= 0 {
+			break
+		}
+		b.shed[c.f] = true
+		excess -= c.instances
+	}
+	b.rankedAt = now
+}
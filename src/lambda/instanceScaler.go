@@ -0,0 +1,286 @@
+package lambda
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// how long a lambda waits between adjustments to its number of
+// instances: a second, plus up to Scaling.Adjust_jitter_ms
+func scalingInterval() time.Duration {
+	interval := time.Second
+	if jitterMs := common.Conf.Scaling.Adjust_jitter_ms; jitterMs > 0 {
+		interval += time.Duration(rand.Int63n(jitterMs)) * time.Millisecond
+	}
+	return interval
+}
+
+// instanceScaler decides how many instances a LambdaFunc's current
+// code should have (see Autoscaler), and gets there one instance at a
+// time, at most once per scalingInterval.  It counts the requests
+// dispatched to instances, and reports to the worker's instance
+// budget.
+//
+// Only the LambdaFunc's Task uses it, so there's no locking.
+type instanceScaler struct {
+	f *LambdaFunc
+
+	// Each request dispatched to an instChan (via pending)
+	// increments outstanding, and is decremented exactly once when
+	// it comes back on doneChan (or is taken back out of pending
+	// or an instChan that will no longer be served; see withdraw)
+	outstanding int
+
+	// the last adjustment, and the last that added an instance
+	// (see Scaling.Scale_down_cooldown_ms)
+	lastScaling *time.Time
+	lastScaleUp time.Time
+
+	// minimum time between scaling adjustments (with jitter,
+	// re-rolled after each adjustment)
+	adjustFreq time.Duration
+
+	// wakes the Task to continue scaling
+	timeout *time.Timer
+
+	// when a request last arrived or finished (see
+	// Features.Scale_to_zero)
+	lastActive time.Time
+
+	// requests received since the last report to the instance
+	// budget (see report)
+	arrivals int
+
+	// see reconcile
+	lastDrift int
+}
+
+func newInstanceScaler(f *LambdaFunc) *instanceScaler {
+	return &instanceScaler{
+		f:          f,
+		adjustFreq: scalingInterval(),
+		timeout:    time.NewTimer(0),
+		lastActive: time.Now(),
+	}
+}
+
+// a request arrived
+func (s *instanceScaler) arrived() {
+	s.lastActive = time.Now()
+	s.arrivals += 1
+}
+
+// a request was dispatched to an instChan
+func (s *instanceScaler) dispatched() {
+	s.outstanding += 1
+}
+
+// a dispatched request came back on doneChan
+func (s *instanceScaler) finished() {
+	s.lastActive = time.Now()
+	s.outstanding -= 1
+	if s.outstanding < 0 {
+		s.f.warnf("more requests finished than were dispatched")
+		s.outstanding = 0
+	}
+}
+
+// a dispatched request was taken back out of pending or an instChan
+func (s *instanceScaler) withdraw() {
+	s.outstanding -= 1
+}
+
+// the count of requests actually in flight is only approximate, as
+// requests move between chans and instances concurrently with this
+// check.  So we only correct outstanding if it is off by the same
+// amount twice in a row
+func (s *instanceScaler) reconcile(pending *invocationQueue) {
+	f := s.f
+	inFlight := pending.Len() + len(f.instChan) + len(f.doneChan) + int(atomic.LoadInt64(&f.serving))
+	if f.canary != nil {
+		inFlight += len(f.canary.instChan)
+	}
+
+	drift := s.outstanding - inFlight
+	if drift != 0 && drift == s.lastDrift {
+		f.warnf("outstanding request count drifted by %d (counted %d, %d in flight), correcting",
+			drift, s.outstanding, inFlight)
+		common.IncCounter("lambda/" + f.name + "/outstanding-drift")
+		s.outstanding = inFlight
+		drift = 0
+	}
+	s.lastDrift = drift
+}
+
+// tell the instance budget how many instances we have (of both code
+// versions), and how busy we've been
+func (s *instanceScaler) report() {
+	f := s.f
+	n := f.instances.Len()
+	if f.canary != nil {
+		n += f.canary.instances.Len()
+	}
+	f.lmgr.instanceBudget.report(f, n, s.arrivals)
+	s.arrivals = 0
+}
+
+// have n instances ready (with their Sandboxes created) for the
+// current code, and keep them from being scaled down right away
+func (s *instanceScaler) prewarm(n int) {
+	f := s.f
+	s.lastActive = time.Now()
+	if f.instances.Len() < n {
+		f.debugf("prewarm %d instances", n-f.instances.Len())
+		s.lastScaleUp = s.lastActive
+	}
+	for f.instances.Len() < n {
+		f.startInstance(f.codeDir, f.meta, f.instChan, f.instances, true)
+	}
+}
+
+// how many instances the current code should have, given the average
+// execution time, how long until the function may scale to zero (if
+// it may), and whether the worker has more instances than its budget
+func (s *instanceScaler) desired(avgExecMs int, breaker *circuitBreaker) (desired int, idleLeft time.Duration, overBudget bool) {
+	f := s.f
+
+	// AUTOSCALING STEP 1: decide how many instances we want
+	// (see Autoscaler)
+	desired = f.autoscaler.Desired(ScalingStats{
+		OutstandingReqs: s.outstanding,
+		AvgExecMs:       avgExecMs,
+		Instances:       f.instances.Len(),
+		Concurrency:     sandboxConcurrency(f.meta),
+		Idle:            time.Since(s.lastActive),
+	})
+
+	// always try to have one instance, unless the function
+	// may scale to zero, and has been idle long enough
+	if desired < 1 {
+		if s.outstanding > 0 || !scaleToZero(f.meta) {
+			desired = 1
+		} else {
+			idle := time.Duration(common.Conf.Limits.Scale_to_zero_idle_ms) * time.Millisecond
+			if idleLeft = idle - time.Since(s.lastActive); idleLeft > 0 {
+				desired = 1
+			}
+		}
+	}
+
+	// while the circuit breaker isn't closed, new instances
+	// would likely fail too (but the probe needs one)
+	if breaker.frozen() && desired > f.instances.Len() {
+		desired = common.Max(f.instances.Len(), 1)
+	}
+
+	// stay within the worker's instance budget (see
+	// Limits.Max_instances): no new instances while it is
+	// used up, and fewer (down to none, if idle) while it is
+	// exceeded and this is among the least busy lambdas
+	budget := f.lmgr.instanceBudget
+	if desired > f.instances.Len() && !budget.mayGrow(f) {
+		desired = f.instances.Len()
+	}
+	overBudget = budget.mustShrink(f)
+	if overBudget {
+		floor := 0
+		if s.outstanding > 0 {
+			floor = 1
+		}
+		desired = common.Min(desired, common.Max(f.instances.Len()-1, floor))
+	}
+
+	return desired, idleLeft, overBudget
+}
+
+// may another adjustment be made yet (see adjustFreq)?
+func (s *instanceScaler) due() bool {
+	return s.lastScaling == nil || time.Since(*s.lastScaling) >= s.adjustFreq
+}
+
+// an adjustment is being made now
+func (s *instanceScaler) adjusting() {
+	now := time.Now()
+	s.lastScaling = &now
+	s.adjustFreq = scalingInterval()
+}
+
+// run the Task again after d, even if nothing else happens
+func (s *instanceScaler) wakeAfter(d time.Duration) {
+	s.timeout = time.NewTimer(d)
+}
+
+// AUTOSCALING STEP 2: tweak how many instances we have, to get closer
+// to desired (and canaryDesired for the canary; see rollout)
+func (s *instanceScaler) scale(desired, canaryDesired int, idleLeft time.Duration, overBudget bool,
+	cleanup *cleanupQueue, feed func()) {
+	f := s.f
+	scaled := func() bool {
+		return f.instances.Len() == desired &&
+			(f.canary == nil || f.canary.instances.Len() == canaryDesired)
+	}
+
+	// make at most one scaling adjustment per adjustFreq
+	now := time.Now()
+	if s.lastScaling != nil {
+		elapsed := now.Sub(*s.lastScaling)
+		if elapsed < s.adjustFreq {
+			if !scaled() {
+				s.wakeAfter(s.adjustFreq - elapsed)
+			}
+			return
+		}
+	}
+
+	cooldown := time.Duration(common.Conf.Scaling.Scale_down_cooldown_ms) * time.Millisecond
+	coolingDown := now.Sub(s.lastScaleUp) < cooldown && !overBudget
+
+	// kill or start at most one instance to get closer to
+	// desired number
+	adjusted := false
+	if f.instances.Len() < desired {
+		f.infof("increase instances to %d", f.instances.Len()+1)
+		f.newInstance()
+		feed()
+		adjusted = true
+		s.lastScaleUp = now
+	} else if f.instances.Len() > desired && !coolingDown {
+		f.infof("reduce instances to %d", f.instances.Len()-1)
+		cleanup.kill(f.instances.Remove(f.instances.Back()).(*LambdaInstance))
+		adjusted = true
+	}
+
+	if f.canary != nil {
+		if n := f.canary.instances.Len(); n < canaryDesired {
+			f.infof("increase canary instances to %d", n+1)
+			f.startInstance(f.canary.codeDir, f.canary.meta, f.canary.instChan, f.canary.instances, false)
+			feed()
+			adjusted = true
+			s.lastScaleUp = now
+		} else if n > canaryDesired && !coolingDown {
+			f.infof("reduce canary instances to %d", n-1)
+			cleanup.kill(f.canary.instances.Remove(f.canary.instances.Back()).(*LambdaInstance))
+			adjusted = true
+		}
+	}
+
+	if adjusted {
+		s.lastScaling = &now
+		s.adjustFreq = scalingInterval()
+		s.report()
+	}
+
+	if !scaled() {
+		// we can only adjust quickly, so we want to run
+		// through this loop again as soon as possible, even
+		// if there are no requests to service.
+		s.wakeAfter(s.adjustFreq)
+	} else if idleLeft > 0 && f.instances.Len() > 0 {
+		// check again once the function has been idle long
+		// enough to scale to zero
+		s.wakeAfter(idleLeft)
+	}
+}
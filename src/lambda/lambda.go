@@ -2,16 +2,24 @@ package lambda
 
 import (
 	"bufio"
+	"bytes"
 	"container/list"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
@@ -28,13 +36,56 @@ type LambdaMgr struct {
 	*ImportCache   // depends PackagePuller
 	*HandlerPuller // depends on sbPool and ImportCache[optional]
 
+	// depends on sbPool (nil if disabled)
+	warmPool *WarmPool
+
 	// storage dirs that we manage
 	codeDirs    *common.DirMaker
 	scratchDirs *common.DirMaker
 
+	*Recorder
+
+	// records invocations of audited lambdas
+	auditor *Auditor
+
 	// thread-safe map from a lambda's name to its LambdaFunc
-	mapMutex sync.Mutex
+	// (lookups of existing functions only need the read lock)
+	mapMutex sync.RWMutex
 	lfuncMap map[string]*LambdaFunc
+
+	// goroutine ID -> description of the task it runs (see
+	// DumpGoroutines)
+	goroutines sync.Map
+
+	// consumers of Conf.Event_sources
+	eventSources []*eventSourceRunner
+
+	// creates each LambdaFunc's Autoscaler
+	newAutoscaler func() Autoscaler
+
+	// other workers that requests may be forwarded to (nil if
+	// there are none)
+	peers *peerSet
+
+	// watches for the worker running out of disk
+	disk *diskWatcher
+
+	// limits concurrent code pulls (nil for no limit)
+	pulls *pullPool
+
+	// limits instances across all lambdas (see Limits.Max_instances)
+	instanceBudget *instanceBudget
+
+	// deploy events, for tooling (see SubscribeEvents)
+	events *EventBus
+
+	// the import cache may be enabled or disabled by Reload, so
+	// the embedded ImportCache is accessed with this held (see
+	// CurrentImportCache)
+	importCacheMutex sync.RWMutex
+
+	// serializes Reload calls
+	reloadMutex sync.Mutex
 }
 
 // Represents a single lambda function (the code)
@@ -42,20 +93,120 @@ type LambdaFunc struct {
 	lmgr *LambdaMgr
 	name string
 
+	// a common.LogLevel (accessed atomically)
+	logLevel int32
+
 	// lambda code
 	lastPull *time.Time
 	codeDir  string
+
+	// after failed pulls, we back off before pulling again
+	pullFailures int
+	pullRetryAt  time.Time
+	pullErr      error
+
+	codeHash string // see hashCodeDir
 	meta     *sandbox.SandboxMeta
 
+	// packages the current code runs with (see Dependencies)
+	depsMutex sync.Mutex
+	deps      *DependencyReport
+
+	// numbers of instances with a hot (never paused) or paused
+	// Sandbox, reported in Stats (accessed atomically)
+	numHot    int32
+	numPaused int32
+
+	// the Task's view of the instance count and average execution
+	// time, for estimating queue delays (accessed atomically)
+	numInstances int32
+	avgExecMs    int64
+
+	// memory (MB) used by all the instances' Sandboxes, as of
+	// their last measurement (accessed atomically)
+	memMB int64
+
+	// requests instances have taken from their instChan, but not
+	// yet handed back on doneChan (accessed atomically)
+	serving int64
+
+	// the Task's count of requests dispatched to instances but not
+	// yet done, as of its last autoscaling step (accessed
+	// atomically)
+	numOutstanding int32
+
+	// rate limits warnings about import cache fallbacks
+	fallbackLog logLimiter
+
+	// the last invocations to finish (see RecentRequests)
+	recentRequests requestLog
+
+	// responses to GET requests, for lambdas with ol-cache-ttl
+	respCache responseCache
+
+	// 1 while the first code is having its packages installed
+	// (accessed atomically)
+	installing int32
+
+	// what the current code (or the canary) declares about
+	// requests, so they can be answered before they are queued
+	// (see publishPolicy): the methods it accepts, as a []string
+	// (nil for all), and its *corsPolicy (nil without ol-cors)
+	methods atomic.Value
+	cors    atomic.Value
+
+	// whether ol-audit turns auditing on or off (*bool, nil to
+	// follow Features.Audit_invocations; see publishPolicy)
+	audit atomic.Value
+
 	// lambda execution
 	funcChan  chan *Invocation // server to func
 	instChan  chan *Invocation // func to instances
 	doneChan  chan *Invocation // instances to func
 	instances *list.List
 
+	// newer code being tried on a fraction of the traffic (only
+	// accessed by Task, may be nil)
+	canary *canaryVersion
+
+	// send the canary weight to this chan (see SetCanaryWeight)
+	canaryChan chan float64
+
+	// send a chan to this to have the code pulled and an instance
+	// readied, then wait for the pull's error on it (see Prewarm)
+	warmChan chan *warmRequest
+
+	// send a chan to this to have all instances killed (but not
+	// the function), then wait for how many there were on it (see
+	// Evict)
+	evictChan chan chan int
+
 	// send chan to the kill chan to destroy the instance, then
 	// wait for msg on sent chan to block until it is done
 	killChan chan chan bool
+
+	// how many instances should we have?  (only used by Task)
+	autoscaler Autoscaler
+
+	// closed (with LambdaMgr.mapMutex held) once the function is
+	// removed from lfuncMap and its Task is exiting (see retire)
+	retired chan bool
+
+	// closed once the Task has exited.  A retired function's Task
+	// may still be handing its queued requests to the function
+	// that replaces it, which needs LambdaMgr.mapMutex
+	exited chan bool
+}
+
+// a newer version of a lambda's code, with its own instances, that
+// runs alongside the current version during a canary deployment
+type canaryVersion struct {
+	codeDir   string
+	codeHash  string
+	meta      *sandbox.SandboxMeta
+	resolved  map[string]string
+	instChan  chan *Invocation
+	instances *list.List
 }
 
 // This is essentially a virtual sandbox.  It is backed by a real
@@ -68,9 +219,23 @@ type LambdaInstance struct {
 	codeDir string
 	meta    *sandbox.SandboxMeta
 
+	// requests for the code version this instance runs
+	instChan chan *Invocation
+
+	// keep the Sandbox unpaused between requests
+	hot bool
+
+	// create the Sandbox before the first request (see Prewarm)
+	prewarm bool
+
 	// send chan to the kill chan to destroy the instance, then
-	// wait for msg on sent chan to block until it is done
+	// wait for msg on sent chan to block until it is done (see
+	// AsyncKill)
 	killChan chan chan bool
+
+	// closed when Task returns, so kills sent after that (which
+	// it will never receive) don't wait forever
+	exited chan bool
 }
 
 // represents an HTTP request to be handled by a lambda instance
@@ -78,14 +243,160 @@ type Invocation struct {
 	w http.ResponseWriter
 	r *http.Request
 
+	// unique within this worker (sent to the client in the
+	// X-OL-Invocation-Id header)
+	id string
+
+	// when the request arrived
+	start time.Time
+
+	// the version of the code the request was dispatched to
+	codeDir string
+
+	// how long the response may be cached, if it can be (see
+	// responseCache)
+	cacheTtlMs int64
+
+	// wraps the original w, recording the status sent to the client
+	sw *statusWriter
+
+	// wraps the original r.Body, counting the bytes read from it
+	body *countingReader
+
+	// the whole body, if it was small enough to buffer (see
+	// Limits.Max_retryable_body_bytes), else nil
+	bodyBuf *bufferedBody
+
+	// was it already sent to a Sandbox that died (it is only
+	// retried once)?
+	retried bool
+
 	// signal to client that response has been written to w
 	done chan bool
 
 	// how many milliseconds did ServeHTTP take?  (doesn't count
 	// queue time or Sandbox init)
 	execMs int
+
+	// how many milliseconds it waited before an instance claimed it
+	queueMs int
+
+	// CPU time (user+sys microseconds) used in the Sandbox, or -1
+	// if unknown (see Features.Cpu_accounting)
+	cpuUs int64
+
+	// did the invocation fail (5xx response or timeout)?
+	error bool
+
+	// did it fail because its instance could not start a Sandbox
+	// (see Limits.Start_failure_budget)?
+	startFailed bool
+
+	// higher priority requests are dispatched to instances first
+	// (see PRIORITY_HEADER)
+	priority int
+
+	// INVOCATION_QUEUED until an instance claims it, or it waits
+	// longer than Max_queue_ms (accessed atomically)
+	state      int32
+	queueTimer *time.Timer
+}
+
+const (
+	INVOCATION_QUEUED  = 0
+	INVOCATION_STARTED = 1
+	INVOCATION_EXPIRED = 2
+)
+
+// claim the invocation, in order to respond to it.  Returns false if
+// it was already claimed, or expired in the queue (and the client got
+// a 503).
+func (req *Invocation) claim() bool {
+	if !atomic.CompareAndSwapInt32(&req.state, INVOCATION_QUEUED, INVOCATION_STARTED) {
+		return false
+	}
+	if req.queueTimer != nil {
+		req.queueTimer.Stop()
+	}
+	req.queueMs = int(time.Since(req.start).Milliseconds())
+	return true
 }
 
+// reset the request body, to send it again; false if it wasn't
+// buffered
+func (req *Invocation) rewind() bool {
+	if req.bodyBuf == nil {
+		return false
+	}
+	req.r.Body = req.bodyBuf.reader()
+	return true
+}
+
+// respond to the invocation with a 503 (or forward it to a peer, see
+// LambdaFunc.forward), if it is still queued after d (the client
+// doesn't need to wait for an instance to dequeue it)
+func (f *LambdaFunc) expireAfter(req *Invocation, d time.Duration, msg string) {
+	req.queueTimer = time.AfterFunc(d, func() {
+		if atomic.CompareAndSwapInt32(&req.state, INVOCATION_QUEUED, INVOCATION_EXPIRED) {
+			if !f.forward(req) {
+				req.fail(http.StatusServiceUnavailable, ERR_QUEUE_TIMEOUT, msg, nil)
+			}
+			req.done <- true
+		}
+	})
+}
+
+// remembers the status code of a response as it is written
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64 // bytes of body
+
+	// copy of the body, for the response cache (see startCapture)
+	capture *bytes.Buffer
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 && !informational(status) {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.written += int64(n)
+	if sw.capture != nil {
+		if sw.capture.Len()+n > RESPONSE_CACHE_MAX_BODY {
+			sw.capture = nil
+		} else {
+			sw.capture.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+// counts the bytes read from a request body (without buffering it)
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+// invocation IDs are "<boot>-<n>", where boot identifies the worker
+// process (by its start time), so that an ID (e.g., of a recording
+// saved to disk) is never reused after a restart
+var invocationIdPrefix = strconv.FormatInt(time.Now().UnixNano(), 36) + "-"
+var nextInvocationId int64 = 0
+
 // Timeout broker manages automatic timeout for lambda
 type TimeoutBroker struct {
 	// Suicide timer- i.e. when this timer expires, it will cause the Lambda Instance
@@ -95,9 +406,13 @@ type TimeoutBroker struct {
 	// Corresponding instance (to destroy)
 	linst *LambdaInstance
 
-	// Cancel function
+	// Cancel function for the current request's context
 	cancel func()
 
+	// when the current request's time is up; a timer that fires
+	// before this is left over from an earlier request
+	deadline time.Time
+
 	// True if timeout occurred, default set to false,
 	// These mostly act as CVs for synchronization
 	timedout     bool
@@ -108,6 +423,10 @@ type TimeoutBroker struct {
 	destlock sync.Mutex
 }
 
+// creates the LambdaMgr's SandboxPool (tests replace it, to run
+// lambdas without real Sandboxes)
+var newSandboxPool = sandbox.SandboxPoolFromConfig
+
 func NewLambdaMgr() (res *LambdaMgr, err error) {
 	mgr := &LambdaMgr{
 		lfuncMap: make(map[string]*LambdaFunc),
@@ -119,6 +438,11 @@ func NewLambdaMgr() (res *LambdaMgr, err error) {
 		}
 	}()
 
+	mgr.newAutoscaler, err = autoscalerFactory(common.Conf.Scaling.Autoscaler)
+	if err != nil {
+		return nil, err
+	}
+
 	mgr.codeDirs, err = common.NewDirMaker("code", common.Conf.Storage.Code.Mode())
 	if err != nil {
 		return nil, err
@@ -129,11 +453,13 @@ func NewLambdaMgr() (res *LambdaMgr, err error) {
 	}
 
 	log.Printf("Create SandboxPool")
-	mgr.sbPool, err = sandbox.SandboxPoolFromConfig("sandboxes", common.Conf.Mem_pool_mb)
+	mgr.sbPool, err = newSandboxPool("sandboxes", common.Conf.Mem_pool_mb)
 	if err != nil {
 		return nil, err
 	}
 
+	mgr.warmPool = NewWarmPool(mgr.sbPool, mgr.codeDirs, mgr.scratchDirs)
+
 	log.Printf("Create DepTracer")
 	mgr.DepTracer, err = NewDepTracer(filepath.Join(common.Conf.Worker_dir, "dep-trace.json"))
 	if err != nil {
@@ -154,65 +480,256 @@ func NewLambdaMgr() (res *LambdaMgr, err error) {
 		}
 	}
 
+	log.Printf("Create Recorder")
+	mgr.Recorder, err = NewRecorder(filepath.Join(common.Conf.Worker_dir, "recordings"))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Create Auditor")
+	mgr.auditor, err = NewAuditor(&common.Conf.Audit)
+	if err != nil {
+		return nil, err
+	}
+
 	log.Printf("Create HandlerPuller")
-	mgr.HandlerPuller, err = NewHandlerPuller(mgr.codeDirs)
+	source, err := NewCodeSource(common.Conf.Code_source, common.Conf.Registry, mgr.codeDirs)
 	if err != nil {
 		return nil, err
 	}
+	mgr.HandlerPuller, err = NewHandlerPuller(source)
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.peers = newPeerSet(common.Conf.Peers)
+	mgr.disk = newDiskWatcher(common.Conf.Worker_dir, common.Conf.Limits.Min_free_disk_mb)
+	mgr.pulls = newPullPool(common.Conf.Limits.Pull_concurrency)
+	mgr.instanceBudget = newInstanceBudget()
+	mgr.events = NewEventBus()
+
+	for _, conf := range common.Conf.Event_sources {
+		log.Printf("Start %s event source for %s", conf.Type, conf.Lambda)
+		runner, err := mgr.startEventSource(conf)
+		if err != nil {
+			return nil, err
+		}
+		mgr.eventSources = append(mgr.eventSources, runner)
+	}
 
 	return mgr, nil
 }
 
-// Returns an existing instance (if there is one), or creates a new one
-func (mgr *LambdaMgr) Get(name string) (f *LambdaFunc) {
+// lambda names end up in paths (e.g., of code and scratch dirs), so
+// they are limited to characters that are safe there
+var validLambdaName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9\.\-_]*$`)
+
+// ValidateName checks that a lambda name is safe to use (e.g., it
+// can't escape a directory, as in "../x")
+func ValidateName(name string) error {
+	if len(name) > 255 {
+		return fmt.Errorf("lambda name '%.32s...' is longer than 255 characters", name)
+	}
+	if !validLambdaName.MatchString(name) {
+		return fmt.Errorf("bad lambda name '%s', can only contain letters, numbers, period, dash, and underscore (and may not start with a period or dash)", name)
+	}
+	return nil
+}
+
+// Lookup is like Get, but returns nil rather than creating a
+// LambdaFunc if there isn't one (e.g., for requests that aren't
+// authorized, which mustn't load a lambda)
+func (mgr *LambdaMgr) Lookup(name string) (*LambdaFunc, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	mgr.mapMutex.RLock()
+	defer mgr.mapMutex.RUnlock()
+	return mgr.lfuncMap[name], nil
+}
+
+// Returns an existing instance (if there is one), or creates a new
+// one.  Fails if the name isn't valid (see ValidateName).
+func (mgr *LambdaMgr) Get(name string) (f *LambdaFunc, err error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	// fast path: the function already exists, so concurrent
+	// lookups don't need to contend with each other
+	mgr.mapMutex.RLock()
+	f = mgr.lfuncMap[name]
+	mgr.mapMutex.RUnlock()
+	if f != nil {
+		return f, nil
+	}
+
+	// slow path: check again with the write lock held, as
+	// somebody else may have created it after we looked, and
+	// there must never be two LambdaFuncs for the same name
 	mgr.mapMutex.Lock()
 	defer mgr.mapMutex.Unlock()
 
 	f = mgr.lfuncMap[name]
 
 	if f == nil {
+		// config was validated at startup
+		level, _ := common.ParseLogLevel(common.Conf.Log_level)
+
 		f = &LambdaFunc{
-			lmgr:      mgr,
-			name:      name,
-			funcChan:  make(chan *Invocation, 32),
-			instChan:  make(chan *Invocation, 32),
-			doneChan:  make(chan *Invocation, 32),
-			instances: list.New(),
-			killChan:  make(chan chan bool, 1),
+			lmgr:       mgr,
+			name:       name,
+			logLevel:   int32(level),
+			funcChan:   make(chan *Invocation, 32),
+			instChan:   make(chan *Invocation, 32),
+			doneChan:   make(chan *Invocation, 32),
+			instances:  list.New(),
+			canaryChan: make(chan float64),
+			warmChan:   make(chan *warmRequest),
+			evictChan:  make(chan chan int),
+			killChan:   make(chan chan bool, 1),
+			retired:    make(chan bool),
+			exited:     make(chan bool),
+			autoscaler: mgr.newAutoscaler(),
 		}
 
 		go f.Task()
 		mgr.lfuncMap[name] = f
 	}
 
-	return f
+	return f, nil
+}
+
+// remove a function that has never had any code (only not-found
+// errors) from lfuncMap, so that requests for random names can't
+// accumulate LambdaFuncs and Tasks.  Once this returns, nothing
+// more will be sent to f.funcChan (see enqueue), though requests
+// already there still need a response.
+func (mgr *LambdaMgr) retire(f *LambdaFunc) {
+	mgr.mapMutex.Lock()
+	defer mgr.mapMutex.Unlock()
+
+	if mgr.lfuncMap[f.name] == f {
+		delete(mgr.lfuncMap, f.name)
+	}
+	close(f.retired)
+}
+
+// InvokeLocal invokes a lambda without a round-trip through the
+// network (e.g., so one lambda can call another on the same worker).
+// The request takes the same path as one from a client, including
+// queue limits and timeouts, but the response is collected in memory.
+// As for a client, a 429 or 503 response means the lambda is
+// overloaded (see the Retry-After header), and canceling req's
+// context abandons the invocation.
+func (mgr *LambdaMgr) InvokeLocal(name string, req *http.Request) (*http.Response, error) {
+	f, err := mgr.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := httptest.NewRecorder()
+	f.invoke(rec, req)
+	return rec.Result(), nil
+}
+
+// ErrNotLoaded is returned for lambdas this worker has no LambdaFunc for
+var ErrNotLoaded = errors.New("lambda is not loaded on this worker")
+
+// EvictFunction kills all of a lambda's instances, freeing their
+// Sandboxes (e.g., to relieve memory pressure), but keeps its
+// LambdaFunc (unlike Kill), so the next request starts a new
+// instance, with the code already pulled.  Returns ErrNotLoaded if
+// the lambda has no LambdaFunc (so nothing to evict).
+func (mgr *LambdaMgr) EvictFunction(name string) error {
+	mgr.mapMutex.RLock()
+	f := mgr.lfuncMap[name]
+	mgr.mapMutex.RUnlock()
+	if f == nil {
+		return ErrNotLoaded
+	}
+
+	f.Evict()
+	return nil
 }
 
 func (mgr *LambdaMgr) Debug() string {
-	return mgr.sbPool.DebugString() + "\n"
+	s := mgr.sbPool.DebugString() + "\n"
+	if cache := mgr.CurrentImportCache(); cache != nil {
+		s += cache.DebugTreeString() + "\n"
+	}
+	return s
+}
+
+// CurrentImportCache returns the import cache, or nil if it is
+// disabled
+func (mgr *LambdaMgr) CurrentImportCache() *ImportCache {
+	mgr.importCacheMutex.RLock()
+	defer mgr.importCacheMutex.RUnlock()
+	return mgr.ImportCache
 }
 
 func (mgr *LambdaMgr) Cleanup() {
-	mgr.mapMutex.Lock() // don't unlock, because this shouldn't be used anymore
+	// event sources invoke lambdas, so they must stop first
+	for _, runner := range mgr.eventSources {
+		runner.stop()
+	}
+	mgr.peers.stop()
+	mgr.disk.stop()
+
+	// (while the lambdas still know their code and traffic)
+	if common.Conf.Features.Handoff {
+		if err := mgr.writeHandoff(); err != nil {
+			log.Printf("could not write handoff snapshot: %v", err)
+		}
+	}
 
 	// HandlerPuller+PackagePuller requires no cleanup
 
 	// 1. cleanup handler Sandboxes
 	// 2. cleanup Zygote Sandboxes (after the handlers, which depend on the Zygotes)
 	// 3. cleanup SandboxPool underlying both of above
-	for _, f := range mgr.lfuncMap {
-		log.Printf("Kill function: %s", f.name)
-		f.Kill()
+	//
+	// mapMutex isn't held while killing functions, as a function's
+	// Task may need it to retire (see retire), so functions may be
+	// created meanwhile; kill those too, until there are no more.
+	// Then mapMutex stays locked, because this shouldn't be used
+	// anymore
+	killed := make(map[*LambdaFunc]bool)
+	for {
+		mgr.mapMutex.Lock()
+		funcs := []*LambdaFunc{}
+		for _, f := range mgr.lfuncMap {
+			if !killed[f] {
+				funcs = append(funcs, f)
+			}
+		}
+		if len(funcs) == 0 {
+			break
+		}
+		mgr.mapMutex.Unlock()
+
+		for _, f := range funcs {
+			log.Printf("Kill function: %s", f.name)
+			f.Kill()
+			killed[f] = true
+		}
 	}
 
-	if mgr.ImportCache != nil {
-		mgr.ImportCache.Cleanup()
+	if cache := mgr.CurrentImportCache(); cache != nil {
+		cache.Cleanup()
 	}
 
+	mgr.warmPool.Cleanup()
+
 	if mgr.sbPool != nil {
 		mgr.sbPool.Cleanup() // assumes all Sandboxes are gone
 	}
 
+	// (after the functions, whose last invocations may be audited)
+	mgr.auditor.Cleanup()
+
 	// cleanup DepTracer
 	if mgr.DepTracer != nil {
 		mgr.DepTracer.Cleanup()
@@ -231,59 +748,309 @@ func (f *LambdaFunc) Invoke(w http.ResponseWriter, r *http.Request) {
 	t := common.T0("LambdaFunc.Invoke")
 	defer t.T1()
 
-	done := make(chan bool)
-	req := &Invocation{w: w, r: r, done: done}
+	f.invoke(w, r)
+}
+
+// like Invoke, but returns the Invocation (after it is done), or nil
+// if it was rejected before reaching the queue (or answered from the
+// response cache)
+func (f *LambdaFunc) invoke(w http.ResponseWriter, r *http.Request) *Invocation {
+	bw := newBodylessWriter(w, r)
+	defer bw.finish()
+	w = bw
+	stripWorkerHeaders(r)
+
+	// installs can take a long time, and if this is the first
+	// version of the code, there's nothing to run requests on
+	// until it is done, so rather than letting requests pile up
+	// behind it, tell the client to come back (unless the pull
+	// was started eagerly, in which case requests wait for it)
+	if atomic.LoadInt32(&f.installing) == 1 && !common.Conf.Features.Eager_pull {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, ERR_CODE_INSTALLING, "lambda function code is being installed, try again later", nil)
+		return nil
+	}
+
+	if f.handleCORS(w, r) || f.checkMethod(w, r) {
+		return nil
+	}
+
+	if f.serveCached(w, r) {
+		return nil
+	}
+
+	id := invocationIdPrefix + strconv.FormatInt(atomic.AddInt64(&nextInvocationId, 1), 10)
+	w.Header().Set("X-OL-Invocation-Id", id)
+
+	// buffered, because an invocation that expires in the
+	// queue may be done twice: once when the client gets a 503,
+	// and again when a function being killed hands back what its
+	// instances dequeued (see claim)
+	done := make(chan bool, 1)
+	sw := &statusWriter{ResponseWriter: w}
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	req := &Invocation{w: sw, r: r, id: id, start: time.Now(), sw: sw, body: body, done: done, cpuUs: -1}
+
+	// a small body is read now, so the request can be sent again
+	// if its Sandbox dies (the client may send it slowly, but it
+	// would have to be read before the handler responded anyway)
+	if limit := common.Conf.Limits.Max_retryable_body_bytes; limit > 0 {
+		buf, err := bufferBody(r, limit)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_BAD_REQUEST_BODY, "could not read request body", err)
+			return nil
+		} else if buf != nil {
+			defer buf.cleanup()
+			req.bodyBuf = buf
+		}
+	}
+	req.priority = requestPriority(r)
+	if r.Header.Get(FORWARDED_HEADER) != "" {
+		common.IncCounter("lambda/" + f.name + "/forwarded-in")
+	}
 
 	// send invocation to lambda func task, if room in queue
-	select {
-	case f.funcChan <- req:
+	if f.enqueue(req) {
 		// block until it's done
 		<-done
-	default:
+		f.cacheResponse(req)
+	} else {
 		// queue cannot accept more, so reply with backoff
-		req.w.WriteHeader(http.StatusTooManyRequests)
-		req.w.Write([]byte("lambda function queue is full"))
+		f.shed(req, "func_queue_full", len(f.funcChan), cap(f.funcChan))
+		<-done
 	}
+	f.lmgr.auditor.record(f, req)
+
+	return req
 }
 
-// add function name to each log message so we know which logs
-// correspond to which LambdaFuncs
-func (f *LambdaFunc) printf(format string, args ...interface{}) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [FUNC %s]", strings.TrimRight(msg, "\n"), f.name)
+// send req to the function's Task (or, if the function was retired,
+// to the Task of whatever LambdaFunc now has the same name).  Returns
+// false if the queue is full.
+func (f *LambdaFunc) enqueue(req *Invocation) bool {
+	for {
+		// holding the read lock means retire can't happen
+		// during the send, which doesn't block
+		f.lmgr.mapMutex.RLock()
+		select {
+		case <-f.retired:
+			f.lmgr.mapMutex.RUnlock()
+			// (the name was valid before)
+			f, _ = f.lmgr.Get(f.name)
+			continue
+		default:
+		}
+
+		sent := false
+		select {
+		case f.funcChan <- req:
+			sent = true
+		default:
+		}
+		f.lmgr.mapMutex.RUnlock()
+		return sent
+	}
 }
 
 // the function code may contain comments such as the following:
 //
 // # ol-install: parso,jedi,idna,chardet,certifi,requests
+// # ol-install-file: requirements.txt
+// # ol-install-optional: ujson
 // # ol-import: parso,jedi,idna,chardet,certifi,requests,urllib3
 // # ol-timeout: 30
+// # ol-record: true
+// # ol-audit: true
+// # ol-keep-hot: true
+// # ol-scale-to-zero: true
+// # ol-python: 3.11
+// # ol-methods: GET,POST
+// # ol-cache-ttl: 5000
+// # ol-cors: https://app.example.com,https://*.example.com
+// # ol-cors-credentials: true
+// # ol-cors-max-age: 600
+// # ol-net-allow: api.internal:443,10.0.0.0/8
+// # ol-sandbox-ttl-ms: 3600000
+// # ol-sandbox-max-requests: 10000
+// # ol-sandbox-concurrency: 8
+// # ol-shutdown-path: /shutdown
+// # ol-warmup-path: /warmup
+// # ol-dir-mode: 0700
+// # ol-log-level: debug
+// # ol-runtime: docker
 //
 // The first list should be installed with pip install.  The second is
-// a hint about what may be imported (useful for import cache).
+// a hint about what may be imported (useful for import cache).  List
+// the most important (base) imports first, as the import cache prefers
+// Zygotes that have already imported a prefix of the ol-import list.
+//
+// ol-install-file names a requirements file in the code dir (e.g., the
+// project's requirements.txt) whose packages are installed along with
+// the ol-install list, so they needn't be listed twice.  Only package
+// specs are supported (see readRequirements), and a missing file fails
+// the pull.
+//
+// ol-install-optional lists packages that are installed if possible,
+// but that the lambda can run without: if one (or one of its deps)
+// fails to install, it is skipped with a warning rather than failing
+// the pull.  The lambda must handle the ImportError.
 //
 // ol-timeout is used to specify a lambda timeout in milliseconds. If the timeout
 // specified is longer than the environment's global timeout, then the gloval
 // timeout will be used
 //
+// ol-record turns on invocation recording (see Recorder) for this
+// lambda, even if it is not enabled for all lambdas
+//
+// ol-audit overrides Features.Audit_invocations (in either direction)
+// for this lambda, so its invocations are (or aren't) in the audit
+// log (see Auditor)
+//
+// ol-keep-hot overrides Features.Keep_one_hot (in either direction)
+// for this lambda
+//
+// ol-scale-to-zero overrides Features.Scale_to_zero (in either
+// direction) for this lambda
+//
+// ol-python selects one of the Python versions configured in
+// Python_interpreters (instead of the default python3).  Packages are
+// installed separately for each version, under /packages/py<version>.
+//
+// ol-methods restricts which HTTP methods the lambda accepts (others
+// get 405 Method Not Allowed, before they are queued, and OPTIONS
+// requests are answered by the worker with the allowed methods).  By
+// default, all methods are allowed.  Allowing GET allows HEAD too
+// (which the handler receives as a GET; see ORIGINAL_METHOD_HEADER).
+//
+// ol-cache-ttl declares that the handler is pure (the same request
+// always gets the same response), so the worker may answer GET
+// requests with a response it stored up to that many milliseconds
+// ago (keyed by path, query, and the RESPONSE_CACHE_KEY_HEADERS),
+// without running the handler.  The cache is flushed when the code
+// changes.  Cached responses carry an ETag (the handler's own, or a
+// hash of the body), and a client whose If-None-Match matches gets a
+// 304 Not Modified.  Responses that set a cookie, or have a
+// Cache-Control of no-store or private, are never cached.
+//
+// ol-cors lets browsers on the given origins (scheme://host[:port],
+// where the host may start with "*." to match its subdomains, or just
+// "*" for any origin) call the lambda: the worker answers CORS
+// preflight requests itself (without queueing them), and adds
+// Access-Control-Allow-* headers to responses.  ol-cors-credentials
+// and ol-cors-max-age override Cors.Allow_credentials and
+// Cors.Max_age_s for the lambda.  Lambdas without ol-cors get no CORS
+// handling.
+//
+// ol-net-allow limits the hosts (host:port) and networks (CIDRs) the
+// lambda may connect to (along with Egress.Default_allow); other
+// connections are refused.  It is only enforced by Sandbox types with
+// their own network namespace (see sandbox.EgressAllow); SOCK
+// Sandboxes can't be created for a lambda with a policy unless
+// Egress.Log_only is set.  A Sandbox is replaced if its policy
+// changes.
+//
+// ol-sandbox-ttl-ms and ol-sandbox-max-requests bound how long (since
+// it was created) and for how many requests a Sandbox is used, to
+// limit state it may accumulate (e.g., leaks).  A Sandbox that
+// reaches either limit is replaced before it serves another request.
+//
+// ol-sandbox-concurrency lets each of the lambda's Sandboxes serve up
+// to that many requests at once (instead of one), for handlers that
+// can (e.g., an async def f).  Each instance then counts as that many
+// instances when autoscaling.
+//
+// ol-shutdown-path names an endpoint that is sent a POST (with an
+// X-OL-Shutdown header, which clients can't send) before one of the lambda's Sandboxes is
+// destroyed because it was killed or recycled, so the handler can
+// release resources (e.g., close connections).  The handler gets
+// SHUTDOWN_HOOK_TIMEOUT, and the Sandbox is destroyed regardless of
+// the response.  Python handlers receive it as a call to their
+// shutdown() function, if they define one.
+//
+// ol-warmup-path names an endpoint that is sent a POST (with an
+// X-OL-Warmup header, which clients can't send) once each new Sandbox of the lambda is created,
+// before it serves any request, so the handler can get ready (e.g.,
+// load a large model) in advance.  A Sandbox whose warmup fails (or
+// takes longer than Limits.Warmup_timeout_ms) is destroyed.  The
+// lambda's instances create their Sandboxes (and warm up) as soon as
+// they start, then pause until a request arrives, so the first
+// request finds the handler ready.  Python handlers receive it as a
+// call to their warmup() function, if they define one (f is imported
+// either way).
+//
+// ol-dir-mode sets the permissions (in octal) of the lambda's code
+// and scratch dirs, instead of the defaults, e.g., so that the files
+// of a lambda handling sensitive data aren't readable by other users
+// on the worker.
+//
+// ol-log-level sets the level of the lambda's log messages (see
+// LambdaFunc.logf) when its code is deployed, instead of Log_level,
+// so one lambda can log verbosely without flooding the worker's log.
+// It may still be changed at runtime (with /log-level), until code
+// with a different ol-log-level is deployed.
+//
+// ol-runtime selects the type of sandbox the lambda runs in, from
+// the main Sandbox type and Extra_sandboxes (e.g., to give untrusted
+// lambdas stronger isolation).  Lambdas in an extra sandbox type
+// don't use the import cache.
+//
 // We support exact pkg versions (e.g., pkg==2.0.0), but not < or >.
 // If different lambdas import different versions of the same package,
-// we will install them, for example, to /packages/pkg==1.0.0/pkg and
-// /packages/pkg==2.0.0/pkg.  We'll symlink the version the user wants
-// to /handler/packages/pkg.  For example, two different lambdas might
-// have links as follows:
+// we will install them, for example, to /packages/pkg==1.0.0/files
+// and /packages/pkg==2.0.0/files, and each Sandbox gets the
+// directories of exactly the versions its lambda needs in sys.path.
+// /packages is shared by all Sandboxes (so identical packages share
+// the page cache), and is always mounted read-only, so a lambda can
+// never modify packages another lambda uses.
 //
-// /handler/packages/pkg => /packages/pkg==1.0.0/pkg
-// /handler/packages/pkg => /packages/pkg==2.0.0/pkg
-//
-// Lambdas should have /handler/packages in their path, but not
-// /packages.
+// Compiled lambdas have no Python source to embed comments in, so the
+// same directives may instead be given in an ol.yaml file (see
+// parseMetaYaml).  A code dir with no f.py, but with an executable
+// named "handler", is treated as a binary lambda with default
+// settings.
 func parseMeta(codeDir string) (meta *sandbox.SandboxMeta, err error) {
 	installs := make([]string, 0)
+	optionalInstalls := make([]string, 0)
 	imports := make([]string, 0)
 	var timeout_time int64 = 0
+	record := false
+	var audit *bool = nil
+	var keepHot *bool = nil
+	var scaleToZero *bool = nil
+	python := ""
+	methods := []string{}
+	sandboxType := ""
+	var cacheTTL int64 = 0
+	corsOrigins := []string{}
+	var corsCredentials *bool = nil
+	corsMaxAgeS := 0
+	netAllow := []string{}
+	var sandboxTTLMs int64 = 0
+	sandboxMaxRequests := 0
+	concurrency := 0
+	shutdownPath := ""
+	warmupPath := ""
+	var dirMode os.FileMode = 0
+	logLevel := ""
+
+	yamlPath := filepath.Join(codeDir, "ol.yaml")
+	if _, err := os.Stat(yamlPath); err == nil {
+		return parseMetaYaml(codeDir, yamlPath)
+	}
 
 	path := filepath.Join(codeDir, "f.py")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(codeDir, "handler")); err == nil {
+			return checkBinaryMeta(codeDir, &sandbox.SandboxMeta{
+				Installs: installs,
+				Imports:  imports,
+				Runtime:  sandbox.RUNTIME_BINARY,
+				Handler:  "handler",
+			})
+		}
+	}
+
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -293,7 +1060,7 @@ func parseMeta(codeDir string) (meta *sandbox.SandboxMeta, err error) {
 	scnr := bufio.NewScanner(file)
 	for scnr.Scan() {
 		line := strings.ReplaceAll(scnr.Text(), " ", "")
-		parts := strings.Split(line, ":")
+		parts := strings.SplitN(line, ":", 2)
 
 		// Check to make sure that we don't go out of bounds.
 		// If not enough arguments specified, then just ignore the OpenLambda Directive...
@@ -305,6 +1072,18 @@ func parseMeta(codeDir string) (meta *sandbox.SandboxMeta, err error) {
 						installs = append(installs, val)
 					}
 				}
+			} else if parts[0] == "#ol-install-file" {
+				reqs, err := readRequirements(codeDir, parts[1])
+				if err != nil {
+					return nil, err
+				}
+				installs = append(installs, reqs...)
+			} else if parts[0] == "#ol-install-optional" {
+				for _, val := range strings.Split(parts[1], ",") {
+					if len(val) > 0 {
+						optionalInstalls = append(optionalInstalls, normalizePkg(val))
+					}
+				}
 			} else if parts[0] == "#ol-import" {
 				for _, val := range strings.Split(parts[1], ",") {
 					val = strings.TrimSpace(val)
@@ -316,14 +1095,122 @@ func parseMeta(codeDir string) (meta *sandbox.SandboxMeta, err error) {
 
 				const BASE_TEN = 10
 				const BITS_64 = 64
-					res, err := strconv.ParseInt(parts[1], BASE_TEN, BITS_64)
-					if err == nil {
-						timeout_time = res
+				res, err := strconv.ParseInt(parts[1], BASE_TEN, BITS_64)
+				if err == nil {
+					timeout_time = res
+				} else {
+					fmt.Printf("WARNING: Malformed floating point value detected for #ol-timeout\n")
+					fmt.Printf("#ol-timeout will be ignored for the affected lambda.\n")
+				}
+
+			} else if parts[0] == "#ol-record" {
+				if b, err := strconv.ParseBool(parts[1]); err == nil {
+					record = b
+				} else {
+					fmt.Printf("WARNING: #ol-record must be true or false, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-audit" {
+				if b, err := strconv.ParseBool(parts[1]); err == nil {
+					audit = &b
+				} else {
+					fmt.Printf("WARNING: #ol-audit must be true or false, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-keep-hot" {
+				if b, err := strconv.ParseBool(parts[1]); err == nil {
+					keepHot = &b
+				} else {
+					fmt.Printf("WARNING: #ol-keep-hot must be true or false, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-scale-to-zero" {
+				if b, err := strconv.ParseBool(parts[1]); err == nil {
+					scaleToZero = &b
+				} else {
+					fmt.Printf("WARNING: #ol-scale-to-zero must be true or false, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-python" {
+				python = parts[1]
+			} else if parts[0] == "#ol-runtime" {
+				sandboxType = parts[1]
+			} else if parts[0] == "#ol-cache-ttl" {
+				if ttl, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+					cacheTTL = ttl
+				} else {
+					fmt.Printf("WARNING: #ol-cache-ttl must be a number of milliseconds, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-cors" {
+				for _, val := range strings.Split(parts[1], ",") {
+					if err := checkCORSOrigin(val); err != nil {
+						fmt.Printf("WARNING: #ol-cors: %v, it will be ignored\n", err)
 					} else {
-						fmt.Printf("WARNING: Malformed floating point value detected for #ol-timeout\n")
-						fmt.Printf("#ol-timeout will be ignored for the affected lambda.\n")
+						corsOrigins = append(corsOrigins, val)
 					}
-
+				}
+			} else if parts[0] == "#ol-cors-credentials" {
+				if b, err := strconv.ParseBool(parts[1]); err == nil {
+					corsCredentials = &b
+				} else {
+					fmt.Printf("WARNING: #ol-cors-credentials must be true or false, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-cors-max-age" {
+				if secs, err := strconv.Atoi(parts[1]); err == nil && secs >= 0 {
+					corsMaxAgeS = secs
+				} else {
+					fmt.Printf("WARNING: #ol-cors-max-age must be a number of seconds, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-net-allow" {
+				for _, val := range strings.Split(parts[1], ",") {
+					if len(val) > 0 {
+						netAllow = append(netAllow, val)
+					}
+				}
+			} else if parts[0] == "#ol-sandbox-ttl-ms" {
+				if ttl, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+					sandboxTTLMs = ttl
+				} else {
+					fmt.Printf("WARNING: #ol-sandbox-ttl-ms must be a number of milliseconds, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-sandbox-max-requests" {
+				if max, err := strconv.Atoi(parts[1]); err == nil {
+					sandboxMaxRequests = max
+				} else {
+					fmt.Printf("WARNING: #ol-sandbox-max-requests must be a number, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-shutdown-path" {
+				if strings.HasPrefix(parts[1], "/") {
+					shutdownPath = parts[1]
+				} else {
+					fmt.Printf("WARNING: #ol-shutdown-path must start with /, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-warmup-path" {
+				if strings.HasPrefix(parts[1], "/") {
+					warmupPath = parts[1]
+				} else {
+					fmt.Printf("WARNING: #ol-warmup-path must start with /, it will be ignored\n")
+				}
+			} else if parts[0] == "#ol-sandbox-concurrency" {
+				if n, err := parseConcurrency(parts[1]); err == nil {
+					concurrency = n
+				} else {
+					fmt.Printf("WARNING: #ol-sandbox-concurrency: %v, it will be ignored\n", err)
+				}
+			} else if parts[0] == "#ol-dir-mode" {
+				if mode, err := parseDirMode(parts[1]); err == nil {
+					dirMode = mode
+				} else {
+					fmt.Printf("WARNING: #ol-dir-mode: %v, it will be ignored\n", err)
+				}
+			} else if parts[0] == "#ol-log-level" {
+				if level, err := common.ParseLogLevel(parts[1]); err == nil {
+					logLevel = level.String()
+				} else {
+					fmt.Printf("WARNING: #ol-log-level: %v, it will be ignored\n", err)
+				}
+			} else if parts[0] == "#ol-methods" {
+				for _, val := range strings.Split(parts[1], ",") {
+					if len(val) > 0 {
+						methods = append(methods, strings.ToUpper(val))
+					}
+				}
 			}
 		} else {
 			fmt.Printf("WARNING: Incorrect format specified for metadata in %s. It will be ignored as a consequence.\n", codeDir)
@@ -336,37 +1223,581 @@ func parseMeta(codeDir string) (meta *sandbox.SandboxMeta, err error) {
 	}
 
 	return &sandbox.SandboxMeta{
-		Installs:     installs,
-		Imports:      imports,
-		Timeout_Time: timeout_time,
+		Installs:           installs,
+		OptionalInstalls:   optionalInstalls,
+		Imports:            imports,
+		Timeout_Time:       timeout_time,
+		Record:             record,
+		Audit:              audit,
+		KeepHot:            keepHot,
+		ScaleToZero:        scaleToZero,
+		Python:             python,
+		Methods:            methods,
+		Sandbox:            sandboxType,
+		CacheTTL:           cacheTTL,
+		CORSOrigins:        corsOrigins,
+		CORSCredentials:    corsCredentials,
+		CORSMaxAgeS:        corsMaxAgeS,
+		NetAllow:           netAllow,
+		SandboxTTLMs:       sandboxTTLMs,
+		SandboxMaxRequests: sandboxMaxRequests,
+		Concurrency:        concurrency,
+		ShutdownPath:       shutdownPath,
+		WarmupPath:         warmupPath,
+		DirMode:            dirMode,
+		LogLevel:           logLevel,
 	}, nil
 }
 
-// if there is any error:
-// 1. we won't switch to the new code
-// 2. we won't update pull time (so well check for a fix next tim)
-func (f *LambdaFunc) pullHandlerIfStale() (err error) {
-	// check if there is newer code, download it if necessary
-	now := time.Now()
-	cache_ns := int64(common.Conf.Registry_cache_ms) * 1000000
-
-	// should we check for new code?
-	if f.lastPull != nil && int64(now.Sub(*f.lastPull)) < cache_ns {
-		return nil
+// a "#" starts a comment in a requirements file if it begins the line
+// or follows whitespace
+var requirementsCommentRe = regexp.MustCompile(`(^|\s)#.*$`)
+
+// the package specs in a requirements file in codeDir (see
+// ol-install-file), one per line, ignoring blank lines and comments.
+// Spaces within a spec ("pkg == 1.0") and trailing per-requirement
+// options (e.g., --hash) are dropped.  Other pip features (option
+// lines like -r or --index-url, URLs) are not supported.
+func readRequirements(codeDir, name string) ([]string, error) {
+	path := filepath.Join(codeDir, name)
+	if rel, err := filepath.Rel(codeDir, path); err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("ol-install-file %s is outside the lambda's code dir", name)
 	}
 
-	// is there new code?
-	codeDir, err := f.lmgr.HandlerPuller.Pull(f.name)
-	if err != nil {
-		return err
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("ol-install-file %s not found in the lambda's code", name)
+	} else if err != nil {
+		return nil, err
 	}
+	defer file.Close()
 
-	if codeDir == f.codeDir {
-		return nil
+	reqs := []string{}
+	scnr := bufio.NewScanner(file)
+	for lineNum := 1; scnr.Scan(); lineNum++ {
+		line := strings.TrimSpace(requirementsCommentRe.ReplaceAllString(scnr.Text(), ""))
+		if idx := strings.Index(line, " --"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.ReplaceAll(line, " ", "")
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "-") || strings.Contains(line, "://") || strings.HasSuffix(line, "\\") {
+			return nil, fmt.Errorf("%s:%d: only package specs are supported, not '%s'", name, lineNum, line)
+		}
+		reqs = append(reqs, line)
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, fmt.Errorf("could not read ol-install-file %s: %v", name, err)
+	}
+	return reqs, nil
+}
+
+// the most requests a Sandbox may serve at once (see
+// ol-sandbox-concurrency)
+const MAX_SANDBOX_CONCURRENCY = 256
+
+func parseConcurrency(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > MAX_SANDBOX_CONCURRENCY {
+		return 0, fmt.Errorf("'%s' is not a number from 1 to %d", s, MAX_SANDBOX_CONCURRENCY)
+	}
+	return n, nil
+}
+
+// how many requests each Sandbox of this version of the code may
+// serve at once
+func sandboxConcurrency(meta *sandbox.SandboxMeta) int {
+	if meta == nil || meta.Concurrency < 1 {
+		return 1
+	}
+	return meta.Concurrency
+}
+
+// permissions for ol-dir-mode, in octal.  The owner (the worker) must
+// keep full access to the dirs.
+func parseDirMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not an octal mode", s)
+	}
+	if mode > 0777 || mode&0700 != 0700 {
+		return 0, fmt.Errorf("mode %04o must be at most 0777, and include 0700", mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// ol.yaml supports a small subset of YAML: one "key: value" per line,
+// where list values may be comma separated, in [brackets], or given
+// as "- item" lines below the key.  For example:
+//
+// runtime: binary
+// handler: my-service
+// timeout: 30
+//
+// Recognized keys are runtime, handler, install, install_file,
+// install_optional, import, timeout, record, audit, keep_hot,
+// scale_to_zero, python, methods, cache_ttl, cors, cors_credentials,
+// cors_max_age, net_allow, sandbox_ttl_ms, sandbox_max_requests,
+// sandbox_concurrency, shutdown_path, warmup_path, dir_mode, log_level,
+// and sandbox.  All but runtime, handler and sandbox mirror the ol-*
+// directive of the same name; as "runtime" here is the language
+// runtime, sandbox corresponds to ol-runtime.
+func parseMetaYaml(codeDir, path string) (*sandbox.SandboxMeta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	vals := make(map[string][]string)
+	key := ""
+
+	scnr := bufio.NewScanner(file)
+	for lineNum := 1; scnr.Scan(); lineNum++ {
+		line := scnr.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// continuation of a block list under the previous key
+		if strings.HasPrefix(line, "-") {
+			if key == "" {
+				return nil, fmt.Errorf("%s:%d: list item without a key", path, lineNum)
+			}
+			item := strings.TrimSpace(line[1:])
+			if item != "" {
+				vals[key] = append(vals[key], strings.Trim(item, `"'`))
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected 'key: value'", path, lineNum)
+		}
+		key = strings.TrimSpace(parts[0])
+		val := strings.TrimSpace(parts[1])
+		val = strings.TrimSuffix(strings.TrimPrefix(val, "["), "]")
+
+		vals[key] = []string{}
+		for _, item := range strings.Split(val, ",") {
+			item = strings.Trim(strings.TrimSpace(item), `"'`)
+			if item != "" {
+				vals[key] = append(vals[key], item)
+			}
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+
+	meta := &sandbox.SandboxMeta{
+		Installs: make([]string, 0),
+		Imports:  make([]string, 0),
+		Runtime:  sandbox.RUNTIME_PYTHON,
+	}
+
+	for key, items := range vals {
+		single := ""
+		if len(items) > 0 {
+			single = items[0]
+		}
+
+		switch key {
+		case "runtime":
+			meta.Runtime = single
+		case "handler":
+			meta.Handler = single
+		case "install":
+			for _, pkg := range items {
+				meta.Installs = append(meta.Installs, normalizePkg(pkg))
+			}
+		case "install_file":
+			for _, name := range items {
+				reqs, err := readRequirements(codeDir, name)
+				if err != nil {
+					return nil, err
+				}
+				for _, pkg := range reqs {
+					meta.Installs = append(meta.Installs, normalizePkg(pkg))
+				}
+			}
+		case "install_optional":
+			for _, pkg := range items {
+				meta.OptionalInstalls = append(meta.OptionalInstalls, normalizePkg(pkg))
+			}
+		case "import":
+			meta.Imports = append(meta.Imports, items...)
+		case "timeout":
+			timeout, err := strconv.ParseInt(single, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad timeout '%s': %v", path, single, err)
+			}
+			meta.Timeout_Time = timeout
+		case "record":
+			record, err := strconv.ParseBool(single)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad record '%s': %v", path, single, err)
+			}
+			meta.Record = record
+		case "audit":
+			audit, err := strconv.ParseBool(single)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad audit '%s': %v", path, single, err)
+			}
+			meta.Audit = &audit
+		case "keep_hot":
+			keepHot, err := strconv.ParseBool(single)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad keep_hot '%s': %v", path, single, err)
+			}
+			meta.KeepHot = &keepHot
+		case "scale_to_zero":
+			scaleToZero, err := strconv.ParseBool(single)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad scale_to_zero '%s': %v", path, single, err)
+			}
+			meta.ScaleToZero = &scaleToZero
+		case "python":
+			meta.Python = single
+		case "sandbox":
+			meta.Sandbox = single
+		case "cache_ttl":
+			ttl, err := strconv.ParseInt(single, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad cache_ttl '%s': %v", path, single, err)
+			}
+			meta.CacheTTL = ttl
+		case "cors":
+			for _, origin := range items {
+				if err := checkCORSOrigin(origin); err != nil {
+					return nil, fmt.Errorf("%s: bad cors: %v", path, err)
+				}
+			}
+			meta.CORSOrigins = append(meta.CORSOrigins, items...)
+		case "cors_credentials":
+			credentials, err := strconv.ParseBool(single)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad cors_credentials '%s': %v", path, single, err)
+			}
+			meta.CORSCredentials = &credentials
+		case "cors_max_age":
+			secs, err := strconv.Atoi(single)
+			if err != nil || secs < 0 {
+				return nil, fmt.Errorf("%s: bad cors_max_age '%s', must be a number of seconds", path, single)
+			}
+			meta.CORSMaxAgeS = secs
+		case "net_allow":
+			meta.NetAllow = append(meta.NetAllow, items...)
+		case "sandbox_ttl_ms":
+			ttl, err := strconv.ParseInt(single, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad sandbox_ttl_ms '%s': %v", path, single, err)
+			}
+			meta.SandboxTTLMs = ttl
+		case "sandbox_max_requests":
+			max, err := strconv.Atoi(single)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad sandbox_max_requests '%s': %v", path, single, err)
+			}
+			meta.SandboxMaxRequests = max
+		case "shutdown_path":
+			if !strings.HasPrefix(single, "/") {
+				return nil, fmt.Errorf("%s: shutdown_path '%s' must start with /", path, single)
+			}
+			meta.ShutdownPath = single
+		case "warmup_path":
+			if !strings.HasPrefix(single, "/") {
+				return nil, fmt.Errorf("%s: warmup_path '%s' must start with /", path, single)
+			}
+			meta.WarmupPath = single
+		case "sandbox_concurrency":
+			n, err := parseConcurrency(single)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad sandbox_concurrency: %v", path, err)
+			}
+			meta.Concurrency = n
+		case "dir_mode":
+			mode, err := parseDirMode(single)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad dir_mode: %v", path, err)
+			}
+			meta.DirMode = mode
+		case "log_level":
+			level, err := common.ParseLogLevel(single)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad log_level: %v", path, err)
+			}
+			meta.LogLevel = level.String()
+		case "methods":
+			for _, method := range items {
+				meta.Methods = append(meta.Methods, strings.ToUpper(method))
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown key '%s'", path, key)
+		}
+	}
+
+	switch meta.Runtime {
+	case sandbox.RUNTIME_PYTHON:
+		if meta.Handler != "" {
+			return nil, fmt.Errorf("%s: handler may only be set for the binary runtime", path)
+		}
+		return meta, nil
+	case sandbox.RUNTIME_BINARY:
+		if meta.Handler == "" {
+			meta.Handler = "handler"
+		}
+		return checkBinaryMeta(codeDir, meta)
+	default:
+		return nil, fmt.Errorf("%s: unknown runtime '%s'", path, meta.Runtime)
+	}
+}
+
+// CPU time (user+sys microseconds) the Sandbox has used so far, if
+// Features.Cpu_accounting is on and the Sandbox can report it
+func sandboxCPUUs(sb sandbox.Sandbox) (int64, bool) {
+	if !common.Conf.Features.Cpu_accounting {
+		return 0, false
+	}
+
+	stat, err := sb.Status(sandbox.StatusCPUUsageUs)
+	if err != nil {
+		return 0, false
+	}
+
+	us, err := strconv.ParseInt(stat, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return us, true
+}
+
+// publish the methods f.meta and the canary's meta accept, and their
+// CORS policy (only the Task calls this, whenever either changes)
+func (f *LambdaFunc) publishPolicy() {
+	var canaryMeta *sandbox.SandboxMeta
+	if f.canary != nil {
+		canaryMeta = f.canary.meta
+	}
+	f.cors.Store(corsPolicyFor(f.meta, canaryMeta))
+
+	var methods []string
+	if f.meta != nil && len(f.meta.Methods) > 0 {
+		methods = append(methods, f.meta.Methods...)
+		if f.canary != nil {
+			if len(f.canary.meta.Methods) == 0 {
+				methods = nil
+			} else {
+				methods = append(methods, f.canary.meta.Methods...)
+			}
+		}
+	}
+	f.methods.Store(methods)
+
+	// with a canary, audit if either version asks for it, and only
+	// skip auditing if both ask for that
+	var audit *bool
+	if f.meta != nil {
+		audit = f.meta.Audit
+	}
+	if canaryMeta != nil {
+		if canaryMeta.Audit == nil || audit == nil {
+			if (canaryMeta.Audit != nil && *canaryMeta.Audit) || (audit != nil && *audit) {
+				yes := true
+				audit = &yes
+			} else {
+				audit = nil
+			}
+		} else if *canaryMeta.Audit {
+			audit = canaryMeta.Audit
+		}
+	}
+	f.audit.Store(audit)
+}
+
+// reject a request whose method no version of the lambda accepts
+// (405, with an Allow header), before it is queued, and answer
+// OPTIONS requests for lambdas that restrict their methods.  Returns
+// true if it responded.
+func (f *LambdaFunc) checkMethod(w http.ResponseWriter, r *http.Request) bool {
+	methods, _ := f.methods.Load().([]string)
+	if methods == nil {
+		return false
+	}
+	meta := &sandbox.SandboxMeta{Methods: methods}
+	if methodAllowed(meta, r.Method) {
+		return false
+	}
+
+	allow := strings.Join(methods, ", ")
+	if !methodAllowed(meta, "OPTIONS") {
+		allow += ", OPTIONS"
+	}
+	w.Header().Set("Allow", allow)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+
+	common.IncCounter("lambda/" + f.name + "/method-rejected")
+	writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "method "+r.Method+" not allowed for this lambda", nil)
+	return true
+}
+
+// does the lambda accept requests with this method (see ol-methods)?
+func methodAllowed(meta *sandbox.SandboxMeta, method string) bool {
+	if len(meta.Methods) == 0 {
+		return true
+	}
+	for _, allowed := range meta.Methods {
+		// (a HEAD is a GET without the body)
+		if allowed == method || (method == "HEAD" && allowed == "GET") {
+			return true
+		}
+	}
+	return false
+}
+
+// binary lambdas don't run in Python, so there is nothing for pip to
+// install into (or import from), and the handler must be a runnable
+// file inside the code dir
+func checkBinaryMeta(codeDir string, meta *sandbox.SandboxMeta) (*sandbox.SandboxMeta, error) {
+	if len(meta.Installs) > 0 || len(meta.Imports) > 0 {
+		return nil, fmt.Errorf("install and import are not supported for the binary runtime")
+	}
+
+	if meta.Python != "" {
+		return nil, fmt.Errorf("a Python version cannot be selected for the binary runtime")
+	}
+
+	if strings.Contains(meta.Handler, "/") {
+		return nil, fmt.Errorf("binary handler '%s' must be a file name in the code dir, not a path", meta.Handler)
+	}
+
+	stat, err := os.Stat(filepath.Join(codeDir, meta.Handler))
+	if err != nil {
+		return nil, fmt.Errorf("binary handler not found: %v", err)
+	} else if !stat.Mode().IsRegular() || stat.Mode()&0111 == 0 {
+		return nil, fmt.Errorf("binary handler '%s' is not an executable file", meta.Handler)
+	}
+
+	return meta, nil
+}
+
+// how often Task checks its count of outstanding requests (used for
+// autoscaling) against the requests actually in flight
+var RECONCILE_INTERVAL = 10 * time.Second
+
+// how long a handler has to clean up (see ol-shutdown-path)
+const SHUTDOWN_HOOK_TIMEOUT = 2 * time.Second
+
+// the shutdown and warmup hooks' requests have these headers (see
+// ol-shutdown-path and ol-warmup-path)
+const (
+	SHUTDOWN_HEADER = "X-OL-Shutdown"
+	WARMUP_HEADER   = "X-OL-Warmup"
+)
+
+// headers that only the worker may send to a handler.  They are
+// removed from client requests, so a client can't pass for the worker
+// (e.g., to run a live Sandbox's shutdown hook).
+var workerOnlyHeaders = []string{SHUTDOWN_HEADER, WARMUP_HEADER, ORIGINAL_METHOD_HEADER}
+
+func stripWorkerHeaders(r *http.Request) {
+	for _, name := range workerOnlyHeaders {
+		r.Header.Del(name)
+	}
+}
+
+// handlers get the deadline for a request (in milliseconds since the
+// epoch) in this header, if it has a timeout
+const DEADLINE_HEADER = "X-OL-Deadline-Ms"
+
+// a timed out request's response says which limit it hit, and what
+// the limit was: the lambda's ol-timeout ("function"), the worker's
+// Limits.Max_timeout_ms ("platform"), or the time a forwarded request
+// had left on the worker it came from ("request")
+const (
+	TIMEOUT_SOURCE_HEADER = "X-OL-Timeout-Source"
+	TIMEOUT_MS_HEADER     = "X-OL-Timeout-Ms"
+)
+
+// with Features.Sandbox_self_test, a new Sandbox gets this long to
+// answer a ping, and Task tries this many Sandboxes before giving up
+// on a request
+const (
+	SELF_TEST_TIMEOUT  = 5 * time.Second
+	SELF_TEST_ATTEMPTS = 3
+)
+
+// how many of the largest packages to name when a lambda's packages
+// exceed Limits.Max_deps_mb
+const DEPS_SIZE_OFFENDERS = 3
+
+// record how long a phase of the lifecycle of a request or version of
+// the code (pull, install, create, queue, or exec) took, in the
+// lambda/<name>/phase/<phase> histogram (see common.ObserveMs)
+func (f *LambdaFunc) observePhase(phase string, d time.Duration) {
+	common.ObserveMs("lambda/"+f.name+"/phase/"+phase, d.Milliseconds())
+}
+
+// should we check for new code?
+func (f *LambdaFunc) codeIsStale() bool {
+	if time.Now().Before(f.pullRetryAt) {
+		return false
+	}
+
+	// a watched registry says when code changes, so there's no
+	// need to check it periodically
+	if changed, ok := f.lmgr.HandlerPuller.Changed(f.name); ok && f.lastPull != nil {
+		return changed
+	}
+
+	cache_ns := int64(common.Conf.Registry_cache_ms) * 1000000
+	return f.lastPull == nil || int64(time.Since(*f.lastPull)) >= cache_ns
+}
+
+// check if there is code newer than curCodeDir, download it and
+// install its packages if necessary.
+//
+// This runs in the background while the Task keeps serving requests
+// with the current code, so it must not modify the LambdaFunc; the
+// Task switches to the new code (if any) when this returns.  If
+// codeDir is the same as curCodeDir, meta is nil.
+//
+// if there is any error:
+// 1. we won't switch to the new code
+// 2. we won't update pull time (so well check for a fix next tim)
+func (f *LambdaFunc) pullHandler(curCodeDir string) (codeDir string, meta *sandbox.SandboxMeta, err error) {
+	// is there new code?
+	codeDir, err = f.lmgr.HandlerPuller.Pull(f.name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if codeDir == curCodeDir {
+		return codeDir, nil, nil
+	}
+
+	// with no old code to fall back on, requests can only wait
+	// for this to finish
+	if curCodeDir == "" {
+		atomic.StoreInt32(&f.installing, 1)
+		defer atomic.StoreInt32(&f.installing, 0)
 	}
 
 	defer func() {
 		if err != nil {
+			// the code exists, but can't be used
+			err = &LoadError{Err: err}
+
 			if err := os.RemoveAll(codeDir); err != nil {
 				log.Printf("could not cleanup %s after failed pull", codeDir)
 			}
@@ -381,21 +1812,138 @@ func (f *LambdaFunc) pullHandlerIfStale() (err error) {
 
 	// inspect new code for dependencies; if we can install
 	// everything necessary, start using new code
-	meta, err := parseMeta(codeDir)
+	meta, err = parseMeta(codeDir)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
-	meta.Installs, err = f.lmgr.PackagePuller.InstallRecursive(meta.Installs)
-	if err != nil {
-		return err
+	if _, err = common.PythonInterpreter(meta.Python); err != nil {
+		return "", nil, err
 	}
-	f.lmgr.DepTracer.TraceFunction(codeDir, meta.Installs)
 
-	f.codeDir = codeDir
-	f.meta = meta
-	f.lastPull = &now
-	return nil
+	if err = common.CheckSandboxType(meta.Sandbox); err != nil {
+		return "", nil, err
+	}
+
+	if meta.DirMode != 0 {
+		if err = os.Chmod(codeDir, meta.DirMode); err != nil {
+			return "", nil, err
+		}
+	}
+
+	for _, rule := range meta.NetAllow {
+		if _, err = sandbox.ParseEgressRule(rule); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// binary lambdas have no Python environment to install into
+	if meta.Runtime != sandbox.RUNTIME_BINARY {
+		ctx := context.Background()
+		if timeoutMs := common.Conf.Limits.Pull_timeout_ms; IsFiniteTimeout(timeoutMs) {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+			defer cancel()
+		}
+
+		// name the limit when installs run out of time
+		installErr := func(err error) error {
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("installs did not finish within limits.pull_timeout_ms (%d ms): %v",
+					common.Conf.Limits.Pull_timeout_ms, err)
+			}
+			return err
+		}
+
+		installStart := time.Now()
+		meta.Installs, err = f.lmgr.PackagePuller.InstallRecursive(ctx, meta.Python, meta.Installs)
+		f.observePhase("install", time.Since(installStart))
+		if err != nil {
+			return "", nil, installErr(err)
+		}
+
+		// each optional package is installed separately, so
+		// that one failing doesn't affect the others
+		for _, pkg := range meta.OptionalInstalls {
+			installs, err := f.lmgr.PackagePuller.InstallRecursive(ctx, meta.Python, append(meta.Installs[:len(meta.Installs):len(meta.Installs)], pkg))
+			if err != nil {
+				if ctx.Err() != nil {
+					return "", nil, installErr(err)
+				}
+				f.warnf("skipping optional package %s: %v", pkg, err)
+				meta.SkippedInstalls = append(meta.SkippedInstalls, pkg)
+				continue
+			}
+			meta.Installs = installs
+		}
+		if err := f.checkDepsSize(meta); err != nil {
+			return "", nil, err
+		}
+		f.lmgr.DepTracer.TraceFunction(codeDir, meta.Installs)
+		f.logImportHints(meta)
+	}
+
+	return codeDir, meta, nil
+}
+
+// Zygotes are Python processes (in the main type of sandbox), so they
+// can't speed up binary handlers, or lambdas in other types of
+// sandboxes
+func usesImportCache(meta *sandbox.SandboxMeta) bool {
+	return meta.Runtime != sandbox.RUNTIME_BINARY &&
+		(meta.Sandbox == "" || meta.Sandbox == common.Conf.Sandbox)
+}
+
+// when new code is deployed, tell its author how well its ol-import
+// hints fit the Zygote tree (see /admin/import-hints for how its
+// Sandboxes were actually created)
+func (f *LambdaFunc) logImportHints(meta *sandbox.SandboxMeta) {
+	cache := f.lmgr.CurrentImportCache()
+	if cache == nil || !usesImportCache(meta) {
+		return
+	}
+
+	_, attr := cache.attribute(meta)
+	f.infof("new code will use Zygote <%s> (%s match)", zygoteName(attr.Zygote), attr.Match)
+	for _, hint := range attr.Hints() {
+		f.infof("import hint: %s", hint)
+	}
+}
+
+// make sure the packages a lambda installs take no more than
+// Limits.Max_deps_mb (or its entry in Limits.Max_deps_mb_overrides),
+// so that one lambda can't fill every worker's disk.  Lambdas can't
+// raise their own limit.
+func (f *LambdaFunc) checkDepsSize(meta *sandbox.SandboxMeta) error {
+	maxMB := common.Conf.Limits.Max_deps_mb
+	if override, ok := common.Conf.Limits.Max_deps_mb_overrides[f.name]; ok {
+		maxMB = override
+	}
+	if maxMB <= 0 {
+		return nil
+	}
+
+	sizes := f.lmgr.PackagePuller.InstalledSizes(meta.Python, meta.Installs)
+	var total int64 = 0
+	pkgs := make([]string, 0, len(sizes))
+	for pkg, size := range sizes {
+		total += size
+		pkgs = append(pkgs, pkg)
+	}
+	if total <= int64(maxMB)*1024*1024 {
+		return nil
+	}
+
+	sort.Slice(pkgs, func(i, j int) bool { return sizes[pkgs[i]] > sizes[pkgs[j]] })
+	if len(pkgs) > DEPS_SIZE_OFFENDERS {
+		pkgs = pkgs[:DEPS_SIZE_OFFENDERS]
+	}
+	offenders := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		offenders[i] = fmt.Sprintf("%s (%.1f MB)", pkg, float64(sizes[pkg])/(1024*1024))
+	}
+	return fmt.Errorf("packages installed for lambda take %.1f MB, exceeding max_deps_mb limit of %d MB (largest: %s)",
+		float64(total)/(1024*1024), maxMB, strings.Join(offenders, ", "))
 }
 
 // this Task receives lambda requests, fetches new lambda code as
@@ -416,393 +1964,1362 @@ func (f *LambdaFunc) pullHandlerIfStale() (err error) {
 //
 // If either LambdaFunc.funcChan or LambdaFunc.instChan is full, we
 // respond to the client with a backoff message: StatusTooManyRequests
+//
+// Between 1 and 2, requests wait in Task's pending queue, highest
+// priority first, and only go to the instChan once an instance could
+// take them (see invocationQueue).  The pending queue counts against
+// the instChan's capacity.
+//
+// During a canary deployment (see SetCanaryWeight), new code doesn't
+// replace the current code right away.  Instead, it runs on its own
+// instances, and requests are randomly routed to it according to the
+// canary weight, until it is promoted.
+//
+// Otherwise, new code replaces the current code with a rolling
+// deploy (using the same mechanism as a canary), so that a burst of
+// requests doesn't hit all cold instances at once: one new instance
+// is started, and once it has served a request successfully (or
+// there is no traffic to wait for), one old instance is killed and
+// another new one started, until no old instances remain.
+//
+// New code is pulled (and its packages installed) by a background
+// goroutine, with at most one pull in progress at a time.  Requests
+// keep going to instances running the current code until the new
+// code is ready, at which point we switch over.  Only before the
+// first successful pull must requests wait (on Task's waiting list).
+// Thus, once Registry_cache_ms expires, we serve stale code while
+// revalidating it.  Failed pulls are retried with exponential backoff
+// (starting at PULL_RETRY_MIN), without affecting requests that can
+// run on the current code.
 func (f *LambdaFunc) Task() {
-	f.printf("debug: LambdaFunc.Task() runs on goroutine %d", common.GetGoroutineID())
+	f.debugf("LambdaFunc.Task() runs on goroutine %d", common.GetGoroutineID())
+	defer f.lmgr.registerGoroutine(fmt.Sprintf("LambdaFunc.Task [FUNC %s]", f.name))()
+	defer close(f.exited)
+
+	// each concern has its own state (see the types' files)
+	cleanup := newCleanupQueue(f)
+	stats := newFuncStats(f)
+	scaler := newInstanceScaler(f)
+	puller := newCodePuller(f)
+	rollout := newRollout(f, cleanup)
+
+	// periodically check the outstanding request count against
+	// what is actually in flight (see instanceScaler.reconcile)
+	reconcileTicker := time.NewTicker(RECONCILE_INTERVAL)
+	defer reconcileTicker.Stop()
+
+	// rejects requests while they are likely to fail anyway
+	breaker := &circuitBreaker{f: f}
+
+	// requests dispatched to an instChan, but not sent yet
+	pending := &invocationQueue{}
+
+	dispatch := func(req *Invocation) {
+		codeDir, meta, instChan := rollout.route()
+		req.codeDir = codeDir
+
+		// reject disallowed methods before they take up
+		// instance capacity (most were already rejected by
+		// checkMethod, but the code may have changed since,
+		// or the method may only be allowed by the canary)
+		if !methodAllowed(meta, req.r.Method) {
+			if req.claim() {
+				req.w.Header().Set("Allow", strings.Join(meta.Methods, ", "))
+				req.fail(http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "method "+req.r.Method+" not allowed for this lambda", nil)
+				req.done <- true
+			}
+			return
+		}
+
+		f.lmgr.DepTracer.TraceInvocation(codeDir)
+
+		if meta.CacheTTL > 0 && req.r.Method == "GET" {
+			req.cacheTtlMs = meta.CacheTTL
+			req.sw.startCapture()
+		}
+
+		// we can't take a request out of the middle of
+		// instChan, so a request that waits too long gets a
+		// response right away, and is skipped when an instance
+		// finally dequeues it
+		if maxMs := common.Conf.Limits.Max_queue_ms; IsFiniteTimeout(maxMs) && req.queueTimer == nil {
+			f.expireAfter(req, time.Duration(maxMs)*time.Millisecond, "request waited too long for a lambda instance")
+		}
+
+		if depth := len(instChan) + pending.count(instChan); depth < cap(instChan) {
+			// msg: function -> instance (see feed)
+			pending.push(req, instChan)
+			scaler.dispatched()
+		} else if req.claim() {
+			// queue cannot accept more, so reply with backoff
+			f.shed(req, "inst_queue_full", depth, cap(instChan))
+		}
+	}
+
+	// send pending requests on to their instChans, allowing about
+	// one queued request per instance (so at least one, to start
+	// from zero)
+	feed := func() {
+		pending.feed(func(instChan chan *Invocation) bool {
+			instances, meta := f.instances, f.meta
+			if f.canary != nil && instChan == f.canary.instChan {
+				instances, meta = f.canary.instances, f.canary.meta
+			}
+			return len(instChan) < common.Max(instances.Len(), 1)*sandboxConcurrency(meta)
+		})
+	}
+
+	// take requests back out of an instChan that won't be served
+	// anymore, and dispatch them again
+	redispatch := func(instChan chan *Invocation) {
+		for _, req := range pending.remove(instChan) {
+			scaler.withdraw()
+			dispatch(req)
+		}
+		for {
+			select {
+			case req := <-instChan:
+				scaler.withdraw()
+				dispatch(req)
+			default:
+				return
+			}
+		}
+	}
+
+	// don't wait for the first request to find out what code
+	// to run
+	if common.Conf.Features.Eager_pull {
+		puller.start()
+	}
+
+	for {
+		select {
+		case <-scaler.timeout.C:
+			if f.codeDir == "" {
+				continue
+			}
+		case req := <-f.funcChan:
+			// msg: client -> function
+			scaler.arrived()
+
+			// check for new code in the background (unless
+			// we're already doing so)
+			if !puller.pulling && f.codeIsStale() {
+				puller.start()
+			}
+
+			if f.codeDir == "" && !puller.pulling {
+				// the last pull failed, and it's too soon
+				// to try again
+				f.failPull(req, f.pullErr)
+				req.done <- true
+				continue
+			} else if f.codeDir == "" {
+				// nothing to run the request on yet
+				puller.wait(req)
+				continue
+			}
+
+			if !breaker.allow(req) {
+				common.IncCounter("lambda/" + f.name + "/breaker-rejected")
+				retry := int(math.Ceil(breaker.retryAfter().Seconds()))
+				req.w.Header().Set("Retry-After", strconv.Itoa(retry))
+				if breaker.unhealthy {
+					req.fail(http.StatusServiceUnavailable, ERR_FUNCTION_UNHEALTHY,
+						fmt.Sprintf("lambda function is unhealthy, as its last %d instance starts failed; try again later", breaker.startFailures), nil)
+				} else {
+					req.fail(http.StatusServiceUnavailable, ERR_CIRCUIT_OPEN, "lambda function is failing, try again later", nil)
+				}
+				req.done <- true
+				continue
+			}
+
+			dispatch(req)
+		case res := <-puller.done:
+			puller.finish(res)
+			if res.err == nil {
+				rollout.deploy(res, redispatch)
+			}
+			puller.release(res, scaler.prewarm, dispatch)
+
+			// a function that never existed shouldn't stick
+			// around (a scanner could create any number of
+			// them).  If it shows up later, Get creates a new
+			// LambdaFunc for it.
+			if f.codeDir == "" && f.canary == nil && errors.Is(res.err, ErrLambdaNotFound) {
+				f.debugf("retire function, as it was not found")
+				f.lmgr.retire(f)
+
+				// answer requests that were enqueued before
+				// retirement (and a Kill that raced with it)
+			Retire:
+				for {
+					select {
+					case req := <-f.funcChan:
+						req.fail(http.StatusNotFound, ERR_LAMBDA_NOT_FOUND, "lambda function not found", res.err)
+						req.done <- true
+					case done := <-f.killChan:
+						done <- true
+					default:
+						break Retire
+					}
+				}
+
+				f.lmgr.instanceBudget.remove(f)
+				cleanup.finish()
+				<-cleanup.done
+				return
+			}
+
+			// the first pull failed, so there's no code to
+			// start instances with
+			if f.codeDir == "" {
+				continue
+			}
+		case req := <-f.doneChan:
+			// msg: instance -> function
+			scaler.finished()
+
+			// a request that expired in the queue was never
+			// served, and its response belongs to
+			// expireAfter (which may still be writing it),
+			// so it has no stats, and its client was
+			// already told it's done
+			if atomic.LoadInt32(&req.state) == INVOCATION_EXPIRED {
+				break
+			}
+
+			if req.sw.status >= 500 {
+				req.error = true
+			}
+			stats.record(req)
+			rollout.record(req)
+			breaker.record(req)
+
+			// msg: function -> client
+			req.done <- true
+
+		case weight := <-f.canaryChan:
+			rollout.setCanaryWeight(weight, redispatch)
+
+		case warm := <-f.warmChan:
+			if f.codeDir != "" {
+				scaler.prewarm(warm.instances)
+				warm.done <- nil
+			} else {
+				puller.warm(warm)
+			}
+
+		case done := <-f.evictChan:
+			// the instances finish the requests they have
+			// (others wait in instChan for new instances,
+			// which only create Sandboxes when they get a
+			// request)
+			n := f.instances.Len()
+			cleanup.killAll(f.instances)
+			f.instances = list.New()
+			if f.canary != nil {
+				n += f.canary.instances.Len()
+				cleanup.killAll(f.canary.instances)
+				f.canary.instances = list.New()
+			}
+			f.infof("evicted %d instances", n)
+			common.AddSum("lambda/"+f.name+"/evicted-instances", int64(n))
+			done <- n
+
+		case <-reconcileTicker.C:
+			scaler.reconcile(pending)
+
+			// proactively check for new code for functions
+			// that are in use, so a new version can be
+			// rolled out before the next burst of requests
+			if f.codeDir != "" && f.instances.Len() > 0 && !puller.pulling && f.codeIsStale() {
+				puller.start()
+			}
+
+			// a function nobody uses still costs goroutines
+			// and memory, so retire it (like a function that
+			// was not found).  Canary settings would be lost,
+			// so a function with a canary stays.
+			retireAfter := time.Duration(common.Conf.Limits.Idle_func_retire_ms) * time.Millisecond
+			if retireAfter > 0 && time.Since(scaler.lastActive) >= retireAfter &&
+				f.instances.Len() == 0 && f.canary == nil && !rollout.canaryOn() &&
+				scaler.outstanding == 0 && puller.idle() {
+				f.debugf("retire function, as it has been idle since %v", scaler.lastActive)
+				f.lmgr.retire(f)
+				f.publishEvent(&DeployEvent{Type: EVENT_FUNCTION_KILLED, Reason: "idle"})
+
+				// requests that were enqueued before
+				// retirement go to the LambdaFunc that
+				// replaces this one
+			RetireIdle:
+				for {
+					select {
+					case req := <-f.funcChan:
+						if !f.enqueue(req) {
+							f.shed(req, "func_queue_full", len(f.funcChan), cap(f.funcChan))
+						}
+					case done := <-f.killChan:
+						done <- true
+					default:
+						break RetireIdle
+					}
+				}
+
+				f.lmgr.instanceBudget.remove(f)
+				cleanup.finish()
+				<-cleanup.done
+				return
+			}
+
+		case done := <-f.killChan:
+			f.publishEvent(&DeployEvent{Type: EVENT_FUNCTION_KILLED, Reason: "shutdown"})
+
+			// nothing will ever serve requests still
+			// waiting for code...
+			puller.shutdown()
+
+			// ...nor requests queued for instances
+			for _, req := range pending.remove(nil) {
+				scaler.withdraw()
+				if req.claim() {
+					req.fail(http.StatusServiceUnavailable, ERR_SHUTTING_DOWN, "lambda function is shutting down", nil)
+					req.done <- true
+				}
+			}
+			instChans := []chan *Invocation{f.instChan}
+			if f.canary != nil {
+				instChans = append(instChans, f.canary.instChan)
+			}
+			for _, instChan := range instChans {
+			Drain:
+				for {
+					select {
+					case req := <-instChan:
+						scaler.withdraw()
+						if req.claim() {
+							req.fail(http.StatusServiceUnavailable, ERR_SHUTTING_DOWN, "lambda function is shutting down", nil)
+							req.done <- true
+						}
+					default:
+						break Drain
+					}
+				}
+			}
+
+			// signal all instances to die, then wait for
+			// cleanup task to finish and exit
+			cleanup.killAll(f.instances)
+			if f.canary != nil {
+				cleanup.killAll(f.canary.instances)
+			}
+
+			// delete the code (after the instances using it
+			// are gone), and make sure the HandlerPuller
+			// forgets it, or a LambdaFunc created later for
+			// the same lambda would get a dir that's gone.
+			// Code from a pull still in progress stays
+			// cached, as it may be used by such a LambdaFunc
+			f.lmgr.HandlerPuller.Reset(f.name)
+			if f.codeDir != "" {
+				cleanup.removeDir(f.codeDir)
+			}
+			if f.canary != nil {
+				cleanup.removeDir(f.canary.codeDir)
+			}
+			cleanup.finish()
+
+			// instances finish their current requests before
+			// dying, so keep handing those back to clients
+			// until the cleanup task is done
+		Cleanup:
+			for {
+				select {
+				case req := <-f.doneChan:
+					scaler.withdraw()
+					req.done <- true
+				case <-cleanup.done:
+					break Cleanup
+				}
+			}
+			f.lmgr.instanceBudget.remove(f)
+			done <- true
+			return
+		}
+
+		feed()
+
+		// POLICY: how many instances (i.e., virtual sandboxes) should we allocate?
+
+		atomic.StoreInt32(&f.numInstances, int32(f.instances.Len()))
+		atomic.StoreInt32(&f.numOutstanding, int32(scaler.outstanding))
+		scaler.report()
+
+		desired, idleLeft, overBudget := scaler.desired(stats.execMs.Avg, breaker)
+
+		// a rolling deploy replaces instances instead
+		if rollout.rolling {
+			rollout.step(scaler, redispatch)
+			continue
+		}
+
+		scaler.scale(desired, rollout.canaryInstances(desired), idleLeft, overBudget, cleanup, feed)
+	}
+}
+
+// identifies the egress policy of Sandboxes for this version of the
+// code (see sandbox.EgressAllow)
+func egressKey(meta *sandbox.SandboxMeta) string {
+	return strings.Join(sandbox.EgressAllow(meta), ",")
+}
+
+// may this version of the code have zero instances when idle?
+func scaleToZero(meta *sandbox.SandboxMeta) bool {
+	if meta != nil && meta.ScaleToZero != nil {
+		return *meta.ScaleToZero
+	}
+	return common.Conf.Features.Scale_to_zero
+}
+
+func (f *LambdaFunc) newInstance() {
+	f.startInstance(f.codeDir, f.meta, f.instChan, f.instances, false)
+}
+
+// start an instance running the given version of the code, adding it
+// to instances.  With prewarm, it creates its Sandbox right away,
+// rather than when its first request arrives
+func (f *LambdaFunc) startInstance(codeDir string, meta *sandbox.SandboxMeta, instChan chan *Invocation, instances *list.List, prewarm bool) {
+	if codeDir == "" {
+		panic("cannot start instance until code has been fetched")
+	}
+
+	keepHot := common.Conf.Features.Keep_one_hot
+	if meta.KeepHot != nil {
+		keepHot = *meta.KeepHot
+	}
+
+	// a handler that warms up should do so before its first
+	// request arrives (see ol-warmup-path)
+	if meta.WarmupPath != "" {
+		prewarm = true
+	}
+
+	// we scale down by killing the newest instances, so the
+	// first one will remain (and stay hot) for as long as this
+	// code version is in use
+	linst := &LambdaInstance{
+		lfunc:    f,
+		codeDir:  codeDir,
+		meta:     meta,
+		instChan: instChan,
+		hot:      keepHot && instances.Len() == 0,
+		prewarm:  prewarm,
+		killChan: make(chan chan bool, 1),
+		exited:   make(chan bool),
+	}
+
+	instances.PushBack(linst)
+
+	go linst.Task()
+}
+
+// Start (or adjust) a canary deployment: the next new version of the
+// code pulled will run alongside the current version, receiving the
+// given fraction (0 to 1) of requests.  A weight of 1 promotes the
+// canary to be the current version (the old version drains) and ends
+// the canary deployment.
+func (f *LambdaFunc) SetCanaryWeight(weight float64) error {
+	if weight < 0 || weight > 1 || math.IsNaN(weight) {
+		return fmt.Errorf("canary weight must be between 0 and 1, not %v", weight)
+	}
+	select {
+	case f.canaryChan <- weight:
+		return nil
+	case <-f.retired:
+		next, err := f.lmgr.Get(f.name)
+		if err != nil {
+			return err
+		}
+		return next.SetCanaryWeight(weight)
+	}
+}
+
+// kill all of f's instances (see LambdaMgr.EvictFunction), returning
+// how many there were
+func (f *LambdaFunc) Evict() int {
+	done := make(chan int, 1)
+	select {
+	case f.evictChan <- done:
+		return <-done
+	case <-f.retired:
+		// (a retired function has no instances)
+		return 0
+	}
+}
+
+func (f *LambdaFunc) Kill() {
+	done := make(chan bool)
+	select {
+	case f.killChan <- done:
+		// (killChan is buffered, so the Task may retire
+		// without ever taking the kill)
+		select {
+		case <-done:
+		case <-f.exited:
+		}
+	case <-f.exited:
+		// the Task exited on its own (see retire)
+	}
+}
+
+// this Task manages a single Sandbox (at any given time), and
+// forwards requests from the function queue to that Sandbox.
+// when there are no requests, the Sandbox is paused.
+//
+// These errors are handled as follows by Task:
+//
+// 1. Sandbox.Pause/Unpause: discard Sandbox, create new one to handle request
+// 2. Sandbox.Create/Channel: discard Sandbox, propagate HTTP 500 to client
+// 3. Error inside Sandbox: simply propagate whatever occured to client (TODO: restart Sandbox)
+func (linst *LambdaInstance) Task() {
+	f := linst.lfunc
+	defer f.lmgr.registerGoroutine(fmt.Sprintf("LambdaInstance.Task [FUNC %s, code %s]", f.name, linst.codeDir))()
+	defer close(linst.exited)
+
+	// (each Sandbox keeps its own keep-alive connections for
+	// requests, which go when it is paused or destroyed)
+	var sb sandbox.Sandbox = nil
+
+	// every request received from instChan must be handed back
+	// exactly once (so the LambdaFunc's count of outstanding
+	// requests stays accurate), using this
+	finish := func(req *Invocation) {
+		atomic.AddInt64(&f.serving, -1)
+		f.doneChan <- req
+	}
 
-	// we want to perform various cleanup actions, such as killing
-	// instances and deleting old code.  We want to do these
-	// asyncronously, but in order.  Thus, we use a chan to get
-	// FIFO behavior and a single cleanup task to get async.
-	//
-	// two types can be sent to this chan:
-	//
-	// 1. string: this is a path to be deleted
-	//
-	// 2. chan: this is a signal chan that corresponds to
-	// previously initiated cleanup work.  We block until we
-	// receive the complete signal, before proceeding to
-	// subsequent cleanup tasks in the FIFO.
-	cleanupChan := make(chan interface{}, 32)
-	cleanupTaskDone := make(chan bool)
-	go func() {
-		for {
-			msg, ok := <-cleanupChan
-			if !ok {
-				cleanupTaskDone <- true
-				return
-			}
+	// which of f.numHot or f.numPaused (if either) currently
+	// counts sb
+	var counted *int32 = nil
+	count := func(counter *int32) {
+		if counted != nil {
+			atomic.AddInt32(counted, -1)
+		}
+		if counter != nil {
+			atomic.AddInt32(counter, 1)
+		}
+		counted = counter
+		common.SetGauge("lambda/"+f.name+"/instances-hot", int64(atomic.LoadInt32(&f.numHot)))
+		common.SetGauge("lambda/"+f.name+"/instances-paused", int64(atomic.LoadInt32(&f.numPaused)))
+	}
 
-			switch op := msg.(type) {
-			case string:
-				if err := os.RemoveAll(op); err != nil {
-					f.printf("Async code cleanup could not delete %s, even after all instances using it killed: %v", op, err)
-				}
-			case chan bool:
-				<-op
-			}
+	// the memory sb used when last measured, counted in f.memMB.
+	// Each Sandbox also has its own gauge, while it lives
+	var memMB int64 = 0
+	memStat := ""
+	trackMem := func(mb int64) {
+		atomic.AddInt64(&f.memMB, mb-memMB)
+		memMB = mb
+		common.SetGauge("lambda/"+f.name+"/mem-mb", atomic.LoadInt64(&f.memMB))
+		if memStat != "" {
+			common.DeleteGauge(memStat)
+			memStat = ""
 		}
-	}()
+		if sb != nil && mb > 0 {
+			memStat = "lambda/" + f.name + "/sandbox/" + sb.ID() + "/mem-mb"
+			common.SetGauge(memStat, mb)
+		}
+	}
+	measureMem := func() {
+		if mb, err := sb.MemoryUsage(); err == nil {
+			trackMem(int64(mb))
+		}
+	}
 
-	// stats for autoscaling
-	outstandingReqs := 0
-	execMs := common.NewRollingAvg(10)
-	var lastScaling *time.Time = nil
-	timeout := time.NewTimer(0)
+	// the egress policy sb was created with, and how many
+	// connections it had refused when last checked
+	sbEgress := ""
+	var egressDenied int64 = 0
+
+	// when sb was created, and how many requests it has served
+	// (see ol-sandbox-ttl-ms and ol-sandbox-max-requests)
+	var sbCreated time.Time
+	sbRequests := 0
+
+	// why sb should be replaced, even though it works (because it
+	// is too old, or has served too many requests), or "" if it
+	// shouldn't be
+	sbWornOut := func() string {
+		if ttl := linst.meta.SandboxTTLMs; ttl > 0 && time.Since(sbCreated) >= time.Duration(ttl)*time.Millisecond {
+			return fmt.Sprintf("it is older than %d ms", ttl)
+		}
+		if max := linst.meta.SandboxMaxRequests; max > 0 && sbRequests >= max {
+			return fmt.Sprintf("it has served %d requests", sbRequests)
+		}
+		return ""
+	}
+	countEgressDenied := func() {
+		stat, err := sb.Status(sandbox.StatusEgressDenied)
+		if err != nil {
+			return
+		}
+		if denied, err := strconv.ParseInt(stat, 10, 64); err == nil && denied > egressDenied {
+			common.AddSum("lambda/"+f.name+"/egress-denied", denied-egressDenied)
+			egressDenied = denied
+		}
+	}
 
-	for {
-		select {
-		case <-timeout.C:
-			if f.codeDir == "" {
-				continue
-			}
-		case req := <-f.funcChan:
-			// msg: client -> function
+	// a new Sandbox is only ready once the handler has warmed up
+	// (see ol-warmup-path).  On failure, sb is destroyed, req is
+	// answered, and nil is returned
+	warmUp := func(sb sandbox.Sandbox, req *Invocation) sandbox.Sandbox {
+		if linst.meta.WarmupPath == "" {
+			return sb
+		}
+		start := time.Now()
+		if err := warmupHook(sb, linst.meta.WarmupPath); err != nil {
+			common.IncCounter("lambda/" + f.name + "/warmup-failed")
+			f.warnf("discard sandbox %s, as its warmup failed: %v", sb.ID(), err)
+			sb.Destroy()
+			req.fail(http.StatusServiceUnavailable, ERR_WARMUP_FAILED, "lambda handler failed to warm up", err)
+			req.startFailed = true
+			return nil
+		}
+		f.observePhase("warmup", time.Since(start))
+		return sb
+	}
 
-			// check for new code, and cleanup old code
-			// (and instances that use it) if necessary
-			oldCodeDir := f.codeDir
-			if err := f.pullHandlerIfStale(); err != nil {
-				f.printf("Error checking for new lambda code: %v", err)
-				req.w.WriteHeader(http.StatusInternalServerError)
-				req.w.Write([]byte(err.Error() + "\n"))
-				req.done <- true
-				continue
+	// create a Sandbox for linst, through the import cache if
+	// possible (and warm it up).  On failure, req (which needed it)
+	// has been answered, and nil is returned
+	createSandbox := func(req *Invocation) sandbox.Sandbox {
+		// lambdas with nothing to install or import don't
+		// need to wait for a Sandbox to be created
+		if sb := f.lmgr.warmPool.Take(linst.codeDir, linst.meta); sb != nil {
+			common.IncCounter("lambda/" + f.name + "/warm-start")
+			return warmUp(sb, req)
+		}
+
+		var sb sandbox.Sandbox
+		var err error
+
+		// a worker that is out of disk can't create Sandboxes for
+		// any lambda, so this isn't counted as this lambda's
+		// start failure (see Start_failure_budget)
+		failStorage := func(err error) sandbox.Sandbox {
+			common.IncCounter("storage/create-failed")
+			f.errorf("not enough storage to create a Sandbox: %v", err)
+			req.fail(http.StatusInsufficientStorage, ERR_INSUFFICIENT_STORAGE, "worker has insufficient storage to create Sandbox", err)
+			req.error = true
+			return nil
+		}
+
+		if cache := f.lmgr.CurrentImportCache(); cache != nil && usesImportCache(linst.meta) {
+			var scratchDir string
+			if scratchDir, err = f.makeScratchDir(linst.meta); err != nil {
+				return failStorage(err)
 			}
 
-			if oldCodeDir != "" && oldCodeDir != f.codeDir {
-				el := f.instances.Front()
-				for el != nil {
-					waitChan := el.Value.(*LambdaInstance).AsyncKill()
-					cleanupChan <- waitChan
-					el = el.Next()
+			// we don't specify parent SB, because ImportCache.Create chooses it for us
+			var attr *ZygoteAttribution
+			sb, attr, err = cache.Create(f.lmgr.sbPool, true, linst.codeDir, scratchDir, linst.meta, f.name)
+			if err == nil {
+				f.lmgr.DepTracer.TraceZygote(f.name, linst.codeDir, attr)
+			} else {
+				sb = nil
+
+				// a systemic import cache problem
+				// shouldn't be hidden by fallbacks
+				// if the operator wants to see it
+				if common.IsDiskFull(err) {
+					return failStorage(err)
+				}
+				if common.Conf.Features.Import_cache_strict {
+					f.errorf("failed to get Sandbox from import cache: %v", err)
+					req.fail(http.StatusServiceUnavailable, ERR_IMPORT_CACHE_FAILED, "import cache could not create Sandbox", err)
+					req.error = true
+					req.startFailed = true
+					return nil
 				}
-				f.instances = list.New()
 
-				// cleanupChan is a FIFO, so this will
-				// happen after the cleanup task waits
-				// for all instance kills to finish
-				cleanupChan <- oldCodeDir
+				common.IncCounter("lambda/" + f.name + "/import-cache-fallback")
+				if ok, suppressed := f.fallbackLog.allow(IMPORT_CACHE_FALLBACK_LOG_INTERVAL); ok {
+					if suppressed > 0 {
+						f.warnf("failed to get Sandbox from import cache, falling back to a cold Sandbox: %v (%d similar messages suppressed)", err, suppressed)
+					} else {
+						f.warnf("failed to get Sandbox from import cache, falling back to a cold Sandbox: %v", err)
+					}
+				}
 			}
+		}
 
-			f.lmgr.DepTracer.TraceInvocation(f.codeDir)
-
-			select {
-			case f.instChan <- req:
-				// msg: function -> instance
-				outstandingReqs += 1
-			default:
-				// queue cannot accept more, so reply with backoff
-				req.w.WriteHeader(http.StatusTooManyRequests)
-				req.w.Write([]byte("lambda instance queue is full"))
-				req.done <- true
+		// import cache is either disabled or it failed
+		if sb == nil {
+			var scratchDir string
+			if scratchDir, err = f.makeScratchDir(linst.meta); err != nil {
+				return failStorage(err)
 			}
-		case req := <-f.doneChan:
-			// msg: instance -> function
+			sb, err = f.lmgr.sbPool.Create(nil, true, linst.codeDir, scratchDir, linst.meta)
+		}
 
-			execMs.Add(req.execMs)
-			outstandingReqs -= 1
+		if common.IsDiskFull(err) {
+			return failStorage(err)
+		} else if err != nil {
+			req.fail(http.StatusInternalServerError, ERR_SANDBOX_CREATE_FAILED, "could not create Sandbox", err)
+			req.startFailed = true
+			return nil
+		}
+		return warmUp(sb, req)
+	}
 
-			// msg: function -> client
-			req.done <- true
+	// serve a (claimed) request with sb, timing it with tb, then
+	// hand it back.  Reports whether it timed out (after which sb
+	// must be destroyed), and whether the handler asked for sb to
+	// be recycled.  Requests run concurrently (in their own
+	// goroutines) with ol-sandbox-concurrency.
+	//
+	// If sb's server couldn't be reached, and the request can be
+	// sent again (its body was buffered, and it wasn't already
+	// retried), it is returned as retry instead of being handed
+	// back, and sb must be destroyed
+	serve := func(sb sandbox.Sandbox, req *Invocation, tb *TimeoutBroker, concurrent bool) (timedout bool, recycle bool, retry *Invocation) {
+		// (to undo the wrapping below, for a retry)
+		origR, origW := req.r, req.w
+
+		// ask Sandbox to respond, via HTTP proxy
+		t := common.T0("ServeHTTP")
+		const NANOSEC_PER_MS = 1000000
+		var chosen_timeout int64
+		var timeout_source string
+
+		default_timeout := common.Conf.Limits.Max_timeout_ms
+		override_timeout := linst.meta.Timeout_Time
+
+		// Resolve timeout:
+		// In general, use the override timeout if it is lower than the default timeout. Otherwise, use the default timeout
+		// An exception is if the default timeout is <=0... then always use the override timeout
+		// Another exception (second precedence) is if the override timeout is <=0... then use the default timeout
+		if default_timeout <= 0 {
+			chosen_timeout, timeout_source = override_timeout, "function"
+		} else if override_timeout <= 0 {
+			chosen_timeout, timeout_source = default_timeout, "platform"
+		} else if override_timeout < default_timeout {
+			chosen_timeout, timeout_source = override_timeout, "function"
+		} else {
+			chosen_timeout, timeout_source = default_timeout, "platform"
+		}
 
-		case done := <-f.killChan:
-			// signal all instances to die, then wait for
-			// cleanup task to finish and exit
-			el := f.instances.Front()
-			for el != nil {
-				waitChan := el.Value.(*LambdaInstance).AsyncKill()
-				cleanupChan <- waitChan
-				el = el.Next()
-			}
-			if f.codeDir != "" {
-				//cleanupChan <- f.codeDir
-			}
-			close(cleanupChan)
-			<-cleanupTaskDone
-			done <- true
-			return
+		// a request forwarded by a peer only gets the time
+		// it had left there
+		if left := forwardedTimeoutMs(req.r); left > 0 && (!IsFiniteTimeout(chosen_timeout) || left < chosen_timeout) {
+			chosen_timeout, timeout_source = left, "request"
 		}
 
-		// POLICY: how many instances (i.e., virtual sandboxes) should we allocate?
+		var conf_to_sec time.Duration = time.Duration(chosen_timeout * NANOSEC_PER_MS)
+
+		// case: timeout time is greater than 0, use it and start the timeout timer
+		// if it's not, then just ignore it (i.e. timeout is disabled).
+		// The deadline counts from when the request arrived (so
+		// time spent queued counts against it), and the handler is
+		// told when it is, so it can budget calls it makes
+		if IsFiniteTimeout(chosen_timeout) {
+			deadline := req.start.Add(conf_to_sec)
+			left := time.Until(deadline)
+			if left <= 0 {
+				req.failTimeout("lambda timed out before an instance could run it", timeout_source, chosen_timeout)
+				req.error = true
+				t.T1()
+				finish(req)
+				return false, false, nil
+			}
+			req.r.Header.Set(DEADLINE_HEADER, strconv.FormatInt(deadline.UnixNano()/int64(time.Millisecond), 10))
+			req.r = req.r.WithContext(tb.arm(req.r.Context(), left))
+		} else {
+			req.r.Header.Del(DEADLINE_HEADER)
+		}
 
-		// AUTOSCALING STEP 1: decide how many instances we want
+		// (the compressWriter goes first, so the
+		// recorder and debug log see the original body)
+		cw := newCompressWriter(req)
+		if cw != nil {
+			req.w = cw
+		}
+		dw := f.debugRequest(req)
+		rec := f.lmgr.Recorder.begin(f, req, linst.meta)
+
+		// the response headers are sent before we know
+		// how much CPU the request used, so that goes
+		// in a trailer (unless other requests share the
+		// Sandbox's CPU time)
+		cpuBefore, cpuOk := sandboxCPUUs(sb)
+		if cpuOk && !concurrent {
+			req.w.Header().Add("Trailer", "X-OL-CPU-Us")
+		}
 
-		// let's aim to have 1 sandbox per second of outstanding work
-		inProgressWorkMs := outstandingReqs * execMs.Avg
-		desiredInstances := inProgressWorkMs / 1000
+		// a HEAD goes to the Sandbox as a GET, as handlers
+		// often write a body regardless, which would be left
+		// on the (keep-alive) connection after a HEAD (the
+		// bodylessWriter drops it, once it has been read)
+		sbReq := req.r
+		if sbReq.Method == "HEAD" {
+			sbReq = req.r.Clone(req.r.Context())
+			sbReq.Method = "GET"
+			sbReq.Header.Set(ORIGINAL_METHOD_HEADER, "HEAD")
+		}
+		retryable := req.bodyBuf != nil && !req.retried
+		if retryable {
+			sbReq = sandbox.RetryIfUnreachable(sbReq)
+		}
+		err := sb.SendRequest(&req.w, sbReq)
 
-		// if we have, say, one job that will take 100
-		// seconds, spinning up 100 instances won't do any
-		// good, so cap by number of outstanding reqs
-		if outstandingReqs < desiredInstances {
-			desiredInstances = outstandingReqs
+		if IsFiniteTimeout(chosen_timeout) {
+			timedout = tb.disarm() // If request finishes, then shouldn't mark for del.
 		}
 
-		// always try to have one instance
-		if desiredInstances < 1 {
-			desiredInstances = 1
+		// nothing was written to the client, so try again
+		// with a new Sandbox (the request keeps its place, as
+		// it was already claimed)
+		if retryable && errors.Is(err, sandbox.ErrUnreachable) && !timedout {
+			req.r, req.w = origR, origW
+			req.w.Header().Del("Trailer")
+			req.retried = true
+			req.rewind()
+			common.IncCounter("lambda/" + f.name + "/retried")
+			f.warnf("retry invocation %s, as sandbox %s could not be reached: %v", req.id, sb.ID(), err)
+			t.T1()
+			return false, false, req
 		}
 
-		// AUTOSCALING STEP 2: tweak how many instances we have, to get closer to our goal
+		// (before any Destroy, or the stats are gone)
+		if cpuAfter, ok := sandboxCPUUs(sb); cpuOk && ok && !concurrent {
+			req.cpuUs = cpuAfter - cpuBefore
+			req.w.Header().Set("X-OL-CPU-Us", strconv.FormatInt(req.cpuUs, 10))
+			common.AddSum("lambda/"+f.name+"/cpu-us", req.cpuUs)
+		}
 
-		// make at most one scaling adjustment per second
-		adjustFreq := time.Second
-		now := time.Now()
-		if lastScaling != nil {
-			elapsed := now.Sub(*lastScaling)
-			if elapsed < adjustFreq {
-				if desiredInstances != f.instances.Len() {
-					timeout = time.NewTimer(adjustFreq - elapsed)
-				}
-				continue
+		if timedout {
+			if req.sw.written == 0 && (cw == nil || cw.discard()) {
+				req.failTimeout("lambda took too long to respond, and has timed out", timeout_source, chosen_timeout)
+			} else {
+				// the body may be binary, so don't
+				// append text to it (the client sees
+				// the body cut short)
+				f.warnf("invocation %s timed out after %d bytes of the response were sent", req.id, req.sw.written)
 			}
+			req.error = true
 		}
 
-		// kill or start at most one instance to get closer to
-		// desired number
-		if f.instances.Len() < desiredInstances {
-			f.printf("increase instances to %d", f.instances.Len()+1)
-			f.newInstance()
-			lastScaling = &now
-		} else if f.instances.Len() > desiredInstances {
-			f.printf("reduce instances to %d", f.instances.Len()-1)
-			waitChan := f.instances.Back().Value.(*LambdaInstance).AsyncKill()
-			f.instances.Remove(f.instances.Back())
-			cleanupChan <- waitChan
-			lastScaling = &now
+		var compressTime time.Duration
+		if cw != nil {
+			compressTime = cw.finish()
 		}
 
-		if f.instances.Len() != desiredInstances {
-			// we can only adjust quickly, so we want to
-			// run through this loop again as soon as
-			// possible, even if there are no requests to
-			// service.
-			timeout = time.NewTimer(adjustFreq)
-		}
-	}
-}
+		f.lmgr.Recorder.finish(rec, req)
+		f.debugResponse(req, dw)
 
-func (f *LambdaFunc) newInstance() {
-	if f.codeDir == "" {
-		panic("cannot start instance until code has been fetched")
-	}
+		// the handler may ask that its Sandbox not be
+		// reused (e.g., because it left it in a bad
+		// state).  Check before handing back the
+		// request, after which w may no longer be used
+		recycle = strings.EqualFold(req.w.Header().Get("X-OL-Recycle"), "true")
 
-	linst := &LambdaInstance{
-		lfunc:    f,
-		codeDir:  f.codeDir,
-		meta:     f.meta,
-		killChan: make(chan chan bool, 1),
+		t.T1()
+		req.execMs = int(t.Milliseconds - compressTime.Milliseconds())
+		finish(req)
+		return timedout, recycle, nil
 	}
 
-	f.instances.PushBack(linst)
-
-	go linst.Task()
-}
+	// destroy sb (before count(nil)), first letting the handler
+	// clean up (see ol-shutdown-path), if it is still responsive
+	destroy := func(graceful bool) {
+		if graceful && linst.meta.ShutdownPath != "" {
+			if counted == &f.numPaused {
+				if err := sb.Unpause(); err != nil {
+					sb.Destroy()
+					return
+				}
+			}
+			if err := shutdownHook(sb, linst.meta.ShutdownPath); err != nil {
+				f.warnf("shutdown hook of sandbox %s failed: %v", sb.ID(), err)
+			}
+		}
+		sb.Destroy()
+	}
 
-func (f *LambdaFunc) Kill() {
-	done := make(chan bool)
-	f.killChan <- done
-	<-done
-}
+	// the outcome of serve
+	type served struct {
+		tb       *TimeoutBroker
+		timedout bool
+		recycle  bool
+		retry    *Invocation
+	}
 
-// this Task manages a single Sandbox (at any given time), and
-// forwards requests from the function queue to that Sandbox.
-// when there are no requests, the Sandbox is paused.
-//
-// These errors are handled as follows by Task:
-//
-// 1. Sandbox.Pause/Unpause: discard Sandbox, create new one to handle request
-// 2. Sandbox.Create/Channel: discard Sandbox, propagate HTTP 500 to client
-// 3. Error inside Sandbox: simply propagate whatever occured to client (TODO: restart Sandbox)
-func (linst *LambdaInstance) Task() {
-	f := linst.lfunc
+	// one broker (and timer) per request this instance serves at
+	// once, reused for later requests
+	brokers := []*TimeoutBroker{{linst: linst}}
+	concurrency := sandboxConcurrency(linst.meta)
+	results := make(chan served, concurrency)
+
+	// a prewarmed instance creates its Sandbox before any request
+	// arrives, so the first one needn't wait for it (a failure is
+	// only logged; the first request will try again)
+	if linst.prewarm {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/run/"+f.name, nil)
+		r.Header.Set("Accept", "text/plain")
+		warmup := &Invocation{w: rec, r: r, sw: &statusWriter{ResponseWriter: rec}, cpuUs: -1}
+
+		createStart := time.Now()
+		if sb = createSandbox(warmup); sb == nil {
+			f.warnf("could not prewarm a sandbox: %s", strings.TrimSpace(rec.Body.String()))
+		} else {
+			f.observePhase("create", time.Since(createStart))
+			sbEgress = egressKey(linst.meta)
+			sbCreated = time.Now()
+			measureMem()
+			if linst.hot {
+				count(&f.numHot)
+			} else if err := sb.Pause(); err != nil {
+				f.warnf("discard sandbox %s due to Pause error: %v", sb.ID(), err)
+				sb = nil
+				trackMem(0)
+			} else {
+				count(&f.numPaused)
+			}
+		}
+	}
 
-	var sb sandbox.Sandbox = nil
-	//var client *http.Client = nil // whenever we create a Sandbox, we init this too
-	var err error
+	// requests to send again, as their Sandbox died before
+	// responding (see serve); they go before any new request
+	retries := []*Invocation{}
 
 	for {
 		// wait for a request (blocking) before making the
 		// Sandbox ready, or kill if we receive that signal
 		var req *Invocation
-		select {
-		case req = <-f.instChan:
-		case killed := <-linst.killChan:
-			if sb != nil {
-				sb.Destroy()
+		if len(retries) > 0 {
+			req, retries = retries[0], retries[1:]
+		} else {
+			select {
+			case req = <-linst.instChan:
+				atomic.AddInt64(&f.serving, 1)
+			case killed := <-linst.killChan:
+				if sb != nil {
+					destroy(true)
+					count(nil)
+					sb = nil
+					trackMem(0)
+				}
+				killed <- true
+				return
 			}
-			killed <- true
-			return
 		}
 
-		// if we have a sandbox, try unpausing it to see if it is still alive
-		if sb != nil {
+		// (a retried request was claimed the first time)
+		if !req.retried {
+			if !req.claim() {
+				// waited too long in the queue (the
+				// client already got a 503)
+				finish(req)
+				continue
+			}
+			f.observePhase("queue", time.Since(req.start))
+		}
+
+		// a Sandbox's egress policy is applied when it is
+		// created, so if the policy changed since (e.g., the
+		// worker's defaults were reloaded), replace it.  Also
+		// replace a Sandbox that became too old while idle
+		reason := ""
+		if sb != nil && egressKey(linst.meta) != sbEgress {
+			reason = "its egress policy changed"
+		} else if sb != nil {
+			reason = sbWornOut()
+		}
+		if reason != "" {
+			f.infof("discard sandbox %s, as %s", sb.ID(), reason)
+			common.IncCounter("lambda/" + f.name + "/recycle")
+			destroy(true)
+			count(nil)
+			sb = nil
+			trackMem(0)
+		}
+
+		// if we have a paused sandbox, try unpausing it to see
+		// if it is still alive (a hot sandbox is never paused)
+		if sb != nil && !linst.hot {
 			// Unpause will often fail, because evictors
 			// are likely to prefer to evict paused
 			// sandboxes rather than inactive sandboxes.
 			// Thus, if this fails, we'll try to handle it
 			// by just creating a new sandbox.
+			count(nil)
 			if err := sb.Unpause(); err != nil {
-				f.printf("discard sandbox %s due to Unpause error: %v", sb.ID(), err)
+				f.infof("discard sandbox %s due to Unpause error: %v", sb.ID(), err)
 				sb = nil
+				trackMem(0)
 			}
 		}
 
 		// if we don't already have a Sandbox, create one, and
 		// HTTP proxy over the channel
 		if sb == nil {
-			sb = nil
-			if f.lmgr.ImportCache != nil {
-				scratchDir := f.lmgr.scratchDirs.Make(f.name)
+			createStart := time.Now()
+			if sb = createSandbox(req); sb == nil {
+				finish(req)
+				continue // wait for another request before retrying
+			}
 
-				// we don't specify parent SB, because ImportCache.Create chooses it for us
-				sb, err = f.lmgr.ImportCache.Create(f.lmgr.sbPool, true, linst.codeDir, scratchDir, linst.meta)
-				if err != nil {
-					f.printf("failed to get Sandbox from import cache")
-					sb = nil
+			// with Features.Sandbox_self_test, make sure the
+			// new Sandbox answers at all before trusting it
+			// with a real request, replacing it (a few times)
+			// if it doesn't
+			for attempt := 1; common.Conf.Features.Sandbox_self_test; attempt++ {
+				err := selfTest(sb)
+				if err == nil {
+					break
+				}
+				common.IncCounter("lambda/" + f.name + "/self-test-failed")
+				f.warnf("discard sandbox %s, as it failed its self-test: %v", sb.ID(), err)
+				sb.Destroy()
+				sb = nil
+				if attempt >= SELF_TEST_ATTEMPTS {
+					req.fail(http.StatusServiceUnavailable, ERR_SANDBOX_CONNECT_FAILED,
+						fmt.Sprintf("no healthy Sandbox after %d attempts", attempt), err)
+					req.startFailed = true
+					break
+				}
+				if sb = createSandbox(req); sb == nil {
+					break
 				}
 			}
-
-			// import cache is either disabled or it failed
 			if sb == nil {
-				scratchDir := f.lmgr.scratchDirs.Make(f.name)
-				sb, err = f.lmgr.sbPool.Create(nil, true, linst.codeDir, scratchDir, linst.meta)
-			}
-
-			if err != nil {
-				req.w.WriteHeader(http.StatusInternalServerError)
-				req.w.Write([]byte("could not create Sandbox: " + err.Error() + "\n"))
-				f.doneChan <- req
+				finish(req)
 				continue // wait for another request before retrying
 			}
-
-			if err != nil {
-				req.w.WriteHeader(http.StatusInternalServerError)
-				req.w.Write([]byte("could not connect to Sandbox: " + err.Error() + "\n"))
-				f.doneChan <- req
-				f.printf("discard sandbox %s due to Channel error: %v", sb.ID(), err)
-				sb = nil
-				continue // wait for another request before retrying
+			f.observePhase("create", time.Since(createStart))
+			sbEgress = egressKey(linst.meta)
+			egressDenied = 0
+			sbCreated = time.Now()
+			sbRequests = 0
+
+			if linst.hot {
+				count(&f.numHot)
 			}
 		}
 
 		// below here, we're guaranteed (1) sb != nil, (2) sb is unpaused
 
-		// serve until we incoming queue is empty
-		for req != nil {
-			// ask Sandbox to respond, via HTTP proxy
-			t := common.T0("ServeHTTP")
-			var tb TimeoutBroker
-			const NANOSEC_PER_MS = 1000000
-			var chosen_timeout int64
-
-			default_timeout := common.Conf.Limits.Max_timeout_ms
-			override_timeout := linst.meta.Timeout_Time
-
-			// Resolve timeout:
-			// In general, use the override timeout if it is lower than the default timeout. Otherwise, use the default timeout
-			// An exception is if the default timeout is <=0... then always use the override timeout
-			// Another exception (second precedence) is if the override timeout is <=0... then use the default timeout
-			if default_timeout <= 0 {
-				chosen_timeout = override_timeout
-			} else if override_timeout <= 0 {
-				chosen_timeout = default_timeout
-			} else if override_timeout < default_timeout {
-				chosen_timeout = override_timeout
-			} else {
-				chosen_timeout = default_timeout
+		// serve until the incoming queue is empty (the first
+		// request was claimed above), up to concurrency requests
+		// at a time.  After a timeout, a kill, or once sb should
+		// be replaced, no more requests are started, and sb is
+		// dealt with once the ones in progress are done
+		first := req
+		active := 0
+		timedout, recycle, unreachable := false, false, false
+		var killed chan bool = nil
+		for {
+			if req != nil && req != first && !req.retried && !req.claim() {
+				finish(req) // expired in the queue
+				req = nil
+			} else if req != nil {
+				if req != first && !req.retried {
+					f.observePhase("queue", time.Since(req.start))
+				}
+				tb := brokers[len(brokers)-1]
+				brokers = brokers[:len(brokers)-1]
+				active += 1
+				if concurrency == 1 {
+					res := served{tb: tb}
+					res.timedout, res.recycle, res.retry = serve(sb, req, tb, false)
+					results <- res
+				} else {
+					go func(sb sandbox.Sandbox, req *Invocation, tb *TimeoutBroker) {
+						res := served{tb: tb}
+						res.timedout, res.recycle, res.retry = serve(sb, req, tb, true)
+						results <- res
+					}(sb, req, tb)
+					if len(brokers) == 0 && active < concurrency {
+						brokers = append(brokers, &TimeoutBroker{linst: linst})
+					}
+				}
+				req = nil
 			}
 
-			var conf_to_sec time.Duration = time.Duration(chosen_timeout * NANOSEC_PER_MS)
-
-			// Set timed out signal to false by default, invalid signal
-			tb.timedout = false
-			tb.timerinvalid = false
+			// check whether we should shutdown (non-blocking)
+			if killed == nil {
+				select {
+				case killed = <-linst.killChan:
+				default:
+				}
+			}
 
-			// case: timeout time is greater than 0, use it and start the timeout timer
-			// if it's not, then just ignore it (i.e. timeout is disabled)
-			if IsFiniteTimeout(chosen_timeout) {
-				ct, cf := context.WithTimeout(req.r.Context(), conf_to_sec)
-				tb.suicideTimer = time.AfterFunc(conf_to_sec, tb.CloseInstance)
-				tb.linst = linst
-				tb.cancel = cf
-				req.r = req.r.WithContext(ct)
+			// grab another request (non-blocking), if sb can
+			// take one
+			more := killed == nil && !timedout && !recycle && !unreachable && active < concurrency
+			if more {
+				if len(retries) > 0 {
+					req, retries = retries[0], retries[1:]
+					continue
+				}
+				select {
+				case req = <-linst.instChan:
+					atomic.AddInt64(&f.serving, 1)
+					continue
+				default:
+				}
+			}
+			if active == 0 {
+				break
 			}
 
-			sb.SendRequest(&req.w, req.r)
+			// wait for a request to finish (or, if there is
+			// room, for another to arrive)
+			var res served
+			if more {
+				select {
+				case res = <-results:
+				case req = <-linst.instChan:
+					atomic.AddInt64(&f.serving, 1)
+					continue
+				case killed = <-linst.killChan:
+					continue
+				}
+			} else {
+				res = <-results
+			}
+			active -= 1
+			brokers = append(brokers, res.tb)
+			sbRequests += 1
+
+			if res.retry != nil {
+				retries = append(retries, res.retry)
+				if !unreachable {
+					f.infof("discard sandbox %s, as its server could not be reached", sb.ID())
+				}
+				unreachable = true
+			} else if res.timedout {
+				timedout = true
+			} else if res.recycle && !recycle {
+				f.infof("discard sandbox %s at the handler's request", sb.ID())
+				recycle = true
+			} else if reason := sbWornOut(); reason != "" && !recycle && !timedout {
+				f.infof("discard sandbox %s, as %s", sb.ID(), reason)
+				recycle = true
+			}
+		}
 
-			if IsFiniteTimeout(chosen_timeout) {
-				tb.destlock.Lock()
-				tb.timerinvalid = true
-				tb.suicideTimer.Stop() // If request finishes, then shouldn't mark for del.
-				tb.destlock.Unlock()
+		if killed != nil {
+			destroy(!timedout && !unreachable)
+			count(nil)
+			sb = nil
+			trackMem(0)
+			for _, req := range retries {
+				req.fail(http.StatusServiceUnavailable, ERR_SHUTTING_DOWN, "lambda function is shutting down", nil)
+				finish(req)
 			}
+			killed <- true
+			return
+		}
 
-			if tb.timedout {
-				sb.Destroy() // Garbage collect sandbox state
-				req.w.Write([]byte("ERROR: Lambda took too long to respond, and has timed out.\n"))
+		// a destroyed Sandbox cannot serve anything else (and
+		// is no longer hot)
+		if recycle || timedout || unreachable {
+			if recycle && !timedout && !unreachable {
+				common.IncCounter("lambda/" + f.name + "/recycle")
 			}
+			destroy(!timedout && !unreachable) // Garbage collect sandbox state
+			count(nil)
+			sb = nil
+			trackMem(0)
+		}
 
-			t.T1()
-			req.execMs = int(t.Milliseconds)
-			f.doneChan <- req
+		// hot Sandboxes stay unpaused, so they keep their full
+		// memory allocation (only a paused Sandbox is downsized)
+		if sb == nil {
+			continue
+		}
 
-			// check whether we should shutdown (non-blocking)
-			select {
-			case killed := <-linst.killChan:
-				sb.Destroy()
-				killed <- true
-				return
-			default:
-			}
+		// measure after serving, when the handler's memory use
+		// is likely highest
+		measureMem()
+		countEgressDenied()
 
-			// grab another request (non-blocking)
-			select {
-			case req = <-f.instChan:
-			default:
-				req = nil
-			}
+		if linst.hot {
+			continue
 		}
 
 		if err := sb.Pause(); err != nil {
-			f.printf("discard sandbox %s due to Pause error: %v", sb.ID(), err)
+			f.warnf("discard sandbox %s due to Pause error: %v", sb.ID(), err)
 			sb = nil
+			trackMem(0)
+		} else {
+			count(&f.numPaused)
+		}
+	}
+}
+
+// check that a new Sandbox is alive, by pinging the server inside it
+// (see Features.Sandbox_self_test).  Any HTTP response will do, so this
+// needs nothing from the handler: the ping is an OPTIONS request,
+// which the Python server answers (with a 405) without even importing
+// the handler
+func selfTest(sb sandbox.Sandbox) error {
+	ctx, cancel := context.WithTimeout(context.Background(), SELF_TEST_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "OPTIONS", "http://container/ol-self-test", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := sb.RoundTrip(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("no response within %v", SELF_TEST_TIMEOUT)
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ask a handler to clean up before its Sandbox is destroyed (see
+// ol-shutdown-path)
+func shutdownHook(sb sandbox.Sandbox, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_HOOK_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://container"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(SHUTDOWN_HEADER, "true")
+	resp, err := sb.RoundTrip(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("no response within %v", SHUTDOWN_HOOK_TIMEOUT)
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// have a handler get ready before its new Sandbox serves requests
+// (see ol-warmup-path)
+func warmupHook(sb sandbox.Sandbox, path string) error {
+	timeout := time.Duration(common.Conf.Limits.Warmup_timeout_ms) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://container"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(WARMUP_HEADER, "true")
+	resp, err := sb.RoundTrip(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("no response within %v", timeout)
 		}
+		return err
 	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// a new scratch dir for a Sandbox running the given version of the
+// lambda (see ol-dir-mode)
+func (f *LambdaFunc) makeScratchDir(meta *sandbox.SandboxMeta) (string, error) {
+	if meta.DirMode != 0 {
+		return f.lmgr.scratchDirs.MakeMode(f.name, meta.DirMode)
+	}
+	return f.lmgr.scratchDirs.Make(f.name)
 }
 
 // signal the instance to die, return chan that can be used to block
-// until it's done
+// until it's done.  The chan is signaled even if the instance's Task
+// already exited (or exits without taking the kill), so the cleanup
+// task never waits on an instance that is gone.
 func (linst *LambdaInstance) AsyncKill() chan bool {
-	done := make(chan bool)
-	linst.killChan <- done
+	done := make(chan bool, 1)
+	killed := make(chan bool, 1)
+	select {
+	case linst.killChan <- killed:
+	case <-linst.exited:
+		done <- true
+		return done
+	}
+
+	go func() {
+		select {
+		case <-killed:
+		case <-linst.exited:
+		}
+		done <- true
+	}()
 	return done
 }
 
+// start timing a request that may run for d, returning the context
+// to serve it with, which is canceled if time runs out.  The timer is
+// allocated on first use and reset for each later request, rather
+// than allocating one (plus another for a context.WithTimeout) per
+// request.
+func (tb *TimeoutBroker) arm(ctx context.Context, d time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+
+	tb.destlock.Lock()
+	tb.cancel = cancel
+	tb.deadline = time.Now().Add(d)
+	tb.timedout = false
+	tb.timerinvalid = false
+	if tb.suicideTimer == nil {
+		tb.suicideTimer = time.AfterFunc(d, tb.CloseInstance)
+	} else {
+		tb.suicideTimer.Reset(d)
+	}
+	tb.destlock.Unlock()
+
+	return ctx
+}
+
+// stop timing the current request, releasing its context (which
+// must always be canceled, even on success), and report whether it
+// timed out
+func (tb *TimeoutBroker) disarm() bool {
+	tb.destlock.Lock()
+	defer tb.destlock.Unlock()
+
+	tb.timerinvalid = true
+	tb.suicideTimer.Stop()
+	tb.cancel()
+	return tb.timedout
+}
+
 // Wrapper to AsyncKill- a function explicitly for causing a lambda function
 // to self destruct
 func (tb *TimeoutBroker) CloseInstance() {
 
 	tb.destlock.Lock()
-	if !tb.timerinvalid {
+	// a timer that fired just as its request finished may only
+	// get the lock after the next request has re-armed the broker
+	if !tb.timerinvalid && !time.Now().Before(tb.deadline) {
 		fmt.Printf("WARNING: A lambda instance has timed out, and will now end itself.\n")
 		tb.timerinvalid = true
-		tb.suicideTimer.Stop()
 
 		// Set destruction bool
 		tb.timedout = true
 
-		// Cancel the current running request
+		// Cancel the current running request.  This closes
+		// the connection to the Sandbox, so SendRequest returns
+		// (with a 504 for the client) even if the handler never
+		// finishes; then the Sandbox is destroyed
 		tb.cancel()
 		fmt.Printf("INFO: Clean up for lambda instance engaged...\n")
 	}
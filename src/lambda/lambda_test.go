@@ -0,0 +1,717 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+func TestInvoke(t *testing.T) {
+	mgr, pool := newTestMgr(t, echoHandler)
+	registerLambda(t, "echo", "def f(event):\n    return event\n")
+
+	rec := invoke(t, mgr, "echo", `{"a": 1}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"a": 1}` {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if pool.numLive() != 1 {
+		t.Errorf("expected one Sandbox, got %d", pool.numLive())
+	}
+}
+
+// lookups of existing lambdas only take the read lock, so they
+// shouldn't slow down as more run at once
+func BenchmarkGetSameName(b *testing.B) {
+	mgr, _ := newTestMgr(b, echoHandler)
+	if _, err := mgr.Get("f"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := mgr.Get("f"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetDifferentNames(b *testing.B) {
+	mgr, _ := newTestMgr(b, echoHandler)
+	names := make([]string, 64)
+	for i := range names {
+		names[i] = fmt.Sprintf("f%d", i)
+		if _, err := mgr.Get(names[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := mgr.Get(names[i%len(names)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// creating a lambda (the slow path) must still happen exactly once
+// per name, however many ask for it at once
+func TestGetCreatesOnce(t *testing.T) {
+	mgr, _ := newTestMgr(t, echoHandler)
+
+	var wg sync.WaitGroup
+	got := make([]*LambdaFunc, 32)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := mgr.Get("f")
+			if err != nil {
+				t.Error(err)
+			}
+			got[i] = f
+		}(i)
+	}
+	wg.Wait()
+
+	for _, f := range got {
+		if f != got[0] {
+			t.Fatalf("Get created more than one LambdaFunc")
+		}
+	}
+}
+
+// when a lambda's first pull fails, its requests fail (rather than
+// the worker trying to start an instance with no code)
+func TestFailedFirstPull(t *testing.T) {
+	mgr, pool := newTestMgr(t, echoHandler)
+	path := filepath.Join(common.Conf.Registry, "broken.tar.gz")
+	if err := ioutil.WriteFile(path, []byte("not a tarball"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := invoke(t, mgr, "broken", "{}"); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if pool.numLive() != 0 {
+		t.Errorf("expected no Sandboxes, got %d", pool.numLive())
+	}
+}
+
+// wait for the Task's count of outstanding requests (and the requests
+// instances are serving) to get back to zero
+func waitIdle(t *testing.T, f *LambdaFunc) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(&f.numOutstanding) == 0 && atomic.LoadInt64(&f.serving) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d requests still outstanding (%d being served)",
+		atomic.LoadInt32(&f.numOutstanding), atomic.LoadInt64(&f.serving))
+}
+
+// every request the Task dispatches comes back to it exactly once,
+// whichever way it fails, so the outstanding count returns to zero
+// (without the periodic reconciliation having to correct it)
+func TestOutstandingAccounting(t *testing.T) {
+	slowHandler := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		echoHandler(w, r)
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		setup    func(f *LambdaFunc, pool *mockPool)
+		requests int
+		status   int // expected for every request, unless 0
+	}{
+		{name: "ok", handler: echoHandler, requests: 1, status: http.StatusOK},
+		{
+			name: "handler-error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			requests: 1,
+			status:   http.StatusInternalServerError,
+		},
+		{
+			name:    "create-failed",
+			handler: echoHandler,
+			setup: func(f *LambdaFunc, pool *mockPool) {
+				pool.createErr = errors.New("out of memory")
+			},
+			requests: 1,
+			status:   http.StatusInternalServerError,
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			setup: func(f *LambdaFunc, pool *mockPool) {
+				common.Conf.Limits.Max_timeout_ms = 50
+			},
+			requests: 1,
+			status:   http.StatusGatewayTimeout,
+		},
+		{
+			name:    "unreachable",
+			handler: echoHandler,
+			setup: func(f *LambdaFunc, pool *mockPool) {
+				pool.sendErrs = []error{fmt.Errorf("%w: connection refused", sandbox.ErrUnreachable)}
+			},
+			requests: 1,
+			status:   http.StatusOK,
+		},
+		{name: "concurrent", handler: slowHandler, requests: 8, status: http.StatusOK},
+		{
+			// some expire in the queue
+			name:    "queue-expired",
+			handler: slowHandler,
+			setup: func(f *LambdaFunc, pool *mockPool) {
+				common.Conf.Limits.Max_queue_ms = 20
+			},
+			requests: 8,
+		},
+		{
+			name:    "evicted",
+			handler: slowHandler,
+			setup: func(f *LambdaFunc, pool *mockPool) {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					f.Evict()
+				}()
+			},
+			requests: 4,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mgr, pool := newTestMgr(t, test.handler)
+			name := "accounting-" + test.name
+			registerLambda(t, name, "def f(event):\n    return event\n")
+			f, err := mgr.Get(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.setup != nil {
+				test.setup(f, pool)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < test.requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := invoke(t, mgr, name, "{}")
+					if test.status != 0 && rec.Code != test.status {
+						t.Errorf("expected %d, got %d: %s", test.status, rec.Code, rec.Body.String())
+					}
+				}()
+			}
+			wg.Wait()
+
+			waitIdle(t, f)
+			if drift := common.SnapshotStats()["lambda/"+name+"/outstanding-drift.cnt"]; drift != 0 {
+				t.Errorf("the outstanding count drifted %d times", drift)
+			}
+		})
+	}
+}
+
+// a small PNG, which has bytes that aren't valid UTF-8 (and a \r\n)
+func testPNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// a binary response reaches the client byte-for-byte, and nothing is
+// appended to it if the lambda times out partway
+func TestBinaryResponse(t *testing.T) {
+	pngBytes := testPNG(t)
+
+	t.Run("complete", func(t *testing.T) {
+		mgr, _ := newTestMgr(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Length", strconv.Itoa(len(pngBytes)))
+			w.Write(pngBytes)
+		})
+		registerLambda(t, "png", "def f(event):\n    return event\n")
+
+		rec := invoke(t, mgr, "png", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+			t.Errorf("got Content-Type %q", ct)
+		}
+		if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(len(pngBytes)) {
+			t.Errorf("got Content-Length %q, expected %d", cl, len(pngBytes))
+		}
+		if !bytes.Equal(rec.Body.Bytes(), pngBytes) {
+			t.Errorf("got %d bytes back, which differ from the %d sent", rec.Body.Len(), len(pngBytes))
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		half := len(pngBytes) / 2
+		mgr, _ := newTestMgr(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngBytes[:half])
+			<-r.Context().Done()
+		})
+		common.Conf.Limits.Max_timeout_ms = 50
+		registerLambda(t, "png", "def f(event):\n    return event\n")
+
+		rec := invoke(t, mgr, "png", "")
+		if !bytes.Equal(rec.Body.Bytes(), pngBytes[:half]) {
+			t.Errorf("expected the first %d bytes, got %d bytes: %q", half, rec.Body.Len(), rec.Body.Bytes())
+		}
+	})
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"echo", true},
+		{"Echo_2", true},
+		{"my-lambda.v2", true},
+		{"_private", true},
+		{"9lives", true},
+		{"a..", true}, // (just a name, not a path)
+		{strings.Repeat("a", 255), true},
+
+		{"", false},
+		{strings.Repeat("a", 256), false},
+		{".", false},
+		{"..", false},
+		{"../x", false},
+		{"..\\x", false},
+		{"a/b", false},
+		{"/etc", false},
+		{"a/../../b", false},
+		{".hidden", false},
+		{"-rf", false},
+		{"a b", false},
+		{"a\x00b", false},
+		{"a\n", false},
+		{"x\ny", false},
+		{"café", false},
+		{"\uff45\uff43\uff48\uff4f", false}, // fullwidth letters
+		{"a\u2215b", false},                 // division slash
+		{"\u2024\u2024", false},             // one-dot leaders
+		{"\u200becho", false},               // zero-width space
+		{"%2e%2e", false},
+	}
+
+	for _, test := range tests {
+		err := ValidateName(test.name)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.name)
+		}
+	}
+}
+
+// a parent context that the context package doesn't recognize, so
+// each child context made from it needs a goroutine watching it, for
+// as long as the child hasn't been canceled (a leak would show)
+type opaqueContext struct {
+	context.Context
+}
+
+// (or the context package would find the parent's cancelCtx through
+// the embedded Value)
+func (c opaqueContext) Value(key interface{}) interface{} { return nil }
+
+// arming and disarming the TimeoutBroker for many fast requests
+// leaves no contexts, timers or goroutines behind
+func TestTimeoutBrokerNoLeaks(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tb := &TimeoutBroker{}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10000; i++ {
+		ctx := tb.arm(opaqueContext{parent}, time.Hour)
+		if i == 0 {
+			defer tb.suicideTimer.Stop()
+		}
+		if tb.disarm() {
+			t.Fatalf("request %d timed out", i)
+		}
+		if ctx.Err() != context.Canceled {
+			t.Fatalf("request %d: context not canceled by disarm (%v)", i, ctx.Err())
+		}
+	}
+
+	// give the watching goroutines a moment to exit
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("%d goroutines before the requests, %d after", before, after)
+	}
+}
+
+// likewise for requests to a lambda (each of which is timed)
+func TestFastRequestsNoLeaks(t *testing.T) {
+	mgr, _ := newTestMgr(t, echoHandler)
+	registerLambda(t, "echo", "def f(event):\n    return event\n")
+	if rec := invoke(t, mgr, "echo", "{}"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 2000; i++ {
+		if rec := invoke(t, mgr, "echo", "{}"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rec.Code)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("%d goroutines before the requests, %d after", before, after)
+	}
+}
+
+// a request that runs out of time has its context canceled, but
+// the timer left over from it doesn't affect the next request
+func TestTimeoutBrokerTimeout(t *testing.T) {
+	tb := &TimeoutBroker{}
+	ctx := tb.arm(context.Background(), 10*time.Millisecond)
+	defer tb.suicideTimer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not canceled after the timeout")
+	}
+	if !tb.disarm() {
+		t.Errorf("disarm didn't report the timeout")
+	}
+
+	ctx = tb.arm(context.Background(), time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Errorf("next request canceled: %v", ctx.Err())
+	}
+	if tb.disarm() {
+		t.Errorf("next request reported as timed out")
+	}
+}
+
+// killing a function deletes its code, and a LambdaFunc created later
+// for the same lambda pulls the code again (rather than being handed
+// the deleted dir)
+func TestKillRemovesCode(t *testing.T) {
+	mgr, pool := newTestMgr(t, echoHandler)
+	registerLambda(t, "echo", "def f(event):\n    return event\n")
+	if rec := invoke(t, mgr, "echo", "{}"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	f, err := mgr.Get("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Kill()
+	codeDir := f.codeDir // (the Task is gone)
+	if codeDir == "" {
+		t.Fatal("no code dir after a successful invocation")
+	}
+	if _, err := os.Stat(codeDir); !os.IsNotExist(err) {
+		t.Errorf("%s still there after Kill (%v)", codeDir, err)
+	}
+	if n := pool.numLive(); n != 0 {
+		t.Errorf("%d sandboxes left after Kill", n)
+	}
+
+	// forget the killed function, so the next request creates a
+	// new one
+	mgr.mapMutex.Lock()
+	delete(mgr.lfuncMap, "echo")
+	mgr.mapMutex.Unlock()
+
+	if rec := invoke(t, mgr, "echo", "{}"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 after Kill, got %d: %s", rec.Code, rec.Body.String())
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if len(pool.live) == 0 {
+		t.Fatal("no sandbox for the new function")
+	}
+	for _, sb := range pool.live {
+		if sb.codeDir == codeDir {
+			t.Errorf("%s was handed out again", codeDir)
+		}
+		if _, err := os.Stat(filepath.Join(sb.codeDir, "f.py")); err != nil {
+			t.Errorf("code wasn't pulled again: %v", err)
+		}
+	}
+}
+
+// wait for a signal on done, failing after a second
+func waitDone(t *testing.T, done chan bool, what string) {
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s: no done signal", what)
+	}
+}
+
+// AsyncKill's done chan is signaled even if the instance's Task has
+// exited (or exits without taking the kill), however many times it is
+// called
+func TestAsyncKillExited(t *testing.T) {
+	linst := &LambdaInstance{killChan: make(chan chan bool, 1), exited: make(chan bool)}
+	close(linst.exited)
+	for i := 0; i < 3; i++ {
+		waitDone(t, linst.AsyncKill(), fmt.Sprintf("kill %d of an exited instance", i+1))
+	}
+
+	// the kill is queued, but the Task exits before taking it
+	linst = &LambdaInstance{killChan: make(chan chan bool, 1), exited: make(chan bool)}
+	done := linst.AsyncKill()
+	time.AfterFunc(10*time.Millisecond, func() { close(linst.exited) })
+	waitDone(t, done, "kill of an exiting instance")
+}
+
+// headers only the worker may send don't get through from clients
+func TestStripWorkerHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/run/f", nil)
+	r.Header.Set(SHUTDOWN_HEADER, "true")
+	r.Header.Set(WARMUP_HEADER, "true")
+	r.Header.Set(ORIGINAL_METHOD_HEADER, "HEAD")
+	r.Header.Set("X-Custom", "kept")
+
+	stripWorkerHeaders(r)
+	for _, name := range workerOnlyHeaders {
+		if r.Header.Get(name) != "" {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	if r.Header.Get("X-Custom") != "kept" {
+		t.Errorf("other headers were removed")
+	}
+}
+
+// a CodeSource that has no lambdas, and answers each Fetch only once
+// released
+type blockingSource struct {
+	fetching chan string
+	release  chan bool
+}
+
+func (s *blockingSource) Fetch(name string) (string, error) {
+	s.fetching <- name
+	<-s.release
+	return "", fmt.Errorf("%w: %s", ErrLambdaNotFound, name)
+}
+
+func (s *blockingSource) Reset(name string) {}
+
+// functions that retire (as they were not found) while the worker
+// shuts down don't hold up Cleanup, even if it is still waiting on
+// another function's request then
+func TestCleanupWhileRetiring(t *testing.T) {
+	serving, finish := make(chan bool, 1), make(chan bool)
+	mgr, _ := newTestMgrNoCleanup(t, func(w http.ResponseWriter, r *http.Request) {
+		serving <- true
+		<-finish
+	})
+	n := common.Conf.Limits.Pull_concurrency
+	source := &blockingSource{fetching: make(chan string, n), release: make(chan bool)}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		registerLambda(t, "slow", "def f(event):\n    return event\n")
+		invoke(t, mgr, "slow", "{}")
+	}()
+	<-serving
+
+	mgr.HandlerPuller.source = source
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			invoke(t, mgr, fmt.Sprintf("missing-%d", i), "{}")
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		<-source.fetching
+	}
+
+	// the functions find out they don't exist (and retire) while
+	// Cleanup waits for the slow request
+	done := make(chan bool)
+	go func() {
+		mgr.Cleanup()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(source.release)
+	time.Sleep(50 * time.Millisecond)
+	close(finish)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Cleanup did not return")
+	}
+	wg.Wait()
+}
+
+func TestRetireIdle(t *testing.T) {
+	interval := RECONCILE_INTERVAL
+	RECONCILE_INTERVAL = 5 * time.Millisecond
+	t.Cleanup(func() { RECONCILE_INTERVAL = interval })
+
+	mgr, _ := newTestMgr(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	common.Conf.Limits.Idle_func_retire_ms = 1
+	registerLambda(t, "idle", "def f(event):\n    return event\n")
+
+	if rec := invoke(t, mgr, "idle", "{}"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	f, err := mgr.Get("idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Evict()
+
+	select {
+	case <-f.retired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("idle function was not retired")
+	}
+	f.Kill()
+	select {
+	case <-f.exited:
+	default:
+		t.Fatalf("Kill returned before the Task exited")
+	}
+
+	// a new LambdaFunc takes over
+	if rec := invoke(t, mgr, "idle", "{}"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if g, _ := mgr.Get("idle"); g == f {
+		t.Fatalf("expected a new LambdaFunc")
+	}
+}
+
+func TestLookupDoesNotLoad(t *testing.T) {
+	mgr, _ := newTestMgr(t, func(w http.ResponseWriter, r *http.Request) {})
+	registerLambda(t, "cold", "def f(event):\n    return event\n")
+
+	if _, err := mgr.Lookup("../cold"); err == nil {
+		t.Fatalf("expected an error for an invalid name")
+	}
+	if f, err := mgr.Lookup("cold"); err != nil || f != nil {
+		t.Fatalf("expected no LambdaFunc, got %v, %v", f, err)
+	}
+
+	r := httptest.NewRequest("OPTIONS", "/run/cold", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	DefaultPreflight(rec, r)
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("unexpected preflight response: %d %v", rec.Code, rec.Header())
+	}
+	if f, _ := mgr.Lookup("cold"); f != nil {
+		t.Fatalf("preflight loaded the lambda")
+	}
+
+	f, err := mgr.Get("cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, err := mgr.Lookup("cold"); err != nil || g != f {
+		t.Fatalf("expected Lookup to find the LambdaFunc from Get")
+	}
+}
+
+func TestDiskWatcher(t *testing.T) {
+	dw := newDiskWatcher(t.TempDir(), 1)
+	dw.setMinMB(2)
+	if minMB := atomic.LoadInt64(&dw.minMB); minMB != 2 {
+		t.Fatalf("expected min free MB of 2, got %d", minMB)
+	}
+
+	dw.stop()
+	select {
+	case <-dw.exited:
+	default:
+		t.Fatalf("stop returned before watchTask exited")
+	}
+}
+
+// Cleanup mustn't leave goroutines behind that read the config, which
+// the next test replaces
+func TestCleanupWaitsForGoroutines(t *testing.T) {
+	mgr, _ := newTestMgrNoCleanup(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	registerLambda(t, "busy", "def f(event):\n    return event\n")
+	for i := 0; i < 4; i++ {
+		invoke(t, mgr, "busy", "{}")
+	}
+	mgr.Cleanup()
+
+	mgr.goroutines.Range(func(id, what interface{}) bool {
+		t.Errorf("goroutine %v still running after Cleanup: %v", id, what)
+		return true
+	})
+	select {
+	case <-mgr.disk.exited:
+	default:
+		t.Errorf("diskWatcher still running after Cleanup")
+	}
+}
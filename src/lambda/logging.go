@@ -0,0 +1,174 @@
+package lambda
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// at debug level, this much of each request and response body is
+// logged along with the headers
+const DEBUG_BODY_BYTES = 1024
+
+// a broken import cache would otherwise log a fallback warning for
+// every Sandbox created, so these are logged at most this often (per
+// lambda)
+const IMPORT_CACHE_FALLBACK_LOG_INTERVAL = 10 * time.Second
+
+// the level is kept in memory only, so it survives code pulls (the
+// LambdaFunc lives on, unless the new code changes ol-log-level), but
+// not worker restarts
+func (f *LambdaFunc) LogLevel() common.LogLevel {
+	return common.LogLevel(atomic.LoadInt32(&f.logLevel))
+}
+
+func (f *LambdaFunc) SetLogLevel(level common.LogLevel) {
+	atomic.StoreInt32(&f.logLevel, int32(level))
+	log.Printf("log level set to %s [FUNC %s]", level, f.name)
+}
+
+// when code with a different ol-log-level than the old code's (oldMeta
+// is nil for the first code) is deployed, switch to its level (or back
+// to Log_level, if it has none).  Otherwise, a level set with
+// SetLogLevel is kept.
+func (f *LambdaFunc) applyLogLevel(oldMeta *sandbox.SandboxMeta, meta *sandbox.SandboxMeta) {
+	oldLevel := ""
+	if oldMeta != nil {
+		oldLevel = oldMeta.LogLevel
+	}
+	if meta.LogLevel == oldLevel {
+		return
+	}
+
+	name := meta.LogLevel
+	if name == "" {
+		name = common.Conf.Log_level
+	}
+	if level, err := common.ParseLogLevel(name); err == nil {
+		f.SetLogLevel(level)
+	}
+}
+
+// add function name to each log message so we know which logs
+// correspond to which LambdaFuncs
+func (f *LambdaFunc) logf(level common.LogLevel, format string, args ...interface{}) {
+	if level < f.LogLevel() {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("%s: %s [FUNC %s]", strings.ToUpper(level.String()), strings.TrimRight(msg, "\n"), f.name)
+}
+
+func (f *LambdaFunc) debugf(format string, args ...interface{}) {
+	f.logf(common.LOG_DEBUG, format, args...)
+}
+
+func (f *LambdaFunc) infof(format string, args ...interface{}) {
+	f.logf(common.LOG_INFO, format, args...)
+}
+
+func (f *LambdaFunc) warnf(format string, args ...interface{}) {
+	f.logf(common.LOG_WARN, format, args...)
+}
+
+func (f *LambdaFunc) errorf(format string, args ...interface{}) {
+	f.logf(common.LOG_ERROR, format, args...)
+}
+
+// logLimiter keeps a repetitive message from flooding the log: at
+// most one message per interval gets through, and the others are
+// only counted
+type logLimiter struct {
+	mutex      sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// should a message be logged now?  If so, also returns how many
+// messages were suppressed since the last one that was logged
+func (l *logLimiter) allow(interval time.Duration) (bool, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if !l.last.IsZero() && now.Sub(l.last) < interval {
+		l.suppressed += 1
+		return false, 0
+	}
+
+	suppressed := l.suppressed
+	l.last = now
+	l.suppressed = 0
+	return true, suppressed
+}
+
+// keeps a copy of the first limit bytes of the response body
+type bodyCaptureWriter struct {
+	http.ResponseWriter
+	limit     int
+	body      []byte
+	truncated bool
+}
+
+func (w *bodyCaptureWriter) Write(b []byte) (int, error) {
+	room := w.limit - len(w.body)
+	if room > 0 {
+		w.body = append(w.body, b[:common.Min(room, len(b))]...)
+	}
+	if room < len(b) {
+		w.truncated = true
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// read the first limit bytes of the request body, then put them back
+// so that whoever reads the body next still sees all of it
+func peekBody(r *http.Request, limit int) (prefix []byte, truncated bool) {
+	buf := make([]byte, limit+1)
+	n, _ := io.ReadFull(r.Body, buf)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf[:n]), r.Body), r.Body}
+
+	if n > limit {
+		return buf[:limit], true
+	}
+	return buf[:n], false
+}
+
+// at debug level, log the request, and prepare to log the response
+// (the returned writer should be passed to debugResponse).  The part
+// of the body we read for logging is put back, so the Sandbox still
+// sees all of it.  Headers in Record.Redact_headers (e.g.,
+// credentials) are left out of the log.
+func (f *LambdaFunc) debugRequest(req *Invocation) *bodyCaptureWriter {
+	if f.LogLevel() > common.LOG_DEBUG {
+		return nil
+	}
+
+	prefix, _ := peekBody(req.r, DEBUG_BODY_BYTES)
+	header := req.r.Header.Clone()
+	redactHeaders(header)
+	f.debugf("request %s %s, headers=%v, body=%q", req.r.Method, req.r.URL.Path, header, prefix)
+	cw := &bodyCaptureWriter{ResponseWriter: req.w, limit: DEBUG_BODY_BYTES}
+	req.w = cw
+	return cw
+}
+
+func (f *LambdaFunc) debugResponse(req *Invocation, cw *bodyCaptureWriter) {
+	if cw != nil {
+		header := cw.Header().Clone()
+		redactHeaders(header)
+		f.debugf("response status=%d, headers=%v, body=%q", req.sw.status, header, cw.body)
+	}
+}
@@ -0,0 +1,175 @@
+package lambda
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// a SandboxPool whose Sandboxes answer requests with handler, in
+// process, so lambdas can run without containers
+type mockPool struct {
+	mutex   sync.Mutex
+	handler http.HandlerFunc
+	nextId  int
+	live    map[string]*mockSandbox
+
+	// returned by Create, if set
+	createErr error
+
+	// returned by the next SendRequests (one per element), in
+	// place of running handler
+	sendErrs []error
+
+	// called by SendRequest before handler (e.g., to read part of
+	// the body), if set; an error is returned in place of running
+	// handler
+	beforeSend func(req *http.Request) error
+}
+
+type mockSandbox struct {
+	// (never used by the lambda package, which only needs the
+	// unexported methods to exist)
+	sandbox.Sandbox
+
+	pool    *mockPool
+	id      string
+	codeDir string
+	meta    *sandbox.SandboxMeta
+}
+
+func (p *mockPool) Create(parent sandbox.Sandbox, isLeaf bool, codeDir, scratchDir string, meta *sandbox.SandboxMeta) (sandbox.Sandbox, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.createErr != nil {
+		return nil, p.createErr
+	}
+	p.nextId += 1
+	sb := &mockSandbox{pool: p, id: fmt.Sprintf("mock-%d", p.nextId), codeDir: codeDir, meta: meta}
+	p.live[sb.id] = sb
+	return sb, nil
+}
+
+func (p *mockPool) Cleanup()                                     {}
+func (p *mockPool) AddListener(handler sandbox.SandboxEventFunc) {}
+func (p *mockPool) DebugString() string                          { return "mock pool\n" }
+
+// how many Sandboxes have been created and not destroyed
+func (p *mockPool) numLive() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.live)
+}
+
+func (sb *mockSandbox) ID() string                 { return sb.id }
+func (sb *mockSandbox) Pause() error               { return nil }
+func (sb *mockSandbox) Unpause() error             { return nil }
+func (sb *mockSandbox) Meta() *sandbox.SandboxMeta { return sb.meta }
+func (sb *mockSandbox) MemoryUsage() (int, error)  { return 0, sandbox.STATUS_UNSUPPORTED }
+func (sb *mockSandbox) DebugString() string        { return sb.id + "\n" }
+func (sb *mockSandbox) Status(sandbox.SandboxStatus) (string, error) {
+	return "", sandbox.STATUS_UNSUPPORTED
+}
+
+func (sb *mockSandbox) Destroy() {
+	sb.pool.mutex.Lock()
+	defer sb.pool.mutex.Unlock()
+	delete(sb.pool.live, sb.id)
+}
+
+func (sb *mockSandbox) SendRequest(rw *http.ResponseWriter, req *http.Request) error {
+	sb.pool.mutex.Lock()
+	var err error
+	if len(sb.pool.sendErrs) > 0 {
+		err, sb.pool.sendErrs = sb.pool.sendErrs[0], sb.pool.sendErrs[1:]
+	}
+	handler, beforeSend := sb.pool.handler, sb.pool.beforeSend
+	sb.pool.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if beforeSend != nil {
+		if err := beforeSend(req); err != nil {
+			return err
+		}
+	}
+	handler(*rw, req)
+	return nil
+}
+
+func (sb *mockSandbox) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	sb.pool.handler(rec, req)
+	return rec.Result(), nil
+}
+
+// a LambdaMgr with a fresh worker dir and registry, whose Sandboxes
+// come from the returned mockPool (which answers with handler)
+func newTestMgr(t testing.TB, handler http.HandlerFunc) (*LambdaMgr, *mockPool) {
+	mgr, pool := newTestMgrNoCleanup(t, handler)
+	t.Cleanup(mgr.Cleanup)
+	return mgr, pool
+}
+
+// like newTestMgr, for tests that call mgr.Cleanup themselves
+func newTestMgrNoCleanup(t testing.TB, handler http.HandlerFunc) (*LambdaMgr, *mockPool) {
+	dir := t.TempDir()
+	if err := common.LoadDefaults(dir); err != nil {
+		t.Fatal(err)
+	}
+	common.Conf.Features.Import_cache = false
+	common.Conf.Features.Handoff = false
+	common.Conf.Limits.Min_free_disk_mb = 0
+	if err := os.MkdirAll(common.Conf.Registry, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &mockPool{handler: handler, live: make(map[string]*mockSandbox)}
+	newSandboxPool = func(name string, sizeMb int) (sandbox.SandboxPool, error) {
+		return pool, nil
+	}
+	t.Cleanup(func() {
+		newSandboxPool = sandbox.SandboxPoolFromConfig
+	})
+
+	mgr, err := NewLambdaMgr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mgr, pool
+}
+
+// add a Python lambda to the registry
+func registerLambda(t testing.TB, name string, code string) {
+	path := filepath.Join(common.Conf.Registry, name+".py")
+	if err := ioutil.WriteFile(path, []byte(code), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// invoke a lambda as a client would
+func invoke(t testing.TB, mgr *LambdaMgr, name string, body string) *httptest.ResponseRecorder {
+	f, err := mgr.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	f.Invoke(rec, httptest.NewRequest("POST", "/run/"+name, strings.NewReader(body)))
+	return rec
+}
+
+// echo the request body
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	w.Write(b)
+}
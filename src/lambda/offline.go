@@ -0,0 +1,251 @@
+package lambda
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// package names as in PEP 503 (but with only one separator replaced
+// at a time, which is enough for the names in wheel and sdist files)
+func canonicalName(name string) string {
+	return strings.NewReplacer("_", "-", ".", "-").Replace(strings.ToLower(name))
+}
+
+// the name and version of the package in a wheel or sdist file ("" if
+// it isn't one).  A wheel's name can't have "-" in it (it is escaped
+// as "_"), but an sdist's can, so its version follows the last "-".
+func distFileVersion(file string) (name string, version string) {
+	if strings.HasSuffix(file, ".whl") {
+		parts := strings.Split(strings.TrimSuffix(file, ".whl"), "-")
+		if len(parts) < 5 {
+			return "", ""
+		}
+		return canonicalName(parts[0]), parts[1]
+	}
+
+	for _, ext := range []string{".tar.gz", ".zip", ".tar.bz2"} {
+		if strings.HasSuffix(file, ext) {
+			base := strings.TrimSuffix(file, ext)
+			if i := strings.LastIndex(base, "-"); i > 0 {
+				return canonicalName(base[:i]), base[i+1:]
+			}
+		}
+	}
+	return "", ""
+}
+
+// the files in dir for pkg ("name", or "name==version"); pip picks the
+// one that suits the Sandbox's Python and platform
+func offlineFiles(dir string, pkg string) ([]string, error) {
+	name, version := pkg, ""
+	if i := strings.Index(pkg, "=="); i >= 0 {
+		name, version = pkg[:i], pkg[i+2:]
+	}
+	name = canonicalName(name)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, entry := range entries {
+		fileName, fileVersion := distFileVersion(entry.Name())
+		if fileName == name && (version == "" || fileVersion == version) {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// put pkg's files from the offline dir (see Package.Offline_dir) in
+// wheelDir, for pip to install from
+func copyOfflineFiles(offlineDir string, pkg string, wheelDir string) error {
+	files, err := offlineFiles(offlineDir, pkg)
+	if err != nil {
+		return err
+	} else if len(files) == 0 {
+		common.IncCounter("packages/offline-missing")
+		return fmt.Errorf("package not available offline: %s", pkg)
+	}
+
+	if err := os.MkdirAll(wheelDir, 0700); err != nil {
+		return err
+	}
+	for _, file := range files {
+		dst := filepath.Join(wheelDir, filepath.Base(file))
+
+		// (a link is enough if they're on the same filesystem)
+		if err := os.Link(file, dst); err == nil {
+			continue
+		}
+		if err := copyFile(file, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// pip download the given (pinned) packages to dir/wheels, in a Sandbox
+// (like installs), returning the names of the files.  If platforms is
+// not empty, only binary wheels for those platforms (e.g.,
+// "manylinux2014_x86_64") are downloaded.
+func (pp *PackagePuller) Download(ctx context.Context, python string, pkgs []string, platforms []string, dir string) ([]string, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "wheels"), 0700); err != nil {
+		return nil, err
+	}
+
+	meta := &sandbox.SandboxMeta{
+		MemLimitMB: common.Conf.Limits.Installer_mem_mb,
+		Python:     python,
+	}
+	sb, err := pp.sbPool.Create(nil, true, pp.pipLambda, dir, meta)
+	if err != nil {
+		return nil, err
+	}
+	defer sb.Destroy()
+
+	msg, err := json.Marshal(map[string]interface{}{
+		"download":  true,
+		"pkgs":      pkgs,
+		"platforms": platforms,
+		"python":    python,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://container/run/pip-install", bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sb.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download lambda returned status %d, body '%s'", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Files []string `json:"Files"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	return result.Files, nil
+}
+
+// Prefetch downloads the wheels (or sdists) of every package the
+// lambda's current code runs with (see Dependencies), at the versions
+// installed here, and writes them to w as a .tar.gz, which can be
+// unpacked into the Package.Offline_dir of workers without internet
+// access.  The code is pulled first, if it hasn't been.
+func (f *LambdaFunc) Prefetch(ctx context.Context, w io.Writer, platforms []string) error {
+	report := f.Dependencies()
+	if report == nil {
+		if err := f.Prewarm(); err != nil {
+			return err
+		}
+		if report = f.Dependencies(); report == nil {
+			return fmt.Errorf("no code has been pulled for %s", f.name)
+		}
+	}
+
+	pkgs := []string{}
+	for name, version := range report.Resolved {
+		if version != "" {
+			name += "==" + version
+		}
+		pkgs = append(pkgs, name)
+	}
+	sort.Strings(pkgs)
+
+	dir, err := f.lmgr.scratchDirs.Make("prefetch-" + f.name)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	f.infof("prefetch %d packages", len(pkgs))
+	files := []string{}
+	if len(pkgs) > 0 {
+		files, err = f.lmgr.PackagePuller.Download(ctx, report.Python, pkgs, platforms, dir)
+		if err != nil {
+			return err
+		}
+	}
+	common.AddSum("packages/prefetched", int64(len(files)))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range files {
+		if err := addTarFile(tw, filepath.Join(dir, "wheels", name), name); err != nil {
+			log.Printf("could not add %s to prefetch of %s: %v", name, f.name, err)
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addTarFile(tw *tar.Writer, path string, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
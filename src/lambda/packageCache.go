@@ -0,0 +1,162 @@
+package lambda
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+var errLayerNotFound = errors.New("package layer not found")
+
+// PackageCache holds pre-built package layers, so a worker can
+// extract a package instead of pip installing it (see Package_cache
+// in the config).  A layer is a .tar.gz of what pip installs for a
+// pinned package (name==version), stored at
+// <location>/[py<version>/]<name>==<version>.tar.gz, beside a
+// .tar.gz.sha256 file holding the hex SHA-256 of the layer.
+type PackageCache interface {
+	// open the layer for pkg (name==version) built for the given
+	// Python ("" for the default), and return its expected
+	// checksum.  If there is no such layer, the error wraps
+	// errLayerNotFound.
+	Open(python, pkg string) (layer io.ReadCloser, sha256Hex string, err error)
+}
+
+// create a PackageCache for a location, which is either a directory
+// or an http(s):// URL
+func NewPackageCache(location string) PackageCache {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return &webPackageCache{prefix: strings.TrimRight(location, "/"), client: &http.Client{}}
+	}
+	return &localPackageCache{prefix: location}
+}
+
+type localPackageCache struct {
+	prefix string
+}
+
+func (c *localPackageCache) Open(python, pkg string) (io.ReadCloser, string, error) {
+	layerPath := filepath.Join(c.prefix, sandbox.PackagesSubdir(python), pkg+".tar.gz")
+	sum, err := ioutil.ReadFile(layerPath + ".sha256")
+	if os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("%w: %s", errLayerNotFound, layerPath)
+	} else if err != nil {
+		return nil, "", err
+	}
+	layer, err := os.Open(layerPath)
+	if os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("%w: %s", errLayerNotFound, layerPath)
+	} else if err != nil {
+		return nil, "", err
+	}
+	return layer, strings.TrimSpace(string(sum)), nil
+}
+
+type webPackageCache struct {
+	prefix string
+	client *http.Client
+}
+
+func (c *webPackageCache) get(url string) (io.ReadCloser, error) {
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", errLayerNotFound, url)
+	} else if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s returned status %d", url, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (c *webPackageCache) Open(python, pkg string) (io.ReadCloser, string, error) {
+	url := c.prefix + "/" + path.Join(sandbox.PackagesSubdir(python), pkg+".tar.gz")
+	sumBody, err := c.get(url + ".sha256")
+	if err != nil {
+		return nil, "", err
+	}
+	defer sumBody.Close()
+	sum, err := ioutil.ReadAll(io.LimitReader(sumBody, 1024))
+	if err != nil {
+		return nil, "", err
+	}
+
+	layer, err := c.get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	return layer, strings.TrimSpace(string(sum)), nil
+}
+
+// try to fill dir with p's layer from the package cache, instead of
+// pip installing it.  Returns false (leaving dir empty) if there is
+// no cache, no layer for p, or the layer is bad, in which case the
+// caller should install p as usual.
+func (pp *PackagePuller) installFromCache(p *Package, dir string) bool {
+	// only a pinned version identifies a layer
+	if pp.cache == nil || !strings.Contains(p.name, "==") {
+		return false
+	}
+
+	err := extractLayer(pp.cache, p.python, p.name, dir)
+	if errors.Is(err, errLayerNotFound) {
+		common.IncCounter("package-cache/miss")
+		return false
+	} else if err != nil {
+		common.IncCounter("package-cache/error")
+		log.Printf("could not use cached layer for %s, falling back to pip: %v", p.name, err)
+		os.RemoveAll(dir)
+		os.MkdirAll(dir, 0700)
+		return false
+	}
+
+	common.IncCounter("package-cache/hit")
+	log.Printf("extracted %s from the package cache to %s", p.name, dir)
+	return true
+}
+
+// download a layer (checking its checksum), then extract it into dir
+func extractLayer(cache PackageCache, python, pkg, dir string) error {
+	layer, sum, err := cache.Open(python, pkg)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	tmp, err := ioutil.TempFile("", "ol-layer-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), layer); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, sum) {
+		return fmt.Errorf("layer checksum is %s, expected %s", actual, sum)
+	}
+
+	cmd := exec.Command("tar", "-xzf", tmp.Name(), "--directory", dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s :: %s", err, string(output))
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package lambda
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +14,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 	"github.com/open-lambda/open-lambda/ol/sandbox"
@@ -89,17 +91,58 @@ def deps(dirname):
                     rv.add(name)
     return list(rv)
 
+def version(dirname):
+    path = None
+    for name in os.listdir(dirname):
+        if name.endswith('-info'):
+            path = os.path.join(dirname, name, "METADATA")
+    if path == None or not os.path.exists(path):
+        return ""
+
+    with open(path, encoding='utf-8') as f:
+        for line in f:
+            prefix = 'Version: '
+            if line.startswith(prefix):
+                return line[len(prefix):].strip()
+    return ""
+
+# download (but don't install) pinned packages to /host/wheels, for
+# workers without internet access
+def download(pip, event):
+    opts = ''
+    for plat in event.get("platforms") or []:
+        opts += ' --platform %s' % plat
+    if opts:
+        opts += ' --only-binary=:all:'
+    for pkg in event["pkgs"]:
+        rc = os.system('%s download --no-deps%s -d /host/wheels %s' % (pip, opts, pkg))
+        print('pip download returned code %d' % rc)
+        assert rc == 0, 'could not download %s' % pkg
+    return {"Files": sorted(os.listdir("/host/wheels"))}
+
 def f(event):
+    # for a non-default Python, use that interpreter's pip
+    pip = 'pip3'
+    if event.get("python"):
+        pip = sys.executable + ' -m pip'
+    if event.get("download"):
+        return download(pip, event)
     pkg = event["pkg"]
     alreadyInstalled = event["alreadyInstalled"]
     if not alreadyInstalled:
-        rc = os.system('pip3 install --no-deps %s -t /host/files' % pkg)
+        # offline, the worker copies the package's files to
+        # /host/wheels, and pip must not look anywhere else
+        opts = ''
+        if event.get("offline"):
+            opts = ' --no-index --find-links /host/wheels'
+        rc = os.system('%s install --no-deps%s %s -t /host/files' % (pip, opts, pkg))
         print('pip install returned code %d' % rc)
         assert(rc == 0)
     name = pkg.split("==")[0]
     d = deps("/host/files")
     t = top("/host/files")
-    return {"Deps":d, "TopLevel":t}
+    v = version("/host/files")
+    return {"Deps":d, "TopLevel":t, "Version":v}
 `
 
 /*
@@ -113,20 +156,30 @@ type PackagePuller struct {
 	// directory of lambda code that installs pip packages
 	pipLambda string
 
+	// pre-built packages to try before pip (nil if there are
+	// none; see Package_cache)
+	cache PackageCache
+
 	packages sync.Map
 }
 
 type Package struct {
 	name         string
+	python       string // "" for the default python3
 	meta         PackageMeta
 	installMutex sync.Mutex
 	installed    uint32
+
+	// bytes the package takes on disk, measured once it is
+	// installed (accessed atomically)
+	sizeBytes int64
 }
 
 // the pip-install admin lambda returns this
 type PackageMeta struct {
 	Deps     []string `json:"Deps"`
 	TopLevel []string `json:"TopLevel"`
+	Version  string   `json:"Version"` // what pip actually installed
 }
 
 func NewPackagePuller(sbPool sandbox.SandboxPool, depTracer *DepTracer) (*PackagePuller, error) {
@@ -151,6 +204,9 @@ func NewPackagePuller(sbPool sandbox.SandboxPool, depTracer *DepTracer) (*Packag
 		depTracer: depTracer,
 		pipLambda: pipLambda,
 	}
+	if common.Conf.Package_cache != "" {
+		installer.cache = NewPackageCache(common.Conf.Package_cache)
+	}
 
 	return installer, nil
 }
@@ -162,26 +218,65 @@ func normalizePkg(pkg string) string {
 	return strings.ReplaceAll(strings.ToLower(pkg), "_", "-")
 }
 
-// "pip install" missing packages to Conf.Pkgs_dir
-func (pp *PackagePuller) InstallRecursive(installs []string) ([]string, error) {
+// "pip install" missing packages to Conf.Pkgs_dir (or a subdirectory,
+// for a non-default Python version; see sandbox.PackagesSubdir)
+//
+// if ctx is done before all installs finish, the in-progress install
+// is killed and an error is returned.  Installs also stop with an
+// error if they exceed Limits.Max_install_pkgs or
+// Limits.Max_install_depth (the error names the chain of
+// dependencies that led there).
+func (pp *PackagePuller) InstallRecursive(ctx context.Context, python string, installs []string) ([]string, error) {
 	// shrink capacity to length so that our appends are not
 	// visible to caller
 	installs = installs[:len(installs):len(installs)]
 
-	installSet := make(map[string]bool)
-	for _, install := range installs {
+	// for each install, which install depended on it (-1 for
+	// those the caller asked for), and how deep it is
+	parents := make([]int, len(installs))
+	depths := make([]int, len(installs))
+
+	installSet := make(map[string]int) // name -> index in installs
+	for i, install := range installs {
 		name := strings.Split(install, "==")[0]
-		installSet[name] = true
+		installSet[name] = i
+		parents[i] = -1
+		depths[i] = 1
 	}
 
+	// how we got to installs[i], e.g., "a -> b -> c"
+	chain := func(i int) string {
+		names := []string{}
+		for ; i >= 0; i = parents[i] {
+			names = append([]string{installs[i]}, names...)
+		}
+		return strings.Join(names, " -> ")
+	}
+
+	// is installs[ancestor] on the chain to installs[i]?
+	dependsOn := func(i int, ancestor int) bool {
+		for ; i >= 0; i = parents[i] {
+			if i == ancestor {
+				return true
+			}
+		}
+		return false
+	}
+
+	maxPkgs := common.Conf.Limits.Max_install_pkgs
+	maxDepth := common.Conf.Limits.Max_install_depth
+
 	// Installs may grow as we loop, because some installs have
 	// deps, leading to other installs
 	for i := 0; i < len(installs); i++ {
 		pkg := installs[i]
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("gave up installing %v before %s: %v", installs, chain(i), err)
+		}
 		if common.Conf.Trace.Package {
 			log.Printf("On %v of %v", pkg, installs)
 		}
-		p, err := pp.GetPkg(pkg)
+		p, err := pp.GetPkg(ctx, python, pkg)
 		if err != nil {
 			return nil, err
 		}
@@ -193,26 +288,79 @@ func (pp *PackagePuller) InstallRecursive(installs []string) ([]string, error) {
 
 		// push any previously unseen deps on the list of ones to install
 		for _, dep := range p.meta.Deps {
-			if !installSet[dep] {
-				installs = append(installs, dep)
-				installSet[dep] = true
+			if j, ok := installSet[dep]; ok {
+				// a dep we already have never needs to
+				// be followed again, which is what
+				// breaks cycles
+				if dependsOn(i, j) {
+					log.Printf("ignoring dependency cycle %s -> %s", chain(i), dep)
+				}
+				continue
+			}
+
+			if maxDepth > 0 && depths[i]+1 > maxDepth {
+				return nil, fmt.Errorf("dependencies nest deeper than limits.max_install_depth (%d): %s -> %s",
+					maxDepth, chain(i), dep)
 			}
+			if maxPkgs > 0 && len(installs)+1 > maxPkgs {
+				return nil, fmt.Errorf("more than limits.max_install_pkgs (%d) packages needed, stopped at %s -> %s",
+					maxPkgs, chain(i), dep)
+			}
+
+			installSet[dep] = len(installs)
+			installs = append(installs, dep)
+			parents = append(parents, i)
+			depths = append(depths, depths[i]+1)
 		}
 	}
 
 	return installs, nil
 }
 
+// the versions pip actually installed for a list of packages
+// returned by InstallRecursive (key=package name, value=version).
+// Packages that aren't installed are left out.
+func (pp *PackagePuller) ResolvedVersions(python string, installs []string) map[string]string {
+	resolved := make(map[string]string)
+	for _, install := range installs {
+		pkg := normalizePkg(install)
+		tmp, ok := pp.packages.Load(filepath.Join(sandbox.PackagesSubdir(python), pkg))
+		if !ok || atomic.LoadUint32(&tmp.(*Package).installed) == 0 {
+			continue
+		}
+		resolved[strings.Split(pkg, "==")[0]] = tmp.(*Package).meta.Version
+	}
+	return resolved
+}
+
+// the size of each installed package in a list returned by
+// InstallRecursive (key=package, value=bytes), from the sizes
+// measured at install time.  Packages that aren't installed are left
+// out.
+func (pp *PackagePuller) InstalledSizes(python string, installs []string) map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, install := range installs {
+		pkg := normalizePkg(install)
+		tmp, ok := pp.packages.Load(filepath.Join(sandbox.PackagesSubdir(python), pkg))
+		if !ok || atomic.LoadUint32(&tmp.(*Package).installed) == 0 {
+			continue
+		}
+		sizes[pkg] = atomic.LoadInt64(&tmp.(*Package).sizeBytes)
+	}
+	return sizes
+}
+
 // does the pip install in a Sandbox, taking care to never install the
 // same Sandbox more than once.
 //
 // the fast/slow path code is tweaked from the sync.Once code, the
 // difference being that may try the installed more than once, but we
 // will never try more after the first success
-func (pp *PackagePuller) GetPkg(pkg string) (*Package, error) {
-	// get (or create) package
+func (pp *PackagePuller) GetPkg(ctx context.Context, python string, pkg string) (*Package, error) {
+	// get (or create) package; each Python version has its own
 	pkg = normalizePkg(pkg)
-	tmp, _ := pp.packages.LoadOrStore(pkg, &Package{name: pkg})
+	key := filepath.Join(sandbox.PackagesSubdir(python), pkg)
+	tmp, _ := pp.packages.LoadOrStore(key, &Package{name: pkg, python: python})
 	p := tmp.(*Package)
 
 	// fast path
@@ -224,9 +372,17 @@ func (pp *PackagePuller) GetPkg(pkg string) (*Package, error) {
 	p.installMutex.Lock()
 	defer p.installMutex.Unlock()
 	if p.installed == 0 {
-		if err := pp.sandboxInstall(p); err != nil {
+		if err := pp.sandboxInstall(ctx, p); err != nil {
 			return p, err
 		} else {
+			// (a package is never reinstalled, so its size
+			// only needs measuring once)
+			dir := filepath.Join(common.Conf.Pkgs_dir, sandbox.PackagesSubdir(p.python), p.name)
+			if size, err := dirSizeBytes(dir); err != nil {
+				log.Printf("could not measure size of package %s: %v", p.name, err)
+			} else {
+				atomic.StoreInt64(&p.sizeBytes, size)
+			}
 			atomic.StoreUint32(&p.installed, 1)
 			pp.depTracer.TracePackage(p)
 			return p, nil
@@ -239,14 +395,14 @@ func (pp *PackagePuller) GetPkg(pkg string) (*Package, error) {
 // do the pip install within a new Sandbox, to a directory mapped from
 // the host.  We want the package on the host to share with all, but
 // want to run the install in the Sandbox because we don't trust it.
-func (pp *PackagePuller) sandboxInstall(p *Package) (err error) {
+func (pp *PackagePuller) sandboxInstall(ctx context.Context, p *Package) (err error) {
 	t := common.T0("pull-package")
 	defer t.T1()
 
 	// the pip-install lambda installs to /host, which is the the
 	// same as scratchDir, which is the same as a sub-directory
 	// named after the package in the packages dir
-	scratchDir := filepath.Join(common.Conf.Pkgs_dir, p.name)
+	scratchDir := filepath.Join(common.Conf.Pkgs_dir, sandbox.PackagesSubdir(p.python), p.name)
 	log.Printf("do pip install, using scratchDir='%v'", scratchDir)
 
 	alreadyInstalled := false
@@ -255,10 +411,14 @@ func (pp *PackagePuller) sandboxInstall(p *Package) (err error) {
 		log.Printf("%s appears already installed from previous run of OL", p.name)
 		alreadyInstalled = true
 	} else {
-		log.Printf("run pip install %s from a new Sandbox to %s on host", p.name, scratchDir)
-		if err := os.Mkdir(scratchDir, 0700); err != nil {
+		if err := os.MkdirAll(scratchDir, 0700); err != nil {
 			return err
 		}
+		if pp.installFromCache(p, scratchDir) {
+			alreadyInstalled = true
+		} else {
+			log.Printf("run pip install %s from a new Sandbox to %s on host", p.name, scratchDir)
+		}
 	}
 
 	defer func() {
@@ -267,8 +427,18 @@ func (pp *PackagePuller) sandboxInstall(p *Package) (err error) {
 		}
 	}()
 
+	offline := !alreadyInstalled && common.Conf.Package.Offline_dir != ""
+	if offline {
+		wheelDir := filepath.Join(scratchDir, "wheels")
+		if err := copyOfflineFiles(common.Conf.Package.Offline_dir, p.name, wheelDir); err != nil {
+			return err
+		}
+		defer os.RemoveAll(wheelDir)
+	}
+
 	meta := &sandbox.SandboxMeta{
 		MemLimitMB: common.Conf.Limits.Installer_mem_mb,
+		Python:     p.python,
 	}
 	sb, err := pp.sbPool.Create(nil, true, pp.pipLambda, scratchDir, meta)
 	if err != nil {
@@ -277,21 +447,42 @@ func (pp *PackagePuller) sandboxInstall(p *Package) (err error) {
 	defer sb.Destroy()
 
 	// we still need to run a Sandbox to parse the dependencies, even if it is already installed
-	msg := fmt.Sprintf(`{"pkg": "%s", "alreadyInstalled": %v}`, p.name, alreadyInstalled)
+	msg := fmt.Sprintf(`{"pkg": "%s", "alreadyInstalled": %v, "python": "%s", "offline": %v}`, p.name, alreadyInstalled, p.python, offline)
 	reqBody := bytes.NewReader([]byte(msg))
 	// the URL doesn't matter, since it is local anyway
 	req, err := http.NewRequest("POST", "http://container/run/pip-install", reqBody)
 	if err != nil {
 		return err
 	}
+
+	// some packages compile native extensions, which can take
+	// minutes; give up (destroying the Sandbox upon return)
+	// rather than blocking the lambda that needs this forever
+	pkgCtx := ctx
+	timeoutMs := common.Conf.Limits.Install_timeout_ms
+	if IsFiniteTimeout(timeoutMs) {
+		var cancel context.CancelFunc
+		pkgCtx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	req = req.WithContext(pkgCtx)
+	timeoutErr := func(err error) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("install of %s canceled: %v", p.name, ctx.Err())
+		} else if pkgCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("install of %s did not finish within install_timeout_ms (%d ms)", p.name, timeoutMs)
+		}
+		return err
+	}
+
 	resp, err := sb.RoundTrip(req)
 	if err != nil {
-		return err
+		return timeoutErr(err)
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return timeoutErr(err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
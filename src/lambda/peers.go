@@ -0,0 +1,249 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// a request one worker forwards to another carries this header, so
+// it is never forwarded again
+const FORWARDED_HEADER = "X-OL-Forwarded"
+
+// a forwarded request only has as long to run as it had left on the
+// worker that forwarded it (in milliseconds)
+const FORWARD_TIMEOUT_HEADER = "X-OL-Timeout-Ms"
+
+// how often each peer's /stats are read, and how old they may get
+// before the peer is assumed to be down
+const (
+	PEER_POLL_INTERVAL = 2 * time.Second
+	PEER_STALE_AFTER   = 3 * PEER_POLL_INTERVAL
+)
+
+// a forwarding worker waits this much longer than the request's time
+// left, so the peer can send its own timeout response
+const PEER_FORWARD_SLACK = time.Second
+
+type peerStatus struct {
+	url string
+
+	// fraction of the peer's memory pools in use (0 to 1), when
+	// it was last polled
+	utilization float64
+	polled      time.Time
+}
+
+// the other workers requests may be forwarded to (see
+// Features.Forward_to_peers), and how loaded each one is.  Each worker
+// publishes its memory pool use in its mem-pool/* gauges, and we poll
+// those.
+type peerSet struct {
+	mutex  sync.Mutex
+	peers  []*peerStatus
+	client *http.Client
+	done   chan bool
+}
+
+// returns nil if there are no peers
+func newPeerSet(urls []string) *peerSet {
+	if len(urls) == 0 {
+		return nil
+	}
+
+	ps := &peerSet{client: &http.Client{}, done: make(chan bool)}
+	for _, url := range urls {
+		ps.peers = append(ps.peers, &peerStatus{url: strings.TrimRight(url, "/")})
+	}
+	go ps.pollTask()
+	return ps
+}
+
+func (ps *peerSet) pollTask() {
+	ticker := time.NewTicker(PEER_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		for _, peer := range ps.peers {
+			utilization, err := ps.poll(peer.url)
+			if err != nil {
+				log.Printf("could not poll peer %s: %v", peer.url, err)
+				continue
+			}
+			ps.mutex.Lock()
+			peer.utilization = utilization
+			peer.polled = time.Now()
+			ps.mutex.Unlock()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ps.done:
+			return
+		}
+	}
+}
+
+// how much of a peer's memory pools are in use
+func (ps *peerSet) poll(url string) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), PEER_POLL_INTERVAL)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/stats", nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("/stats returned status %d", resp.StatusCode)
+	}
+
+	var stats map[string]int64
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return 0, err
+	}
+	var used, total int64
+	for name, value := range stats {
+		if !strings.HasPrefix(name, "mem-pool/") {
+			continue
+		}
+		if strings.HasSuffix(name, "/used-mb") {
+			used += value
+		} else if strings.HasSuffix(name, "/total-mb") {
+			total += value
+		}
+	}
+	if total == 0 {
+		return 0, nil // (e.g., only Docker sandboxes)
+	}
+	return float64(used) / float64(total), nil
+}
+
+// the least loaded peer that could take r, or "" if forwarding is
+// disabled, r was already forwarded, or no peer has room
+func (ps *peerSet) pick(r *http.Request) string {
+	if ps == nil || !common.Conf.Features.Forward_to_peers || r.Header.Get(FORWARDED_HEADER) != "" {
+		return ""
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	var best *peerStatus
+	for _, peer := range ps.peers {
+		if time.Since(peer.polled) > PEER_STALE_AFTER || peer.utilization >= 1 {
+			continue
+		}
+		if best == nil || peer.utilization < best.utilization {
+			best = peer
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.url
+}
+
+func (ps *peerSet) stop() {
+	if ps != nil {
+		close(ps.done)
+	}
+}
+
+// the time left (in milliseconds) for a request another worker
+// forwarded to us, or 0 if it wasn't forwarded (or has no limit)
+func forwardedTimeoutMs(r *http.Request) int64 {
+	if r.Header.Get(FORWARDED_HEADER) == "" {
+		return 0
+	}
+	ms, err := strconv.ParseInt(r.Header.Get(FORWARD_TIMEOUT_HEADER), 10, 64)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return ms
+}
+
+// proxy req to the least loaded peer, instead of rejecting it.
+// Returns false (having written nothing to req.w) if no peer could
+// take it.
+func (f *LambdaFunc) forward(req *Invocation) bool {
+	peer := f.lmgr.peers.pick(req.r)
+	if peer == "" {
+		return false
+	}
+
+	// the request doesn't get a fresh timeout on the peer
+	ctx := req.r.Context()
+	timeoutMs := common.Conf.Limits.Max_timeout_ms
+	if IsFiniteTimeout(timeoutMs) {
+		left := time.Duration(timeoutMs)*time.Millisecond - time.Since(req.start)
+		if left <= 0 {
+			return false
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, left+PEER_FORWARD_SLACK)
+		defer cancel()
+		timeoutMs = left.Milliseconds()
+	}
+
+	out, err := http.NewRequestWithContext(ctx, req.r.Method, peer+req.r.URL.RequestURI(), req.r.Body)
+	if err != nil {
+		f.warnf("could not forward request to peer %s: %v", peer, err)
+		return false
+	}
+	out.ContentLength = req.r.ContentLength
+	for k, v := range req.r.Header {
+		out.Header[k] = v
+	}
+	out.Header.Set(FORWARDED_HEADER, "1")
+	if IsFiniteTimeout(timeoutMs) {
+		out.Header.Set(FORWARD_TIMEOUT_HEADER, strconv.FormatInt(timeoutMs, 10))
+	}
+
+	resp, err := f.lmgr.peers.client.Do(out)
+	if err != nil {
+		common.IncCounter("lambda/" + f.name + "/forward-failed")
+		f.warnf("could not forward request to peer %s: %v", peer, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	common.IncCounter("lambda/" + f.name + "/forwarded-out")
+	f.debugf("forwarded request to peer %s", peer)
+	for k, v := range resp.Header {
+		req.w.Header()[k] = v
+	}
+	req.w.WriteHeader(resp.StatusCode)
+	io.Copy(req.w, resp.Body)
+	return true
+}
+
+// respond to req, which a queue had no room for: forward it to a
+// peer, if one can take it, or else reject it (see failQueueFull).
+// Either way, req is then done.
+func (f *LambdaFunc) shed(req *Invocation, reason string, depth, capacity int) {
+	if f.lmgr.peers.pick(req.r) == "" {
+		f.failQueueFull(req.w, req.r, reason, depth, capacity)
+		req.done <- true
+		return
+	}
+
+	// (the caller may be a Task, which can't wait on the peer)
+	go func() {
+		if !f.forward(req) {
+			f.failQueueFull(req.w, req.r, reason, depth, capacity)
+		}
+		req.done <- true
+	}()
+}
@@ -0,0 +1,78 @@
+package lambda
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// Prewarm pulls f's code (installing its packages) if there is none
+// yet, and starts an instance with its Sandbox already created, so the
+// first request needn't wait for either.  Returns the pull's error, if
+// it failed.
+func (f *LambdaFunc) Prewarm() error {
+	return f.PrewarmInstances(1)
+}
+
+// a Prewarm, for the Task
+type warmRequest struct {
+	instances int
+	done      chan error
+}
+
+// PrewarmInstances is like Prewarm, but has at least n instances
+// ready (e.g., for a lambda expected to be busy right away)
+func (f *LambdaFunc) PrewarmInstances(n int) error {
+	warm := &warmRequest{instances: n, done: make(chan error, 1)}
+	select {
+	case f.warmChan <- warm:
+		return <-warm.done
+	case <-f.retired:
+		next, err := f.lmgr.Get(f.name)
+		if err != nil {
+			return err
+		}
+		return next.PrewarmInstances(n)
+	}
+}
+
+// Preload prewarms the given lambdas (see Conf.Preload_functions), all
+// at once, returning when they are done.  Failures are logged, and
+// don't stop the others.
+func (mgr *LambdaMgr) Preload(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	start := time.Now()
+	log.Printf("preload %d lambdas", len(names))
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failed := 0
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			f, err := mgr.Get(name)
+			if err == nil {
+				err = f.Prewarm()
+			}
+			if err != nil {
+				log.Printf("could not preload lambda %s: %v", name, err)
+				common.IncCounter("preload/failed")
+				mutex.Lock()
+				failed += 1
+				mutex.Unlock()
+				return
+			}
+			common.IncCounter("preload/ok")
+		}(name)
+	}
+	wg.Wait()
+
+	log.Printf("preloaded %d of %d lambdas in %v", len(names)-failed, len(names), time.Since(start))
+}
@@ -0,0 +1,133 @@
+package lambda
+
+import (
+	"container/heap"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// requests may ask to be served before others that are waiting for
+// the same lambda by setting this header to an integer (higher goes
+// first; the default is 0)
+const PRIORITY_HEADER = "X-OL-Priority"
+
+// the priority of a request, from its X-OL-Priority header (missing
+// or malformed headers get the default)
+func requestPriority(r *http.Request) int {
+	priority, err := strconv.Atoi(r.Header.Get(PRIORITY_HEADER))
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
+type pendingInvocation struct {
+	req *Invocation
+
+	// the instChan the request was dispatched to
+	instChan chan *Invocation
+
+	// arrival order, so requests of equal priority are FIFO
+	seq uint64
+}
+
+// requests a LambdaFunc's Task has dispatched, but not yet handed to
+// an instChan.  Requests only move to their instChan once an instance
+// should be ready to take them, so until then, a high priority
+// request that arrives later can go ahead of them.  Only the Task
+// uses it, so there's no locking.
+type invocationQueue struct {
+	items   []*pendingInvocation
+	nextSeq uint64
+}
+
+// heap.Interface
+func (q *invocationQueue) Len() int { return len(q.items) }
+
+func (q *invocationQueue) Less(i, j int) bool {
+	a, b := q.items[i], q.items[j]
+	if a.req.priority != b.req.priority {
+		return a.req.priority > b.req.priority
+	}
+	return a.seq < b.seq
+}
+
+func (q *invocationQueue) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+
+func (q *invocationQueue) Push(x interface{}) {
+	q.items = append(q.items, x.(*pendingInvocation))
+}
+
+func (q *invocationQueue) Pop() interface{} {
+	n := len(q.items)
+	item := q.items[n-1]
+	q.items[n-1] = nil
+	q.items = q.items[:n-1]
+	return item
+}
+
+// add a request that was dispatched to instChan
+func (q *invocationQueue) push(req *Invocation, instChan chan *Invocation) {
+	heap.Push(q, &pendingInvocation{req: req, instChan: instChan, seq: q.nextSeq})
+	q.nextSeq += 1
+}
+
+// how many queued requests were dispatched to instChan
+func (q *invocationQueue) count(instChan chan *Invocation) int {
+	n := 0
+	for _, item := range q.items {
+		if item.instChan == instChan {
+			n += 1
+		}
+	}
+	return n
+}
+
+// hand the highest priority requests to their instChans, as long as
+// room(instChan) says an instance could take another request.
+// Requests for a busy instChan don't hold up those for others.
+func (q *invocationQueue) feed(room func(chan *Invocation) bool) {
+	var blocked []*pendingInvocation
+	for q.Len() > 0 {
+		item := heap.Pop(q).(*pendingInvocation)
+		if !room(item.instChan) {
+			blocked = append(blocked, item)
+			continue
+		}
+		select {
+		case item.instChan <- item.req:
+		default:
+			blocked = append(blocked, item)
+		}
+	}
+	for _, item := range blocked {
+		heap.Push(q, item)
+	}
+}
+
+// take out the requests dispatched to instChan (or all of them, if
+// instChan is nil), in the order they arrived
+func (q *invocationQueue) remove(instChan chan *Invocation) []*Invocation {
+	var removed []*pendingInvocation
+	kept := q.items[:0]
+	for _, item := range q.items {
+		if instChan == nil || item.instChan == instChan {
+			removed = append(removed, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	for i := len(kept); i < len(q.items); i++ {
+		q.items[i] = nil
+	}
+	q.items = kept
+	heap.Init(q)
+
+	sort.Slice(removed, func(i, j int) bool { return removed[i].seq < removed[j].seq })
+	reqs := make([]*Invocation, len(removed))
+	for i, item := range removed {
+		reqs[i] = item.req
+	}
+	return reqs
+}
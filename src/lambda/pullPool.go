@@ -0,0 +1,49 @@
+package lambda
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// bounds how many code pulls (fetching a lambda's code and installing
+// its packages) run at once across the worker, so a deploy that
+// touches many lambdas doesn't hit the registry and disk with all of
+// their pulls together.  Pulls beyond Limits.Pull_concurrency wait
+// their turn, oldest first (goroutines blocked sending on a channel
+// are served in order).
+type pullPool struct {
+	slots  chan bool
+	queued int64 // pulls waiting for a slot (accessed atomically)
+}
+
+// returns nil (no limit) if size isn't positive
+func newPullPool(size int) *pullPool {
+	if size <= 0 {
+		return nil
+	}
+	return &pullPool{slots: make(chan bool, size)}
+}
+
+// run pull once a slot is free, returning how long it waited
+func (p *pullPool) do(pull func()) time.Duration {
+	if p == nil {
+		pull()
+		return 0
+	}
+
+	start := time.Now()
+	common.SetGauge("pull-pool/queued", atomic.AddInt64(&p.queued, 1))
+	p.slots <- true
+	common.SetGauge("pull-pool/queued", atomic.AddInt64(&p.queued, -1))
+	common.SetGauge("pull-pool/active", int64(len(p.slots)))
+	waited := time.Since(start)
+
+	defer func() {
+		<-p.slots
+		common.SetGauge("pull-pool/active", int64(len(p.slots)))
+	}()
+	pull()
+	return waited
+}
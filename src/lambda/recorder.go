@@ -0,0 +1,218 @@
+package lambda
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// Recorder saves invocations (request and response) to disk, so that
+// a problem reported after the fact can be inspected and replayed.
+// It acts as a ring buffer: only the most recent Record.Max_entries
+// recordings are kept.
+//
+// Recording is enabled for all lambdas by Features.Record_invocations,
+// or for individual lambdas with the ol-record directive.
+type Recorder struct {
+	dir string
+
+	mutex sync.Mutex
+	ids   *list.List // oldest first
+}
+
+// a single recorded invocation, as saved to disk
+type Recording struct {
+	ID     string    `json:"id"`
+	Lambda string    `json:"lambda"`
+	Time   time.Time `json:"time"`
+
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body"`
+	BodyTruncated bool        `json:"body_truncated"`
+
+	Status            int         `json:"status"`
+	RespHeader        http.Header `json:"resp_header"`
+	RespBody          []byte      `json:"resp_body"`
+	RespBodyTruncated bool        `json:"resp_body_truncated"`
+
+	// names of headers that were left out (see Record.Redact_headers)
+	Redacted []string `json:"redacted"`
+
+	cw *bodyCaptureWriter
+}
+
+// (older workers' IDs had no prefix)
+var recordingIdRegexp = regexp.MustCompile(`^([0-9a-z]+-)?[0-9]+$`)
+
+// recordings already in dir (e.g., from before the worker restarted)
+// count towards Record.Max_entries, oldest first
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	rc := &Recorder{
+		dir: dir,
+		ids: list.New(),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if strings.HasSuffix(file.Name(), ".json") && recordingIdRegexp.MatchString(id) {
+			rc.ids.PushBack(id)
+		}
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.prune()
+	return rc, nil
+}
+
+// remove headers that should never be saved, returning their names
+func redactHeaders(header http.Header) []string {
+	redacted := []string{}
+	for _, name := range common.Conf.Record.Redact_headers {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := header[name]; ok {
+			header.Del(name)
+			redacted = append(redacted, name)
+		}
+	}
+	return redacted
+}
+
+// start recording req if recording is enabled for it (otherwise,
+// returns nil).  Must be called before the request is sent to the
+// Sandbox, and followed by finish once the response is written.
+func (rc *Recorder) begin(f *LambdaFunc, req *Invocation, meta *sandbox.SandboxMeta) *Recording {
+	if !common.Conf.Features.Record_invocations && !meta.Record {
+		return nil
+	}
+
+	limit := common.Conf.Record.Max_body_bytes
+	body, truncated := peekBody(req.r, limit)
+
+	rec := &Recording{
+		ID:            req.id,
+		Lambda:        f.name,
+		Time:          time.Now(),
+		Method:        req.r.Method,
+		URL:           req.r.URL.String(),
+		Header:        req.r.Header.Clone(),
+		Body:          body,
+		BodyTruncated: truncated,
+		cw:            &bodyCaptureWriter{ResponseWriter: req.w, limit: limit},
+	}
+	rec.Redacted = redactHeaders(rec.Header)
+	req.w = rec.cw
+
+	return rec
+}
+
+// save the response to a recording from begin (rec may be nil).  The
+// write to disk happens in the background.
+func (rc *Recorder) finish(rec *Recording, req *Invocation) {
+	if rec == nil {
+		return
+	}
+
+	rec.Status = req.sw.status
+	rec.RespHeader = rec.cw.Header().Clone()
+	rec.RespBody = rec.cw.body
+	rec.RespBodyTruncated = rec.cw.truncated
+	rec.Redacted = append(rec.Redacted, redactHeaders(rec.RespHeader)...)
+
+	go func() {
+		if err := rc.save(rec); err != nil {
+			log.Printf("could not save recording of invocation %s: %v", rec.ID, err)
+		}
+	}()
+}
+
+func (rc *Recorder) save(rec *Recording) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(rc.path(rec.ID), b, 0600); err != nil {
+		return err
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	rc.ids.PushBack(rec.ID)
+	rc.prune()
+	return nil
+}
+
+// delete the oldest recordings, beyond Record.Max_entries (called with
+// the mutex held)
+func (rc *Recorder) prune() {
+	for rc.ids.Len() > common.Max(common.Conf.Record.Max_entries, 1) {
+		oldest := rc.ids.Remove(rc.ids.Front()).(string)
+		if err := os.Remove(rc.path(oldest)); err != nil {
+			log.Printf("could not delete old recording %s: %v", oldest, err)
+		}
+	}
+}
+
+func (rc *Recorder) path(id string) string {
+	return filepath.Join(rc.dir, id+".json")
+}
+
+// lookup a recording by invocation ID (see the X-OL-Invocation-Id
+// response header)
+func (rc *Recorder) Load(id string) (*Recording, error) {
+	if !recordingIdRegexp.MatchString(id) {
+		return nil, fmt.Errorf("bad invocation ID '%s'", id)
+	}
+
+	b, err := ioutil.ReadFile(rc.path(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recording of invocation %s (it may have been deleted to make room for newer ones)", id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	rec := &Recording{}
+	if err := json.Unmarshal(b, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// build a new request equivalent to the recorded one (minus any
+// redacted headers) that can be passed to LambdaFunc.Invoke
+func (rec *Recording) Request() (*http.Request, error) {
+	req, err := http.NewRequest(rec.Method, rec.URL, bytes.NewReader(rec.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = rec.Header.Clone()
+	return req, nil
+}
@@ -0,0 +1,69 @@
+package lambda
+
+import (
+	"log"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// Reload applies a new config (see common.ReplaceConf) without
+// restarting the worker, so warm Sandboxes survive.  Most limits and
+// features take effect the next time they are read (e.g., timeouts
+// for the next request).  Beyond that:
+//
+//   - Features.Import_cache can be turned on, creating the import
+//     cache, or off, in which case new Sandboxes stop using it, and
+//     its Zygotes are killed in the background (handlers already
+//     forked from them keep running)
+//   - a new Scaling.Autoscaler (or Scaling.Exec_avg_window) applies
+//     to lambdas created afterwards
+//
+// An invalid config is rejected before anything changes.
+func (mgr *LambdaMgr) Reload(conf *common.Config) error {
+	mgr.reloadMutex.Lock()
+	defer mgr.reloadMutex.Unlock()
+
+	// prepare everything that can fail first
+	newAutoscaler, err := autoscalerFactory(conf.Scaling.Autoscaler)
+	if err != nil {
+		return err
+	}
+
+	oldCache := mgr.CurrentImportCache()
+	var newCache *ImportCache = nil
+	if conf.Features.Import_cache && oldCache == nil {
+		log.Printf("Create ImportCache")
+		newCache, err = NewImportCache(mgr.codeDirs, mgr.scratchDirs, mgr.sbPool, mgr.PackagePuller)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := common.ReplaceConf(conf); err != nil {
+		if newCache != nil {
+			newCache.Cleanup()
+		}
+		return err
+	}
+	log.Printf("reloaded config")
+
+	mgr.mapMutex.Lock()
+	mgr.newAutoscaler = newAutoscaler
+	mgr.mapMutex.Unlock()
+	mgr.disk.setMinMB(conf.Limits.Min_free_disk_mb)
+
+	if newCache != nil {
+		mgr.importCacheMutex.Lock()
+		mgr.ImportCache = newCache
+		mgr.importCacheMutex.Unlock()
+		log.Printf("enabled import cache")
+	} else if !conf.Features.Import_cache && oldCache != nil {
+		mgr.importCacheMutex.Lock()
+		mgr.ImportCache = nil
+		mgr.importCacheMutex.Unlock()
+		log.Printf("disabled import cache, killing its Zygotes")
+		go oldCache.Cleanup()
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package lambda
+
+import (
+	"sync"
+	"time"
+)
+
+// how many recent invocations each function remembers (see
+// LambdaFunc.RecentRequests)
+const REQUEST_LOG_SIZE = 100
+
+// RequestLogEntry summarizes one finished invocation
+type RequestLogEntry struct {
+	Time   time.Time `json:"time"` // when the request arrived
+	Id     string    `json:"id"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	ExecMs int       `json:"exec_ms"`
+}
+
+// fixed-size ring of the most recent invocations (in memory only, so
+// it's available when something goes wrong, even if no logging was
+// turned on beforehand)
+type requestLog struct {
+	mutex   sync.Mutex
+	entries []RequestLogEntry
+	next    int // where the next entry goes, once entries is full
+}
+
+func (l *requestLog) add(req *Invocation) {
+	entry := RequestLogEntry{
+		Time:   req.start,
+		Id:     req.id,
+		Method: req.r.Method,
+		Path:   req.r.URL.Path,
+		Status: req.sw.status,
+		ExecMs: req.execMs,
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.entries) < REQUEST_LOG_SIZE {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % REQUEST_LOG_SIZE
+}
+
+// oldest first
+func (l *requestLog) snapshot() []RequestLogEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries := make([]RequestLogEntry, 0, len(l.entries))
+	entries = append(entries, l.entries[l.next:]...)
+	return append(entries, l.entries[:l.next]...)
+}
+
+// RecentRequests returns the function's last REQUEST_LOG_SIZE
+// finished invocations, oldest first
+func (f *LambdaFunc) RecentRequests() []RequestLogEntry {
+	return f.recentRequests.snapshot()
+}
@@ -0,0 +1,245 @@
+package lambda
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// bounds on each function's response cache (see ol-cache-ttl)
+const (
+	RESPONSE_CACHE_ENTRIES  = 256
+	RESPONSE_CACHE_MAX_BODY = 1024 * 1024
+)
+
+// besides the path and query, these request headers can change a
+// response, so they are part of the cache key
+var RESPONSE_CACHE_KEY_HEADERS = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// response headers that describe a particular invocation, so they
+// aren't replayed from the cache
+var responseCacheSkipHeaders = map[string]bool{
+	"X-Ol-Invocation-Id": true,
+	"X-Ol-Cpu-Us":        true,
+	"Trailer":            true,
+}
+
+// the headers a 304 Not Modified repeats from the response it stands
+// for (RFC 9110, section 15.4.5)
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Vary"}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// LRU of GET responses of a lambda that declares its handler pure
+// (with ol-cache-ttl), so identical requests can be answered without
+// a Sandbox.  Entries are for the current code only.
+type responseCache struct {
+	mutex   sync.Mutex
+	codeDir string
+	lru     *list.List // of *cachedResponse, most recently used first
+	entries map[string]*list.Element
+}
+
+func responseCacheKey(r *http.Request) string {
+	key := r.URL.Path + "?" + r.URL.RawQuery
+	for _, name := range RESPONSE_CACHE_KEY_HEADERS {
+		key += "\n" + name + ":" + r.Header.Get(name)
+	}
+	return key
+}
+
+// forget all responses, which came from code other than codeDir
+func (c *responseCache) reset(codeDir string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.codeDir = codeDir
+	c.lru = nil
+	c.entries = nil
+}
+
+// FlushResponseCache drops all cached responses of the lambda
+func (f *LambdaFunc) FlushResponseCache() {
+	f.respCache.mutex.Lock()
+	defer f.respCache.mutex.Unlock()
+	f.respCache.lru = nil
+	f.respCache.entries = nil
+}
+
+// serve r from the cache, if there is a fresh response for it.
+// Returns true if it did.
+func (f *LambdaFunc) serveCached(w http.ResponseWriter, r *http.Request) bool {
+	// (a HEAD gets the cached GET response's headers; see
+	// bodylessWriter)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	c := &f.respCache
+	key := responseCacheKey(r)
+
+	c.mutex.Lock()
+	caching := c.entries != nil
+	var resp *cachedResponse
+	if elem, ok := c.entries[key]; ok {
+		resp = elem.Value.(*cachedResponse)
+		if time.Now().After(resp.expires) {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+			resp = nil
+		} else {
+			c.lru.MoveToFront(elem)
+		}
+	}
+	c.mutex.Unlock()
+
+	// functions that don't cache don't count misses
+	if resp == nil {
+		if caching {
+			common.IncCounter("lambda/" + f.name + "/cache-miss")
+		}
+		return false
+	}
+
+	common.IncCounter("lambda/" + f.name + "/cache-hit")
+
+	// the client already has this response
+	if etagMatches(r.Header.Get("If-None-Match"), resp.etag) {
+		common.IncCounter("lambda/" + f.name + "/cache-not-modified")
+		for _, name := range notModifiedHeaders {
+			if vals, ok := resp.header[name]; ok {
+				w.Header()[name] = vals
+			}
+		}
+		w.Header().Set("X-OL-Cache", "hit")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	for name, vals := range resp.header {
+		w.Header()[name] = vals
+	}
+	w.Header().Set("X-OL-Cache", "hit")
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+	return true
+}
+
+// is a response meant for one caller only (it sets a cookie, or says
+// it may not be stored in a shared cache), so it must not be replayed
+// to others?
+func privateResponse(header http.Header) bool {
+	if len(header.Values("Set-Cookie")) > 0 {
+		return true
+	}
+	for _, val := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(val, ",") {
+			name, _, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "no-store" || name == "private" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// remember the response to a finished invocation, if the code it ran
+// on asked for caching (and the response isn't private)
+func (f *LambdaFunc) cacheResponse(req *Invocation) {
+	sw := req.sw
+	if req.cacheTtlMs <= 0 || sw.capture == nil || req.error || sw.status < 200 || sw.status >= 300 {
+		return
+	}
+	if privateResponse(req.w.Header()) {
+		common.IncCounter("lambda/" + f.name + "/cache-private")
+		return
+	}
+
+	resp := &cachedResponse{
+		key:     responseCacheKey(req.r),
+		status:  sw.status,
+		header:  http.Header{},
+		body:    sw.capture.Bytes(),
+		expires: time.Now().Add(time.Duration(req.cacheTtlMs) * time.Millisecond),
+	}
+	for name, vals := range req.w.Header() {
+		if !responseCacheSkipHeaders[name] && !strings.HasPrefix(name, http.TrailerPrefix) {
+			resp.header[name] = vals
+		}
+	}
+	for _, name := range corsResponseHeaders {
+		resp.header.Del(name)
+	}
+
+	// keep the handler's own ETag, or else make one from the body
+	// (the response that was just sent goes without, but later
+	// ones served from the cache have it)
+	resp.etag = resp.header.Get("Etag")
+	if resp.etag == "" {
+		sum := sha256.Sum256(resp.body)
+		resp.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		resp.header.Set("Etag", resp.etag)
+	}
+
+	c := &f.respCache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// a response from old code (e.g., during a canary) must not
+	// be served for the current code
+	if req.codeDir != c.codeDir {
+		return
+	}
+
+	if c.entries == nil {
+		c.lru = list.New()
+		c.entries = make(map[string]*list.Element)
+	}
+	if elem, ok := c.entries[resp.key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[resp.key] = c.lru.PushFront(resp)
+	for c.lru.Len() > RESPONSE_CACHE_ENTRIES {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedResponse)
+		delete(c.entries, oldest.key)
+	}
+}
+
+// does an If-None-Match header match etag?  As for GET, the weak
+// comparison is used (RFC 9110, section 13.1.2)
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// start copying the body written to sw, so it can be cached (unless
+// it gets bigger than RESPONSE_CACHE_MAX_BODY)
+func (sw *statusWriter) startCapture() {
+	sw.capture = &bytes.Buffer{}
+}
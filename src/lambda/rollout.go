@@ -0,0 +1,228 @@
+package lambda
+
+import (
+	"container/list"
+	"math"
+	"math/rand"
+
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// rollout switches a LambdaFunc to new code from a pull: right away,
+// if nothing runs the old code; as a canary that gets a share of the
+// requests, during a canary deployment (see SetCanaryWeight); or else
+// by a rolling deploy, which replaces one instance at a time, each
+// time the last new instance has served a request.  The new version
+// is f.canary until it is promoted.
+//
+// Only the LambdaFunc's Task uses it, so there's no locking.
+type rollout struct {
+	f       *LambdaFunc
+	cleanup *cleanupQueue
+
+	// fraction of requests routed to the canary; negative when
+	// canary deployments are off
+	canaryWeight float64
+
+	// is the canary a rolling deploy (rather than a canary the
+	// user asked for)?  If so, requests are routed in proportion
+	// to its share of the instances, and rollServed tells us
+	// whether its newest instance has successfully served a
+	// request yet
+	rolling    bool
+	rollServed bool
+}
+
+func newRollout(f *LambdaFunc, cleanup *cleanupQueue) *rollout {
+	return &rollout{f: f, cleanup: cleanup, canaryWeight: -1}
+}
+
+// is a canary deployment on?
+func (r *rollout) canaryOn() bool {
+	return r.canaryWeight >= 0
+}
+
+// the version of the code a request should run on (the canary's, for
+// its share of the requests)
+func (r *rollout) route() (codeDir string, meta *sandbox.SandboxMeta, instChan chan *Invocation) {
+	f := r.f
+	weight := r.canaryWeight
+	if r.rolling {
+		n := f.canary.instances.Len()
+		weight = float64(n) / float64(n+f.instances.Len())
+	}
+
+	if f.canary != nil && rand.Float64() < weight {
+		return f.canary.codeDir, f.canary.meta, f.canary.instChan
+	}
+	return f.codeDir, f.meta, f.instChan
+}
+
+// switch to the code from a successful pull, if it is new.  Requests
+// queued for a version that is dropped are dispatched again.
+func (r *rollout) deploy(res *pullResult, redispatch func(instChan chan *Invocation)) {
+	f := r.f
+	latestCodeDir, latestCodeHash := f.codeDir, f.codeHash
+	if f.canary != nil {
+		latestCodeDir, latestCodeHash = f.canary.codeDir, f.canary.codeHash
+	}
+
+	if res.codeDir == latestCodeDir {
+		// nothing new
+		return
+	}
+	f.publishEvent(&DeployEvent{Type: EVENT_CODE_PULLED, OldHash: latestCodeHash, NewHash: res.codeHash})
+	f.publishEvent(&DeployEvent{Type: EVENT_INSTALL_COMPLETED, Packages: res.resolved})
+
+	if f.codeDir != "" && (r.canaryOn() || f.instances.Len() > 0) {
+		// try new code as a canary (or roll it out), replacing
+		// any older canary
+		if f.canary != nil {
+			r.cleanup.killAll(f.canary.instances)
+			r.cleanup.removeDir(f.canary.codeDir)
+			oldInstChan := f.canary.instChan
+			f.canary = nil
+			redispatch(oldInstChan)
+		}
+		f.canary = &canaryVersion{
+			codeDir:   res.codeDir,
+			codeHash:  res.codeHash,
+			meta:      res.meta,
+			resolved:  res.resolved,
+			instChan:  make(chan *Invocation, cap(f.instChan)),
+			instances: list.New(),
+		}
+		f.publishPolicy()
+		if r.canaryOn() {
+			f.infof("new code %s is a canary, receiving %v of requests", res.codeDir, r.canaryWeight)
+		} else {
+			f.infof("rolling deploy of new code %s", res.codeDir)
+			r.rolling = true
+			r.rollServed = false
+			f.startInstance(f.canary.codeDir, f.canary.meta, f.canary.instChan, f.canary.instances, false)
+		}
+		return
+	}
+
+	// switch to new code, and cleanup old code (and instances
+	// that use it) if necessary
+	oldCodeDir, oldCodeHash := f.codeDir, f.codeHash
+	f.codeDir = res.codeDir
+	f.respCache.reset(f.codeDir)
+	f.codeHash = res.codeHash
+	f.applyLogLevel(f.meta, res.meta)
+	f.meta = res.meta
+	f.setDeps(res.codeHash, res.meta, res.resolved)
+	f.publishPolicy()
+
+	if oldCodeDir != "" {
+		if oldCodeHash != f.codeHash {
+			f.publishCodeChange(oldCodeHash, f.codeHash)
+		}
+		if n := f.instances.Len(); n > 0 {
+			f.publishEvent(&DeployEvent{Type: EVENT_INSTANCES_REPLACED, NewHash: f.codeHash, Instances: n})
+		}
+		r.cleanup.killAll(f.instances)
+		f.instances = list.New()
+
+		// the cleanupQueue is a FIFO, so this will happen
+		// after it waits for all instance kills to finish
+		r.cleanup.removeDir(oldCodeDir)
+	}
+}
+
+// note a finished request (see Invocation.error)
+func (r *rollout) record(req *Invocation) {
+	if r.rolling && req.codeDir == r.f.canary.codeDir && !req.error {
+		r.rollServed = true
+	}
+}
+
+// change the canary's share of the requests (from SetCanaryWeight);
+// a weight of 1 promotes it, and ends the canary deployment
+func (r *rollout) setCanaryWeight(weight float64, redispatch func(instChan chan *Invocation)) {
+	f := r.f
+
+	// (a rolling deploy in progress becomes a canary
+	// deployment, or is finished right away)
+	r.rolling = false
+	if weight < 1 {
+		r.canaryWeight = weight
+		f.infof("canary weight set to %v", weight)
+		return
+	}
+
+	// promotion
+	r.canaryWeight = -1
+	if f.canary == nil {
+		f.infof("canary deployment ended (there was no canary to promote)")
+		return
+	}
+	r.promote(redispatch)
+}
+
+// the canary becomes the current version, and the old version drains
+func (r *rollout) promote(redispatch func(instChan chan *Invocation)) {
+	f := r.f
+	f.infof("promote canary code %s", f.canary.codeDir)
+	oldCodeDir, oldInstChan := f.codeDir, f.instChan
+	if n := f.instances.Len(); n > 0 {
+		f.publishEvent(&DeployEvent{Type: EVENT_INSTANCES_REPLACED, NewHash: f.canary.codeHash, Instances: n})
+	}
+	r.cleanup.killAll(f.instances)
+	if f.codeHash != f.canary.codeHash {
+		f.publishCodeChange(f.codeHash, f.canary.codeHash)
+	}
+	f.codeDir = f.canary.codeDir
+	f.respCache.reset(f.codeDir)
+	f.codeHash = f.canary.codeHash
+	f.applyLogLevel(f.meta, f.canary.meta)
+	f.meta = f.canary.meta
+	f.setDeps(f.canary.codeHash, f.canary.meta, f.canary.resolved)
+	f.instChan = f.canary.instChan
+	f.instances = f.canary.instances
+	f.canary = nil
+	f.publishPolicy()
+	r.cleanup.removeDir(oldCodeDir)
+
+	// requests still queued for the old version are served by
+	// the new one
+	redispatch(oldInstChan)
+}
+
+// how many instances the canary should have, if the current code
+// should have desired: in proportion to its share of the requests (at
+// least one, unless it gets none)
+func (r *rollout) canaryInstances(desired int) int {
+	if r.f.canary == nil {
+		return 0
+	}
+	return int(math.Ceil(float64(desired) * r.canaryWeight))
+}
+
+// during a rolling deploy, replace one old instance at a time (once
+// the last new one has served a request), instead of autoscaling
+func (r *rollout) step(scaler *instanceScaler, redispatch func(instChan chan *Invocation)) {
+	f := r.f
+	if (r.rollServed || scaler.outstanding == 0) && scaler.due() {
+		scaler.adjusting()
+
+		if f.instances.Len() > 0 {
+			f.infof("rolling deploy: replace an old instance (%d left)", f.instances.Len()-1)
+			f.publishEvent(&DeployEvent{Type: EVENT_INSTANCES_REPLACED, NewHash: f.canary.codeHash, Instances: 1})
+			r.cleanup.kill(f.instances.Remove(f.instances.Back()).(*LambdaInstance))
+		}
+
+		if f.instances.Len() > 0 {
+			f.startInstance(f.canary.codeDir, f.canary.meta, f.canary.instChan, f.canary.instances, false)
+			r.rollServed = false
+		} else {
+			r.rolling = false
+			r.promote(redispatch)
+		}
+	}
+
+	if r.rolling {
+		scaler.wakeAfter(scaler.adjustFreq)
+	}
+}
@@ -0,0 +1,175 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// starts sock2.py's web server (args: sock2.py's dir, the handler's
+// dir, and the socket to listen on)
+const sock2Driver = `
+import sys, types
+sys.modules["ol"] = types.ModuleType("ol")
+sys.path[:0] = [sys.argv[1], sys.argv[2]]
+import tornado.netutil, sock2
+sock2.file_sock = tornado.netutil.bind_unix_socket(sys.argv[3])
+sock2.web_server()
+`
+
+// runs sock2.py's web server as a SOCK Sandbox would (but without
+// the container: no chroot, and a stub for its ol module) on a unix
+// socket, and returns a handler for a mockPool that sends requests
+// to it.  Skips the test if python3 or tornado is missing.
+func startSock2(t *testing.T, handlerDir string) http.HandlerFunc {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not installed")
+	}
+	if err := exec.Command("python3", "-c", "import tornado").Run(); err != nil {
+		t.Skip("tornado is not installed for python3")
+	}
+
+	sock2Dir, err := filepath.Abs(filepath.Join("..", "..", "lambda"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockPath := filepath.Join(t.TempDir(), "ol.sock")
+	cmd := exec.Command("python3", "-c", sock2Driver, sock2Dir, handlerDir, sockPath)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", sockPath)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := dial(context.Background(), "", "")
+		if err == nil {
+			conn.Close()
+			break
+		} else if time.Since(start) > 10*time.Second {
+			t.Fatalf("sock2.py did not start: %v", err)
+		}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = "sock2"
+		},
+		Transport: &http.Transport{DialContext: dial},
+	}
+	return proxy.ServeHTTP
+}
+
+// requests of every method reach the handler, and GET responses are
+// cached, revalidated (304), and stripped for HEAD, end to end
+func TestSock2Shim(t *testing.T) {
+	code := "# ol-cache-ttl: 60000\n" +
+		"calls = 0\n\n" +
+		"def f(event, context):\n" +
+		"    global calls\n" +
+		"    calls += 1\n" +
+		"    return {'calls': calls, 'method': context.method, 'event': event}\n"
+	handlerDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(handlerDir, "f.py"), []byte(code), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mgr, _ := newTestMgr(t, startSock2(t, handlerDir))
+	registerLambda(t, "shim", code)
+
+	send := func(method string, path string, body string, ifNoneMatch string) *httptest.ResponseRecorder {
+		f, err := mgr.Get("shim")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		f.Invoke(rec, r)
+		return rec
+	}
+	type result struct {
+		Calls  int
+		Method string
+		Event  interface{}
+	}
+	parse := func(rec *httptest.ResponseRecorder) result {
+		var res result
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("bad response %q: %v", rec.Body.String(), err)
+		}
+		return res
+	}
+
+	calls := 0
+	for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		rec := send(method, "/run/shim", `{"x": 1}`, "")
+		calls += 1
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", method, rec.Code, rec.Body.String())
+		}
+		if res := parse(rec); res.Calls != calls || res.Method != method || res.Event == nil {
+			t.Fatalf("%s: unexpected response %+v", method, res)
+		}
+	}
+
+	// a GET has no body, so the event is None
+	first := send("GET", "/run/shim", "", "")
+	calls += 1
+	if first.Code != http.StatusOK {
+		t.Fatalf("GET: expected 200, got %d: %s", first.Code, first.Body.String())
+	}
+	if res := parse(first); res.Calls != calls || res.Method != "GET" || res.Event != nil {
+		t.Fatalf("GET: unexpected response %+v", res)
+	}
+
+	// the same GET comes from the cache, with an ETag
+	cached := send("GET", "/run/shim", "", "")
+	if cached.Body.String() != first.Body.String() || cached.Header().Get("X-OL-Cache") != "hit" {
+		t.Fatalf("expected a cached response, got %q (%v)", cached.Body.String(), cached.Header())
+	}
+	etag := cached.Header().Get("Etag")
+	if etag == "" {
+		t.Fatalf("cached response has no ETag")
+	}
+
+	if rec := send("GET", "/run/shim", "", etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("expected an empty 304, got %d: %q", rec.Code, rec.Body.String())
+	}
+
+	head := send("HEAD", "/run/shim", "", "")
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Fatalf("HEAD: expected an empty 200, got %d: %q", head.Code, head.Body.String())
+	}
+	if head.Header().Get("Etag") != etag {
+		t.Fatalf("HEAD: expected the cached ETag %s, got %v", etag, head.Header())
+	}
+
+	// a HEAD that isn't cached reaches the handler (as a GET)
+	if rec := send("HEAD", "/run/shim?x=1", "", ""); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("HEAD: expected an empty 200, got %d: %q", rec.Code, rec.Body.String())
+	}
+	calls += 1
+
+	// (the requests answered from the cache didn't run the handler)
+	if res := parse(send("POST", "/run/shim", "{}", "")); res.Calls != calls+1 {
+		t.Fatalf("expected call %d, got %+v", calls+1, res)
+	}
+}
@@ -0,0 +1,212 @@
+package lambda
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/sandbox"
+)
+
+// how long the warm pool waits before creating another Sandbox, after
+// failing to create one
+const WARM_POOL_RETRY = time.Second
+
+// a Sandbox the warm pool created, with the (initially empty) dir
+// mounted as its code dir
+type warmSandbox struct {
+	sb   sandbox.Sandbox
+	slot string
+}
+
+// WarmPool keeps paused Sandboxes that have no code, packages, or
+// imports yet (see Conf.Warm_sandboxes), so that a lambda that needs
+// none of those can start without waiting for a Sandbox to be
+// created.  Its code is copied into the Sandbox's code dir (which the
+// Sandbox only reads when it gets its first request), and the Sandbox
+// is unpaused.  The pool refills in the background.
+type WarmPool struct {
+	sbPool      sandbox.SandboxPool
+	codeDirs    *common.DirMaker
+	scratchDirs *common.DirMaker
+
+	ready   chan *warmSandbox
+	done    chan bool
+	stopped chan bool // closed when refillTask returns
+
+	// Sandbox ID -> code dir, for Sandboxes that were taken (the
+	// dir is removed when the Sandbox is destroyed)
+	mutex sync.Mutex
+	slots map[string]string
+}
+
+// returns nil if the warm pool is disabled
+func NewWarmPool(sbPool sandbox.SandboxPool, codeDirs, scratchDirs *common.DirMaker) *WarmPool {
+	size := common.Conf.Warm_sandboxes
+	if budgetMB := common.Conf.Warm_pool_mb; budgetMB > 0 {
+		size = common.Min(size, budgetMB/common.Conf.Limits.Mem_mb)
+	}
+	if size <= 0 {
+		return nil
+	}
+
+	wp := &WarmPool{
+		sbPool:      sbPool,
+		codeDirs:    codeDirs,
+		scratchDirs: scratchDirs,
+		ready:       make(chan *warmSandbox, size),
+		done:        make(chan bool),
+		stopped:     make(chan bool),
+		slots:       make(map[string]string),
+	}
+	sbPool.AddListener(wp.event)
+	go wp.refillTask()
+	return wp
+}
+
+// may a lambda with this meta use a warm Sandbox?  Only if it would
+// otherwise get a Sandbox just like one, with nothing to install or
+// import, in the main Sandbox type
+func warmEligible(meta *sandbox.SandboxMeta) bool {
+	return len(meta.Installs) == 0 && len(meta.Imports) == 0 &&
+		(meta.Runtime == "" || meta.Runtime == sandbox.RUNTIME_PYTHON) &&
+		meta.Python == "" &&
+		(meta.Sandbox == "" || meta.Sandbox == common.Conf.Sandbox) &&
+		(meta.MemLimitMB == 0 || meta.MemLimitMB == common.Conf.Limits.Mem_mb) &&
+		len(meta.NetAllow) == 0 &&
+		meta.DirMode == 0
+}
+
+// keep the pool full (the send blocks while it is)
+func (wp *WarmPool) refillTask() {
+	defer close(wp.stopped)
+
+	for {
+		w, err := wp.create()
+		if err != nil {
+			log.Printf("could not create warm Sandbox (will retry in %v): %v", WARM_POOL_RETRY, err)
+			select {
+			case <-time.After(WARM_POOL_RETRY):
+				continue
+			case <-wp.done:
+				return
+			}
+		}
+
+		select {
+		case wp.ready <- w:
+			common.SetGauge("warm-pool/ready", int64(len(wp.ready)))
+		case <-wp.done:
+			w.sb.Destroy()
+			os.RemoveAll(w.slot)
+			return
+		}
+	}
+}
+
+func (wp *WarmPool) create() (*warmSandbox, error) {
+	slot, err := wp.codeDirs.Make("warm")
+	if err != nil {
+		return nil, err
+	}
+	scratchDir, err := wp.scratchDirs.Make("warm")
+	if err != nil {
+		os.RemoveAll(slot)
+		return nil, err
+	}
+	sb, err := wp.sbPool.Create(nil, true, slot, scratchDir, &sandbox.SandboxMeta{})
+	if err != nil {
+		os.RemoveAll(slot)
+		return nil, err
+	}
+	if err := sb.Pause(); err != nil {
+		sb.Destroy()
+		os.RemoveAll(slot)
+		return nil, err
+	}
+	return &warmSandbox{sb: sb, slot: slot}, nil
+}
+
+// an unpaused Sandbox running the code in codeDir, or nil if meta
+// isn't eligible (see warmEligible) or no warm Sandbox is ready
+func (wp *WarmPool) Take(codeDir string, meta *sandbox.SandboxMeta) sandbox.Sandbox {
+	if wp == nil || !warmEligible(meta) {
+		return nil
+	}
+
+	for {
+		var w *warmSandbox
+		select {
+		case w = <-wp.ready:
+			common.SetGauge("warm-pool/ready", int64(len(wp.ready)))
+		default:
+			common.IncCounter("warm-pool/miss")
+			return nil
+		}
+
+		// (it may have been evicted while it waited)
+		if err := wp.fill(w, codeDir); err != nil {
+			log.Printf("could not use warm Sandbox %s: %v", w.sb.ID(), err)
+			w.sb.Destroy()
+			os.RemoveAll(w.slot)
+			continue
+		}
+
+		common.IncCounter("warm-pool/hit")
+		return w.sb
+	}
+}
+
+// copy the code into w's code dir, and unpause it
+func (wp *WarmPool) fill(w *warmSandbox, codeDir string) error {
+	cmd := exec.Command("cp", "-a", codeDir+"/.", w.slot)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("copying code failed: %s :: %s", err, string(output))
+	}
+
+	wp.mutex.Lock()
+	wp.slots[w.sb.ID()] = w.slot
+	wp.mutex.Unlock()
+
+	return w.sb.Unpause()
+}
+
+// remove the code dirs of destroyed Sandboxes that were taken
+func (wp *WarmPool) event(evType sandbox.SandboxEventType, sb sandbox.Sandbox) {
+	if evType != sandbox.EvDestroy {
+		return
+	}
+
+	wp.mutex.Lock()
+	slot, ok := wp.slots[sb.ID()]
+	delete(wp.slots, sb.ID())
+	wp.mutex.Unlock()
+
+	if ok {
+		go os.RemoveAll(slot)
+	}
+}
+
+// destroy the Sandboxes that were never taken (before the SandboxPool
+// is cleaned up)
+func (wp *WarmPool) Cleanup() {
+	if wp == nil {
+		return
+	}
+
+	close(wp.done)
+	<-wp.stopped
+	for {
+		select {
+		case w := <-wp.ready:
+			w.sb.Destroy()
+			os.RemoveAll(w.slot)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package lambda
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// editors often save a file in several steps (e.g., write a temp file,
+// then rename it over the original), so a lambda is only considered
+// changed once its files have been quiet this long
+const WATCH_DEBOUNCE = 100 * time.Millisecond
+
+// what a watchSource listens for.  Moves cover editors that save by
+// renaming a temp file over the original.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+// a CodeSource that knows which lambdas changed since they were last
+// fetched, so they need not be checked every Registry_cache_ms
+type codeWatcher interface {
+	changed(name string) bool
+}
+
+// a local registry directory (like "local"), watched with inotify, for
+// development: a lambda's code is fetched again as soon as one of its
+// files changes, and never otherwise
+type watchSource struct {
+	*localSource
+
+	fd    int
+	mutex sync.Mutex
+	dirs  map[int32]string       // watch descriptor -> dir
+	dirty map[string]bool        // lambda name -> changed since Fetch
+	quiet map[string]*time.Timer // lambda name -> debounce timer
+}
+
+func newWatchSource(location string, dirMaker *common.DirMaker) (CodeSource, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &watchSource{
+		localSource: &localSource{codeDirCache: codeDirCache{dirMaker: dirMaker}, prefix: location},
+		fd:          fd,
+		dirs:        make(map[int32]string),
+		dirty:       make(map[string]bool),
+		quiet:       make(map[string]*time.Timer),
+	}
+	if err := s.watchTree(location); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	go s.watchTask()
+	return s, nil
+}
+
+// watch dir and every directory under it
+func (s *watchSource) watchTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(s.fd, path, watchMask)
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.dirs[int32(wd)] = path
+		s.mutex.Unlock()
+		return nil
+	})
+}
+
+func (s *watchSource) watchTask() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(s.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			log.Printf("stop watching registry %s: %v", s.prefix, err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			s.mutex.Lock()
+			dir, ok := s.dirs[event.Wd]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(s.dirs, event.Wd)
+			}
+			s.mutex.Unlock()
+			if !ok {
+				continue
+			}
+
+			path := dir
+			if name := string(bytes.TrimRight(nameBytes, "\x00")); name != "" {
+				path = filepath.Join(dir, name)
+			}
+
+			// new dirs (e.g., a new lambda) must be watched too
+			if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				if err := s.watchTree(path); err != nil {
+					log.Printf("could not watch %s: %v", path, err)
+				}
+			}
+
+			if lambdaName := s.lambdaOf(path); lambdaName != "" {
+				s.touch(lambdaName)
+			}
+		}
+	}
+}
+
+// which lambda a path in the registry belongs to ("" if none): the
+// first component under the registry, less any .py or .tar.gz suffix
+func (s *watchSource) lambdaOf(path string) string {
+	rel, err := filepath.Rel(s.prefix, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	name := strings.Split(rel, string(filepath.Separator))[0]
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".py"), ".tar.gz")
+	if ValidateName(name) != nil {
+		return "" // (e.g., an editor's swap file)
+	}
+	return name
+}
+
+// mark a lambda changed, once its files have been quiet for
+// WATCH_DEBOUNCE
+func (s *watchSource) touch(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if timer, ok := s.quiet[name]; ok {
+		timer.Reset(WATCH_DEBOUNCE)
+		return
+	}
+	s.quiet[name] = time.AfterFunc(WATCH_DEBOUNCE, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.quiet, name)
+		s.dirty[name] = true
+	})
+}
+
+func (s *watchSource) changed(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dirty[name]
+}
+
+func (s *watchSource) Fetch(name string) (string, error) {
+	// (cleared first, so a change during the fetch isn't missed)
+	s.mutex.Lock()
+	delete(s.dirty, name)
+	s.mutex.Unlock()
+	return s.localSource.Fetch(name)
+}
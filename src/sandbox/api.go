@@ -2,6 +2,7 @@ package sandbox
 
 import (
 	"net/http"
+	"os"
 )
 
 type SandboxPool interface {
@@ -62,6 +63,11 @@ type Sandbox interface {
 	// Lookup a particular stat (changes over time)
 	Status(SandboxStatus) (string, error)
 
+	// How much memory (in MB) the Sandbox's processes are actually
+	// using, as accounted by its cgroup (returns STATUS_UNSUPPORTED
+	// if the Sandbox has no memory accounting)
+	MemoryUsage() (int, error)
+
 	// Represent state as a multi-line string
 	DebugString() string
 
@@ -78,6 +84,118 @@ type SandboxMeta struct {
 	Imports      []string
 	MemLimitMB   int
 	Timeout_Time int64
+
+	// packages the lambda can run without.  Any that could not
+	// be installed are listed in SkippedInstalls (the rest are
+	// added to Installs)
+	OptionalInstalls []string
+	SkippedInstalls  []string
+
+	// RUNTIME_PYTHON (default) or RUNTIME_BINARY.  For binary
+	// lambdas, Handler names an executable in the code dir that
+	// serves HTTP on ol.sock itself (no Python shim)
+	Runtime string
+	Handler string
+
+	// Python version to run (see Python_interpreters); "" means
+	// the default python3
+	Python string
+
+	// type of SandboxPool (e.g., "sock" or "docker") to create
+	// the Sandbox in (see MultiPool); "" means the main one
+	Sandbox string
+
+	// the directories bind mounted into the Sandbox, in the order
+	// they were mounted.  Filled in by SandboxPools that use bind
+	// mounts (in the Sandbox's own copy of the meta, as returned
+	// by Meta), so it can be checked what a lambda can write to
+	Mounts []Mount
+
+	// record invocations of this lambda (see lambda.Recorder)
+	Record bool
+
+	// record invocations of this lambda in the audit log (see
+	// lambda.Auditor); nil means use Features.Audit_invocations
+	Audit *bool
+
+	// never pause this lambda's first instance; nil means use
+	// Features.Keep_one_hot
+	KeepHot *bool
+
+	// allow zero instances when idle; nil means use
+	// Features.Scale_to_zero
+	ScaleToZero *bool
+
+	// HTTP methods (upper case) the lambda accepts; empty means
+	// all methods
+	Methods []string
+
+	// origins browsers may call the lambda from (see ol-cors);
+	// empty means the worker adds no CORS headers.  CORSCredentials
+	// and CORSMaxAgeS override Cors.Allow_credentials and
+	// Cors.Max_age_s (when non-nil and non-zero)
+	CORSOrigins     []string
+	CORSCredentials *bool
+	CORSMaxAgeS     int
+
+	// how long (ms) the worker may serve responses to GET
+	// requests from its cache; 0 means no caching
+	CacheTTL int64
+
+	// hosts ("host:port") and networks (CIDRs) the lambda may
+	// connect to, besides Egress.Default_allow (see EgressAllow)
+	NetAllow []string
+
+	// replace a lambda's Sandboxes after this long (ms since
+	// creation), or this many requests (0 means no limit)
+	SandboxTTLMs       int64
+	SandboxMaxRequests int
+
+	// path of an endpoint the handler serves to clean up before
+	// its Sandbox is destroyed ("" if it has none)
+	ShutdownPath string
+
+	// path of an endpoint the handler serves to get ready (e.g.,
+	// load a model) before its Sandbox serves requests ("" if it
+	// has none)
+	WarmupPath string
+
+	// how many requests a Sandbox may serve at once, for handlers
+	// that can handle several concurrently (0 or 1 means one at a
+	// time)
+	Concurrency int
+
+	// permissions for the lambda's code and scratch dirs (0 means
+	// the defaults), e.g., 0700 for lambdas handling sensitive
+	// data
+	DirMode os.FileMode
+
+	// the lambda's log level ("debug", "info", "warn", or "error");
+	// "" means Log_level
+	LogLevel string
+}
+
+const (
+	RUNTIME_PYTHON = "python"
+	RUNTIME_BINARY = "binary"
+)
+
+// PackagesSubdir returns where (relative to the packages dir)
+// packages for the given Python version are installed.  Packages
+// with native code are not ABI compatible across versions, so each
+// version has its own packages.
+func PackagesSubdir(python string) string {
+	if python == "" {
+		return ""
+	}
+	return "py" + python
+}
+
+// a host directory bind mounted into a Sandbox
+type Mount struct {
+	Source   string // on the host
+	Target   string // in the Sandbox
+	ReadOnly bool
 }
 
 type SockError string
@@ -120,5 +238,8 @@ type SandboxEvent struct {
 type SandboxStatus int
 
 const (
-	StatusMemFailures SandboxStatus = iota // boolean
+	StatusMemFailures  SandboxStatus = iota // boolean
+	StatusCPUUsageUs                        // int, user+sys microseconds since creation
+	StatusMemUsageMB                        // int
+	StatusEgressDenied                      // int, connections refused by the egress policy
 )
@@ -15,12 +15,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -35,6 +35,12 @@ type DockerContainer struct {
 	client    *docker.Client
 	installed map[string]bool
 	meta      *SandboxMeta
+
+	// is an egress policy applied in the container's netns?
+	egressEnforced bool
+
+	// for RoundTrip (drained on Pause)
+	conns sockConns
 }
 
 type HandlerState int
@@ -116,23 +122,7 @@ func (c *DockerContainer) SendRequest(rw *http.ResponseWriter, req *http.Request
 		return fmt.Errorf("socket path length cannot exceed 108 characters (try moving cluster closer to the root directory")
 	}
 
-	dial := func(proto, addr string) (net.Conn, error) {
-		return net.Dial("unix", sockPath)
-	}
-
-	tr := &http.Transport{Dial: dial}
-	u, err := url.Parse("http://sock-container")
-	if err != nil {
-		panic(err)
-	}
-
-	proxy := httputil.NewSingleHostReverseProxy(u)
-	proxy.Transport = tr
-
-	// Handle request using HttpServe
-	proxy.ServeHTTP(*rw, req)
-
-	return nil
+	return proxyToSock(*rw, req, c.conns.transport(sockPath), sockPath)
 }
 
 // process a request, given a response to write back
@@ -142,18 +132,13 @@ func (c *DockerContainer) RoundTrip(req *http.Request) (*http.Response, error) {
 		return nil, fmt.Errorf("socket path length cannot exceed 108 characters (try moving cluster closer to the root directory")
 	}
 
-	dial := func(proto, addr string) (net.Conn, error) {
-		return net.Dial("unix", sockPath)
-	}
-
-	tr := &http.Transport{Dial: dial}
 	u, err := url.Parse("http://sock-container")
 	if err != nil {
 		panic(err)
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(u)
-	proxy.Transport = tr
+	proxy.Transport = c.conns.transport(sockPath)
 
 	// Handle request using HttpServe
 	return proxy.Transport.RoundTrip(req)
@@ -186,6 +171,9 @@ func (c *DockerContainer) Pause() error {
 		return nil
 	}
 
+	// (before the server stops answering)
+	c.conns.drain()
+
 	if err := c.client.PauseContainer(c.container.ID); err != nil {
 		log.Printf("failed to pause container with error %v\n", err)
 		return c.dockerError(err)
@@ -219,6 +207,7 @@ func (c *DockerContainer) Destroy() {
 
 // frees all resources associated with the lambda
 func (c *DockerContainer) destroy() error {
+	c.conns.drain()
 	c.Unpause()
 
 	// TODO(tyler): is there any advantage to trying to stop
@@ -359,7 +348,23 @@ func waitForServerPipeReady(hostDir string) error {
 }
 
 func (c *DockerContainer) Status(key SandboxStatus) (string, error) {
-	return "", STATUS_UNSUPPORTED
+	switch key {
+	case StatusEgressDenied:
+		if !c.egressEnforced {
+			return "", STATUS_UNSUPPORTED
+		}
+		denied, err := egressDenied(c.nspid)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(denied, 10), nil
+	default:
+		return "", STATUS_UNSUPPORTED
+	}
+}
+
+func (c *DockerContainer) MemoryUsage() (int, error) {
+	return 0, STATUS_UNSUPPORTED
 }
 
 func (c *DockerContainer) Meta() *SandboxMeta {
@@ -2,6 +2,7 @@ package sandbox
 
 import (
 	"fmt"
+	"log"
 	"path/filepath"
 	"sync/atomic"
 	"syscall"
@@ -67,6 +68,14 @@ func (pool *DockerPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir
 		panic("Non-leaves not supported for DockerPool")
 	}
 
+	if meta.Runtime == RUNTIME_BINARY {
+		return nil, fmt.Errorf("binary runtime not supported for DockerPool")
+	}
+
+	if meta.Python != "" {
+		return nil, fmt.Errorf("selecting a Python version (%s) not supported for DockerPool", meta.Python)
+	}
+
 	id := fmt.Sprintf("%d", atomic.AddInt64(pool.idxPtr, 1))
 
 	volumes := []string{
@@ -117,6 +126,19 @@ func (pool *DockerPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir
 		return nil, err
 	}
 
+	// the container has its own network namespace, so the
+	// egress policy can be enforced there
+	if allow := EgressAllow(meta); allow != nil {
+		if common.Conf.Egress.Log_only {
+			log.Printf("egress of container %s would be limited to %v (log-only)", id, allow)
+		} else if err := enforceEgress(c.nspid, allow); err != nil {
+			c.Destroy()
+			return nil, fmt.Errorf("could not apply egress policy: %v", err)
+		} else {
+			c.egressEnforced = true
+		}
+	}
+
 	if err := c.runServer(); err != nil {
 		c.Destroy()
 		return nil, err
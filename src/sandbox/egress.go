@@ -0,0 +1,135 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// EgressRule allows outgoing connections to a network, on one port
+// (or any port, if Port is 0)
+type EgressRule struct {
+	Net  string // CIDR, or a hostname (resolved when the rule is applied)
+	Port int
+}
+
+// ParseEgressRule parses a "host:port" or CIDR allowlist entry
+func ParseEgressRule(s string) (EgressRule, error) {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return EgressRule{Net: ipnet.String()}, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return EgressRule{}, fmt.Errorf("bad egress rule '%s': expected host:port or a CIDR", s)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return EgressRule{}, fmt.Errorf("bad egress rule '%s': bad port", s)
+	}
+	return EgressRule{Net: host, Port: port}, nil
+}
+
+// ErrEgressNotEnforced is returned when creating a Sandbox with an
+// egress policy its type can't enforce (unless Egress.Log_only is set)
+var ErrEgressNotEnforced = errors.New("egress policy cannot be enforced for this Sandbox type")
+
+// EgressAllow returns the allowlist for a Sandbox with the given
+// meta (Egress.Default_allow, plus the lambda's ol-net-allow), or nil
+// if its connections aren't restricted
+func EgressAllow(meta *SandboxMeta) []string {
+	allow := append([]string{}, common.Conf.Egress.Default_allow...)
+	if meta != nil {
+		allow = append(allow, meta.NetAllow...)
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	return allow
+}
+
+// iptables commands (OUTPUT chain) that let through only the allowed
+// connections, and loopback.  Others are refused, so that connect()
+// fails right away with ECONNREFUSED inside the handler.
+func egressIptablesRules(allow []string) ([][]string, error) {
+	rules := [][]string{
+		{"-o", "lo", "-j", "ACCEPT"},
+		{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	}
+
+	for _, s := range allow {
+		rule, err := ParseEgressRule(s)
+		if err != nil {
+			return nil, err
+		}
+
+		// hostnames are pinned to the addresses they have now
+		dests := []string{rule.Net}
+		if _, _, err := net.ParseCIDR(rule.Net); err != nil && net.ParseIP(rule.Net) == nil {
+			addrs, err := net.LookupHost(rule.Net)
+			if err != nil {
+				return nil, fmt.Errorf("could not resolve egress rule '%s': %v", s, err)
+			}
+			dests = addrs
+		}
+
+		for _, dest := range dests {
+			if rule.Port == 0 {
+				rules = append(rules, []string{"-d", dest, "-j", "ACCEPT"})
+				continue
+			}
+			for _, proto := range []string{"tcp", "udp"} {
+				rules = append(rules, []string{"-d", dest, "-p", proto, "--dport", strconv.Itoa(rule.Port), "-j", "ACCEPT"})
+			}
+		}
+	}
+
+	return append(rules,
+		[]string{"-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset"},
+		[]string{"-j", "REJECT", "--reject-with", "icmp-port-unreachable"},
+	), nil
+}
+
+// restrict the outgoing connections of the network namespace of
+// process pid to those allowed
+func enforceEgress(pid string, allow []string) error {
+	rules, err := egressIptablesRules(allow)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		args := append([]string{"-t", pid, "-n", "iptables", "-A", "OUTPUT"}, rule...)
+		if out, err := exec.Command("nsenter", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("iptables %s: %v: %s", strings.Join(rule, " "), err, out)
+		}
+	}
+	return nil
+}
+
+// how many outgoing packets the egress policy in the network
+// namespace of process pid has refused (see enforceEgress)
+func egressDenied(pid string) (int64, error) {
+	out, err := exec.Command("nsenter", "-t", pid, "-n", "iptables", "-L", "OUTPUT", "-v", "-x", "-n").Output()
+	if err != nil {
+		return 0, err
+	}
+
+	var denied int64 = 0
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && fields[2] == "REJECT" {
+			pkts, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("unexpected iptables output: %s", line)
+			}
+			denied += pkts
+		}
+	}
+	return denied, nil
+}
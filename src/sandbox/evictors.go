@@ -180,11 +180,30 @@ func (evictor *SOCKEvictor) updateState() {
 	}
 }
 
-// evict whatever SB is at the front of the queue, assumes
-// queue is not empty
-func (evictor *SOCKEvictor) evictFront(queue *list.List) {
-	front := queue.Front()
-	sb := front.Value.(Sandbox)
+// the MemPool partition a Sandbox's memory is charged to
+func memPartition(sb Sandbox) int {
+	if safe, ok := sb.(*safeSandbox); ok {
+		sb = safe.Sandbox
+	}
+	if c, ok := sb.(*SOCKContainer); ok {
+		return c.memPart
+	}
+	return PART_ANY
+}
+
+// evict the first SB in the queue charged to the given partition (any,
+// for PART_ANY).  Returns false if there is none.
+func (evictor *SOCKEvictor) evictFront(queue *list.List, part int) bool {
+	var sb Sandbox
+	for e := queue.Front(); e != nil; e = e.Next() {
+		if s := e.Value.(Sandbox); part == PART_ANY || memPartition(s) == part {
+			sb = s
+			break
+		}
+	}
+	if sb == nil {
+		return false
+	}
 
 	evictor.printf("Evict Sandbox %v", sb.ID())
 
@@ -196,18 +215,31 @@ func (evictor *SOCKEvictor) evictFront(queue *list.List) {
 		t.T1()
 	}()
 	evictor.move(sb, evictor.evicting)
+	return true
 }
 
-// POLICY: how should we select a victim?
+// POLICY: how should we select a victim?  Each partition of the
+// memory pool (see Zygote_pool) needs free memory of its own, which
+// only evicting its own Sandboxes provides
 func (evictor *SOCKEvictor) doEvictions() {
+	for _, part := range evictor.mem.partitions() {
+		evictor.doEvictionsIn(part)
+	}
+}
+
+func (evictor *SOCKEvictor) doEvictionsIn(part int) {
 	memLimitMB := common.Conf.Limits.Mem_mb
+	freeMB, totalMB := evictor.mem.partitionMB(part)
+	if part == PART_ANY {
+		freeMB = evictor.mem.getAvailableMB()
+	}
 
 	// how many sandboxes could we spin up, given available mem?
-	freeSandboxes := evictor.mem.getAvailableMB() / memLimitMB
+	freeSandboxes := freeMB / memLimitMB
 
 	// how many sandboxes would we like to be able to spin up,
 	// without waiting for more memory?
-	freeGoal := 1 + ((evictor.mem.totalMB/memLimitMB)-2)*FREE_SANDBOXES_PERCENT_GOAL/100
+	freeGoal := 1 + ((totalMB/memLimitMB)-2)*FREE_SANDBOXES_PERCENT_GOAL/100
 
 	// how many shoud we try to evict?
 	//
@@ -222,11 +254,16 @@ func (evictor *SOCKEvictor) doEvictions() {
 	}
 
 	// try evicting the desired number, starting with the paused queue
-	for evictCount > 0 && evictor.prioQueues[0].Len() > 0 {
-		evictor.evictFront(evictor.prioQueues[0])
+	for evictCount > 0 && evictor.evictFront(evictor.prioQueues[0], part) {
 		evictCount -= 1
 	}
 
+	// a partition that may borrow isn't stuck just because its
+	// own share is used up
+	if part != PART_ANY && common.Conf.Features.Mem_pool_borrow {
+		freeSandboxes = evictor.mem.getAvailableMB() / memLimitMB
+	}
+
 	// we don't like to evict running containers, because that
 	// interrupts requests, but we do if necessary to keep the
 	// system moving (what if all lambdas hanged forever?)
@@ -235,9 +272,7 @@ func (evictor *SOCKEvictor) doEvictions() {
 	// this state
 	if freeSandboxes <= 0 && evictor.evicting.Len() == 0 {
 		evictor.printf("WARNING!  Critically low on memory, so evicting an active Sandbox")
-		if evictor.prioQueues[1].Len() > 0 {
-			evictor.evictFront(evictor.prioQueues[1])
-		}
+		evictor.evictFront(evictor.prioQueues[1], part)
 	}
 
 	// we never evict from prioQueues[2], because have descendents
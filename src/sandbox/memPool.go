@@ -5,16 +5,35 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 )
 
+// a MemPool may be split into partitions (see Zygote_pool), each of
+// which its Sandboxes draw memory from
+const (
+	PART_HANDLERS = 0
+	PART_ZYGOTES  = 1
+
+	// for requests against the whole pool, which ignore the
+	// partitions (also the partition of all Sandboxes when the
+	// pool isn't partitioned)
+	PART_ANY = -1
+)
+
+var partNames = []string{"handlers", "zygotes"}
+
 type MemPool struct {
 	name string
 
 	// how much memory is being managed (includes free and allocated)
 	totalMB int
 
+	// each partition's share of totalMB (all zero if the pool
+	// isn't partitioned)
+	budgetMB [2]int
+
 	// a task listens on this, with requests to decrement memory
 	// (which may block) or increment it
 	memRequests chan *memReq
@@ -22,12 +41,21 @@ type MemPool struct {
 	// decrement requests read from memRequests that need to wait
 	// for memory sit here until it's available
 	memRequestsWaiting *list.List
+
+	// a snapshot of the task's accounting, for the evictor and
+	// debug output
+	mutex       sync.Mutex
+	availableMB int
+	usedMB      [2]int
 }
 
 type memReq struct {
 	// how much we're requesting
 	mb int
 
+	// which partition (or PART_ANY)
+	part int
+
 	// any response means the memory is allocated; the particular
 	// number indicates the total remaining memory available in
 	// the pool
@@ -35,11 +63,21 @@ type memReq struct {
 }
 
 func NewMemPool(name string, totalMB int) *MemPool {
+	return NewPartitionedMemPool(name, totalMB, 0)
+}
+
+// create a MemPool with zygoteMB set aside for Zygotes, and the rest
+// for handlers (if zygoteMB is 0, it isn't partitioned)
+func NewPartitionedMemPool(name string, totalMB int, zygoteMB int) *MemPool {
 	pool := &MemPool{
 		name:               name,
 		totalMB:            totalMB,
 		memRequests:        make(chan *memReq, 32),
 		memRequestsWaiting: list.New(),
+		availableMB:        totalMB,
+	}
+	if zygoteMB > 0 {
+		pool.budgetMB = [2]int{totalMB - zygoteMB, zygoteMB}
 	}
 
 	go pool.memTask()
@@ -47,6 +85,46 @@ func NewMemPool(name string, totalMB int) *MemPool {
 	return pool
 }
 
+func (pool *MemPool) partitioned() bool {
+	return pool.budgetMB[PART_ZYGOTES] > 0
+}
+
+// the partition Sandboxes of the given kind draw from
+func (pool *MemPool) partitionFor(isLeaf bool) int {
+	if !pool.partitioned() {
+		return PART_ANY
+	} else if isLeaf {
+		return PART_HANDLERS
+	}
+	return PART_ZYGOTES
+}
+
+// the partitions the evictor should keep memory free in
+func (pool *MemPool) partitions() []int {
+	if !pool.partitioned() {
+		return []int{PART_ANY}
+	}
+	return []int{PART_HANDLERS, PART_ZYGOTES}
+}
+
+// publish how much of the pool is in use, in the mem-pool/<name>/*
+// gauges (peer workers read these from /stats, to decide whether to
+// forward requests here)
+func (pool *MemPool) publish(availableMB int, usedMB [2]int) {
+	pool.printf("%d of %d MB available", availableMB, pool.totalMB)
+	common.SetGauge("mem-pool/"+pool.name+"/used-mb", int64(pool.totalMB-availableMB))
+	if pool.partitioned() {
+		for part, name := range partNames {
+			common.SetGauge("mem-pool/"+pool.name+"/"+name+"-used-mb", int64(usedMB[part]))
+		}
+	}
+
+	pool.mutex.Lock()
+	pool.availableMB = availableMB
+	pool.usedMB = usedMB
+	pool.mutex.Unlock()
+}
+
 func (pool *MemPool) printf(format string, args ...interface{}) {
 	if common.Conf.Trace.Memory {
 		msg := fmt.Sprintf(format, args...)
@@ -54,11 +132,43 @@ func (pool *MemPool) printf(format string, args ...interface{}) {
 	}
 }
 
+// can a (decrement) request be granted now?  waiting counts the
+// requests of each partition that are still waiting
+func (pool *MemPool) fits(req *memReq, availableMB int, usedMB [2]int, waiting [2]int) bool {
+	if availableMB+req.mb < 0 {
+		return false
+	}
+	if req.part == PART_ANY || usedMB[req.part]-req.mb <= pool.budgetMB[req.part] {
+		return true
+	}
+
+	// POLICY: borrow from the other partition only when nothing
+	// is waiting for its memory
+	return common.Conf.Features.Mem_pool_borrow && waiting[1-req.part] == 0
+}
+
 // this task is responsible for tracking available memory in the
 // system, adding to the count when memory is released, and blocking
 // requesters until enough is free
 func (pool *MemPool) memTask() {
 	availableMB := pool.totalMB
+	var usedMB [2]int
+	common.SetGauge("mem-pool/"+pool.name+"/total-mb", int64(pool.totalMB))
+	if pool.partitioned() {
+		for part, name := range partNames {
+			common.SetGauge("mem-pool/"+pool.name+"/"+name+"-total-mb", int64(pool.budgetMB[part]))
+		}
+	}
+	pool.publish(availableMB, usedMB)
+
+	grant := func(req *memReq) {
+		availableMB += req.mb
+		if req.part != PART_ANY {
+			usedMB[req.part] -= req.mb
+		}
+		pool.publish(availableMB, usedMB)
+		req.resp <- availableMB
+	}
 
 	for {
 		req, ok := <-pool.memRequests
@@ -72,23 +182,42 @@ func (pool *MemPool) memTask() {
 		}
 
 		if req.mb >= 0 {
-			availableMB += req.mb
-			pool.printf("%d of %d MB available", availableMB, pool.totalMB)
-			req.resp <- availableMB
+			grant(req)
 		} else {
 			pool.memRequestsWaiting.PushBack(req)
 		}
 
-		// POLICY: which requests should we serve first?
-		if e := pool.memRequestsWaiting.Front(); e != nil {
+		// POLICY: which requests should we serve first?  Oldest
+		// first, though with partitions, a request that doesn't
+		// fit only holds up later requests of its own partition
+		var waiting [2]int
+		for e := pool.memRequestsWaiting.Front(); e != nil; e = e.Next() {
+			if part := e.Value.(*memReq).part; part != PART_ANY {
+				waiting[part] += 1
+			}
+		}
+
+		var blocked [2]bool
+		for e := pool.memRequestsWaiting.Front(); e != nil; {
+			next := e.Next()
 			req = e.Value.(*memReq)
-			// req.mb is negative
-			if availableMB+req.mb >= 0 {
+			if req.part != PART_ANY && blocked[req.part] {
+				e = next
+				continue
+			}
+
+			if pool.fits(req, availableMB, usedMB, waiting) {
 				pool.memRequestsWaiting.Remove(e)
-				availableMB += req.mb
-				pool.printf("%d of %d MB available", availableMB, pool.totalMB)
-				req.resp <- availableMB
+				if req.part != PART_ANY {
+					waiting[req.part] -= 1
+				}
+				grant(req)
+			} else if req.part == PART_ANY {
+				break
+			} else {
+				blocked[req.part] = true
 			}
+			e = next
 		}
 	}
 }
@@ -103,8 +232,16 @@ func (pool *MemPool) memTask() {
 // evictor (it doesn't change anything, but provides a way to monitor
 // available memory).
 func (pool *MemPool) adjustAvailableMB(mb int) (availableMB int) {
+	return pool.adjustPartitionMB(PART_ANY, mb)
+}
+
+// like adjustAvailableMB, but the memory is taken from (or returned
+// to) the given partition, so a negative mb may also block until the
+// partition has room
+func (pool *MemPool) adjustPartitionMB(part int, mb int) (availableMB int) {
 	req := &memReq{
 		mb:   mb,
+		part: part,
 		resp: make(chan int),
 	}
 
@@ -115,3 +252,30 @@ func (pool *MemPool) adjustAvailableMB(mb int) (availableMB int) {
 func (pool *MemPool) getAvailableMB() (availableMB int) {
 	return pool.adjustAvailableMB(0)
 }
+
+// how much memory is free in a partition (without borrowing), and how
+// big it is (as of the last change)
+func (pool *MemPool) partitionMB(part int) (freeMB int, totalMB int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if part == PART_ANY {
+		return pool.availableMB, pool.totalMB
+	}
+	freeMB = common.Min(pool.budgetMB[part]-pool.usedMB[part], pool.availableMB)
+	return freeMB, pool.budgetMB[part]
+}
+
+// memory use per partition, for debug output
+func (pool *MemPool) DebugString() string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	s := fmt.Sprintf("mem pool %s: %d of %d MB used\n", pool.name, pool.totalMB-pool.availableMB, pool.totalMB)
+	if pool.partitioned() {
+		for part, name := range partNames {
+			s += fmt.Sprintf("  %s: %d of %d MB used\n", name, pool.usedMB[part], pool.budgetMB[part])
+		}
+	}
+	return s
+}
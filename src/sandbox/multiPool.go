@@ -0,0 +1,65 @@
+package sandbox
+
+import (
+	"fmt"
+)
+
+// MultiPool hosts several types of SandboxPool at once (see
+// Extra_sandboxes), creating each Sandbox in the pool of the type
+// named by its SandboxMeta.Sandbox (or the main pool, by default).
+type MultiPool struct {
+	main  string
+	pools map[string]SandboxPool
+}
+
+func NewMultiPool(main string, pools map[string]SandboxPool) *MultiPool {
+	return &MultiPool{
+		main:  main,
+		pools: pools,
+	}
+}
+
+func (mp *MultiPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir string, meta *SandboxMeta) (Sandbox, error) {
+	typ := mp.main
+	if meta != nil && meta.Sandbox != "" {
+		typ = meta.Sandbox
+	}
+
+	pool, ok := mp.pools[typ]
+	if !ok {
+		return nil, fmt.Errorf("no SandboxPool of type '%s'", typ)
+	}
+
+	// a child can only be forked from a parent in the same pool
+	if parent != nil {
+		parentType := parent.Meta().Sandbox
+		if parentType == "" {
+			parentType = mp.main
+		}
+		if parentType != typ {
+			return nil, fmt.Errorf("cannot create %s Sandbox from %s parent", typ, parentType)
+		}
+	}
+
+	return pool.Create(parent, isLeaf, codeDir, scratchDir, meta)
+}
+
+func (mp *MultiPool) Cleanup() {
+	for _, pool := range mp.pools {
+		pool.Cleanup()
+	}
+}
+
+func (mp *MultiPool) AddListener(handler SandboxEventFunc) {
+	for _, pool := range mp.pools {
+		pool.AddListener(handler)
+	}
+}
+
+func (mp *MultiPool) DebugString() string {
+	s := ""
+	for typ, pool := range mp.pools {
+		s += fmt.Sprintf("=== %s ===\n%s\n", typ, pool.DebugString())
+	}
+	return s
+}
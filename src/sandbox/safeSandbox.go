@@ -214,6 +214,24 @@ func (sb *safeSandbox) Status(key SandboxStatus) (stat string, err error) {
 	return stat, err
 }
 
+func (sb *safeSandbox) MemoryUsage() (mb int, err error) {
+	sb.printf("MemoryUsage()")
+	t := common.T0("MemoryUsage()")
+	defer t.T1()
+	sb.Mutex.Lock()
+	defer sb.Mutex.Unlock()
+
+	if sb.dead {
+		return 0, DEAD_SANDBOX
+	}
+
+	mb, err = sb.Sandbox.MemoryUsage()
+	if err != nil && err != STATUS_UNSUPPORTED {
+		sb.destroyOnErr(err)
+	}
+	return mb, err
+}
+
 func (sb *safeSandbox) DebugString() string {
 	sb.Mutex.Lock()
 	defer sb.Mutex.Unlock()
@@ -1,17 +1,56 @@
 package sandbox
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 )
 
 func SandboxPoolFromConfig(name string, sizeMb int) (cf SandboxPool, err error) {
-	if common.Conf.Sandbox == "docker" {
+	main, err := newPoolOfType(common.Conf.Sandbox, name, sizeMb)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(common.Conf.Extra_sandboxes) == 0 {
+		return main, nil
+	}
+
+	pools := map[string]SandboxPool{common.Conf.Sandbox: main}
+	for _, typ := range common.Conf.Extra_sandboxes {
+		if _, ok := pools[typ]; ok {
+			return nil, fmt.Errorf("sandbox type '%s' configured more than once", typ)
+		}
+		pool, err := newPoolOfType(typ, name+"-"+typ, sizeMb)
+		if err != nil {
+			return nil, err
+		}
+		pools[typ] = pool
+	}
+
+	return NewMultiPool(common.Conf.Sandbox, pools), nil
+}
+
+func newPoolOfType(typ string, name string, sizeMb int) (SandboxPool, error) {
+	if typ == "docker" {
 		return NewDockerPool("", nil)
-	} else if common.Conf.Sandbox == "sock" {
-		mem := NewMemPool(name, sizeMb)
+	} else if typ == "sock" {
+		zygoteMB, err := common.Conf.ZygotePoolMB(sizeMb)
+		if err != nil {
+			return nil, err
+		}
+		mem := NewPartitionedMemPool(name, sizeMb, zygoteMB)
 		pool, err := NewSOCKPool(name, mem)
 		if err != nil {
 			return nil, err
@@ -20,7 +59,133 @@ func SandboxPoolFromConfig(name string, sizeMb int) (cf SandboxPool, err error)
 		return pool, nil
 	}
 
-	return nil, fmt.Errorf("invalid sandbox type: '%s'", common.Conf.Sandbox)
+	return nil, fmt.Errorf("invalid sandbox type: '%s'", typ)
+}
+
+// returned by SendRequest for a request marked with
+// RetryIfUnreachable, if the Sandbox's server could not be reached (or
+// closed the connection without responding); nothing was written to
+// the response, so the request may be sent to another Sandbox
+var ErrUnreachable = errors.New("sandbox server unreachable")
+
+type retryKey struct{}
+
+// RetryIfUnreachable marks req (whose body must be re-readable), so
+// that SendRequest returns ErrUnreachable instead of responding with
+// a 502 if the Sandbox's server can't be reached
+func RetryIfUnreachable(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), retryKey{}, true))
+}
+
+// did a request fail because the server wasn't there (e.g., it died),
+// rather than because of the request?
+func unreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ENOENT) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// proxy a request to the HTTP server listening on a Sandbox's
+// ol.sock (for SendRequest), over one of the Sandbox's keep-alive
+// connections (see sockConns), so a warm request doesn't pay to dial.
+//
+// If req's context is done before the response is complete (e.g.,
+// the lambda timed out), the Transport closes the connection to the
+// Sandbox right away (it is never reused), even if the handler is
+// still busy, so that we never wait on a handler that ignores the
+// cancellation.  The client gets a 504 (unless the response had
+// already started).  See RetryIfUnreachable for when an error is
+// returned instead.
+func proxyToSock(rw http.ResponseWriter, req *http.Request, tr *http.Transport, sockPath string) error {
+	u, err := url.Parse("http://sock-container")
+	if err != nil {
+		panic(err)
+	}
+
+	var sendErr error
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = tr
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("proxy to %s failed: %v", sockPath, err)
+		if r.Context().Value(retryKey{}) != nil && r.Context().Err() == nil && unreachable(err) {
+			sendErr = fmt.Errorf("%w: %v", ErrUnreachable, err)
+			return
+		}
+		if r.Context().Err() == context.DeadlineExceeded {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		} else {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+
+	// if copying the response body fails partway (e.g., the
+	// request timed out, or the client went away), the proxy
+	// panics with http.ErrAbortHandler, which the http.Server
+	// would handle by dropping the connection.  We aren't on the
+	// server's goroutine, so do that ourselves: whatever was
+	// already written stays as-is (never mixed with error text)
+	defer abortResponse()
+
+	proxy.ServeHTTP(rw, req)
+	return sendErr
+}
+
+// keep-alive HTTP connections to a Sandbox's ol.sock (for
+// SendRequest and RoundTrip).  A connection must not be left open
+// across a Pause: the server can't answer on it while paused, and may
+// have given up on it by the time it is unpaused, so the first request
+// after Unpause would fail.  Thus, Pause drains the connections first,
+// and requests after Unpause dial new ones.  Destroy drains them too,
+// so none outlive the Sandbox (a request in flight on one then fails
+// when the server's end is closed).  The zero value is ready to use.
+type sockConns struct {
+	mutex sync.Mutex
+	tr    *http.Transport
+}
+
+// the most idle connections kept to one Sandbox (enough for
+// ol-sandbox-concurrency requests at once, usually)
+const SOCK_MAX_IDLE_CONNS = 16
+
+// the transport for requests to the server on sockPath
+func (sc *sockConns) transport(sockPath string) *http.Transport {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if sc.tr == nil {
+		sc.tr = &http.Transport{
+			DialContext: func(ctx context.Context, proto, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", sockPath)
+			},
+			MaxIdleConnsPerHost: SOCK_MAX_IDLE_CONNS,
+		}
+	}
+	return sc.tr
+}
+
+// close the idle connections, so the next request uses a new one.
+// A request still in flight keeps its connection until it is done,
+// but that connection isn't reused.
+func (sc *sockConns) drain() {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if sc.tr != nil {
+		sc.tr.CloseIdleConnections()
+		sc.tr = nil
+	}
+}
+
+// deferred by proxyToSock, to recover from the http.ErrAbortHandler
+// panic a ReverseProxy raises when it can't copy all of a response
+// (any other panic is re-raised)
+func abortResponse() {
+	if r := recover(); r != nil {
+		if r != http.ErrAbortHandler {
+			panic(r)
+		}
+		log.Printf("response from sandbox was cut short")
+	}
 }
 
 func fillMetaDefaults(meta *SandboxMeta) *SandboxMeta {
@@ -30,12 +195,22 @@ func fillMetaDefaults(meta *SandboxMeta) *SandboxMeta {
 	if meta.MemLimitMB == 0 {
 		meta.MemLimitMB = common.Conf.Limits.Mem_mb
 	}
+	if meta.Runtime == "" {
+		meta.Runtime = RUNTIME_PYTHON
+	}
+	if meta.Runtime == RUNTIME_BINARY && meta.Handler == "" {
+		meta.Handler = "handler"
+	}
 	return meta
 }
 
 func (meta *SandboxMeta) String() string {
-	return fmt.Sprintf("<installs=[%s], imports=[%s], mem-limit-mb=%v>",
-		strings.Join(meta.Installs, ","), strings.Join(meta.Imports, ","), meta.MemLimitMB)
+	runtime := meta.Runtime
+	if meta.Python != "" {
+		runtime += meta.Python
+	}
+	return fmt.Sprintf("<installs=[%s], imports=[%s], mem-limit-mb=%v, runtime=%s>",
+		strings.Join(meta.Installs, ","), strings.Join(meta.Imports, ","), meta.MemLimitMB, runtime)
 }
 
 func (e SockError) Error() string {
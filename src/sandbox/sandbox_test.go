@@ -0,0 +1,128 @@
+package sandbox
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve handler on a unix socket, as a Sandbox's server does on
+// ol.sock, returning the socket's path
+func serveSock(t *testing.T, handler http.HandlerFunc) string {
+	sockPath := filepath.Join(t.TempDir(), "ol.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return sockPath
+}
+
+// a handler that ignores the cancellation doesn't hold up the
+// response: the client gets a 504 as soon as the deadline passes
+func TestProxyToSockTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	sockPath := serveSock(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release // sleep forever
+	})
+
+	var sc sockConns
+	defer sc.drain()
+
+	const timeout = 100 * time.Millisecond
+	const epsilon = 400 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req := httptest.NewRequest("POST", "/run/f", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- proxyToSock(rec, req, sc.transport(sockPath), sockPath)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected a response, got %v", err)
+		}
+	case <-time.After(timeout + epsilon):
+		t.Fatalf("no response %v after a %v timeout", time.Since(start), timeout)
+	}
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("responded after %v, before the %v timeout", elapsed, timeout)
+	}
+}
+
+// requests to a Sandbox reuse one connection to its ol.sock, until
+// the connections are drained (as on Pause and Destroy), which closes
+// them; the next request then dials a new one
+func TestSockConnsReuse(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "ol.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opened, closed int32
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				atomic.AddInt32(&opened, 1)
+			case http.StateClosed:
+				atomic.AddInt32(&closed, 1)
+			}
+		},
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	var sc sockConns
+	defer sc.drain()
+	send := func() {
+		rec := httptest.NewRecorder()
+		err := proxyToSock(rec, httptest.NewRequest("POST", "/run/f", nil), sc.transport(sockPath), sockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		send()
+	}
+	if n := atomic.LoadInt32(&opened); n != 1 {
+		t.Errorf("10 requests dialed %d connections, expected 1", n)
+	}
+
+	sc.drain()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&closed) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("%d connections closed by drain, expected 1", n)
+	}
+
+	send()
+	if n := atomic.LoadInt32(&opened); n != 2 {
+		t.Errorf("%d connections dialed after drain, expected 2", n)
+	}
+}
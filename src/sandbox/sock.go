@@ -13,7 +13,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -36,6 +35,9 @@ type SOCKContainer struct {
 	scratchDir       string
 	cg               *Cgroup
 
+	// the pool.mem partition this container's memory is charged to
+	memPart int
+
 	// 1 for self, plus 1 for each child (we can't release memory
 	// until all descendents are dead, because they share the
 	// pages of this Container, but this is the only container
@@ -44,6 +46,9 @@ type SOCKContainer struct {
 
 	parent   Sandbox
 	children map[string]Sandbox
+
+	// for RoundTrip (drained on Pause)
+	conns sockConns
 }
 
 // add ID to each log message so we know which logs correspond to
@@ -66,23 +71,7 @@ func (c *SOCKContainer) SendRequest(rw * http.ResponseWriter, req *http.Request)
 		return fmt.Errorf("socket path length cannot exceed 108 characters (try moving cluster closer to the root directory")
 	}
 
-	dial := func(proto, addr string) (net.Conn, error) {
-		return net.Dial("unix", sockPath)
-	}
-
-	tr := &http.Transport{Dial: dial}
-	u, err := url.Parse("http://sock-container")
-	if err != nil {
-		panic(err)
-	}
-
-	proxy := httputil.NewSingleHostReverseProxy(u)
-	proxy.Transport = tr
-
-	// Handle using ServeHttp, inside
-	proxy.ServeHTTP(*rw, req)
-
-	return nil
+	return proxyToSock(*rw, req, c.conns.transport(sockPath), sockPath)
 }
 
 func (c *SOCKContainer) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -94,18 +83,13 @@ func (c *SOCKContainer) RoundTrip(req *http.Request) (*http.Response, error) {
 		return nil, fmt.Errorf("socket path length cannot exceed 108 characters (try moving cluster closer to the root directory")
 	}
 
-	dial := func(proto, addr string) (net.Conn, error) {
-		return net.Dial("unix", sockPath)
-	}
-
-	tr := &http.Transport{Dial: dial}
 	u, err := url.Parse("http://sock-container")
 	if err != nil {
 		panic(err)
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(u)
-	proxy.Transport = tr
+	proxy.Transport = c.conns.transport(sockPath)
 
 	return proxy.Transport.RoundTrip(req)
 }
@@ -123,8 +107,15 @@ func (c *SOCKContainer) freshProc() (err error) {
 		defer cgFiles[i].Close()
 	}
 
+	// a Zygote and its children must all run the same Python
+	// (the import cache keeps separate trees per version)
+	python, err := common.PythonInterpreter(c.meta.Python)
+	if err != nil {
+		return err
+	}
+
 	cmd := exec.Command(
-		"chroot", c.containerRootDir, "python3", "-u",
+		"chroot", c.containerRootDir, python, "-u",
 		"sock2.py", "/host/bootstrap.py", strconv.Itoa(len(cgFiles)),
 	)
 	cmd.Env = []string{} // for security, DO NOT expose host env to guest
@@ -143,55 +134,74 @@ func (c *SOCKContainer) freshProc() (err error) {
 	return cmd.Wait()
 }
 
-func (c *SOCKContainer) populateRoot() (err error) {
-	// FILE SYSTEM STEP 1: mount base
-	baseDir := common.Conf.SOCK_base_path
-	if err := syscall.Mount(baseDir, c.containerRootDir, "", common.BIND, ""); err != nil {
-		return fmt.Errorf("failed to bind root dir: %s -> %s :: %v\n", baseDir, c.containerRootDir, err)
-	}
-
-	if err := syscall.Mount("none", c.containerRootDir, "", common.BIND_RO, ""); err != nil {
-		return fmt.Errorf("failed to bind root dir RO: %s :: %v\n", c.containerRootDir, err)
+// the bind mounts that make up a SOCK Sandbox's root, in the order
+// they must be made: the base, the shared packages dir, the lambda's
+// code, and its scratch dir (also mounted at /tmp).  All but the
+// scratch dir are read-only.  The packages are shared by all
+// Sandboxes, so a lambda must never be able to write them.  By
+// default, they're in the base (so read-only already); if Pkgs_dir is
+// elsewhere, it is mounted over the base's packages dir.
+func sockMounts(baseDir, pkgsDir, codeDir, scratchDir string) []Mount {
+	mounts := []Mount{{Source: baseDir, Target: "/", ReadOnly: true}}
+	if filepath.Clean(pkgsDir) != filepath.Join(baseDir, "packages") {
+		mounts = append(mounts, Mount{Source: pkgsDir, Target: "/packages", ReadOnly: true})
 	}
-
-	if err := syscall.Mount("none", c.containerRootDir, "", common.PRIVATE, ""); err != nil {
-		return fmt.Errorf("failed to make root dir private :: %v", err)
+	if codeDir != "" {
+		mounts = append(mounts, Mount{Source: codeDir, Target: "/handler", ReadOnly: true})
 	}
+	return append(mounts,
+		Mount{Source: scratchDir, Target: "/host"},
+		Mount{Source: filepath.Join(scratchDir, "tmp"), Target: "/tmp"})
+}
 
-	// FILE SYSTEM STEP 2: code dir
-	if c.codeDir != "" {
-		sbCodeDir := filepath.Join(c.containerRootDir, "handler")
+// bind mount each of mounts into the dir root (the root itself, for
+// a Target of "/", which is made private so later mounts under it
+// don't propagate back to the host)
+func bindMounts(root string, mounts []Mount) error {
+	for _, m := range mounts {
+		target := filepath.Join(root, m.Target)
+		if err := syscall.Mount(m.Source, target, "", common.BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind %s -> %s :: %v", m.Source, target, err)
+		}
 
-		if err := syscall.Mount(c.codeDir, sbCodeDir, "", common.BIND, ""); err != nil {
-			return fmt.Errorf("failed to bind code dir: %s -> %s :: %v", c.codeDir, sbCodeDir, err.Error())
+		if m.ReadOnly {
+			if err := syscall.Mount("none", target, "", common.BIND_RO, ""); err != nil {
+				return fmt.Errorf("failed to bind %s RO :: %v", target, err)
+			}
 		}
 
-		if err := syscall.Mount("none", sbCodeDir, "", common.BIND_RO, ""); err != nil {
-			return fmt.Errorf("failed to bind code dir RO: %v", err.Error())
+		if m.Target == "/" {
+			if err := syscall.Mount("none", target, "", common.PRIVATE, ""); err != nil {
+				return fmt.Errorf("failed to make root dir private :: %v", err)
+			}
 		}
 	}
+	return nil
+}
 
-	// FILE SYSTEM STEP 3: scratch dir (tmp and communication)
+func (c *SOCKContainer) populateRoot() (err error) {
+	// (tmp lives in the scratch dir, for handlers to write)
 	tmpDir := filepath.Join(c.scratchDir, "tmp")
 	if err := os.Mkdir(tmpDir, 0777); err != nil && !os.IsExist(err) {
 		return err
 	}
 
-	sbScratchDir := filepath.Join(c.containerRootDir, "host")
-	if err := syscall.Mount(c.scratchDir, sbScratchDir, "", common.BIND, ""); err != nil {
-		return fmt.Errorf("failed to bind scratch dir: %v", err.Error())
-	}
-
-	// TODO: cheaper to handle with symlink in lambda image?
-	sbTmpDir := filepath.Join(c.containerRootDir, "tmp")
-	if err := syscall.Mount(tmpDir, sbTmpDir, "", common.BIND, ""); err != nil {
-		return fmt.Errorf("failed to bind tmp dir: %v", err.Error())
+	mounts := sockMounts(common.Conf.SOCK_base_path, common.Conf.Pkgs_dir, c.codeDir, c.scratchDir)
+	if err := bindMounts(c.containerRootDir, mounts); err != nil {
+		return err
 	}
 
+	// (the meta may be shared with other Sandboxes)
+	meta := *c.meta
+	meta.Mounts = mounts
+	c.meta = &meta
 	return nil
 }
 
 func (c *SOCKContainer) Pause() (err error) {
+	// (before the server stops answering)
+	c.conns.drain()
+
 	if err := c.cg.Pause(); err != nil {
 		return err
 	}
@@ -204,7 +214,7 @@ func (c *SOCKContainer) Pause() (err error) {
 		newLimit := c.cg.getMemUsageMB() + 1
 		if newLimit < oldLimit {
 			c.cg.setMemLimitMB(newLimit)
-			c.pool.mem.adjustAvailableMB(oldLimit - newLimit)
+			c.pool.mem.adjustPartitionMB(c.memPart, oldLimit-newLimit)
 		}
 	}
 	return nil
@@ -216,7 +226,7 @@ func (c *SOCKContainer) Unpause() (err error) {
 		// normal size before unpausing
 		oldLimit := c.cg.getMemLimitMB()
 		newLimit := common.Conf.Limits.Mem_mb
-		c.pool.mem.adjustAvailableMB(oldLimit - newLimit)
+		c.pool.mem.adjustPartitionMB(c.memPart, oldLimit-newLimit)
 		c.cg.setMemLimitMB(newLimit)
 	}
 
@@ -224,6 +234,8 @@ func (c *SOCKContainer) Unpause() (err error) {
 }
 
 func (c *SOCKContainer) Destroy() {
+	c.conns.drain()
+
 	if err := c.cg.Pause(); err != nil {
 		panic(err)
 	}
@@ -264,7 +276,7 @@ func (c *SOCKContainer) decCgRefCount() {
 		t.T1()
 
 		c.cg.Release()
-		c.pool.mem.adjustAvailableMB(c.cg.getMemLimitMB())
+		c.pool.mem.adjustPartitionMB(c.memPart, c.cg.getMemLimitMB())
 
 		if c.parent != nil {
 			c.parent.childExit(c)
@@ -358,11 +370,31 @@ func (c *SOCKContainer) Status(key SandboxStatus) (string, error) {
 	switch key {
 	case StatusMemFailures:
 		return strconv.FormatBool(c.cg.ReadInt("memory", "memory.failcnt") > 0), nil
+	case StatusMemUsageMB:
+		return strconv.Itoa(c.cg.getMemUsageMB()), nil
+	case StatusCPUUsageUs:
+		// the cpuacct controller may not be mounted with cpu
+		ns, err := c.cg.TryReadInt("cpu", "cpuacct.usage")
+		if err != nil {
+			return "", STATUS_UNSUPPORTED
+		}
+		return strconv.FormatInt(ns/1000, 10), nil
 	default:
 		return "", STATUS_UNSUPPORTED
 	}
 }
 
+func (c *SOCKContainer) MemoryUsage() (int, error) {
+	usage, err := c.cg.TryReadInt("memory", "memory.usage_in_bytes")
+	if err != nil {
+		return 0, err
+	}
+
+	// round up to nearest MB
+	mb := int64(1024 * 1024)
+	return int((usage + mb - 1) / mb), nil
+}
+
 func (c *SOCKContainer) Meta() *SandboxMeta {
 	return c.meta
 }
@@ -71,21 +71,28 @@ func (pool *SOCKPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir st
 	t := common.T0("Create()")
 	defer t.T1()
 
+	containerRootDir, err := pool.rootDirs.Make("SB-" + id)
+	if err != nil {
+		return nil, err
+	}
+
 	var cSock *SOCKContainer = &SOCKContainer{
 		pool:             pool,
 		id:               id,
-		containerRootDir: pool.rootDirs.Make("SB-" + id),
+		containerRootDir: containerRootDir,
 		codeDir:          codeDir,
 		scratchDir:       scratchDir,
 		cgRefCount:       1,
 		children:         make(map[string]Sandbox),
 		meta:             meta,
+		memPart:          pool.mem.partitionFor(isLeaf),
 	}
 	var c Sandbox = cSock
 
 	// block until we have enough to cover the cgroup mem limits
+	// (in the Zygote or handler partition, if the pool is split)
 	t2 := t.T0("acquire-mem")
-	pool.mem.adjustAvailableMB(-meta.MemLimitMB)
+	pool.mem.adjustPartitionMB(cSock.memPart, -meta.MemLimitMB)
 	t2.T1()
 
 	t2 = t.T0("acquire-cgroup")
@@ -110,6 +117,17 @@ func (pool *SOCKPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir st
 		return nil, fmt.Errorf("leaf sandboxes must have codeDir set")
 	}
 
+	// SOCK Sandboxes share the worker's network namespace, so
+	// there's nowhere to apply an egress policy to only this one,
+	// and the handler mustn't run unrestricted unless the config
+	// says that's OK
+	if allow := EgressAllow(meta); isLeaf && allow != nil {
+		if !common.Conf.Egress.Log_only {
+			return nil, fmt.Errorf("%w (SOCK), would limit to %v", ErrEgressNotEnforced, allow)
+		}
+		cSock.printf("egress policy cannot be enforced for SOCK Sandboxes, would limit to %v (log-only)", allow)
+	}
+
 	t2 = t.T0("make-root-fs")
 	if err := cSock.populateRoot(); err != nil {
 		return nil, fmt.Errorf("failed to create root FS: %v", err)
@@ -119,8 +137,9 @@ func (pool *SOCKPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir st
 	// add installed packages to the path, and import the modules we'll need
 	var pyCode []string
 
+	pkgsDir := filepath.Join("/packages", PackagesSubdir(meta.Python))
 	for _, pkg := range meta.Installs {
-		path := "'/packages/" + pkg + "/files'"
+		path := "'" + filepath.Join(pkgsDir, pkg, "files") + "'"
 		pyCode = append(pyCode, "if not "+path+" in sys.path:")
 		pyCode = append(pyCode, "    sys.path.append("+path+")")
 	}
@@ -129,8 +148,11 @@ func (pool *SOCKPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir st
 		pyCode = append(pyCode, "import "+mod)
 	}
 
-	// handler or Zygote?
-	if isLeaf {
+	// handler or Zygote?  Binary handlers are exec'd in place of
+	// the Python web server, inheriting its listening socket
+	if isLeaf && meta.Runtime == RUNTIME_BINARY {
+		pyCode = append(pyCode, "binary_server('/handler/"+meta.Handler+"')")
+	} else if isLeaf {
 		pyCode = append(pyCode, "web_server()")
 	} else {
 		pyCode = append(pyCode, "fork_server()")
@@ -195,5 +217,5 @@ func (pool *SOCKPool) Cleanup() {
 }
 
 func (pool *SOCKPool) DebugString() string {
-	return pool.debugger.Dump()
+	return pool.mem.DebugString() + pool.debugger.Dump()
 }
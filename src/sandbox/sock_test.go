@@ -0,0 +1,71 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// a fake SOCK base, code and scratch dir under a temp dir, with the
+// packages either in the base (the default) or outside it
+func sockDirs(t *testing.T, pkgsInBase bool) (root, baseDir, pkgsDir, codeDir, scratchDir string) {
+	dir := t.TempDir()
+	root = filepath.Join(dir, "root")
+	baseDir = filepath.Join(dir, "base")
+	pkgsDir = filepath.Join(baseDir, "packages")
+	if !pkgsInBase {
+		pkgsDir = filepath.Join(dir, "packages")
+	}
+	codeDir = filepath.Join(dir, "code")
+	scratchDir = filepath.Join(dir, "scratch")
+	for _, d := range []string{root, pkgsDir, codeDir, filepath.Join(scratchDir, "tmp"),
+		filepath.Join(baseDir, "handler"), filepath.Join(baseDir, "host"), filepath.Join(baseDir, "tmp"),
+		filepath.Join(baseDir, "packages")} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, baseDir, pkgsDir, codeDir, scratchDir
+}
+
+// a lambda can write its scratch dir and /tmp, but not the packages
+// shared with other lambdas (wherever Pkgs_dir is), nor its code
+func TestSockMountsReadOnly(t *testing.T) {
+	for name, pkgsInBase := range map[string]bool{"default": true, "outside-base": false} {
+		t.Run(name, func(t *testing.T) {
+			root, baseDir, pkgsDir, codeDir, scratchDir := sockDirs(t, pkgsInBase)
+			if err := os.WriteFile(filepath.Join(pkgsDir, "pkg"), nil, 0666); err != nil {
+				t.Fatal(err)
+			}
+			mounts := sockMounts(baseDir, pkgsDir, codeDir, scratchDir)
+			if err := bindMounts(root, mounts); err != nil {
+				if errors.Is(err, syscall.EPERM) {
+					t.Skip("bind mounts need root")
+				}
+				t.Fatal(err)
+			}
+			defer syscall.Unmount(root, syscall.MNT_DETACH)
+
+			for _, m := range mounts {
+				if m.Target == "/packages" && pkgsInBase {
+					t.Errorf("packages in the base mounted again")
+				}
+			}
+			if _, err := os.Stat(filepath.Join(root, "packages", "pkg")); err != nil {
+				t.Errorf("packages not visible in the Sandbox: %v", err)
+			}
+
+			writable := map[string]bool{"packages": false, "handler": false, "host": true, "tmp": true}
+			for dir, ok := range writable {
+				err := os.WriteFile(filepath.Join(root, dir, "x"), nil, 0666)
+				if ok && err != nil {
+					t.Errorf("could not write /%s: %v", dir, err)
+				} else if !ok && !errors.Is(err, syscall.EROFS) {
+					t.Errorf("write to /%s: expected EROFS, got %v", dir, err)
+				}
+			}
+		})
+	}
+}
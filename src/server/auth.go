@@ -0,0 +1,384 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/lambda"
+)
+
+// verified JWTs are cached (until they expire), so each request
+// needn't check a signature; beyond this many, the cache is cleared
+const AUTH_CACHE_MAX = 10000
+
+const (
+	PERM_INVOKE = "invoke"
+	PERM_ADMIN  = "admin"
+)
+
+var errNoToken = errors.New("no bearer token")
+
+// an authenticated caller, and what it may do
+type principal struct {
+	subject string
+	perms   []permission
+
+	// when the token stops being valid (zero for never)
+	expires time.Time
+}
+
+// an action (PERM_INVOKE or PERM_ADMIN, or "*" for both), and a glob
+// for the lambdas or admin endpoints it applies to
+type permission struct {
+	action string
+	glob   string
+}
+
+func parsePermission(s string) (permission, error) {
+	if s == "*" {
+		return permission{action: "*", glob: "*"}, nil
+	}
+	action, glob, ok := strings.Cut(s, ":")
+	if !ok || (action != PERM_INVOKE && action != PERM_ADMIN) || glob == "" {
+		return permission{}, fmt.Errorf("permission '%s' must be *, invoke:<lambda-glob>, or admin:<endpoint-glob>", s)
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return permission{}, fmt.Errorf("permission '%s' has a bad glob: %v", s, err)
+	}
+	return permission{action: action, glob: glob}, nil
+}
+
+func parsePermissions(perms []string) ([]permission, error) {
+	parsed := make([]permission, 0, len(perms))
+	for _, s := range perms {
+		perm, err := parsePermission(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, perm)
+	}
+	return parsed, nil
+}
+
+// may p do action to name (a lambda, or an admin endpoint)?
+func (p *principal) allowed(action, name string) bool {
+	for _, perm := range p.perms {
+		if perm.action != "*" && perm.action != action {
+			continue
+		}
+		if perm.glob == "*" {
+			return true
+		}
+		if ok, _ := path.Match(perm.glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checks the bearer tokens of requests (see Auth), before they reach
+// a lambda (so names a caller may not invoke don't get a LambdaFunc)
+// or an admin endpoint
+type authenticator struct {
+	open map[string]bool
+
+	// for "tokens" mode: SHA-256 of each token -> its principal
+	tokens map[[sha256.Size]byte]*principal
+
+	// for "jwt" mode
+	jwt   *jwtVerifier
+	mutex sync.Mutex
+	cache map[string]*principal
+}
+
+// returns nil if authentication is disabled
+func newAuthenticator(conf *common.AuthConfig) (*authenticator, error) {
+	a := &authenticator{open: make(map[string]bool)}
+	for _, p := range conf.Open_paths {
+		a.open[p] = true
+	}
+
+	switch conf.Mode {
+	case "":
+		return nil, nil
+	case "tokens":
+		a.tokens = make(map[[sha256.Size]byte]*principal)
+		for i, token := range conf.Tokens {
+			if token.Token == "" {
+				return nil, fmt.Errorf("auth.tokens[%d] has no token", i)
+			}
+			perms, err := parsePermissions(token.Permissions)
+			if err != nil {
+				return nil, fmt.Errorf("auth.tokens[%d]: %v", i, err)
+			}
+			a.tokens[sha256.Sum256([]byte(token.Token))] = &principal{subject: token.Subject, perms: perms}
+		}
+	case "jwt":
+		jwt, err := newJwtVerifier(conf)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = jwt
+		a.cache = make(map[string]*principal)
+	default:
+		return nil, fmt.Errorf("unknown auth.mode '%s' (expected tokens or jwt)", conf.Mode)
+	}
+	return a, nil
+}
+
+// who sent r, according to its bearer token
+func (a *authenticator) authenticate(r *http.Request) (*principal, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errNoToken
+	}
+
+	if a.tokens != nil {
+		if p, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+			return p, nil
+		}
+		return nil, fmt.Errorf("unknown token")
+	}
+
+	a.mutex.Lock()
+	p, ok := a.cache[token]
+	a.mutex.Unlock()
+	if ok && (p.expires.IsZero() || time.Now().Before(p.expires)) {
+		return p, nil
+	}
+
+	p, err := a.jwt.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	a.mutex.Lock()
+	if len(a.cache) >= AUTH_CACHE_MAX {
+		a.cache = make(map[string]*principal)
+	}
+	a.cache[token] = p
+	a.mutex.Unlock()
+	return p, nil
+}
+
+// check that r may do action to name, responding with 401 (no valid
+// token) or 403 (not permitted) if not.  Returns r (noting the caller,
+// for the audit log), or nil if it responded.
+func (a *authenticator) authorize(w http.ResponseWriter, r *http.Request, action, name string) *http.Request {
+	if a == nil || a.open[r.URL.Path] {
+		return r
+	}
+
+	p, err := a.authenticate(r)
+	if err != nil {
+		common.IncCounter("auth/unauthenticated")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="open-lambda"`)
+		lambda.WriteError(w, r, http.StatusUnauthorized, lambda.ERR_UNAUTHENTICATED, "a valid bearer token is required", err)
+		return nil
+	}
+	if !p.allowed(action, name) {
+		common.IncCounter("auth/forbidden")
+		log.Printf("%s lacks permission %s:%s", p.subject, action, name)
+		lambda.WriteError(w, r, http.StatusForbidden, lambda.ERR_FORBIDDEN,
+			fmt.Sprintf("token lacks permission %s:%s", action, name), nil)
+		return nil
+	}
+	return lambda.WithCaller(r, p.subject)
+}
+
+// the name an admin endpoint is permitted by (e.g., "reload" for
+// /admin/reload, or "cache-flush" for /admin/cache/flush/)
+func adminEndpoint(pattern string) string {
+	name := strings.Trim(strings.TrimPrefix(pattern, "/admin/"), "/")
+	return strings.ReplaceAll(name, "/", "-")
+}
+
+// wrap the handler for an admin endpoint, so only callers with an
+// admin permission for it may use it
+func (a *authenticator) admin(pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return handler
+	}
+	name := adminEndpoint(pattern)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r = a.authorize(w, r, PERM_ADMIN, name); r != nil {
+			handler(w, r)
+		}
+	}
+}
+
+// verifies HS256 or RS256 JWTs (see Auth.Mode)
+type jwtVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	issuer    string
+	audience  string
+	claim     string
+}
+
+func newJwtVerifier(conf *common.AuthConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		issuer:   conf.Jwt_issuer,
+		audience: conf.Jwt_audience,
+		claim:    conf.Jwt_permissions_claim,
+	}
+	if v.claim == "" {
+		v.claim = "permissions"
+	}
+
+	if conf.Jwt_secret != "" {
+		v.secret = []byte(conf.Jwt_secret)
+	} else if conf.Jwt_public_key_file != "" {
+		raw, err := ioutil.ReadFile(conf.Jwt_public_key_file)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(raw)
+		if block == nil {
+			return nil, fmt.Errorf("%s has no PEM block", conf.Jwt_public_key_file)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", conf.Jwt_public_key_file, err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an RSA public key", conf.Jwt_public_key_file)
+		}
+		v.publicKey = rsaKey
+	} else {
+		return nil, fmt.Errorf("auth.mode jwt requires auth.jwt_secret or auth.jwt_public_key_file")
+	}
+	return v, nil
+}
+
+// a string, or a list of them (as "aud" and permission claims may be)
+type jwtStrings []string
+
+func (s *jwtStrings) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = strings.Fields(one)
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*s = many
+	return nil
+}
+
+func (v *jwtVerifier) verify(token string) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	// only the algorithm the configured key is for is accepted
+	switch {
+	case header.Alg == "HS256" && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("bad JWT signature")
+		}
+	case header.Alg == "RS256" && v.publicKey != nil:
+		if err := rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, fmt.Errorf("bad JWT signature")
+		}
+	default:
+		return nil, fmt.Errorf("unexpected JWT algorithm '%s'", header.Alg)
+	}
+
+	var claims map[string]json.RawMessage
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	var std struct {
+		Sub string     `json:"sub"`
+		Iss string     `json:"iss"`
+		Aud jwtStrings `json:"aud"`
+		Exp int64      `json:"exp"`
+		Nbf int64      `json:"nbf"`
+	}
+	if err := decodeJwtPart(parts[1], &std); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if std.Exp != 0 && !now.Before(time.Unix(std.Exp, 0)) {
+		return nil, fmt.Errorf("JWT expired")
+	}
+	if std.Nbf != 0 && now.Before(time.Unix(std.Nbf, 0)) {
+		return nil, fmt.Errorf("JWT not valid yet")
+	}
+	if v.issuer != "" && std.Iss != v.issuer {
+		return nil, fmt.Errorf("JWT issuer '%s' is not trusted", std.Iss)
+	}
+	if v.audience != "" {
+		found := false
+		for _, aud := range std.Aud {
+			found = found || aud == v.audience
+		}
+		if !found {
+			return nil, fmt.Errorf("JWT is not for audience '%s'", v.audience)
+		}
+	}
+
+	var permStrings jwtStrings
+	if raw, ok := claims[v.claim]; ok {
+		if err := json.Unmarshal(raw, &permStrings); err != nil {
+			return nil, fmt.Errorf("JWT claim '%s': %v", v.claim, err)
+		}
+	}
+	perms, err := parsePermissions(permStrings)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &principal{subject: std.Sub, perms: perms}
+	if std.Exp != 0 {
+		p.expires = time.Unix(std.Exp, 0)
+	}
+	return p, nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed JWT")
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("malformed JWT: %v", err)
+	}
+	return nil
+}
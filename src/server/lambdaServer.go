@@ -1,10 +1,14 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 	"github.com/open-lambda/open-lambda/ol/lambda"
@@ -14,6 +18,7 @@ import (
 // these requests to its sandboxes.
 type LambdaServer struct {
 	lambdaMgr *lambda.LambdaMgr
+	routes    *routeTable
 }
 
 // getUrlComponents parses request URL into its "/" delimated components
@@ -34,36 +39,547 @@ func getUrlComponents(r *http.Request) []string {
 	return components
 }
 
+// get the lambda with the given name, or respond with 400 (and
+// return nil) if the name is invalid
+func (s *LambdaServer) getLambda(w http.ResponseWriter, name string) *lambda.LambdaFunc {
+	f, err := s.lambdaMgr.Get(name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return nil
+	}
+	return f
+}
+
 // RunLambda expects POST requests like this:
 //
 // curl -X POST localhost:8080/run/<lambda-name> -d '{}'
+//
+// or, to invoke the lambda once per element of an array:
+//
+// curl -X POST localhost:8080/run/<lambda-name> -H 'X-OL-Batch: true' -d '[{}, {}]'
 func (s *LambdaServer) RunLambda(w http.ResponseWriter, r *http.Request) {
 	t := common.T0("web-request")
 	defer t.T1()
 
 	log.Printf("Receive request to %s\n", r.URL.Path)
 
-	// write response headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods",
-		"GET, PUT, POST, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers",
-		"Content-Type, Content-Range, Content-Disposition, Content-Description, X-Requested-With")
+	// components represent run[0]/<name_of_sandbox>[1]/<extra_things>...
+	// ergo we want [1] for name of sandbox
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 2 {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("expected invocation format: /run/<lambda-name>"))
+		return
+	}
 
-	if r.Method == "OPTIONS" {
-		// TODO: why not let the lambda decide?
-		w.WriteHeader(http.StatusOK)
+	// the lambda decides on CORS headers (see ol-cors), and
+	// answers preflights, which have no credentials (so they
+	// mustn't load a lambda that isn't loaded already)
+	img := urlParts[1]
+	if lambda.IsPreflight(r) {
+		if f, err := s.lambdaMgr.Lookup(img); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error() + "\n"))
+		} else if f != nil {
+			f.Preflight(w, r)
+		} else {
+			lambda.DefaultPreflight(w, r)
+		}
+	} else if r = auth.authorize(w, r, PERM_INVOKE, img); r == nil {
+		return
+	} else if f := s.getLambda(w, img); f == nil {
+		return
+	} else if strings.EqualFold(r.Header.Get("X-OL-Batch"), "true") {
+		f.InvokeBatch(w, r)
 	} else {
-		// components represent run[0]/<name_of_sandbox>[1]/<extra_things>...
-		// ergo we want [1] for name of sandbox
-		urlParts := getUrlComponents(r)
-		if len(urlParts) < 2 {
+		f.Invoke(w, r)
+	}
+}
+
+// LogLevel reports a lambda's log level, or changes it for POST requests:
+//
+// curl localhost:8080/log-level/<lambda-name>
+// curl -X POST localhost:8080/log-level/<lambda-name> -d debug
+func (s *LambdaServer) LogLevel(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Receive request to %s\n", r.URL.Path)
+
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: /log-level/<lambda-name>\n"))
+		return
+	}
+	f := s.getLambda(w, urlParts[1])
+	if f == nil {
+		return
+	}
+
+	if r.Method == "POST" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("expected invocation format: /run/<lambda-name>"))
-		} else {
-			img := urlParts[1]
-			s.lambdaMgr.Get(img).Invoke(w, r)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+
+		level, err := common.ParseLogLevel(strings.TrimSpace(string(body)))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error() + "\n"))
+			return
 		}
+		f.SetLogLevel(level)
+	}
+
+	w.Write([]byte(f.LogLevel().String() + "\n"))
+}
+
+// Recording returns a recorded invocation (as JSON), by the ID from
+// its X-OL-Invocation-Id response header:
+//
+// curl localhost:8080/recording/<invocation-id>
+func (s *LambdaServer) Recording(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Receive request to %s\n", r.URL.Path)
+
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: /recording/<invocation-id>\n"))
+		return
+	}
+
+	rec, err := s.lambdaMgr.Recorder.Load(urlParts[1])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	if b, err := json.MarshalIndent(rec, "", "\t"); err != nil {
+		panic(err)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// Replay invokes the lambda of a recorded invocation again, with the
+// same request (minus redacted headers):
+//
+// curl -X POST localhost:8080/replay/<invocation-id>
+func (s *LambdaServer) Replay(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Receive request to %s\n", r.URL.Path)
+
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 2 || r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: POST /replay/<invocation-id>\n"))
+		return
+	}
+
+	rec, err := s.lambdaMgr.Recorder.Load(urlParts[1])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	req, err := rec.Request()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	if f := s.getLambda(w, rec.Lambda); f != nil {
+		f.Invoke(w, req)
+	}
+}
+
+// Canary routes a fraction of a lambda's requests to the next version
+// of its code, while the rest go to the current version.  A weight of
+// 1 promotes the new version (the old one drains):
+//
+// curl -X POST localhost:8080/admin/canary/<lambda-name>?new_weight=0.1
+// curl -X POST localhost:8080/admin/canary/<lambda-name>?new_weight=1
+func (s *LambdaServer) Canary(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Receive request to %s\n", r.URL.Path)
+
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 3 || r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: POST /admin/canary/<lambda-name>?new_weight=<0-1>\n"))
+		return
+	}
+
+	f := s.getLambda(w, urlParts[2])
+	if f == nil {
+		return
+	}
+
+	weight, err := strconv.ParseFloat(r.URL.Query().Get("new_weight"), 64)
+	if err == nil {
+		err = f.SetCanaryWeight(weight)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	w.Write([]byte(fmt.Sprintf("canary weight for %s set to %v\n", urlParts[2], weight)))
+}
+
+// Goroutines dumps the stacks of all goroutines, noting which lambda
+// each LambdaFunc and LambdaInstance Task goroutine belongs to:
+//
+// curl localhost:8080/admin/goroutines
+func (s *LambdaServer) Goroutines(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(s.lambdaMgr.DumpGoroutines()))
+}
+
+// Zygotes describes the import cache's tree of Zygotes, as JSON:
+//
+// curl localhost:8080/admin/zygotes
+func (s *LambdaServer) Zygotes(w http.ResponseWriter, r *http.Request) {
+	cache := s.lambdaMgr.CurrentImportCache()
+	if cache == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("import cache is disabled\n"))
+		return
+	}
+
+	if b, err := json.MarshalIndent(cache.DebugTree(), "", "\t"); err != nil {
+		panic(err)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// Register creates the lambda's LambdaFunc ahead of its first
+// request.  With Features.Eager_pull, this starts pulling its code
+// right away:
+//
+// curl -X POST localhost:8080/admin/register/<lambda-name>
+func (s *LambdaServer) Register(w http.ResponseWriter, r *http.Request) {
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: /admin/register/<lambda-name>\n"))
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if f := s.getLambda(w, urlParts[2]); f == nil {
+		return
+	}
+	w.Write([]byte("registered " + urlParts[2] + "\n"))
+}
+
+// Deps describes the packages (including transitive deps, with
+// exact versions) that a lambda's current code runs with, and how
+// they changed since the previous version of the code, as JSON:
+//
+// curl localhost:8080/admin/deps/<lambda-name>
+func (s *LambdaServer) Deps(w http.ResponseWriter, r *http.Request) {
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: /admin/deps/<lambda-name>\n"))
+		return
+	}
+
+	f := s.getLambda(w, urlParts[2])
+	if f == nil {
+		return
+	}
+
+	report := f.Dependencies()
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no code has been pulled for " + urlParts[2] + " yet\n"))
+		return
+	}
+
+	if b, err := json.MarshalIndent(report, "", "\t"); err != nil {
+		panic(err)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// Requests lists a lambda's most recent invocations (time, method,
+// path, status, and execution time), oldest first, as JSON:
+//
+// curl localhost:8080/admin/requests/<lambda-name>
+func (s *LambdaServer) Requests(w http.ResponseWriter, r *http.Request) {
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: /admin/requests/<lambda-name>\n"))
+		return
+	}
+
+	f := s.getLambda(w, urlParts[2])
+	if f == nil {
+		return
+	}
+
+	requests := f.RecentRequests()
+	if b, err := json.MarshalIndent(requests, "", "\t"); err != nil {
+		panic(err)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// FlushCache drops a lambda's cached responses (see ol-cache-ttl):
+//
+// curl -X POST localhost:8080/admin/cache/flush/<lambda-name>
+func (s *LambdaServer) FlushCache(w http.ResponseWriter, r *http.Request) {
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 4 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: /admin/cache/flush/<lambda-name>\n"))
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	f := s.getLambda(w, urlParts[3])
+	if f == nil {
+		return
+	}
+
+	f.FlushResponseCache()
+	w.Write([]byte("flushed response cache of " + urlParts[3] + "\n"))
+}
+
+// Evict kills all instances of a lambda, freeing their Sandboxes,
+// without removing the lambda (see LambdaMgr.EvictFunction):
+//
+// curl -X POST localhost:8080/admin/evict/<lambda-name>
+func (s *LambdaServer) Evict(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Receive request to %s\n", r.URL.Path)
+
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: POST /admin/evict/<lambda-name>\n"))
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// (ErrNotLoaded is the only error)
+	if err := s.lambdaMgr.EvictFunction(urlParts[2]); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	w.Write([]byte("evicted instances of " + urlParts[2] + "\n"))
+}
+
+// notes whether anything was written (after which an error can't be
+// reported with a status)
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (sw *startedWriter) Write(b []byte) (int, error) {
+	sw.started = true
+	return sw.ResponseWriter.Write(b)
+}
+
+// Prefetch downloads the packages a lambda runs with, as a .tar.gz to
+// unpack into the Package.Offline_dir of air-gapped workers (see
+// LambdaFunc.Prefetch).  Wheels for other platforms can be chosen with
+// one or more platform parameters:
+//
+// curl -X POST -o deps.tar.gz 'localhost:8080/admin/prefetch/<lambda-name>?platform=manylinux2014_x86_64'
+func (s *LambdaServer) Prefetch(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Receive request to %s\n", r.URL.Path)
+
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: POST /admin/prefetch/<lambda-name>\n"))
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	f := s.getLambda(w, urlParts[2])
+	if f == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-deps.tar.gz\"", urlParts[2]))
+	sw := &startedWriter{ResponseWriter: w}
+	if err := f.Prefetch(r.Context(), sw, r.URL.Query()["platform"]); err != nil {
+		log.Printf("could not prefetch packages of %s: %v", urlParts[2], err)
+		if !sw.started {
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error() + "\n"))
+		}
+	}
+}
+
+// while nothing happens, an event stream still sends a comment this
+// often, so proxies don't close it as idle
+const EVENT_STREAM_KEEPALIVE = 15 * time.Second
+
+// Events streams deploy events (see lambda.DeployEvent) as they
+// happen, as Server-Sent Events, for all lambdas or only those named
+// by lambda parameters.  Events a slow client missed are reported in
+// a "dropped" event:
+//
+// curl -N 'localhost:8080/admin/events?lambda=<lambda-name>'
+func (s *LambdaServer) Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming not supported\n"))
+		return
+	}
+
+	sub := s.lambdaMgr.SubscribeEvents(r.URL.Query()["lambda"])
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENT_STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case <-sub.Ready():
+			events, dropped := sub.Take()
+			if dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\": %d}\n\n", dropped)
+			}
+			for _, ev := range events {
+				b, err := json.Marshal(ev)
+				if err != nil {
+					panic(err)
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, b); err != nil {
+					return
+				}
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// re-read the config file the worker was started with, and apply it
+// (see LambdaMgr.Reload)
+func (s *LambdaServer) reload() error {
+	path := common.ReloadConfPath()
+	if path == "" {
+		return fmt.Errorf("the worker was not started with a config file")
+	}
+
+	conf, err := common.ParseConf(path)
+	if err != nil {
+		return err
+	}
+	return s.lambdaMgr.Reload(conf)
+}
+
+// Reload applies changes to the worker's config file (limits,
+// features, and scaling only) without a restart, like SIGHUP:
+//
+// curl -X POST localhost:8080/admin/reload
+func (s *LambdaServer) Reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.reload(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("config not reloaded: " + err.Error() + "\n"))
+		return
+	}
+	w.Write([]byte("config reloaded\n"))
+}
+
+// DepTrace returns the dependency trace so far (as in dep-trace.json,
+// which is flushed first), without stopping the worker:
+//
+// curl localhost:8080/admin/dep-trace
+func (s *LambdaServer) DepTrace(w http.ResponseWriter, r *http.Request) {
+	trace := s.lambdaMgr.DepTracer.Snapshot()
+	if trace == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not read dep trace (see worker log)\n"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Write(trace)
+}
+
+// ImportHints describes which Zygotes a lambda's Sandboxes were
+// created from, for its latest versions, with suggestions for its
+// ol-import hints, as JSON:
+//
+// curl localhost:8080/admin/import-hints/<lambda-name>
+func (s *LambdaServer) ImportHints(w http.ResponseWriter, r *http.Request) {
+	urlParts := getUrlComponents(r)
+	if len(urlParts) < 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: /admin/import-hints/<lambda-name>\n"))
+		return
+	}
+
+	deploys := s.lambdaMgr.DepTracer.ImportHints(urlParts[2])
+	if deploys == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("the import cache has not created a sandbox for " + urlParts[2] + "\n"))
+		return
+	}
+
+	if b, err := json.MarshalIndent(deploys, "", "\t"); err != nil {
+		panic(err)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
 	}
 }
 
@@ -79,19 +595,48 @@ func (s *LambdaServer) cleanup() {
 func NewLambdaServer() (*LambdaServer, error) {
 	log.Printf("Start Lambda Server")
 
+	routes, err := newRouteTable(common.Conf.Routes)
+	if err != nil {
+		return nil, err
+	}
+
 	lambdaMgr, err := lambda.NewLambdaMgr()
 	if err != nil {
 		return nil, err
 	}
+	go lambdaMgr.Preload(common.Conf.Preload_functions)
+	go lambdaMgr.Handoff()
 
 	server := &LambdaServer{
 		lambdaMgr: lambdaMgr,
+		routes:    routes,
 	}
 
 	log.Printf("Setups Handlers")
 	port := fmt.Sprintf(":%s", common.Conf.Worker_port)
-	http.HandleFunc(RUN_PATH, server.RunLambda)
-	http.HandleFunc(DEBUG_PATH, server.Debug)
+	http.HandleFunc(RUN_PATH, server.RunLambda) // (checks each lambda's permission)
+	http.HandleFunc(DEBUG_PATH, auth.admin(DEBUG_PATH, server.Debug))
+	http.HandleFunc(LOG_LEVEL_PATH, auth.admin(LOG_LEVEL_PATH, server.LogLevel))
+	http.HandleFunc(RECORDING_PATH, auth.admin(RECORDING_PATH, server.Recording))
+	http.HandleFunc(REPLAY_PATH, auth.admin(REPLAY_PATH, server.Replay))
+	http.HandleFunc(ADMIN_CANARY_PATH, auth.admin(ADMIN_CANARY_PATH, server.Canary))
+	http.HandleFunc(ADMIN_GOROUTINES_PATH, auth.admin(ADMIN_GOROUTINES_PATH, server.Goroutines))
+	http.HandleFunc(ADMIN_ZYGOTES_PATH, auth.admin(ADMIN_ZYGOTES_PATH, server.Zygotes))
+	http.HandleFunc(ADMIN_DEPS_PATH, auth.admin(ADMIN_DEPS_PATH, server.Deps))
+	http.HandleFunc(ADMIN_REQUESTS_PATH, auth.admin(ADMIN_REQUESTS_PATH, server.Requests))
+	http.HandleFunc(ADMIN_REGISTER_PATH, auth.admin(ADMIN_REGISTER_PATH, server.Register))
+	http.HandleFunc(ADMIN_CACHE_FLUSH_PATH, auth.admin(ADMIN_CACHE_FLUSH_PATH, server.FlushCache))
+	http.HandleFunc(ADMIN_RELOAD_PATH, auth.admin(ADMIN_RELOAD_PATH, server.Reload))
+	http.HandleFunc(ADMIN_DEP_TRACE_PATH, auth.admin(ADMIN_DEP_TRACE_PATH, server.DepTrace))
+	http.HandleFunc(ADMIN_ROUTES_PATH, auth.admin(ADMIN_ROUTES_PATH, server.Routes))
+	http.HandleFunc(ADMIN_IMPORT_HINTS_PATH, auth.admin(ADMIN_IMPORT_HINTS_PATH, server.ImportHints))
+	http.HandleFunc(ADMIN_EVICT_PATH, auth.admin(ADMIN_EVICT_PATH, server.Evict))
+	http.HandleFunc(ADMIN_PREFETCH_PATH, auth.admin(ADMIN_PREFETCH_PATH, server.Prefetch))
+	http.HandleFunc(ADMIN_EVENTS_PATH, auth.admin(ADMIN_EVENTS_PATH, server.Events))
+
+	// anything else may match a custom route (the paths above
+	// take precedence)
+	http.HandleFunc("/", server.Route)
 
 	log.Printf("Execute handler by POSTing to localhost%s%s%s\n", port, RUN_PATH, "<lambda>")
 	log.Printf("Get status by sending request to localhost%s%s\n", port, STATUS_PATH)
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// the worker's custom routes (see common.RouteConfig), starting with
+// those in the config, and changed with the /admin/routes API
+type routeTable struct {
+	mutex  sync.RWMutex
+	routes []common.RouteConfig
+}
+
+func newRouteTable(routes []common.RouteConfig) (*routeTable, error) {
+	copied := make([]common.RouteConfig, len(routes))
+	copy(copied, routes)
+	if err := common.CheckRoutes(copied); err != nil {
+		return nil, err
+	}
+	return &routeTable{routes: copied}, nil
+}
+
+// the route for a request, and the part of the path after the route's
+// prefix (nil if no route matches).  The longest matching prefix
+// wins; for the same prefix, a route for the request's host wins
+// over one for any host.
+func (rt *routeTable) match(r *http.Request) (*common.RouteConfig, string) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	var best *common.RouteConfig
+	for i := range rt.routes {
+		route := &rt.routes[i]
+		if route.Host != "" && route.Host != host {
+			continue
+		}
+		if len(route.Methods) > 0 && !containsString(route.Methods, r.Method) {
+			continue
+		}
+		if !pathUnder(r.URL.Path, route.Prefix) {
+			continue
+		}
+		if best == nil || len(route.Prefix) > len(best.Prefix) ||
+			(len(route.Prefix) == len(best.Prefix) && best.Host == "") {
+			best = route
+		}
+	}
+
+	if best == nil {
+		return nil, ""
+	}
+	matched := *best
+	if matched.Prefix == "/" {
+		return &matched, r.URL.Path
+	}
+	return &matched, strings.TrimPrefix(r.URL.Path, matched.Prefix)
+}
+
+// is path the prefix, or under it? (/api matches /api/x, not /apix)
+func pathUnder(path, prefix string) bool {
+	if prefix == "/" || path == prefix {
+		return true
+	}
+	return strings.HasPrefix(path, prefix+"/")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *routeTable) add(route common.RouteConfig) error {
+	if err := route.Normalize(); err != nil {
+		return err
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	for i := range rt.routes {
+		if route.ConflictsWith(&rt.routes[i]) {
+			return fmt.Errorf("route %s conflicts with route %s (to %s)",
+				route.String(), rt.routes[i].String(), rt.routes[i].Lambda)
+		}
+	}
+	rt.routes = append(rt.routes, route)
+	return nil
+}
+
+// remove the routes with the given prefix and host, returning how
+// many there were
+func (rt *routeTable) remove(prefix, host string) int {
+	route := common.RouteConfig{Prefix: prefix, Host: host, Lambda: "-"}
+	if err := route.Normalize(); err != nil {
+		return 0
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	kept := rt.routes[:0]
+	for _, other := range rt.routes {
+		if other.Prefix != route.Prefix || other.Host != route.Host {
+			kept = append(kept, other)
+		}
+	}
+	removed := len(rt.routes) - len(kept)
+	rt.routes = kept
+	return removed
+}
+
+func (rt *routeTable) list() []common.RouteConfig {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	routes := make([]common.RouteConfig, len(rt.routes))
+	copy(routes, rt.routes)
+	return routes
+}
+
+// Route runs the lambda for a request that matches a custom route, as
+// if the request were to /run/<lambda>, followed by the rest of the
+// path after the route's prefix.  Other requests get a 404, as before
+// there were routes.
+func (s *LambdaServer) Route(w http.ResponseWriter, r *http.Request) {
+	route, rest := s.routes.match(r)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if rest != "" && !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	r.URL.Path = RUN_PATH + route.Lambda + rest
+	r.URL.RawPath = ""
+	s.RunLambda(w, r)
+}
+
+// Routes lists the custom routes (GET), adds one (POST, with a JSON
+// common.RouteConfig), or removes those with a given prefix and host
+// (DELETE):
+//
+// curl localhost:8080/admin/routes
+// curl -X POST localhost:8080/admin/routes -d '{"prefix": "/api/orders", "lambda": "orders"}'
+// curl -X DELETE 'localhost:8080/admin/routes?prefix=/api/orders&host='
+func (s *LambdaServer) Routes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		b, err := json.MarshalIndent(s.routes.list(), "", "\t")
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case "POST":
+		var route common.RouteConfig
+		if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("could not parse route: " + err.Error() + "\n"))
+			return
+		}
+		if err := s.routes.add(route); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("added route to %s\n", route.Lambda)))
+	case "DELETE":
+		q := r.URL.Query()
+		n := s.routes.remove(q.Get("prefix"), q.Get("host"))
+		if n == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no such route\n"))
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("removed %d route(s)\n", n)))
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -21,8 +21,31 @@ const (
 	STATUS_PATH = "/status"
 	STATS_PATH  = "/stats"
 	DEBUG_PATH  = "/debug"
+
+	LOG_LEVEL_PATH = "/log-level/"
+	RECORDING_PATH = "/recording/"
+	REPLAY_PATH    = "/replay/"
+
+	ADMIN_CANARY_PATH       = "/admin/canary/"
+	ADMIN_GOROUTINES_PATH   = "/admin/goroutines"
+	ADMIN_ZYGOTES_PATH      = "/admin/zygotes"
+	ADMIN_DEPS_PATH         = "/admin/deps/"
+	ADMIN_REQUESTS_PATH     = "/admin/requests/"
+	ADMIN_STATS_RESET_PATH  = "/admin/stats/reset"
+	ADMIN_REGISTER_PATH     = "/admin/register/"
+	ADMIN_CACHE_FLUSH_PATH  = "/admin/cache/flush/"
+	ADMIN_RELOAD_PATH       = "/admin/reload"
+	ADMIN_DEP_TRACE_PATH    = "/admin/dep-trace"
+	ADMIN_ROUTES_PATH       = "/admin/routes"
+	ADMIN_IMPORT_HINTS_PATH = "/admin/import-hints/"
+	ADMIN_EVICT_PATH        = "/admin/evict/"
+	ADMIN_PREFETCH_PATH     = "/admin/prefetch/"
+	ADMIN_EVENTS_PATH       = "/admin/events"
 )
 
+// checks callers' tokens (nil if Auth.Mode is "")
+var auth *authenticator
+
 // GetPid returns process ID, useful for making sure we're talking to the expected server
 func GetPid(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Receive request to %s\n", r.URL.Path)
@@ -42,6 +65,28 @@ func Status(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ResetStats clears the latency histograms (e.g., the
+// lambda/<name>/phase/* ones), for all lambdas or just one:
+//
+// curl -X POST localhost:8080/admin/stats/reset
+// curl -X POST localhost:8080/admin/stats/reset?lambda=<lambda-name>
+func ResetStats(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Receive request to %s\n", r.URL.Path)
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: POST /admin/stats/reset[?lambda=<lambda-name>]\n"))
+		return
+	}
+
+	prefix := ""
+	if name := r.URL.Query().Get("lambda"); name != "" {
+		prefix = "lambda/" + name + "/"
+	}
+	common.ResetHistograms(prefix)
+	w.Write([]byte("histograms reset\n"))
+}
+
 func Stats(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Receive request to %s\n", r.URL.Path)
 	snapshot := common.SnapshotStats()
@@ -57,6 +102,11 @@ func Main() (err error) {
 		cleanup()
 	}
 
+	// (not all servers can reload their config)
+	type reloader interface {
+		reload() error
+	}
+
 	pidPath := filepath.Join(common.Conf.Worker_dir, "worker.pid")
 	if _, err := os.Stat(pidPath); err == nil {
 		return fmt.Errorf("previous worker may be running, %s already exists", pidPath)
@@ -84,10 +134,16 @@ func Main() (err error) {
 		}
 	}()
 
+	auth, err = newAuthenticator(&common.Conf.Auth)
+	if err != nil {
+		return err
+	}
+
 	// things shared by all servers
-	http.HandleFunc(PID_PATH, GetPid)
-	http.HandleFunc(STATUS_PATH, Status)
-	http.HandleFunc(STATS_PATH, Stats)
+	http.HandleFunc(PID_PATH, auth.admin(PID_PATH, GetPid))
+	http.HandleFunc(STATUS_PATH, auth.admin(STATUS_PATH, Status))
+	http.HandleFunc(STATS_PATH, auth.admin(STATS_PATH, Stats))
+	http.HandleFunc(ADMIN_STATS_RESET_PATH, auth.admin(ADMIN_STATS_RESET_PATH, ResetStats))
 
 	switch common.Conf.Server_mode {
 	case "lambda":
@@ -127,6 +183,20 @@ func Main() (err error) {
 		os.Exit(1)
 	}()
 
+	// reload the config file on SIGHUP
+	if r, ok := s.(reloader); ok {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Printf("received SIGHUP, reloading config")
+				if err := r.reload(); err != nil {
+					log.Printf("config reload failed, keeping the old config: %v", err)
+				}
+			}
+		}()
+	}
+
 	port := fmt.Sprintf(":%s", common.Conf.Worker_port)
 	log.Fatal(http.ListenAndServe(port, nil))
 	panic("ListenAndServe should never return")
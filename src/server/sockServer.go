@@ -193,7 +193,7 @@ func NewSOCKServer() (*SOCKServer, error) {
 		sbPool: sbPool,
 	}
 
-	http.HandleFunc("/", server.Handle)
+	http.HandleFunc("/", auth.admin("/sock", server.Handle))
 
 	return server, nil
 }